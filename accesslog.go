@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogWriter is the -accessLogFile the access log goes to, or nil for
+// stdout.
+var accessLogWriter *rotatingFile
+
+// accessLogFormats format the access log line of a request, with its
+// trailing newline.
+var accessLogFormats = map[string]func(r *http.Request, w *statusWriter, start time.Time) []byte{
+	"common":   commonLogLine,
+	"combined": combinedLogLine,
+	"json":     jsonLogLine,
+}
+
+// accessLogSecrets are the query params whose values are replaced by
+// REDACTED in the access log: GA4 API secrets, tenant keys, URL signatures
+// and bearer tokens passed in the query.
+var accessLogSecrets = map[string]bool{"api_secret": true, "key": true, "sig": true, "token": true}
+
+// loggedURI returns the request URI of r with the values of
+// accessLogSecrets redacted, leaving the rest of the query as sent.
+func loggedURI(r *http.Request) string {
+	uri := r.URL.RequestURI()
+	if r.URL.RawQuery == "" {
+		return uri
+	}
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	for i, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(name); err == nil && accessLogSecrets[name] {
+			pairs[i] = url.QueryEscape(name) + "=REDACTED"
+		}
+	}
+	return strings.TrimSuffix(uri, r.URL.RawQuery) + strings.Join(pairs, "&")
+}
+
+// commonLogLine formats a request in the Common Log Format.
+func commonLogLine(r *http.Request, w *statusWriter, start time.Time) []byte {
+	return []byte(fmt.Sprintf("%s - - [%s] %q %d %d\n", realIP(r, trustProxy),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+loggedURI(r)+" "+r.Proto, w.status, w.bytes))
+}
+
+// combinedLogLine formats a request in the Combined Log Format, the Common
+// Log Format followed by the Referer and User-Agent.
+func combinedLogLine(r *http.Request, w *statusWriter, start time.Time) []byte {
+	line := commonLogLine(r, w, start)
+	return append(line[:len(line)-1], fmt.Sprintf(" %q %q\n", orDash(r.Referer()), orDash(r.UserAgent()))...)
+}
+
+// jsonLogLine formats a request as a JSON object, with the request ID the
+// beacon answered with so the line can be matched with the hit's logs.
+func jsonLogLine(r *http.Request, w *statusWriter, start time.Time) []byte {
+	line, _ := json.Marshal(struct {
+		Time       time.Time `json:"time"`
+		RemoteAddr string    `json:"remote_addr"`
+		Method     string    `json:"method"`
+		URI        string    `json:"uri"`
+		Proto      string    `json:"proto"`
+		Status     int       `json:"status"`
+		Bytes      int       `json:"bytes"`
+		DurationMS float64   `json:"duration_ms"`
+		Referer    string    `json:"referer,omitempty"`
+		UserAgent  string    `json:"user_agent,omitempty"`
+		RequestID  string    `json:"request_id,omitempty"`
+	}{
+		start, realIP(r, trustProxy), r.Method, loggedURI(r), r.Proto, w.status, w.bytes,
+		float64(time.Since(start).Microseconds()) / 1000, r.Referer(), r.UserAgent(),
+		w.Header().Get("X-Request-ID"),
+	})
+	return append(line, '\n')
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// rotatingFile is a log file that is rotated once it grows past maxBytes:
+// path is renamed to path.1, path.1 to path.2 and so on, keeping at most
+// maxFiles old files. With maxBytes 0 it is never rotated, for logrotate,
+// which can make the beacon reopen it with SIGHUP.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	logger   *slog.Logger
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxFiles int, logger *slog.Logger) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles, logger: logger}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			rf.logger.Error("Cannot rotate access log", "path", rf.path, "err", err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts a
+// new file. Should the new file fail to open, writing goes on to the old
+// one.
+func (rf *rotatingFile) rotate() error {
+	os.Remove(rf.path + "." + strconv.Itoa(rf.maxFiles))
+	for i := rf.maxFiles - 1; i >= 1; i-- {
+		os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+	}
+	if rf.maxFiles > 0 {
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(rf.path, 0); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Reopen closes the file and opens path again, after logrotate moved it.
+func (rf *rotatingFile) Reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
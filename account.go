@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// accountBadges maps accounts to the badge variant served when the query
+	// selects none. Set from -accountBadges.
+	accountBadges map[string]string
+
+	// accountDefaultPages maps accounts to the page reported for a bare
+	// /account request, which otherwise shows the account page. Set from
+	// -accountDefaultPages.
+	accountDefaultPages map[string]string
+)
+
+// parseAccountMap parses a comma-separated list of account=value pairs,
+// checking each value with validate.
+func parseAccountMap(s string, validate func(string) error) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		account, value, ok := strings.Cut(pair, "=")
+		if !ok || account == "" {
+			return nil, fmt.Errorf("malformed pair %q, want account=value", pair)
+		}
+		if err := validate(value); err != nil {
+			return nil, fmt.Errorf("%s: %v", account, err)
+		}
+		values[account] = value
+	}
+	return values, nil
+}
+
+// validBadgeVariant accepts the names of the badge variants, "badge" for the
+// default one.
+func validBadgeVariant(v string) error {
+	if _, ok := badgeImages[v]; (ok && v != "") || v == "badge" {
+		return nil
+	}
+	return fmt.Errorf("unknown badge variant %q", v)
+}
+
+// accountBadgeVariant returns the default badge variant for account, "" for
+// the default badge.
+func accountBadgeVariant(account string) string {
+	if v := accountBadges[account]; v != "badge" {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTrackedAccounts bounds the per-account hit counts kept for
+// /admin/stats; hits for accounts beyond it are counted under "other".
+const maxTrackedAccounts = 10000
+
+var (
+	accountHitsMu sync.Mutex
+	accountHits   = map[string]*atomic.Int64{}
+)
+
+// countAccountHit counts a tracked hit for /admin/stats.
+func countAccountHit(account string) {
+	accountHitsMu.Lock()
+	n, ok := accountHits[account]
+	if !ok {
+		if len(accountHits) >= maxTrackedAccounts {
+			account = "other"
+			n, ok = accountHits[account]
+		}
+		if !ok {
+			n = new(atomic.Int64)
+			accountHits[account] = n
+		}
+	}
+	accountHitsMu.Unlock()
+	n.Add(1)
+}
+
+// adminStats is the body of /admin/stats.
+type adminStats struct {
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	LogLevel      string           `json:"log_level"`
+	Hits          map[string]int64 `json:"hits"`
+	AccountHits   map[string]int64 `json:"account_hits"`
+	Queue         struct {
+		Depth    int     `json:"depth"`
+		Capacity int     `json:"capacity"`
+		Fill     float64 `json:"fill"`
+	} `json:"queue"`
+	OpenCircuits int   `json:"open_circuits"`
+	SpoolBytes   int64 `json:"spool_bytes"`
+}
+
+// adminAuthorized checks the bearer token required by -adminToken, returning
+// the status to refuse the request with: 401 without a token, 403 with a
+// wrong one, or 0 if it may go on. The admin API is disabled without a
+// -adminToken, refusing every request with 401.
+func adminAuthorized(r *http.Request) int {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case adminToken == "" || !ok || token == "":
+		return http.StatusUnauthorized
+	case subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1:
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// adminHandler serves the admin API under /admin/:
+//
+//	GET  /admin/stats               hit counts, queue and collector status
+//	POST /admin/flush               send batched hits and replay the spool now
+//	POST /admin/reload              reload the config, assets, allowlist and GeoIP database, as on SIGHUP
+//	POST /admin/loglevel?level=...  change -logLevel
+func (s *server) adminHandler(w http.ResponseWriter, r *http.Request) {
+	switch adminAuthorized(r) {
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	case http.StatusForbidden:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Path == "/admin/stats" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.writeAdminJSON(w, currentAdminStats())
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/flush":
+		if hitBatcher != nil {
+			hitBatcher.flush()
+		}
+		if hitSpool != nil {
+			if err := hitSpool.Replay(); err != nil {
+				http.Error(w, "cannot replay spool: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		s.logger.Info("Flushed hits from the admin API")
+	case "/admin/reload":
+		if err := s.reload(); err != nil {
+			http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "/admin/loglevel":
+		var lvl slog.Level
+		if err := lvl.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		logLevelVar.Set(lvl)
+		s.logger.Info("Log level changed from the admin API", "level", lvl.String())
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	s.writeAdminJSON(w, map[string]string{"status": "ok"})
+}
+
+func currentAdminStats() adminStats {
+	stats := adminStats{
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		LogLevel:      logLevelVar.Level().String(),
+		Hits: map[string]int64{
+			"logged":  hitsLogged.Value(),
+			"skipped": hitsSkipped.Value(),
+			"error":   hitsErrored.Value(),
+			"spooled": hitsSpooled.Value(),
+		},
+		AccountHits:  map[string]int64{},
+		OpenCircuits: openBreakers(),
+	}
+	accountHitsMu.Lock()
+	for account, n := range accountHits {
+		stats.AccountHits[account] = n.Load()
+	}
+	accountHitsMu.Unlock()
+	if hitWorkers != nil {
+		stats.Queue.Depth = hitWorkers.QueueLen()
+		stats.Queue.Capacity = gaQueueDepth
+		stats.Queue.Fill = hitWorkers.QueueFillPct()
+	}
+	if hitSpool != nil {
+		stats.SpoolBytes = hitSpool.Size()
+	}
+	return stats
+}
+
+func (s *server) writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error("Cannot encode admin response", "err", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// admin serves a request of the admin API with the given Authorization
+// header.
+func admin(method, target, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	testServer.adminHandler(w, r)
+	return w
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"disabled", "", "Bearer ", http.StatusUnauthorized},
+		{"disabled with a token", "", "Bearer s3cret", http.StatusUnauthorized},
+		{"missing", "s3cret", "", http.StatusUnauthorized},
+		{"other scheme", "s3cret", "Basic czNjcmV0", http.StatusUnauthorized},
+		{"empty", "s3cret", "Bearer ", http.StatusUnauthorized},
+		{"wrong", "s3cret", "Bearer guess", http.StatusForbidden},
+		// Tokens of another length are compared in full too, not cut to
+		// the shorter one.
+		{"prefix", "s3cret", "Bearer s3cre", http.StatusForbidden},
+		{"longer", "s3cret", "Bearer s3cret2", http.StatusForbidden},
+		{"case", "s3cret", "Bearer S3CRET", http.StatusForbidden},
+		{"valid", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, "-adminToken="+tt.token)
+			w := admin("GET", "/admin/stats", tt.authorization)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); (tt.want == http.StatusUnauthorized) != (got == "Bearer") {
+				t.Errorf("WWW-Authenticate = %q with status %d", got, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	setFlags(t, "-adminToken=s3cret")
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"POST", "/admin/stats", http.StatusMethodNotAllowed},
+		{"GET", "/admin/flush", http.StatusMethodNotAllowed},
+		{"GET", "/admin/loglevel?level=debug", http.StatusMethodNotAllowed},
+		{"POST", "/admin/restart", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := admin(tt.method, tt.target, "Bearer s3cret"); w.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	stub := newTestBeacon(t, "-adminToken=s3cret", "-coalesceWindow=0", "-gaQueueDepth=50")
+	before := currentAdminStats()
+	get("/UA-5555-1/page")
+	get("/UA-5555-1/other")
+	stub.next(t)
+	stub.next(t)
+
+	w := admin("GET", "/admin/stats", "Bearer s3cret")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("status = %d, Cache-Control %q, want 200 and no-store", w.Code, w.Header().Get("Cache-Control"))
+	}
+	var stats adminStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	// Workers count a hit as logged after the collector has answered it.
+	for deadline := time.Now().Add(5 * time.Second); stats.Hits["logged"] < before.Hits["logged"]+2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		stats = currentAdminStats()
+	}
+	if stats.Hits["logged"] < before.Hits["logged"]+2 {
+		t.Errorf("logged hits = %d, want at least %d", stats.Hits["logged"], before.Hits["logged"]+2)
+	}
+	if got := stats.AccountHits["UA-5555-1"] - before.AccountHits["UA-5555-1"]; got != 2 {
+		t.Errorf("account hits = %v, want 2 more for UA-5555-1", stats.AccountHits)
+	}
+	if stats.Queue.Capacity != 50 || stats.LogLevel != logLevelVar.Level().String() || stats.UptimeSeconds < 0 {
+		t.Errorf("stats = %+v, want a queue capacity of 50 and the current log level", stats)
+	}
+}
+
+func TestAdminFlush(t *testing.T) {
+	stub := newTestBeacon(t, "-adminToken=s3cret", "-gaBatch", "-coalesceWindow=0")
+	keep(t, &hitBatcher)
+	hitBatcher = newBatchDispatcher(time.Hour, testServer.logger)
+	t.Cleanup(func() { hitBatcher.Stop(context.Background()) })
+	keep(t, &hitSpool)
+	var err error
+	if hitSpool, err = openSpool(filepath.Join(t.TempDir(), "spool"), 0, time.Hour, testServer.logger); err != nil {
+		t.Fatal(err)
+	}
+	hitSpool.Add(spooledHit{Time: time.Now(), URL: gaEndpoint, ContentType: "application/x-www-form-urlencoded", Body: "v=1&tid=UA-6666-1&t=pageview"})
+
+	get("/UA-5555-1/page")
+	stub.none(t)
+
+	if w := admin("POST", "/admin/flush", "Bearer s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	paths := map[string]string{}
+	for i := 0; i < 2; i++ {
+		hit := stub.next(t)
+		paths[hit.path] = hit.body
+	}
+	if got := paths["/batch"]; got == "" || !strings.Contains(got, "tid=UA-5555-1") {
+		t.Errorf("batch = %q, want the batched hit", got)
+	}
+	if got := paths["/collect"]; !strings.Contains(got, "tid=UA-6666-1") {
+		t.Errorf("collect = %q, want the spooled hit", got)
+	}
+	if hitSpool.Size() != 0 {
+		t.Errorf("spool holds %d bytes after the flush, want 0", hitSpool.Size())
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	setFlags(t, "-adminToken=s3cret")
+	useTenants(t, `{"tenants": [{"name": "acme", "key": "old", "trackingIDs": ["UA-1111-1"]}]}`)
+
+	os.WriteFile(tenantsFile, []byte(`{"tenants": [{"name": "acme", "key": "new", "trackingIDs": ["UA-1111-1"]}]}`), 0600)
+	if w := admin("POST", "/admin/reload", "Bearer s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if acme, _ := lookupTenant("UA-1111-1"); acme.Key != "new" {
+		t.Errorf("key = %q after the reload, want new", acme.Key)
+	}
+
+	os.WriteFile(tenantsFile, []byte(`{"tenants": []}`), 0600)
+	if w := admin("POST", "/admin/reload", "Bearer s3cret"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d for an invalid tenants file, want 500", w.Code)
+	}
+	if acme, _ := lookupTenant("UA-1111-1"); acme == nil || acme.Key != "new" {
+		t.Errorf("tenant = %+v after a failed reload, want the previous one kept", acme)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	setFlags(t, "-adminToken=s3cret")
+	level := logLevelVar.Level()
+	t.Cleanup(func() { logLevelVar.Set(level) })
+	logLevelVar.Set(slog.LevelInfo)
+
+	if w := admin("POST", "/admin/loglevel?level=debug", "Bearer s3cret"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if logLevelVar.Level() != slog.LevelDebug {
+		t.Errorf("level = %s, want DEBUG", logLevelVar.Level())
+	}
+	for _, target := range []string{"/admin/loglevel?level=verbose", "/admin/loglevel"} {
+		if w := admin("POST", target, "Bearer s3cret"); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: status = %d, want 400", target, w.Code)
+		}
+	}
+	if logLevelVar.Level() != slog.LevelDebug {
+		t.Errorf("level = %s after invalid levels, want DEBUG kept", logLevelVar.Level())
+	}
+	if w := admin("POST", "/admin/loglevel?level=warn", "Bearer guess"); w.Code != http.StatusForbidden || logLevelVar.Level() != slog.LevelDebug {
+		t.Errorf("status = %d, level %s with a wrong token, want 403 and DEBUG kept", w.Code, logLevelVar.Level())
+	}
+}
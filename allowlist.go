@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const allowlistFetchAttempts = 3
+
+var (
+	// staticAllowlist holds the -allowedIDs tracking IDs. It is nil when the
+	// flag is empty.
+	staticAllowlist atomic.Pointer[map[string]struct{}]
+
+	// remoteAllowlist holds the tracking IDs fetched from -allowedAccountsURL.
+	// It is nil when no remote allowlist is configured.
+	remoteAllowlist atomic.Pointer[map[string]struct{}]
+
+	// allowlistSource fetches remoteAllowlist. It is nil without
+	// -allowedAccountsURL.
+	allowlistSource *allowlistFetcher
+
+	allowlistFetchErrors atomic.Int64
+)
+
+// accountAllowed reports whether hits for account may be handled. With
+// neither allowlist configured every account is allowed; otherwise account
+// must be on one of them.
+func accountAllowed(account string) bool {
+	static, remote := staticAllowlist.Load(), remoteAllowlist.Load()
+	if static == nil && remote == nil {
+		return true
+	}
+	if static != nil {
+		if _, ok := (*static)[account]; ok {
+			return true
+		}
+	}
+	if remote != nil {
+		_, ok := (*remote)[account]
+		return ok
+	}
+	return false
+}
+
+// parseAllowedIDs parses -allowedIDs into a set, or nil if it lists no IDs.
+func parseAllowedIDs(s string) *map[string]struct{} {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	set := newAllowlist(ids)
+	return &set
+}
+
+// newAllowlist turns a list of tracking IDs into a set.
+func newAllowlist(ids []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// allowlistFetcher polls a URL returning a JSON array of allowed tracking IDs.
+type allowlistFetcher struct {
+	url    string
+	client *http.Client
+	logger *slog.Logger
+	etag   string
+}
+
+func newAllowlistFetcher(url string, logger *slog.Logger) *allowlistFetcher {
+	return &allowlistFetcher{url: url, client: &http.Client{Timeout: 10 * time.Second}, logger: logger}
+}
+
+// fetch downloads the allowlist. It returns nil without error if the list has
+// not changed since the last fetch.
+func (f *allowlistFetcher) fetch() ([]string, error) {
+	req, err := http.NewRequest("GET", f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.etag != "" {
+		req.Header.Set("If-None-Match", f.etag)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("allowlist endpoint returned %s", resp.Status)
+	}
+
+	var ids []string
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, fmt.Errorf("cannot decode allowlist: %v", err)
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	f.etag = resp.Header.Get("ETag")
+	return ids, nil
+}
+
+// refresh fetches the allowlist, retrying with exponential backoff, and
+// swaps it in. On failure the previous allowlist stays active.
+func (f *allowlistFetcher) refresh() error {
+	var err error
+	delay := time.Second
+	for attempt := 1; attempt <= allowlistFetchAttempts; attempt++ {
+		var ids []string
+		if ids, err = f.fetch(); err == nil {
+			if ids != nil {
+				set := newAllowlist(ids)
+				remoteAllowlist.Store(&set)
+				f.logger.Info("Loaded allowlist", "accounts", len(ids), "url", f.url)
+			}
+			return nil
+		}
+		if attempt < allowlistFetchAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	allowlistFetchErrors.Add(1)
+	f.logger.Error("Cannot fetch allowlist, keeping the previous one", "url", f.url, "err", err)
+	return err
+}
+
+// run refreshes the allowlist every interval.
+func (f *allowlistFetcher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		f.refresh()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// allowlistServer serves a JSON allowlist with an ETag, answering 304 to
+// requests for the current one.
+type allowlistServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	body     string
+	etag     string
+	status   int
+	requests int
+	notMod   int
+}
+
+func newAllowlistServer(t *testing.T, body, etag string) *allowlistServer {
+	s := &allowlistServer{body: body, etag: etag, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == s.etag {
+			s.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", s.etag)
+		w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	t.Cleanup(func() { remoteAllowlist.Store(nil) })
+	return s
+}
+
+func (s *allowlistServer) set(body, etag string, status int) {
+	s.mu.Lock()
+	s.body, s.etag, s.status = body, etag, status
+	s.mu.Unlock()
+}
+
+func TestAllowlistFetcherUpdate(t *testing.T) {
+	srv := newAllowlistServer(t, `["UA-1234-1"]`, `"v1"`)
+	f := newAllowlistFetcher(srv.URL, testServer.logger)
+
+	if err := f.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !accountAllowed("UA-1234-1") || accountAllowed("UA-5678-1") {
+		t.Error("first allowlist not in use")
+	}
+
+	srv.set(`["UA-5678-1"]`, `"v2"`, http.StatusOK)
+	if err := f.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if accountAllowed("UA-1234-1") || !accountAllowed("UA-5678-1") {
+		t.Error("updated allowlist not in use")
+	}
+}
+
+func TestAllowlistFetcherNotModified(t *testing.T) {
+	srv := newAllowlistServer(t, `["UA-1234-1"]`, `"v1"`)
+	f := newAllowlistFetcher(srv.URL, testServer.logger)
+	if err := f.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	before := remoteAllowlist.Load()
+
+	if err := f.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.notMod != 1 {
+		t.Errorf("server answered %d requests with 304, want 1", srv.notMod)
+	}
+	if remoteAllowlist.Load() != before {
+		t.Error("allowlist replaced although it did not change")
+	}
+}
+
+func TestAllowlistFetcherFailure(t *testing.T) {
+	srv := newAllowlistServer(t, `["UA-1234-1"]`, `"v1"`)
+	f := newAllowlistFetcher(srv.URL, testServer.logger)
+	if err := f.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.set("", "", http.StatusInternalServerError)
+	srv.requests = 0
+	errors := allowlistFetchErrors.Load()
+	if err := f.refresh(); err == nil {
+		t.Fatal("refresh() succeeded against a failing endpoint")
+	}
+	if srv.requests != allowlistFetchAttempts {
+		t.Errorf("endpoint got %d requests, want %d", srv.requests, allowlistFetchAttempts)
+	}
+	if got := allowlistFetchErrors.Load(); got != errors+1 {
+		t.Errorf("allowlistFetchErrors = %d, want %d", got, errors+1)
+	}
+	if !accountAllowed("UA-1234-1") {
+		t.Error("previous allowlist dropped after a failed fetch")
+	}
+}
+
+func TestAllowlistFetcherInvalidJSON(t *testing.T) {
+	srv := newAllowlistServer(t, `{"accounts": []}`, `"v1"`)
+	if _, err := newAllowlistFetcher(srv.URL, testServer.logger).fetch(); err == nil {
+		t.Error("fetch() accepted a JSON object")
+	}
+}
+
+func TestParseAllowedIDs(t *testing.T) {
+	for _, s := range []string{"", " ", ",, ,"} {
+		if got := parseAllowedIDs(s); got != nil {
+			t.Errorf("parseAllowedIDs(%q) = %v, want nil", s, *got)
+		}
+	}
+	got := parseAllowedIDs(" UA-12345-1, G-ABCDEFGH ,,")
+	if got == nil || len(*got) != 2 {
+		t.Fatalf("parseAllowedIDs() = %v, want the two IDs", got)
+	}
+	for _, id := range []string{"UA-12345-1", "G-ABCDEFGH"} {
+		if _, ok := (*got)[id]; !ok {
+			t.Errorf("parseAllowedIDs() lacks %s", id)
+		}
+	}
+}
+
+func TestStaticAllowlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		account string
+		status  int
+	}{
+		{"empty list", "", "UA-5678-1", http.StatusOK},
+		{"allowed", "UA-1234-1,G-ABCDEFGH", "UA-1234-1", http.StatusOK},
+		{"disallowed", "UA-1234-1,G-ABCDEFGH", "UA-5678-1", http.StatusForbidden},
+		{"disallowed GA4", "UA-1234-1", "G-ABCDEFGH", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t)
+			staticAllowlist.Store(parseAllowedIDs(tt.allowed))
+			w := get("/" + tt.account + "/page")
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				stub.next(t)
+			} else {
+				stub.none(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	assetSumsPath = "static/assets.sha256"
+
+	// fallbackPageTemplate is shown for /<account> if page.html is unusable.
+	fallbackPageTemplate = `<!DOCTYPE HTML><title>GA account: {{.Account}}</title><p>GA account: {{.Account}}</p>`
+)
+
+// embeddedFS holds the page template and static assets, so the binary runs
+// from any working directory.
+//
+//go:embed page.html static
+var embeddedFS embed.FS
+
+var (
+	// badgeAssetFiles maps each badge variant to the file it is read from.
+	badgeAssetFiles = map[string]string{
+		"":         "badge.svg",
+		"pixel":    "pixel.gif",
+		"gif":      "badge.gif",
+		"flat":     "badge-flat.svg",
+		"flat-gif": "badge-flat.gif",
+	}
+
+	// overriddenBadges are the variants loaded from -overrideBadgeDir or
+	// -staticDir. They are not part of the integrity check.
+	overriddenBadges = map[string]bool{}
+
+	// degradedMode is set when an asset failed its integrity check and is
+	// being replaced by the pixel, or an embedded asset is unusable.
+	degradedMode atomic.Bool
+
+	// embeddedAssetErrors maps the embedded assets that can't be used to why.
+	// They are replaced by fallbacks: the pixel for badges, a bare page for
+	// templates. Recorded as they are first loaded, before main runs.
+	embeddedAssetErrors map[string]error
+
+	// fallbackPixel is a transparent 1x1 GIF, served if static/pixel.gif is
+	// unusable.
+	fallbackPixel = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+	// assetsMu guards the assets reloadAssets replaces: badgeImages,
+	// greyBadges, overriddenBadges, badgeModTime, pageTemplate, badgeTemplate
+	// and crawlerUAs. Before the server starts they are set without it.
+	assetsMu sync.RWMutex
+)
+
+// loadAssets replaces the embedded assets with those found in -staticDir,
+// -overrideBadgeDir and -botUAFile, in that order, checks the badges and
+// derives the grey ones from them.
+func loadAssets(logger *slog.Logger) error {
+	if staticDir != "" {
+		if err := loadStaticDir(logger, staticDir); err != nil {
+			return fmt.Errorf("-staticDir: %w", err)
+		}
+	}
+	if overrideBadgeDir != "" {
+		if err := loadBadgeOverrides(logger, overrideBadgeDir); err != nil {
+			return fmt.Errorf("-overrideBadgeDir: %w", err)
+		}
+	}
+	if botUAFile != "" {
+		if err := loadCrawlerList(botUAFile); err != nil {
+			return fmt.Errorf("-botUAFile: %w", err)
+		}
+	}
+	if !skipIntegrityCheck {
+		assetIntegrityCheck(logger)
+	}
+	greyBadges = map[string]badgeImage{
+		"":     greyBadge(badgeImages[""]),
+		"flat": greyBadge(badgeImages["flat"]),
+	}
+	badgeModTime = time.Now()
+	return nil
+}
+
+// reloadAssets loads the assets again as at startup, so edited files in the
+// asset directories are served without a restart. If any of them cannot be
+// loaded, the assets in use are kept.
+func reloadAssets(logger *slog.Logger) error {
+	// Rendered badges are cached under renderedBadgesMu, which renderBadge
+	// holds while it reads badgeTemplate.
+	renderedBadgesMu.Lock()
+	defer renderedBadgesMu.Unlock()
+	assetsMu.Lock()
+	defer assetsMu.Unlock()
+
+	images, grey, overridden, modTime := badgeImages, greyBadges, overriddenBadges, badgeModTime
+	page, badgeTmpl, crawlers, degraded := pageTemplate, badgeTemplate, crawlerUAs, degradedMode.Load()
+
+	badgeImages = embeddedBadgeImages()
+	overriddenBadges = map[string]bool{}
+	pageTemplate = embeddedPageTemplate()
+	badgeTemplate = embeddedBadgeTemplate()
+	crawlerUAs = parseCrawlerList(embeddedAsset("static/crawlers.txt"))
+	degradedMode.Store(len(embeddedAssetErrors) > 0)
+	if err := loadAssets(logger); err != nil {
+		badgeImages, greyBadges, overriddenBadges, badgeModTime = images, grey, overridden, modTime
+		pageTemplate, badgeTemplate, crawlerUAs = page, badgeTmpl, crawlers
+		degradedMode.Store(degraded)
+		return err
+	}
+	renderedBadges = map[badgeText]badgeImage{}
+	return nil
+}
+
+// parseAssetSums parses sha256sum output into a map from file name to hash.
+func parseAssetSums(data []byte) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line %q", scanner.Text())
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return sums, scanner.Err()
+}
+
+// assetIntegrityCheck verifies every badge against static/assets.sha256 and
+// serves the pixel in place of any badge that does not match, since a broken
+// image is worse than an invisible one.
+func assetIntegrityCheck(logger *slog.Logger) {
+	data := embeddedAsset(assetSumsPath)
+	if data == nil {
+		logger.Error("Asset checksums unavailable, skipping asset integrity check", "path", assetSumsPath)
+		return
+	}
+	sums, err := parseAssetSums(data)
+	if err != nil {
+		logger.Error("Cannot parse asset checksums, skipping asset integrity check", "path", assetSumsPath, "err", err)
+		return
+	}
+
+	for variant, file := range badgeAssetFiles {
+		if overriddenBadges[variant] {
+			continue
+		}
+		img := badgeImages[variant]
+		sum := sha256.Sum256(img.data)
+		if hex.EncodeToString(sum[:]) == sums[file] {
+			continue
+		}
+		logger.Error("Asset failed its integrity check, serving the pixel instead", "asset", file)
+		badgeImages[variant] = badgeImage{"image/gif", pixel}
+		degradedMode.Store(true)
+	}
+}
+
+// embeddedPageTemplate returns the built-in account page template.
+func embeddedPageTemplate() *template.Template {
+	return embeddedHTMLTemplate("page.html", fallbackPageTemplate)
+}
+
+// embeddedAsset returns a file embedded in the binary, or nil if it can't be
+// read.
+func embeddedAsset(path string) []byte {
+	b, err := fs.ReadFile(embeddedFS, path)
+	if err != nil {
+		embeddedAssetFailed(path, err)
+		return nil
+	}
+	return b
+}
+
+// embeddedAssetOr returns a file embedded in the binary, or fallback if it
+// can't be read.
+func embeddedAssetOr(path string, fallback []byte) []byte {
+	if b := embeddedAsset(path); b != nil {
+		return b
+	}
+	return fallback
+}
+
+// embeddedHTMLTemplate parses the template embedded at path, named after its
+// file, or fallback if it can't be read or parsed.
+func embeddedHTMLTemplate(path, fallback string) *template.Template {
+	name := filepath.Base(path)
+	if data := embeddedAsset(path); data != nil {
+		t, err := template.New(name).Parse(string(data))
+		if err == nil {
+			return t
+		}
+		embeddedAssetFailed(path, err)
+	}
+	return template.Must(template.New(name).Parse(fallback))
+}
+
+// embeddedAssetFailed records an embedded asset that can't be used. The
+// beacon still starts, serving a fallback in its place, in degraded mode.
+// The self-test and `ga-beacon check` report it.
+func embeddedAssetFailed(path string, err error) {
+	if embeddedAssetErrors == nil {
+		embeddedAssetErrors = map[string]error{}
+	}
+	embeddedAssetErrors[path] = err
+}
+
+// loadStaticDir replaces the embedded assets with the files of the same path
+// found in dir, laid out like the repo: dir/page.html, dir/static/badge.svg,
+// dir/static/badge.svg.tmpl, dir/static/crawlers.txt and so on. Missing files
+// keep the embedded asset.
+func loadStaticDir(logger *slog.Logger, dir string) error {
+	if err := loadBadgeOverrides(logger, filepath.Join(dir, "static")); err != nil {
+		return err
+	}
+
+	if data, err := readOverride(logger, dir, "page.html"); err != nil {
+		return err
+	} else if data != nil {
+		t, err := template.New("page.html").Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("page.html: %w", err)
+		}
+		pageTemplate = t
+	}
+	if data, err := readOverride(logger, dir, "static/badge.svg.tmpl"); err != nil {
+		return err
+	} else if data != nil {
+		t, err := parseBadgeTemplate(data)
+		if err != nil {
+			return fmt.Errorf("static/badge.svg.tmpl: %w", err)
+		}
+		badgeTemplate = t
+	}
+	if data, err := readOverride(logger, dir, "static/crawlers.txt"); err != nil {
+		return err
+	} else if data != nil {
+		crawlerUAs = parseCrawlerList(data)
+	}
+	return nil
+}
+
+// readOverride returns the file name in dir, or nil if there is none.
+func readOverride(logger *slog.Logger, dir, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Serving asset override", "asset", name, "dir", dir)
+	return data, nil
+}
+
+// loadBadgeOverrides replaces the built-in badges with the files of the same
+// name found in dir. Missing files keep the built-in badge.
+func loadBadgeOverrides(logger *slog.Logger, dir string) error {
+	for variant, file := range badgeAssetFiles {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("%s is empty", file)
+		}
+		badgeImages[variant] = badgeImage{badgeImages[variant].contentType, data}
+		overriddenBadges[variant] = true
+		logger.Info("Serving badge override", "asset", file, "dir", dir)
+	}
+	return nil
+}
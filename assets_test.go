@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keepAssets lets t replace the badges and degraded mode, restoring them
+// when it ends. The badge map is copied so that it can be modified.
+func keepAssets(t *testing.T) {
+	keep(t, &badgeImages)
+	keep(t, &greyBadges)
+	keep(t, &overriddenBadges)
+	keep(t, &badgeModTime)
+	degraded := degradedMode.Load()
+	t.Cleanup(func() { degradedMode.Store(degraded) })
+	badgeImages = maps.Clone(badgeImages)
+	overriddenBadges = map[string]bool{}
+	degradedMode.Store(false)
+}
+
+// corrupt flips a byte of the data of the badge variant.
+func corrupt(variant string) {
+	img := badgeImages[variant]
+	data := bytes.Clone(img.data)
+	data[len(data)/2] ^= 0xff
+	badgeImages[variant] = badgeImage{img.contentType, data}
+}
+
+func TestAssetIntegrityCheck(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		keepAssets(t)
+		before := maps.Clone(badgeImages)
+		assetIntegrityCheck(testServer.logger)
+		if degradedMode.Load() {
+			t.Error("degraded with intact badges")
+		}
+		for variant, img := range badgeImages {
+			if !bytes.Equal(img.data, before[variant].data) {
+				t.Errorf("badge %q replaced although intact", variant)
+			}
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		keepAssets(t)
+		corrupt("flat")
+		assetIntegrityCheck(testServer.logger)
+		if !degradedMode.Load() {
+			t.Error("not degraded with a corrupted badge")
+		}
+		if img := badgeImages["flat"]; img.contentType != "image/gif" || !bytes.Equal(img.data, pixel) {
+			t.Errorf("corrupted badge served as %s, want the pixel", img.contentType)
+		}
+		if img := badgeImages[""]; img.contentType != "image/svg+xml" {
+			t.Errorf("intact badge served as %s, want it kept", img.contentType)
+		}
+	})
+
+	t.Run("served", func(t *testing.T) {
+		keepAssets(t)
+		newTestBeacon(t)
+		corrupt("flat")
+		assetIntegrityCheck(testServer.logger)
+		w := get("/UA-1234-1/page?flat")
+		if got := w.Header().Get("Content-Type"); got != "image/gif" || !bytes.Equal(w.Body.Bytes(), pixel) {
+			t.Errorf("corrupted badge response is %s, want the pixel", got)
+		}
+	})
+
+	t.Run("overridden", func(t *testing.T) {
+		keepAssets(t)
+		corrupt("flat")
+		overriddenBadges["flat"] = true
+		assetIntegrityCheck(testServer.logger)
+		if degradedMode.Load() || badgeImages["flat"].contentType != "image/svg+xml" {
+			t.Error("overridden badge checked against the embedded checksums")
+		}
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		keepAssets(t)
+		setFlags(t, "-skipIntegrityCheck")
+		corrupt("flat")
+		if err := loadAssets(testServer.logger); err != nil {
+			t.Fatal(err)
+		}
+		if degradedMode.Load() || badgeImages["flat"].contentType != "image/svg+xml" {
+			t.Error("badges checked with -skipIntegrityCheck")
+		}
+	})
+}
+
+func TestHealthzDegraded(t *testing.T) {
+	for _, degraded := range []bool{false, true} {
+		keepAssets(t)
+		if degraded {
+			corrupt("")
+			assetIntegrityCheck(testServer.logger)
+		}
+		w := httptest.NewRecorder()
+		healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("degraded=%v: status = %d, want 200 either way", degraded, w.Code)
+		}
+		var status healthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Degraded != degraded {
+			t.Errorf("degraded = %v, want %v", status.Degraded, degraded)
+		}
+	}
+}
+
+func TestParseAssetSums(t *testing.T) {
+	sums, err := parseAssetSums([]byte("abc123  badge.svg\ndef456 *badge.gif\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 2 || sums["badge.svg"] != "abc123" || sums["badge.gif"] != "def456" {
+		t.Errorf("parseAssetSums() = %v", sums)
+	}
+	if _, err := parseAssetSums([]byte("abc123\n")); err == nil {
+		t.Error("parseAssetSums() accepted a line without a file name")
+	}
+}
+
+func TestEmbeddedAssets(t *testing.T) {
+	files := []string{"page.html", "static/crawlers.txt", assetSumsPath}
+	for _, file := range badgeAssetFiles {
+		files = append(files, "static/"+file)
+	}
+	for _, file := range files {
+		if data, err := fs.ReadFile(embeddedFS, file); err != nil || len(data) == 0 {
+			t.Errorf("embedded %s: %d bytes, %v", file, len(data), err)
+		}
+	}
+}
+
+func TestEmbeddedPageTemplate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var page bytes.Buffer
+	err := embeddedPageTemplate().ExecuteTemplate(&page, "page.html", struct {
+		Account string
+		Referer string
+	}{"UA-1234-1", "https://example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "UA-1234-1") {
+		t.Errorf("page does not show the account: %.80q...", page.String())
+	}
+}
+
+func TestLoadBadgeOverrides(t *testing.T) {
+	keepAssets(t)
+	embedded := badgeImages["flat"]
+	dir := t.TempDir()
+	custom := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><text>custom</text></svg>`)
+	os.WriteFile(filepath.Join(dir, "badge.svg"), custom, 0644)
+	if err := loadBadgeOverrides(testServer.logger, dir); err != nil {
+		t.Fatal(err)
+	}
+	if img := badgeImages[""]; !bytes.Equal(img.data, custom) || img.contentType != "image/svg+xml" || !overriddenBadges[""] {
+		t.Errorf("badge = %s %.40q..., want the override", img.contentType, img.data)
+	}
+	if img := badgeImages["flat"]; !bytes.Equal(img.data, embedded.data) || overriddenBadges["flat"] {
+		t.Error("badge missing from the directory not kept embedded")
+	}
+
+	os.WriteFile(filepath.Join(dir, "badge.gif"), nil, 0644)
+	if err := loadBadgeOverrides(testServer.logger, dir); err == nil {
+		t.Error("loadBadgeOverrides() accepted an empty badge")
+	}
+}
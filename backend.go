@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultPlausibleURL = "https://plausible.io/api/event"
+
+// Collector reports hits to an analytics backend.
+type Collector interface {
+	Collect(ctx context.Context, job hitJob) error
+}
+
+// collectors are the backends selectable with -collector and
+// -accountCollectors.
+var collectors = map[string]Collector{
+	"ga":        gaCollector{},
+	"matomo":    matomoCollector{},
+	"plausible": plausibleCollector{},
+	"none":      noneCollector{},
+	"local":     localCollector{},
+}
+
+// accountCollectorNames maps accounts to the collector their hits go to,
+// overriding -collector. Set from -accountCollectors.
+var accountCollectorNames map[string]string
+
+// collectorFor returns the collector hits for account are reported to.
+func collectorFor(account string) Collector {
+	return collectors[collectorNameFor(account)]
+}
+
+// collectorNameFor returns the name of the collector hits for account are
+// reported to.
+func collectorNameFor(account string) string {
+	if name, ok := accountCollectorNames[account]; ok {
+		return name
+	}
+	return defaultCollector
+}
+
+// parseAccountCollectors parses -accountCollectors, a comma-separated list of
+// account=collector pairs.
+func parseAccountCollectors(s string) (map[string]string, error) {
+	return parseAccountMap(s, func(name string) error {
+		if _, ok := collectors[name]; !ok {
+			return fmt.Errorf("unknown collector %q", name)
+		}
+		return nil
+	})
+}
+
+// usesCollector reports whether any account or fan-out destination is
+// reported to the named collector.
+func usesCollector(name string) bool {
+	if defaultCollector == name {
+		return true
+	}
+	for _, n := range accountCollectorNames {
+		if n == name {
+			return true
+		}
+	}
+	for _, dests := range fanoutDestinations {
+		for _, d := range dests {
+			if d.collector == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fanoutDestination is an extra account a hit is reported to. An empty
+// collector means the one collectorFor picks for the account.
+type fanoutDestination struct {
+	collector string
+	account   string
+}
+
+// fanoutDestinations maps accounts to the destinations their hits are also
+// reported to. Set from -fanout.
+var fanoutDestinations map[string][]fanoutDestination
+
+// parseFanout parses -fanout, a comma-separated list of
+// account=destination+destination pairs where each destination is
+// [collector:]account, e.g. UA-1234-1=G-ABC123+matomo:5.
+func parseFanout(s string) (map[string][]fanoutDestination, error) {
+	groups, err := parseAccountMap(s, func(value string) error {
+		_, err := parseFanoutDestinations(value)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fanout := map[string][]fanoutDestination{}
+	for account, value := range groups {
+		fanout[account], _ = parseFanoutDestinations(value)
+	}
+	return fanout, nil
+}
+
+func parseFanoutDestinations(value string) ([]fanoutDestination, error) {
+	var dests []fanoutDestination
+	for _, d := range strings.Split(value, "+") {
+		name, account, ok := strings.Cut(strings.TrimSpace(d), ":")
+		if !ok {
+			name, account = "", name
+		}
+		if _, known := collectors[name]; !known && name != "" {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		if account == "" || maxPrintable(256)(account) != nil {
+			return nil, fmt.Errorf("invalid destination %q", d)
+		}
+		dests = append(dests, fanoutDestination{name, account})
+	}
+	return dests, nil
+}
+
+// fanoutJobs returns a copy of job for each -fanout destination of its
+// account, with the collector to report it to.
+func fanoutJobs(job hitJob) ([]hitJob, []Collector) {
+	dests := fanoutDestinations[job.params[0]]
+	jobs := make([]hitJob, 0, len(dests))
+	targets := make([]Collector, 0, len(dests))
+	for _, d := range dests {
+		copied := job
+		copied.params = []string{d.account, job.params[1]}
+		jobs = append(jobs, copied)
+		if d.collector != "" {
+			targets = append(targets, collectors[d.collector])
+		} else {
+			targets = append(targets, collectorFor(d.account))
+		}
+	}
+	return jobs, targets
+}
+
+// noneCollector reports hits nowhere, for beacons that only -mirror them.
+type noneCollector struct{}
+
+func (noneCollector) Collect(ctx context.Context, job hitJob) error { return nil }
+
+// send reports a built hit, or only logs it with -dryRun.
+func send(ctx context.Context, job hitJob, payload gaRequest) error {
+	if dryRun {
+		job.logger.Info("Dry run, not reporting hit", "url", redactSecret(payload.url), "payload", payload.body, "cid", job.cid, "request_id", job.requestID)
+		return nil
+	}
+	return log(ctx, job, payload)
+}
+
+// gaCollector reports hits to Google Analytics with the protocol picked by
+// selectProtocol, batching v1 hits to each /collect
+// endpoint with -gaBatch.
+type gaCollector struct{}
+
+func (gaCollector) Collect(ctx context.Context, job hitJob) error {
+	protocol := selectProtocol(job.params[0], gaProtocol)
+	payload, err := payloadBuilders[protocol].Build(job)
+	if err != nil {
+		hitsErrored.Inc()
+		job.logger.Error("Cannot build payload", "protocol", string(protocol), "err", err, "request_id", job.requestID)
+		return err
+	}
+	if hitBatcher != nil && protocol == ProtocolV1 && batchURL(payload.url) != "" && !dryRun {
+		hitBatcher.Add(job, payload)
+		return nil
+	}
+	return send(ctx, job, payload)
+}
+
+// pageURL returns the absolute URL of the hit's page: ?dl if given, otherwise
+// the page path on host. It returns "" if neither is known.
+func pageURL(job hitJob, forwarded url.Values, host string) string {
+	if dl := forwarded.Get("dl"); dl != "" {
+		return dl
+	}
+	if host == "" {
+		return ""
+	}
+	return "https://" + host + "/" + strings.TrimPrefix(job.params[1], "/")
+}
+
+// matomoCollector reports hits to the Matomo HTTP tracking API at
+// -matomoURL. The account is the Matomo site ID. The client IP is only
+// sent with -matomoToken, since Matomo ignores cip without a token, and
+// unless the account's IP mode omits it.
+//
+// Matomo API reference: https://developer.matomo.org/api-reference/tracking-api
+type matomoCollector struct{}
+
+func (matomoCollector) Collect(ctx context.Context, job hitJob) error {
+	forwarded := forwardedQuery(job.logger, job.query)
+	payload := url.Values{
+		"idsite":      {job.params[0]},
+		"rec":         {"1"},
+		"apiv":        {"1"},
+		"action_name": {job.params[1]},
+		"_id":         {matomoVisitorID(job.cid)},
+		"ua":          {job.ua},
+	}
+	if u := pageURL(job, forwarded, forwarded.Get("dh")); u != "" {
+		payload.Set("url", u)
+	}
+	if dr := forwarded.Get("dr"); dr != "" {
+		payload.Set("urlref", dr)
+	}
+	if dt := forwarded.Get("dt"); dt != "" {
+		payload.Set("action_name", dt)
+	}
+	if uid := forwarded.Get("uid"); uid != "" {
+		payload.Set("uid", uid)
+	}
+	if ul := forwarded.Get("ul"); ul != "" {
+		payload.Set("lang", ul)
+	}
+	if cn := forwarded.Get("cn"); cn != "" {
+		payload.Set("_rcn", cn) // campaign name
+	}
+	if ck := forwarded.Get("ck"); ck != "" {
+		payload.Set("_rck", ck) // campaign keyword
+	}
+	if forwarded.Get("t") == "event" {
+		payload.Set("e_c", forwarded.Get("ec"))
+		payload.Set("e_a", forwarded.Get("ea"))
+		if el := forwarded.Get("el"); el != "" {
+			payload.Set("e_n", el)
+		}
+		if ev := forwarded.Get("ev"); ev != "" {
+			payload.Set("e_v", ev)
+		}
+	}
+	if ip := reportedIP(job); matomoToken != "" && ip != "" {
+		payload.Set("token_auth", matomoToken)
+		payload.Set("cip", ip)
+	}
+
+	return send(ctx, job, gaRequest{
+		url:         matomoURL,
+		contentType: "application/x-www-form-urlencoded",
+		body:        payload.Encode(),
+	})
+}
+
+// matomoVisitorID derives Matomo's 16 hex digit visitor ID from a client ID.
+func matomoVisitorID(cid string) string {
+	id := strings.ReplaceAll(cid, "-", "")
+	if len(id) > 16 {
+		id = id[:16]
+	}
+	return id
+}
+
+// plausibleCollector reports hits to the Plausible events API at
+// -plausibleURL. The account is the site's domain as registered in
+// Plausible. Plausible identifies visitors by User-Agent and IP, so the
+// client ID is not sent.
+//
+// Plausible API reference: https://plausible.io/docs/events-api
+type plausibleCollector struct{}
+
+func (plausibleCollector) Collect(ctx context.Context, job hitJob) error {
+	forwarded := forwardedQuery(job.logger, job.query)
+	event := map[string]interface{}{
+		"domain": job.params[0],
+		"name":   "pageview",
+		"url":    pageURL(job, forwarded, job.params[0]),
+	}
+	if dr := forwarded.Get("dr"); dr != "" {
+		event["referrer"] = dr
+	}
+	if forwarded.Get("t") == "event" {
+		event["name"] = forwarded.Get("ea")
+		props := map[string]string{"category": forwarded.Get("ec")}
+		if el := forwarded.Get("el"); el != "" {
+			props["label"] = el
+		}
+		event["props"] = props
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var header http.Header
+	if ip := reportedIP(job); ip != "" {
+		header = http.Header{"X-Forwarded-For": {ip}}
+	}
+	return send(ctx, job, gaRequest{
+		url:         plausibleURL,
+		contentType: "application/json",
+		body:        string(body),
+		header:      header,
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	for _, account := range []string{"UA-1234-1", "G-ABCDEFGH"} {
+		t.Run(account, func(t *testing.T) {
+			stub := newTestBeacon(t, "-dryRun", "-ga4APISecret=s3cret")
+			var log bytes.Buffer
+			w := getFrom(newLoggingServer(&log), "/"+account+"/page")
+			if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), badgeImages[""].data) {
+				t.Errorf("status = %d, want the badge served normally", w.Code)
+			}
+			if cidCookieFrom(w) == nil {
+				t.Error("no cid cookie set with -dryRun")
+			}
+			stub.none(t)
+			hitWorkers.Stop(context.Background()) // so the dry run is logged before log is read
+			if !strings.Contains(log.String(), `msg="Dry run, not reporting hit"`) || !strings.Contains(log.String(), account) {
+				t.Errorf("logged %s, want the payload of the hit", log.String())
+			}
+			if strings.Contains(log.String(), "s3cret") {
+				t.Errorf("logged %s, want the API secret redacted", log.String())
+			}
+		})
+	}
+}
+
+func TestGAEndpoint(t *testing.T) {
+	proxy := newGAStub(t)
+	stub := newTestBeacon(t, "-gaEndpoint="+proxy.URL+"/proxy/collect")
+	get("/UA-1234-1/page")
+	hit := proxy.next(t)
+	if hit.path != "/proxy/collect" {
+		t.Errorf("hit sent to %s, want -gaEndpoint", hit.path)
+	}
+	if got := hit.form().Get("tid"); got != "UA-1234-1" {
+		t.Errorf("tid = %q, want UA-1234-1", got)
+	}
+	stub.none(t)
+}
+
+func TestMatomoCollector(t *testing.T) {
+	stub := newTestBeacon(t, "-matomoToken=t0ken", "-gaMaxAttempts=1", "-breakerThreshold=0")
+	setFlags(t, "-matomoURL="+stub.URL+"/matomo.php")
+	job := hitJob{
+		params: []string{"5", "docs/intro"},
+		query:  url.Values{"t": {"event"}, "ec": {"video"}, "ea": {"play"}, "el": {"intro"}, "ev": {"3"}, "dr": {"https://example.org/"}, "dh": {"example.com"}},
+		ua:     "Firefox",
+		ip:     "198.51.100.7",
+		cid:    "35009a79-1a05-49d7-b876-2b884d0f825b",
+		logger: testServer.logger,
+	}
+	if err := collectors["matomo"].Collect(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	hit := stub.next(t)
+	if hit.path != "/matomo.php" || hit.header.Get("Content-Type") != "application/x-www-form-urlencoded" || hit.header.Get("User-Agent") != "Firefox" {
+		t.Errorf("hit = %s with %v, want a form POSTed to -matomoURL", hit.path, hit.header)
+	}
+	want := url.Values{
+		"idsite": {"5"}, "rec": {"1"}, "apiv": {"1"}, "action_name": {"docs/intro"}, "_id": {"35009a791a0549d7"}, "ua": {"Firefox"},
+		"url": {"https://example.com/docs/intro"}, "urlref": {"https://example.org/"},
+		"e_c": {"video"}, "e_a": {"play"}, "e_n": {"intro"}, "e_v": {"3"},
+		"token_auth": {"t0ken"}, "cip": {"198.51.100.7"},
+	}
+	if got := hit.form(); got.Encode() != want.Encode() {
+		t.Errorf("payload = %s, want %s", got.Encode(), want.Encode())
+	}
+
+	// Without a token, Matomo would ignore the client IP.
+	setFlags(t, "-matomoToken=")
+	collectors["matomo"].Collect(context.Background(), job)
+	if form := stub.next(t).form(); form.Has("cip") || form.Has("token_auth") {
+		t.Errorf("payload = %s, want no cip without -matomoToken", form.Encode())
+	}
+
+	stub.respond(http.StatusServiceUnavailable)
+	if err := collectors["matomo"].Collect(context.Background(), job); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Collect() = %v, want the 503 reported", err)
+	}
+	stub.next(t)
+}
+
+func TestPlausibleCollector(t *testing.T) {
+	stub := newTestBeacon(t, "-gaMaxAttempts=1", "-breakerThreshold=0")
+	setFlags(t, "-plausibleURL="+stub.URL+"/api/event")
+	tests := []struct {
+		name  string
+		job   hitJob
+		event map[string]interface{}
+		xff   string
+	}{
+		{
+			"pageview",
+			hitJob{params: []string{"example.com", "docs"}, query: url.Values{"dr": {"https://example.org/"}}, ua: "Firefox", ip: "198.51.100.7", logger: testServer.logger},
+			map[string]interface{}{"domain": "example.com", "name": "pageview", "url": "https://example.com/docs", "referrer": "https://example.org/"},
+			"198.51.100.7",
+		},
+		{
+			"event",
+			hitJob{params: []string{"example.com", "docs"}, query: url.Values{"t": {"event"}, "ec": {"video"}, "ea": {"play"}, "el": {"intro"}, "dl": {"https://example.com/docs?x=1"}}, ua: "Firefox", logger: testServer.logger},
+			map[string]interface{}{"domain": "example.com", "name": "play", "url": "https://example.com/docs?x=1", "props": map[string]interface{}{"category": "video", "label": "intro"}},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		if err := collectors["plausible"].Collect(context.Background(), tt.job); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		hit := stub.next(t)
+		if hit.path != "/api/event" || hit.header.Get("Content-Type") != "application/json" || hit.header.Get("User-Agent") != "Firefox" {
+			t.Errorf("%s: hit = %s with %v, want JSON POSTed to -plausibleURL", tt.name, hit.path, hit.header)
+		}
+		if got := hit.header.Get("X-Forwarded-For"); got != tt.xff {
+			t.Errorf("%s: X-Forwarded-For = %q, want %q", tt.name, got, tt.xff)
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(hit.body), &event); err != nil {
+			t.Fatalf("%s: %v: %s", tt.name, err, hit.body)
+		}
+		if !reflect.DeepEqual(event, tt.event) {
+			t.Errorf("%s: event = %v, want %v", tt.name, event, tt.event)
+		}
+	}
+
+	stub.Close()
+	if err := collectors["plausible"].Collect(context.Background(), tests[0].job); err == nil {
+		t.Error("Collect() to a closed server succeeded")
+	}
+}
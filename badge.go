@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/gif"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+const maxLabelLength = 32
+
+// badgeModTime is the Last-Modified time of the static badges: when they
+// were last loaded.
+var badgeModTime = time.Now()
+
+// badgeETag returns the strong ETag of img, derived from its bytes.
+func badgeETag(img badgeImage) string {
+	sum := sha256.Sum256(img.data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// badgeNotModified sets the ETag, and Last-Modified unless modTime is zero,
+// of the badge img and reports whether the client's cached copy, named by
+// If-None-Match or failing that If-Modified-Since, is still current.
+func badgeNotModified(w http.ResponseWriter, r *http.Request, img badgeImage, modTime time.Time) bool {
+	etag := badgeETag(img)
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.IsZero() && !modTime.Truncate(time.Second).After(since)
+}
+
+// badgeImage is a pre-rendered image served by the beacon.
+type badgeImage struct {
+	contentType string
+	data        []byte
+}
+
+var (
+	// badgeVariantOrder lists the query params selecting a badge variant, in
+	// order of precedence when several are present.
+	badgeVariantOrder = []string{"pixel", "gif", "flat", "flat-gif"}
+
+	// badgeImages maps each variant to its image. The empty variant is the
+	// default badge.
+	badgeImages = embeddedBadgeImages()
+
+	// Named colors accepted by ?color=, in addition to hex codes.
+	badgeColors = map[string]bool{
+		"brightgreen": true,
+		"green":       true,
+		"yellowgreen": true,
+		"yellow":      true,
+		"orange":      true,
+		"red":         true,
+		"blue":        true,
+		"lightgrey":   true,
+		"grey":        true,
+		"gray":        true,
+	}
+
+	hexColorPattern = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+	svgSizePattern  = regexp.MustCompile(`<svg[^>]*\swidth="([0-9.]+)"[^>]*\sheight="([0-9.]+)"`)
+)
+
+// embeddedBadgeImages returns the built-in image of each variant.
+func embeddedBadgeImages() map[string]badgeImage {
+	images := map[string]badgeImage{
+		"":         {"image/svg+xml", badge},
+		"pixel":    {"image/gif", pixel},
+		"gif":      {"image/gif", badgeGif},
+		"flat":     {"image/svg+xml", badgeFlat},
+		"flat-gif": {"image/gif", badgeFlatGif},
+	}
+	// A missing badge is served as the pixel, as on a failed integrity check.
+	for variant, img := range images {
+		if len(img.data) == 0 {
+			images[variant] = badgeImage{"image/gif", pixel}
+		}
+	}
+	return images
+}
+
+// greySVGTemplate dims a badge by wrapping its content in a half-transparent
+// group.
+var greySVGTemplate = template.Must(template.New("grey").Parse(`{{.Open}}<g opacity="0.5">{{.Content}}</g></svg>`))
+
+// greyBadges holds the dimmed SVG badges served by -disabledBadgeVariant=grey,
+// keyed by variant.
+var greyBadges map[string]badgeImage
+
+// greyBadge returns a dimmed copy of an SVG badge.
+func greyBadge(img badgeImage) badgeImage {
+	svg := string(img.data)
+	open := strings.Index(svg, ">") + 1
+	end := strings.LastIndex(svg, "</svg>")
+	if open <= 0 || end < open {
+		return img
+	}
+
+	var b bytes.Buffer
+	greySVGTemplate.Execute(&b, struct{ Open, Content string }{svg[:open], svg[open:end]})
+	return badgeImage{"image/svg+xml", b.Bytes()}
+}
+
+// disabledBadge returns the image served for variant when tracking is
+// suppressed.
+func disabledBadge(variant string) badgeImage {
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	switch disabledBadgeVariant {
+	case "grey":
+		if variant == "pixel" {
+			return badgeImages["pixel"]
+		}
+		if img, ok := greyBadges[variant]; ok {
+			return img
+		}
+		if variant == "flat-gif" {
+			return greyBadges["flat"]
+		}
+		return greyBadges[""]
+	case "blank":
+		return badgeImages["pixel"]
+	default:
+		return badgeImages[variant]
+	}
+}
+
+// badgeVariantFor returns the badge variant selected by query.
+func badgeVariantFor(query url.Values) string {
+	for _, variant := range badgeVariantOrder {
+		if _, ok := query[variant]; ok {
+			return variant
+		}
+	}
+	return ""
+}
+
+// size returns the pixel dimensions of the image.
+func (img badgeImage) size() (int, int) {
+	if img.contentType == "image/gif" {
+		cfg, err := gif.DecodeConfig(bytes.NewReader(img.data))
+		if err != nil {
+			return 0, 0
+		}
+		return cfg.Width, cfg.Height
+	}
+
+	m := svgSizePattern.FindSubmatch(img.data)
+	if m == nil {
+		return 0, 0
+	}
+	width, _ := strconv.ParseFloat(string(m[1]), 64)
+	height, _ := strconv.ParseFloat(string(m[2]), 64)
+	return int(width), int(height)
+}
+
+// BadgePreview describes the badge a beacon URL would serve.
+type BadgePreview struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	BadgeWidth  int    `json:"badge_width"`
+	BadgeHeight int    `json:"badge_height"`
+	LabelText   string `json:"label_text"`
+	ValueText   string `json:"value_text"`
+	CacheTTL    int    `json:"cache_ttl"`
+}
+
+// parseBadgeRequest validates a /api/v1/preview request and describes the
+// badge the corresponding beacon URL would serve.
+func parseBadgeRequest(r *http.Request) (*BadgePreview, error) {
+	query := r.URL.Query()
+
+	account := query.Get("account")
+	if account == "" || strings.Contains(account, "/") {
+		return nil, errors.New("account must be a tracking ID")
+	}
+	page := strings.Trim(query.Get("page"), "/")
+	if page == "" {
+		return nil, errors.New("page is required")
+	}
+
+	variant := query.Get("variant")
+	if variant == "badge" {
+		variant = ""
+	}
+	assetsMu.RLock()
+	img, ok := badgeImages[variant]
+	assetsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown badge variant %q", variant)
+	}
+
+	label, message, color := query.Get("label"), query.Get("message"), query.Get("color")
+	if err := validateBadgeText(label, message, color); err != nil {
+		return nil, err
+	}
+
+	// Rebuild the beacon URL, keeping the style params in a stable order.
+	beaconQuery := url.Values{}
+	var params []string
+	if variant != "" {
+		beaconQuery[variant] = []string{""}
+		params = append(params, variant)
+	}
+	if label != "" {
+		beaconQuery.Set("label", label)
+		params = append(params, "label="+url.QueryEscape(label))
+	}
+	if message != "" {
+		beaconQuery.Set("message", message)
+		params = append(params, "message="+url.QueryEscape(message))
+	}
+	if color != "" {
+		beaconQuery.Set("color", color)
+		params = append(params, "color="+url.QueryEscape(color))
+	}
+	link := "/" + account + "/" + page
+	if len(params) > 0 {
+		link += "?" + strings.Join(params, "&")
+	}
+
+	preview := &BadgePreview{
+		URL:         link,
+		ContentType: img.contentType,
+		LabelText:   label,
+		ValueText:   message,
+	}
+	if wantsRenderedBadge(variant, beaconQuery) {
+		img = renderVariantBadge(variant, label, message, color)
+		preview.LabelText, preview.ValueText = renderedBadgeText(label, message)
+	}
+	preview.BadgeWidth, preview.BadgeHeight = img.size()
+	if isCacheable(beaconQuery, cacheableQueryParams) {
+		preview.CacheTTL = badgeCacheSeconds
+	}
+	return preview, nil
+}
+
+// previewHandler serves GET /api/v1/preview.
+func (s *server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	preview, err := parseBadgeRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(preview); err != nil {
+		s.logger.Error("Cannot encode badge preview", "err", err)
+	}
+}
+
+var (
+	// imageFormatPriority orders image formats from most to least efficient,
+	// breaking ties between formats a client names with the same q-value.
+	// The default badge only comes in SVG and GIF: there are no AVIF or WebP
+	// badges to serve yet.
+	imageFormatPriority = []string{"image/avif", "image/webp", "image/gif", "image/svg+xml"}
+
+	// negotiableVariants maps the formats the default badge is available in
+	// to the variant serving it.
+	negotiableVariants = map[string]string{
+		"image/svg+xml": "",
+		"image/gif":     "gif",
+	}
+
+	// negotiableFormats are the keys of negotiableVariants, the default
+	// first: it is served to clients accepting the formats alike.
+	negotiableFormats = []string{"image/svg+xml", "image/gif"}
+)
+
+// mediaRange is an entry of an Accept header.
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept splits an Accept header into its media ranges, skipping
+// malformed ones. A range without a q-value has q=1.
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok || !isToken(typ) || !isToken(subtype) {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "q") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || v < 0 || v > 1 {
+				ok = false
+			}
+			q = v
+		}
+		if ok {
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+	return ranges
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !httpguts.IsTokenRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateImageFormat picks the format to serve from available given an
+// Accept header: the one with the highest q-value, taken from the most
+// specific range matching it (image/gif, then image/*, then */*). Among
+// formats of equal q, those the client names win over those it accepts
+// through a wildcard. Named ones are then ordered by imageFormatPriority,
+// and the others by available, whose first format is thus the default. It
+// returns an empty string if the client accepts none of them.
+func negotiateImageFormat(accept string, available []string) string {
+	ranges := parseAccept(accept)
+	best, bestQ, bestNamed, bestRank := "", 0.0, false, 0
+	for i, format := range available {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			s := -1
+			switch {
+			case r.mediaType == format:
+				s = 2
+			case r.mediaType == "image/*" && strings.HasPrefix(format, "image/"):
+				s = 1
+			case r.mediaType == "*/*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		named := specificity == 2
+		rank := i
+		if named {
+			rank = formatPriority(format)
+		}
+		if best == "" || q > bestQ || q == bestQ && (named && !bestNamed || named == bestNamed && rank < bestRank) {
+			best, bestQ, bestNamed, bestRank = format, q, named, rank
+		}
+	}
+	return best
+}
+
+// formatPriority returns the index of format in imageFormatPriority, after
+// all of them if it is not listed.
+func formatPriority(format string) int {
+	for i, f := range imageFormatPriority {
+		if f == format {
+			return i
+		}
+	}
+	return len(imageFormatPriority)
+}
+
+// negotiateBadgeVariant chooses the default badge variant from the Accept
+// header.
+func negotiateBadgeVariant(r *http.Request) string {
+	return negotiableVariants[negotiateImageFormat(r.Header.Get("Accept"), negotiableFormats)]
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPreviewVariants(t *testing.T) {
+	tests := []struct {
+		variant     string
+		contentType string
+	}{
+		{"", "image/svg+xml"},
+		{"badge", "image/svg+xml"},
+		{"pixel", "image/gif"},
+		{"gif", "image/gif"},
+		{"flat", "image/svg+xml"},
+		{"flat-gif", "image/gif"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.variant, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			testServer.previewHandler(w, httptest.NewRequest("GET", "/api/v1/preview?account=UA-123&page=/readme&variant="+tt.variant, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			var preview BadgePreview
+			if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+				t.Fatal(err)
+			}
+			if preview.ContentType != tt.contentType {
+				t.Errorf("content_type = %q, want %q", preview.ContentType, tt.contentType)
+			}
+			if preview.BadgeWidth == 0 || preview.BadgeHeight == 0 {
+				t.Errorf("badge size = %dx%d, want it known", preview.BadgeWidth, preview.BadgeHeight)
+			}
+			if preview.CacheTTL != badgeCacheSeconds {
+				t.Errorf("cache_ttl = %d, want %d", preview.CacheTTL, badgeCacheSeconds)
+			}
+		})
+	}
+}
+
+func TestPreviewValid(t *testing.T) {
+	w := httptest.NewRecorder()
+	testServer.previewHandler(w, httptest.NewRequest("GET", "/api/v1/preview?account=UA-123&page=/readme&variant=flat&label=visits&color=blue", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var preview BadgePreview
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/UA-123/readme?flat&label=visits&color=blue"; preview.URL != want {
+		t.Errorf("url = %q, want %q", preview.URL, want)
+	}
+	if preview.ContentType != "image/svg+xml" || preview.LabelText != "visits" {
+		t.Errorf("preview = %+v, want an SVG labelled visits", preview)
+	}
+	if preview.BadgeHeight != 20 {
+		t.Errorf("badge_height = %d, want 20", preview.BadgeHeight)
+	}
+}
+
+func TestPreviewInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"no account", "page=/readme"},
+		{"no page", "account=UA-123"},
+		{"unknown variant", "account=UA-123&page=/readme&variant=shiny"},
+		{"invalid color", "account=UA-123&page=/readme&color=ultraviolet"},
+		{"invalid hex color", "account=UA-123&page=/readme&color=%23abcd"},
+		{"label too long", "account=UA-123&page=/readme&label=" + strings.Repeat("a", maxLabelLength+1)},
+		{"message too long", "account=UA-123&page=/readme&message=" + strings.Repeat("a", maxLabelLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			testServer.previewHandler(w, httptest.NewRequest("GET", "/api/v1/preview?"+tt.query, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestNegotiateImageFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", "image/svg+xml"},
+		{"image/*", "image/svg+xml"},
+		{"image/gif", "image/gif"},
+		{"image/svg+xml", "image/svg+xml"},
+		{"image/gif, image/svg+xml", "image/gif"},
+		{"image/svg+xml;q=0.8, image/gif", "image/gif"},
+		{"image/gif;q=0.5, image/svg+xml;q=0.9", "image/svg+xml"},
+		{"image/gif;q=0.9, */*;q=0.9", "image/gif"},
+		{"image/gif;q=0, image/*", "image/svg+xml"},
+		{"image/svg+xml;q=0, */*", "image/gif"},
+		{"image/avif, image/webp, image/*;q=0.8", "image/svg+xml"},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", "image/svg+xml"},
+		{"text/html", ""},
+		{"image/gif;q=2, image/svg+xml;q=0.1", "image/svg+xml"},
+		{"image/gif;q=x", ""},
+		{"IMAGE/GIF", "image/gif"},
+	}
+	for _, tt := range tests {
+		if got := negotiateImageFormat(tt.accept, negotiableFormats); got != tt.want {
+			t.Errorf("negotiateImageFormat(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiatedBadge(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		accept      string
+		contentType string
+		vary        bool
+	}{
+		{"svg", "/UA-1234-1/page", "image/svg+xml", "image/svg+xml", true},
+		{"gif", "/UA-1234-1/page", "image/gif", "image/gif", true},
+		{"explicit style wins", "/UA-1234-1/page?flat", "image/gif", "image/svg+xml", false},
+		{"explicit gif wins", "/UA-1234-1/page?gif", "image/svg+xml", "image/gif", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBeacon(t, "-negotiateFormat")
+			w := get(tt.target, "Accept", tt.accept)
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			vary := strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept")
+			if vary != tt.vary {
+				t.Errorf("Vary = %q, want Accept listed: %v", w.Header().Values("Vary"), tt.vary)
+			}
+		})
+	}
+}
+
+func TestDisabledBadge(t *testing.T) {
+	tests := []struct {
+		args        []string
+		target      string
+		contentType string
+		grey        bool
+	}{
+		{nil, "/UA-1234-1/page", "image/svg+xml", false},
+		{nil, "/UA-1234-1/page?gif", "image/gif", false},
+		{[]string{"-disabledBadgeVariant=same"}, "/UA-1234-1/page?flat", "image/svg+xml", false},
+		{[]string{"-disabledBadgeVariant=grey"}, "/UA-1234-1/page", "image/svg+xml", true},
+		{[]string{"-disabledBadgeVariant=grey"}, "/UA-1234-1/page?flat", "image/svg+xml", true},
+		{[]string{"-disabledBadgeVariant=grey"}, "/UA-1234-1/page?gif", "image/svg+xml", true},
+		{[]string{"-disabledBadgeVariant=grey"}, "/UA-1234-1/page?pixel", "image/gif", false},
+		{[]string{"-disabledBadgeVariant=blank"}, "/UA-1234-1/page", "image/gif", false},
+		{[]string{"-disabledBadgeVariant=blank"}, "/UA-1234-1/page?flat", "image/gif", false},
+	}
+	for _, tt := range tests {
+		name := strings.Join(append(tt.args, tt.target), " ")
+		t.Run(name, func(t *testing.T) {
+			stub := newTestBeacon(t, append(tt.args, "-respectDNT")...)
+			w := get(tt.target, "DNT", "1")
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			body := w.Body.String()
+			if grey := strings.Contains(body, `<g opacity="0.5">`); grey != tt.grey {
+				t.Errorf("badge dimmed: %v, want %v", grey, tt.grey)
+			}
+			if tt.grey && !strings.HasSuffix(strings.TrimSpace(body), "</g></svg>") {
+				t.Errorf("grey badge does not end its group and SVG: %.40q", body[max(0, len(body)-40):])
+			}
+			if tt.contentType == "image/gif" && !strings.HasPrefix(body, "GIF8") {
+				t.Errorf("body is not a GIF: %.10q", body)
+			}
+			stub.none(t)
+		})
+	}
+}
+
+func TestDisabledBadgeOnlyWhenSuppressed(t *testing.T) {
+	stub := newTestBeacon(t, "-respectDNT", "-disabledBadgeVariant=blank")
+	w := get("/UA-1234-1/page")
+	if got := w.Header().Get("Content-Type"); got != "image/svg+xml" {
+		t.Errorf("Content-Type = %q for a tracked hit, want the badge", got)
+	}
+	stub.next(t)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchHits is the most hits the v1 /batch endpoint accepts per request.
+const maxBatchHits = 20
+
+// batchURL returns the /batch endpoint next to the v1 collect endpoint, or
+// "" if endpoint does not end in /collect and has none.
+func batchURL(endpoint string) string {
+	if !strings.HasSuffix(endpoint, "/collect") {
+		return ""
+	}
+	return strings.TrimSuffix(endpoint, "/collect") + "/batch"
+}
+
+// hitBatcher is set when -gaBatch is enabled.
+var hitBatcher *batchDispatcher
+
+// batchDispatcher collects v1 payloads and sends them to the /batch endpoint
+// next to their collect endpoint once maxBatchHits have accumulated for it
+// or the interval passes, whichever comes first. Hits of tenants with their
+// own gaEndpoint are batched apart from the others.
+type batchDispatcher struct {
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	pending map[string][]string // payloads by collect endpoint
+	flushes sync.WaitGroup
+
+	// ctx is cancelled when Stop gives up waiting for batches in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newBatchDispatcher(interval time.Duration, logger *slog.Logger) *batchDispatcher {
+	d := &batchDispatcher{interval: interval, logger: logger, pending: map[string][]string{}, stop: make(chan struct{}), done: make(chan struct{})}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	go d.run()
+	return d
+}
+
+// Add queues a v1 payload, whose endpoint must have a batchURL. The user
+// agent goes into the payload since the batch request's own header cannot
+// carry one per hit.
+func (d *batchDispatcher) Add(job hitJob, payload gaRequest) {
+	body := payload.body
+	if job.ua != "" && !strings.Contains("&"+body, "&ua=") {
+		body += "&ua=" + url.QueryEscape(job.ua)
+	}
+
+	d.mu.Lock()
+	d.pending[payload.url] = append(d.pending[payload.url], body)
+	var batch []string
+	if len(d.pending[payload.url]) >= maxBatchHits {
+		batch = d.pending[payload.url]
+		delete(d.pending, payload.url)
+	}
+	d.mu.Unlock()
+
+	if batch != nil {
+		d.send(payload.url, batch)
+	}
+}
+
+func (d *batchDispatcher) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.flush()
+		case <-d.stop:
+			d.flush()
+			return
+		}
+	}
+}
+
+// flush sends whatever is pending.
+func (d *batchDispatcher) flush() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = map[string][]string{}
+	d.mu.Unlock()
+	for endpoint, batch := range pending {
+		d.send(endpoint, batch)
+	}
+}
+
+// send posts batch to the /batch endpoint next to the collect endpoint.
+func (d *batchDispatcher) send(endpoint string, batch []string) {
+	d.flushes.Add(1)
+	defer d.flushes.Done()
+
+	body := strings.Join(batch, "\n")
+	breaker := breakerFor(batchURL(endpoint), d.logger)
+	if !breaker.Allow() {
+		lost := spoolBatch(endpoint, batch)
+		d.logger.Debug("Not sending GA batch", "err", errCircuitOpen, "hits_lost", lost)
+		return
+	}
+	err := budgetedRetry(d.ctx, d.logger, gaBudget, func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, "POST", batchURL(endpoint), strings.NewReader(body))
+		req.Header.Add("Content-Type", "text/plain")
+
+		start := time.Now()
+		resp, err := gaClient.Do(req)
+		gaRequestDuration.ObserveSince(start)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		countProto(resp)
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("GA batch endpoint returned %s", resp.Status)
+		}
+
+		d.logger.Debug("GA batch sent", "status", resp.StatusCode, "proto", resp.Proto, "hits", len(batch))
+		return nil
+	})
+	breaker.Record(err == nil)
+	if err != nil {
+		lost := spoolBatch(endpoint, batch)
+		d.logger.Error("GA batch POST failed", "err", err, "hits_lost", lost)
+	} else {
+		hitsLogged.Add(int64(len(batch)))
+	}
+}
+
+// spoolBatch spools the hits of a failed batch as single hits to the collect
+// endpoint, returning how many were lost. Their user agent is in the payload
+// already.
+func spoolBatch(endpoint string, batch []string) (lost int) {
+	for _, body := range batch {
+		if spoolHit(hitJob{}, gaRequest{url: endpoint, contentType: "application/x-www-form-urlencoded", body: body}) {
+			hitsSpooled.Inc()
+		} else {
+			hitsErrored.Inc()
+			lost++
+		}
+	}
+	return lost
+}
+
+// Stop sends the pending hits and waits for in-flight batches. When ctx is
+// done first, the batches still being sent are cancelled and spooled.
+func (d *batchDispatcher) Stop(ctx context.Context) {
+	close(d.stop)
+	sent := make(chan struct{})
+	go func() {
+		<-d.done
+		d.flushes.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		return
+	case <-ctx.Done():
+	}
+	d.logger.Warn("Shutdown deadline reached, cancelling GA batches in flight")
+	d.cancel()
+	<-sent
+}
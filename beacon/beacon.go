@@ -0,0 +1,155 @@
+// Package beacon serves a Google Analytics tracking pixel that reports a
+// pageview for every request, so it can be mounted in any Go HTTP server:
+//
+//	http.Handle("/beacon/", http.StripPrefix("/beacon", beacon.New(beacon.Config{})))
+//
+// Requests are of the form /<tracking ID>/<page path>. The ga-beacon command
+// is built on the same pieces and adds badges, counters, other collectors and
+// its many flags.
+package beacon
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint is the Measurement Protocol v1 collector.
+const DefaultEndpoint = "https://www.google-analytics.com/collect"
+
+// Pixel is a transparent 1x1 GIF.
+var Pixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// TrackingIDPattern matches the tracking IDs New accepts.
+var TrackingIDPattern = regexp.MustCompile(`^[A-Z]{1,3}-[A-Za-z0-9-]+$`)
+
+// Config configures New. The zero value is ready to use.
+type Config struct {
+	// Endpoint is the collector hits are sent to. Defaults to
+	// DefaultEndpoint.
+	Endpoint string
+	// Client sends the hits. Defaults to NewClient with Timeout.
+	Client *http.Client
+	// Timeout bounds reporting one hit. Defaults to 3s.
+	Timeout time.Duration
+	// CookieName is the cookie keeping the client ID. Defaults to "cid".
+	// It is scoped to the tracking ID's path as the browser requested it,
+	// including any prefix an http.StripPrefix in front removed.
+	CookieName string
+	// ClientIP returns the visitor's IP. Defaults to the request's remote
+	// address; set it when running behind a proxy.
+	ClientIP func(r *http.Request) string
+	// MaxInFlight caps the hits being reported at once. Hits arriving while
+	// it is reached are dropped and logged. Defaults to 64.
+	MaxInFlight int
+	// Logger gets the hits that could not be reported. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+// New returns a handler serving Pixel and reporting a pageview for each
+// request in the background, up to MaxInFlight at a time.
+func New(cfg Config) http.Handler {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultEndpoint
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 3 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = NewClient(ClientOptions{Timeout: cfg.Timeout})
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = "cid"
+	}
+	if cfg.ClientIP == nil {
+		cfg.ClientIP = remoteIP
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 64
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &handler{cfg: cfg, inFlight: make(chan struct{}, cfg.MaxInFlight)}
+}
+
+type handler struct {
+	cfg      Config
+	inFlight chan struct{}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tid, page, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !TrackingIDPattern.MatchString(tid) {
+		http.Error(w, "invalid tracking ID", http.StatusNotFound)
+		return
+	}
+
+	var cid string
+	if c, err := r.Cookie(h.cfg.CookieName); err == nil && c.Value != "" {
+		cid = c.Value
+	} else {
+		if cid, err = NewUUID(); err != nil {
+			http.Error(w, "cannot generate client ID", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     h.cfg.CookieName,
+			Value:    cid,
+			Path:     cookiePath(r, tid),
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+
+	hit := Hit{TrackingID: tid, ClientID: cid, Path: "/" + page, IP: h.cfg.ClientIP(r)}
+	ua := r.Header.Get("User-Agent")
+	select {
+	case h.inFlight <- struct{}{}:
+		go func() {
+			defer func() { <-h.inFlight }()
+			ctx, cancel := context.WithTimeout(context.Background(), h.cfg.Timeout)
+			defer cancel()
+			if err := Send(ctx, h.cfg.Client, h.cfg.Endpoint, hit, ua); err != nil {
+				h.cfg.Logger.Error("Cannot report hit", "tid", hit.TrackingID, "path", hit.Path, "err", err)
+			}
+		}()
+	default:
+		h.cfg.Logger.Warn("Dropping hit, too many being reported", "tid", hit.TrackingID, "path", hit.Path, "max_in_flight", h.cfg.MaxInFlight)
+	}
+
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Write(Pixel)
+}
+
+// cookiePath returns /<tid> under the prefix the request path had before a
+// handler in front, such as http.StripPrefix, removed it from r.URL.Path.
+func cookiePath(r *http.Request, tid string) string {
+	prefix := ""
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		if p, ok := strings.CutSuffix(u.Path, r.URL.Path); ok {
+			prefix = strings.TrimSuffix(p, "/")
+		}
+	}
+	return prefix + "/" + tid
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
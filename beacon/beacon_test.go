@@ -0,0 +1,158 @@
+package beacon
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nextHit waits for the collector to receive a hit.
+func nextHit(t *testing.T, hits chan collected) collected {
+	t.Helper()
+	select {
+	case hit := <-hits:
+		return hit
+	case <-time.After(5 * time.Second):
+		t.Fatal("no hit reported")
+		return collected{}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to log to from the reporting goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestNew(t *testing.T) {
+	srv, hits := newTestCollector(t, http.StatusOK)
+	h := New(Config{Endpoint: srv.URL + "/collect"})
+
+	r := httptest.NewRequest("GET", "/UA-1234-1/docs/intro", nil)
+	r.Header.Set("User-Agent", "Firefox")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), Pixel) || w.Header().Get("Content-Type") != "image/gif" {
+		t.Fatalf("got %d %s, want the pixel", w.Code, w.Header().Get("Content-Type"))
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-cache, no-store, must-revalidate" {
+		t.Errorf("Cache-Control = %q, want the pixel never cached", got)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "cid" || cookies[0].Path != "/UA-1234-1" || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("cookies = %v, want a secure, HTTP-only cid scoped to /UA-1234-1", cookies)
+	}
+
+	hit := nextHit(t, hits)
+	want := Hit{TrackingID: "UA-1234-1", ClientID: cookies[0].Value, Path: "/docs/intro", IP: "192.0.2.1"}
+	if hit.form.Encode() != want.Values().Encode() || hit.header.Get("User-Agent") != "Firefox" {
+		t.Errorf("collector got %s from %q, want %s from Firefox", hit.form.Encode(), hit.header.Get("User-Agent"), want.Values().Encode())
+	}
+
+	// A returning visitor keeps their client ID.
+	r = httptest.NewRequest("GET", "/UA-1234-1/docs", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if len(w.Result().Cookies()) != 0 {
+		t.Errorf("cookies = %v for a returning visitor, want none set", w.Result().Cookies())
+	}
+	if got := nextHit(t, hits).form.Get("cid"); got != cookies[0].Value {
+		t.Errorf("cid = %s, want the cookie's %s", got, cookies[0].Value)
+	}
+}
+
+func TestNewInvalidTrackingID(t *testing.T) {
+	srv, hits := newTestCollector(t, http.StatusOK)
+	h := New(Config{Endpoint: srv.URL})
+
+	for _, target := range []string{"/", "/docs", "/ua-1234-1/docs", "/UA_1234/docs"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 404", target, w.Code)
+		}
+	}
+	select {
+	case hit := <-hits:
+		t.Errorf("reported %s for an invalid tracking ID", hit.form.Encode())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	srv, hits := newTestCollector(t, http.StatusOK)
+	h := http.StripPrefix("/beacon", New(Config{
+		Endpoint:   srv.URL,
+		CookieName: "visitor",
+		ClientIP:   func(r *http.Request) string { return r.Header.Get("X-Real-IP") },
+	}))
+
+	r := httptest.NewRequest("GET", "/beacon/UA-1234-1/docs", nil)
+	r.Header.Set("X-Real-IP", "203.0.113.7")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	// The cookie is scoped to the path the browser requested.
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "visitor" || cookies[0].Path != "/beacon/UA-1234-1" {
+		t.Fatalf("cookies = %v, want visitor scoped to /beacon/UA-1234-1", cookies)
+	}
+	if hit := nextHit(t, hits); hit.form.Get("uip") != "203.0.113.7" || hit.form.Get("dp") != "/docs" {
+		t.Errorf("collector got %s, want the ClientIP's address and /docs", hit.form.Encode())
+	}
+}
+
+func TestNewMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	var logs syncBuffer
+	h := New(Config{Endpoint: srv.URL, MaxInFlight: 1, Timeout: time.Minute, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/UA-1234-1/docs", nil))
+		// Dropped hits still get the pixel.
+		if w.Code != http.StatusOK {
+			t.Errorf("status = %d, want 200", w.Code)
+		}
+	}
+	if got := logs.String(); !strings.Contains(got, "Dropping hit, too many being reported") || !strings.Contains(got, "max_in_flight=1") {
+		t.Errorf("logged %q, want the second hit dropped", got)
+	}
+}
+
+func TestNewReportError(t *testing.T) {
+	srv, hits := newTestCollector(t, http.StatusBadGateway)
+	var logs syncBuffer
+	h := New(Config{Endpoint: srv.URL, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/UA-1234-1/docs", nil))
+	nextHit(t, hits)
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(logs.String(), "Cannot report hit") && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := logs.String(); !strings.Contains(got, "Cannot report hit") || !strings.Contains(got, "502 Bad Gateway") {
+		t.Errorf("logged %q, want the collector's error", got)
+	}
+}
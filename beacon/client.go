@@ -0,0 +1,75 @@
+package beacon
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 2 * time.Second
+
+// ClientOptions configures NewClient.
+type ClientOptions struct {
+	// Timeout bounds each request, even without a context deadline. 0
+	// means no timeout.
+	Timeout time.Duration
+	// MaxIdleConns is how many idle connections are kept for reuse. 0 keeps
+	// net/http's default.
+	MaxIdleConns int
+	// MaxConns caps open connections per host. 0 means no limit.
+	MaxConns int
+	// ForceHTTP2 only offers h2 during the TLS handshake; otherwise HTTP/2
+	// is disabled entirely.
+	ForceHTTP2 bool
+}
+
+// NewClient returns a client for a collector. It keeps connections alive and
+// honors HTTPS_PROXY and friends.
+func NewClient(opts ClientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+		if transport.MaxIdleConns < opts.MaxIdleConns {
+			transport.MaxIdleConns = opts.MaxIdleConns
+		}
+	}
+	transport.MaxConnsPerHost = opts.MaxConns
+	if opts.ForceHTTP2 {
+		transport.ForceAttemptHTTP2 = true
+		transport.TLSClientConfig = &tls.Config{NextProtos: []string{"h2"}}
+	} else {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		// The clone of DefaultTransport still offers h2 in the handshake; a
+		// server picking it would get HTTP/1.1 on an HTTP/2 connection.
+		if transport.TLSClientConfig != nil {
+			transport.TLSClientConfig.NextProtos = nil
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}
+}
+
+// Send reports hit to the v1 collector at endpoint on behalf of userAgent.
+// A 5xx response is an error; GA answers 2xx to anything else, valid or not.
+func Send(ctx context.Context, client *http.Client, endpoint string, hit Hit, userAgent string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(hit.Values().Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package beacon
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collected is a hit received by a test collector.
+type collected struct {
+	method string
+	header http.Header
+	form   url.Values
+}
+
+// newTestCollector starts a collector answering status and returns the hits
+// it receives.
+func newTestCollector(t *testing.T, status int) (*httptest.Server, chan collected) {
+	t.Helper()
+	hits := make(chan collected, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		hits <- collected{method: r.Method, header: r.Header.Clone(), form: form}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, hits
+}
+
+func TestSend(t *testing.T) {
+	srv, hits := newTestCollector(t, http.StatusOK)
+	hit := Hit{TrackingID: "UA-1234-1", ClientID: "1", Path: "/docs", IP: "192.0.2.1"}
+
+	if err := Send(context.Background(), srv.Client(), srv.URL+"/collect", hit, "Firefox"); err != nil {
+		t.Fatal(err)
+	}
+	got := <-hits
+	if got.method != "POST" || got.header.Get("Content-Type") != "application/x-www-form-urlencoded" || got.header.Get("User-Agent") != "Firefox" {
+		t.Errorf("collector got %s (%s) from %q, want a form POST from Firefox", got.method, got.header.Get("Content-Type"), got.header.Get("User-Agent"))
+	}
+	if got.form.Encode() != hit.Values().Encode() {
+		t.Errorf("collector got %s, want %s", got.form.Encode(), hit.Values().Encode())
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		err    string
+	}{
+		{http.StatusNoContent, ""},
+		// GA answers invalid hits with a 2xx; anything below 500 is taken.
+		{http.StatusBadRequest, ""},
+		{http.StatusInternalServerError, "collector returned 500 Internal Server Error"},
+		{http.StatusServiceUnavailable, "collector returned 503 Service Unavailable"},
+	}
+	for _, tt := range tests {
+		srv, _ := newTestCollector(t, tt.status)
+		err := Send(context.Background(), srv.Client(), srv.URL, Hit{TrackingID: "UA-1234-1"}, "")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("Send() to a %d = %v, want %q", tt.status, err, tt.err)
+		}
+	}
+
+	srv, _ := newTestCollector(t, http.StatusOK)
+	srv.Close()
+	if err := Send(context.Background(), srv.Client(), srv.URL, Hit{}, ""); err == nil {
+		t.Error("Send() to a closed collector succeeded")
+	}
+	if err := Send(context.Background(), http.DefaultClient, "://collector", Hit{}, ""); err == nil {
+		t.Error("Send() to an invalid endpoint succeeded")
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Send(ctx, srv.Client(), srv.URL, Hit{}, ""); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Send() to a hanging collector = %v, want the context's deadline", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ClientOptions
+	}{
+		{"defaults", ClientOptions{}},
+		{"limits", ClientOptions{Timeout: time.Second, MaxIdleConns: 500, MaxConns: 8}},
+		{"HTTP/2", ClientOptions{ForceHTTP2: true}},
+	}
+	for _, tt := range tests {
+		client := NewClient(tt.opts)
+		transport := client.Transport.(*http.Transport)
+		if client.Timeout != tt.opts.Timeout || transport.MaxConnsPerHost != tt.opts.MaxConns {
+			t.Errorf("%s: timeout %v, %d conns per host, want %v and %d", tt.name, client.Timeout, transport.MaxConnsPerHost, tt.opts.Timeout, tt.opts.MaxConns)
+		}
+		if tt.opts.MaxIdleConns > 0 && (transport.MaxIdleConnsPerHost != tt.opts.MaxIdleConns || transport.MaxIdleConns < tt.opts.MaxIdleConns) {
+			t.Errorf("%s: %d idle conns, %d per host, want at least %d", tt.name, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, tt.opts.MaxIdleConns)
+		}
+		offersH2 := transport.TLSClientConfig != nil && len(transport.TLSClientConfig.NextProtos) > 0
+		if offersH2 != tt.opts.ForceHTTP2 || transport.ForceAttemptHTTP2 != tt.opts.ForceHTTP2 {
+			t.Errorf("%s: offers h2 = %v, want %v", tt.name, offersH2, tt.opts.ForceHTTP2)
+		}
+	}
+	// The clone leaves http.DefaultTransport alone.
+	if http.DefaultTransport.(*http.Transport).MaxConnsPerHost != 0 {
+		t.Error("NewClient() changed http.DefaultTransport")
+	}
+}
@@ -0,0 +1,28 @@
+package beacon
+
+import "net/url"
+
+// Hit is a Measurement Protocol v1 pageview.
+type Hit struct {
+	TrackingID string // tracking / property ID, e.g. UA-XXXXX-X
+	ClientID   string // unique client ID, see NewUUID
+	Path       string // page path
+	IP         string // IP address of the user, omitted if empty
+}
+
+// Values encodes the hit as Measurement Protocol v1 parameters.
+//
+// GA Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/v1/reference
+func (h Hit) Values() url.Values {
+	v := url.Values{
+		"v":   {"1"},
+		"t":   {"pageview"},
+		"tid": {h.TrackingID},
+		"cid": {h.ClientID},
+		"dp":  {h.Path},
+	}
+	if h.IP != "" {
+		v.Set("uip", h.IP)
+	}
+	return v
+}
@@ -0,0 +1,33 @@
+package beacon
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestHitValues(t *testing.T) {
+	tests := []struct {
+		name string
+		hit  Hit
+		want url.Values
+	}{
+		{"pageview", Hit{TrackingID: "UA-1234-1", ClientID: "35009a79-1a05-49d7-b876-2b884d0f825b", Path: "/docs/intro"}, url.Values{
+			"v": {"1"}, "t": {"pageview"}, "tid": {"UA-1234-1"}, "cid": {"35009a79-1a05-49d7-b876-2b884d0f825b"}, "dp": {"/docs/intro"},
+		}},
+		{"with IP", Hit{TrackingID: "UA-1234-1", ClientID: "1", Path: "/", IP: "2001:db8::1"}, url.Values{
+			"v": {"1"}, "t": {"pageview"}, "tid": {"UA-1234-1"}, "cid": {"1"}, "dp": {"/"}, "uip": {"2001:db8::1"},
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.hit.Values(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Values() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Paths are escaped in the encoded form.
+	hit := Hit{TrackingID: "UA-1234-1", ClientID: "1", Path: "/a b&c=d?é"}
+	if got, want := hit.Values().Encode(), "cid=1&dp=%2Fa+b%26c%3Dd%3F%C3%A9&t=pageview&tid=UA-1234-1&v=1"; got != want {
+		t.Errorf("Values().Encode() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,25 @@
+package beacon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewUUID returns a random RFC 4122 version 4 UUID, the format GA expects
+// for client IDs.
+func NewUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return FormatUUID(b), nil
+}
+
+// FormatUUID formats 16 random bytes as a version 4 UUID, setting the version
+// and variant bits in b.
+func FormatUUID(b []byte) string {
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4 (random)
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
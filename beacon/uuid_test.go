@@ -0,0 +1,54 @@
+package beacon
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFormatUUID(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"zeros", make([]byte, 16), "00000000-0000-4000-8000-000000000000"},
+		{"ones", bytes.Repeat([]byte{0xff}, 16), "ffffffff-ffff-4fff-bfff-ffffffffffff"},
+		{"sequence", []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, "00010203-0405-4607-8809-0a0b0c0d0e0f"},
+		{"other version and variant", []byte{0, 0, 0, 0, 0, 0, 0x1a, 0, 0xca, 0, 0, 0, 0, 0, 0, 0}, "00000000-0000-4a00-8a00-000000000000"},
+	}
+	for _, tt := range tests {
+		if got := FormatUUID(tt.b); got != tt.want {
+			t.Errorf("%s: FormatUUID() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 10000; i++ {
+		u, err := NewUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := strings.Split(u, "-")
+		if len(groups) != 5 || len(groups[0]) != 8 || len(groups[1]) != 4 || len(groups[2]) != 4 || len(groups[3]) != 4 || len(groups[4]) != 12 {
+			t.Fatalf("NewUUID() = %s, want the 8-4-4-4-12 form", u)
+		}
+		b, err := hex.DecodeString(strings.Join(groups, ""))
+		if err != nil || strings.ToLower(u) != u {
+			t.Fatalf("NewUUID() = %s, want lowercase hex digits", u)
+		}
+		if version := b[6] >> 4; version != 4 {
+			t.Fatalf("NewUUID() = %s has version %d, want 4", u, version)
+		}
+		if variant := b[8] >> 6; variant != 0b10 {
+			t.Fatalf("NewUUID() = %s has variant bits %02b, want 10 (RFC 4122)", u, variant)
+		}
+		if seen[u] {
+			t.Fatalf("NewUUID() returned %s twice", u)
+		}
+		seen[u] = true
+	}
+}
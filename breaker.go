@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCircuitOpen is returned for hits not sent because the collector's
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open, collector assumed down")
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+
+	// circuitRejectedHits counts hits dropped by an open breaker.
+	circuitRejectedHits atomic.Int64
+)
+
+// circuitBreaker stops sending to a collector after -breakerThreshold hits
+// in a row failed, including their retries. After -breakerCooldown one hit
+// is let through as a probe: if it succeeds the breaker closes, otherwise it
+// stays open for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	logger    *slog.Logger
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// breakerFor returns the breaker for the host rawURL points at, creating it
+// with logger if there is none yet.
+func breakerFor(rawURL string, logger *slog.Logger) *circuitBreaker {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Host
+	}
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[host]
+	if !ok {
+		b = &circuitBreaker{threshold: breakerThreshold, cooldown: breakerCooldown, now: time.Now, logger: logger}
+		breakers[host] = b
+	}
+	return b
+}
+
+// Allow reports whether a hit may be sent now. A true result must be
+// followed by Record.
+func (b *circuitBreaker) Allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		circuitRejectedHits.Add(1)
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record records the outcome of a hit let through by Allow.
+func (b *circuitBreaker) Record(ok bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		if b.failures >= b.threshold {
+			b.logger.Info("Collector recovered, closing circuit breaker")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			b.logger.Warn("Collector failing, opening circuit breaker", "failures", b.failures, "cooldown", b.cooldown.String())
+		}
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// openBreakers returns the number of collectors whose breaker is open.
+func openBreakers() int {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	n := 0
+	for _, b := range breakers {
+		b.mu.Lock()
+		if b.threshold > 0 && b.failures >= b.threshold {
+			n++
+		}
+		b.mu.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := &circuitBreaker{threshold: 3, cooldown: time.Minute, now: func() time.Time { return now }, logger: testServer.logger}
+	rejected := circuitRejectedHits.Load()
+
+	// send lets a hit through if the breaker allows it, recording ok.
+	send := func(ok bool) bool {
+		if !b.Allow() {
+			return false
+		}
+		b.Record(ok)
+		return true
+	}
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		ok      bool
+		sent    bool
+	}{
+		{"closed, first failure", 0, false, true},
+		{"closed, second failure", 0, false, true},
+		{"a success resets the count", 0, true, true},
+		{"closed, failure 1 again", 0, false, true},
+		{"closed, failure 2 again", 0, false, true},
+		{"failure 3 opens", 0, false, true},
+		{"open", 0, true, false},
+		{"open until the cooldown is over", 59 * time.Second, true, false},
+		{"failed probe reopens", time.Second, false, true},
+		{"open after the failed probe", 30 * time.Second, true, false},
+		{"open for a whole cooldown again", 29 * time.Second, true, false},
+		{"successful probe closes", time.Second, true, true},
+		{"closed", 0, false, true},
+		{"closed, one failure is not enough", 0, true, true},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if sent := send(step.ok); sent != step.sent {
+			t.Fatalf("%s: sent = %v, want %v", step.name, sent, step.sent)
+		}
+	}
+	if got := circuitRejectedHits.Load() - rejected; got != 4 {
+		t.Errorf("%d hits rejected, want 4", got)
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := &circuitBreaker{threshold: 1, cooldown: time.Minute, now: func() time.Time { return now }, logger: testServer.logger}
+	b.Allow()
+	b.Record(false)
+
+	now = now.Add(time.Minute)
+	if !b.Allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	// Until the probe is recorded, other hits wait.
+	if b.Allow() {
+		t.Error("a second hit let through while probing")
+	}
+	b.Record(true)
+	if !b.Allow() {
+		t.Error("closed breaker refuses a hit")
+	}
+}
+
+func TestBreakerFor(t *testing.T) {
+	setFlags(t, "-breakerThreshold=2", "-breakerCooldown=1m")
+	t.Cleanup(func() {
+		breakersMu.Lock()
+		delete(breakers, "collector.example.com")
+		delete(breakers, "other.example.com")
+		breakersMu.Unlock()
+	})
+	open := openBreakers()
+
+	collect := breakerFor("https://collector.example.com/collect", testServer.logger)
+	if batch := breakerFor("https://collector.example.com/batch", testServer.logger); batch != collect {
+		t.Error("endpoints of the same host got different breakers")
+	}
+	if other := breakerFor("https://other.example.com/collect", testServer.logger); other == collect {
+		t.Error("another host shares the breaker")
+	}
+	if collect.threshold != 2 || collect.cooldown != time.Minute {
+		t.Errorf("breaker = %d failures, %v, want the flags' 2 and 1m", collect.threshold, collect.cooldown)
+	}
+
+	for i := 0; i < 2; i++ {
+		collect.Allow()
+		collect.Record(false)
+	}
+	if n := openBreakers() - open; n != 1 {
+		t.Errorf("openBreakers() = %d more, want 1", n)
+	}
+	if !breakerFor("https://other.example.com/collect", testServer.logger).Allow() {
+		t.Error("an open breaker stops hits to another host")
+	}
+}
+
+func TestBreakerStopsHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0", "-gaMaxAttempts=1", "-breakerThreshold=2", "-breakerCooldown=1h", "-gaWorkers=1")
+	stub.respond(http.StatusInternalServerError)
+
+	for i := 0; i < 2; i++ {
+		get("/UA-1234-1/page")
+		stub.next(t)
+	}
+	if w := get("/UA-1234-1/page"); w.Code != http.StatusOK {
+		t.Errorf("status = %d with the breaker open, want the badge", w.Code)
+	}
+	stub.none(t)
+}
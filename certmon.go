@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const certCheckInterval = 24 * time.Hour
+
+// certNotAfter is the expiry of the TLS certificate as a Unix timestamp, or
+// 0 if it has not been checked.
+var certNotAfter atomic.Int64
+
+// checkCertExpiry returns how long the first certificate in certFile remains
+// valid. It is negative for expired certificates.
+func checkCertExpiry(certFile string) (time.Duration, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return 0, errors.New("no certificate found in " + certFile)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return 0, err
+		}
+		certNotAfter.Store(cert.NotAfter.Unix())
+		return time.Until(cert.NotAfter), nil
+	}
+}
+
+// certMonitor warns about the TLS certificate nearing expiry.
+type certMonitor struct {
+	certFile     string
+	warnDays     int
+	criticalDays int
+	webhookURL   string
+	logger       *slog.Logger
+	critical     bool
+}
+
+// check logs a Warning within warnDays of expiry and an Error within
+// criticalDays, notifying the webhook when the certificate first becomes
+// critical.
+func (m *certMonitor) check() {
+	left, err := checkCertExpiry(m.certFile)
+	if err != nil {
+		m.logger.Error("Cannot check TLS certificate expiry", "err", err)
+		return
+	}
+
+	days := int(left.Hours() / 24)
+	switch {
+	case days < m.criticalDays:
+		m.logger.Error("TLS certificate expires soon", "cert", m.certFile, "days_left", days)
+		if !m.critical && m.webhookURL != "" {
+			if err := m.notify(days); err != nil {
+				m.logger.Error("Cannot send certificate expiry notification", "err", err)
+			}
+		}
+		m.critical = true
+	case days < m.warnDays:
+		m.logger.Warn("TLS certificate expires soon", "cert", m.certFile, "days_left", days)
+		m.critical = false
+	default:
+		m.critical = false
+	}
+}
+
+func (m *certMonitor) notify(days int) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"certificate": m.certFile,
+		"expires_at":  time.Unix(certNotAfter.Load(), 0).UTC().Format(time.RFC3339),
+		"days_left":   days,
+		"level":       "critical",
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(m.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// run checks the certificate immediately and then every interval.
+func (m *certMonitor) run(interval time.Duration) {
+	m.check()
+	for range time.Tick(interval) {
+		m.check()
+	}
+}
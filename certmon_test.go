@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate expiring at notAfter, after
+// its private key as in a combined PEM file, and returns its path.
+func writeCert(t *testing.T, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "beacon.example.com"},
+		DNSNames:     []string{"beacon.example.com"},
+		NotBefore:    notAfter.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	for _, days := range []int{90, 10, -1} {
+		notAfter := time.Now().Add(time.Duration(days) * 24 * time.Hour).Truncate(time.Second)
+		path := writeCert(t, notAfter)
+		want := time.Until(notAfter)
+		left, err := checkCertExpiry(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left > want || left < want-time.Minute {
+			t.Errorf("cert expiring in %d days: checkCertExpiry() = %v, want about %v", days, left, want)
+		}
+		if got := certNotAfter.Load(); got != notAfter.Unix() {
+			t.Errorf("cert expiring in %d days: certNotAfter = %d, want %d", days, got, notAfter.Unix())
+		}
+	}
+
+	noCert := filepath.Join(t.TempDir(), "key.pem")
+	os.WriteFile(noCert, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key")}), 0600)
+	for _, path := range []string{noCert, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := checkCertExpiry(path); err == nil {
+			t.Errorf("checkCertExpiry(%s) found a certificate", filepath.Base(path))
+		}
+	}
+}
+
+func TestCertMonitor(t *testing.T) {
+	var notified []map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		notified = append(notified, body)
+	}))
+	defer webhook.Close()
+	var log bytes.Buffer
+	m := &certMonitor{warnDays: 30, criticalDays: 7, webhookURL: webhook.URL, logger: newLoggingServer(&log).logger}
+	tests := []struct {
+		daysLeft int
+		level    string
+		notified int
+	}{
+		{90, "", 0},
+		{20, "WARN", 0},
+		{5, "ERROR", 1},
+		{4, "ERROR", 1},
+		{20, "WARN", 1},
+		{3, "ERROR", 2},
+		{-1, "ERROR", 2},
+	}
+	for _, tt := range tests {
+		log.Reset()
+		m.certFile = writeCert(t, time.Now().Add(time.Duration(tt.daysLeft)*24*time.Hour+time.Hour))
+		m.check()
+		if tt.level == "" && log.Len() != 0 {
+			t.Errorf("%d days left: logged %s, want nothing", tt.daysLeft, log.String())
+		}
+		if tt.level != "" && !strings.Contains(log.String(), "level="+tt.level+` msg="TLS certificate expires soon"`) {
+			t.Errorf("%d days left: logged %s, want a %s", tt.daysLeft, log.String(), tt.level)
+		}
+		if len(notified) != tt.notified {
+			t.Errorf("%d days left: %d notifications, want %d", tt.daysLeft, len(notified), tt.notified)
+		}
+	}
+	if n := notified[0]; n["level"] != "critical" || n["days_left"] != float64(5) || n["certificate"] == "" {
+		t.Errorf("notification = %v, want the critical certificate with 5 days left", n)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/irvinlim/ga-beacon/beacon"
+)
+
+// CIDGenerator generates client IDs for visitors without a cid cookie.
+type CIDGenerator interface {
+	Generate() (string, error)
+}
+
+var cidGenerator CIDGenerator = cryptoRandGenerator{}
+
+// newCIDGenerator returns the generator for the -cidEntropy source.
+func newCIDGenerator(source string) (CIDGenerator, error) {
+	switch source {
+	case "crypto":
+		return cryptoRandGenerator{}, nil
+	case "math":
+		return newMathRandGenerator()
+	case "uuid":
+		return uuidLibGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown entropy source %q", source)
+	}
+}
+
+// cryptoRandGenerator reads every client ID from crypto/rand.
+type cryptoRandGenerator struct{}
+
+func (cryptoRandGenerator) Generate() (string, error) {
+	return beacon.NewUUID()
+}
+
+// mathRandGenerator uses math/rand seeded once from crypto/rand. It never
+// blocks on the entropy pool, but its IDs are predictable to anyone who learns
+// the seed.
+type mathRandGenerator struct {
+	mu  sync.Mutex
+	rnd *mrand.Rand
+}
+
+func newMathRandGenerator() (*mathRandGenerator, error) {
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	src := mrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))
+	return &mathRandGenerator{rnd: mrand.New(src)}, nil
+}
+
+func (g *mathRandGenerator) Generate() (string, error) {
+	b := make([]byte, 16)
+	g.mu.Lock()
+	g.rnd.Read(b)
+	g.mu.Unlock()
+	return beacon.FormatUUID(b), nil
+}
+
+// uuidLibGenerator delegates to github.com/google/uuid.
+type uuidLibGenerator struct{}
+
+func (uuidLibGenerator) Generate() (string, error) {
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
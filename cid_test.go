@@ -0,0 +1,60 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// uuidV4Pattern matches RFC 4122 version 4 UUIDs.
+var uuidV4Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+var cidSources = []string{"crypto", "math", "uuid"}
+
+func TestCIDGenerators(t *testing.T) {
+	for _, source := range cidSources {
+		t.Run(source, func(t *testing.T) {
+			gen, err := newCIDGenerator(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := map[string]bool{}
+			for i := 0; i < 1000; i++ {
+				cid, err := gen.Generate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !uuidV4Pattern.MatchString(cid) {
+					t.Fatalf("Generate() = %q, want a version 4 UUID", cid)
+				}
+				if seen[cid] {
+					t.Fatalf("Generate() returned %q twice", cid)
+				}
+				seen[cid] = true
+			}
+		})
+	}
+}
+
+func TestNewCIDGeneratorUnknown(t *testing.T) {
+	if _, err := newCIDGenerator("dice"); err == nil {
+		t.Error("newCIDGenerator(\"dice\") succeeded, want an error")
+	}
+}
+
+func BenchmarkCIDGeneration(b *testing.B) {
+	for _, source := range cidSources {
+		b.Run(source, func(b *testing.B) {
+			gen, err := newCIDGenerator(source)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := gen.Generate(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hitCoalescer merges repeated hits for the same client, account and page
+// that arrive within a short window, e.g. when a visitor goes back and forth
+// between pages or an image proxy retries. Only the first hit in each window
+// is reported. At most maxEntries hits are remembered; beyond that the least
+// recently seen are forgotten first.
+type hitCoalescer struct {
+	window     time.Duration
+	maxEntries int
+	logger     *slog.Logger
+
+	mu        sync.Mutex
+	hits      map[string]*list.Element
+	lru       *list.List // of *coalescedHit, most recently seen first
+	coalesced atomic.Int64
+}
+
+type coalescedHit struct {
+	key   string
+	first time.Time
+	count int
+}
+
+func newHitCoalescer(window time.Duration, maxEntries int, logger *slog.Logger) *hitCoalescer {
+	c := &hitCoalescer{window: window, maxEntries: maxEntries, logger: logger, hits: map[string]*list.Element{}, lru: list.New()}
+	if window > 0 {
+		go c.sweep()
+	}
+	return c
+}
+
+// Allow reports whether the hit should be sent, or false if it was merged into
+// an earlier hit still inside the window.
+func (c *hitCoalescer) Allow(cid, account, page string) bool {
+	if c.window <= 0 {
+		return true
+	}
+
+	key := cid + "\x00" + account + "\x00" + page
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.hits[key]; ok {
+		hit := e.Value.(*coalescedHit)
+		c.lru.MoveToFront(e)
+		if now.Sub(hit.first) < c.window {
+			hit.count++
+			c.coalesced.Add(1)
+			c.logger.Debug("Coalesced hit", "cid", cid, "account", account, "page", page, "coalesced_hit_count", hit.count-1)
+			return false
+		}
+		hit.first, hit.count = now, 1
+		return true
+	}
+	c.hits[key] = c.lru.PushFront(&coalescedHit{key: key, first: now, count: 1})
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.hits, oldest.Value.(*coalescedHit).key)
+	}
+	return true
+}
+
+// Coalesced returns how many hits were merged into earlier ones.
+func (c *hitCoalescer) Coalesced() int64 {
+	return c.coalesced.Load()
+}
+
+// sweep periodically forgets hits whose window has expired.
+func (c *hitCoalescer) sweep() {
+	for range time.Tick(c.window) {
+		now := time.Now()
+		c.mu.Lock()
+		for key, e := range c.hits {
+			if now.Sub(e.Value.(*coalescedHit).first) >= c.window {
+				c.lru.Remove(e)
+				delete(c.hits, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHitCoalescer(t *testing.T) {
+	const window = 50 * time.Millisecond
+
+	t.Run("within window", func(t *testing.T) {
+		c := newHitCoalescer(window, 0, testServer.logger)
+		if !c.Allow("cid", "UA-1234-1", "page") {
+			t.Error("first hit coalesced")
+		}
+		if c.Allow("cid", "UA-1234-1", "page") {
+			t.Error("second hit within the window sent")
+		}
+	})
+
+	t.Run("outside window", func(t *testing.T) {
+		c := newHitCoalescer(window, 0, testServer.logger)
+		c.Allow("cid", "UA-1234-1", "page")
+		time.Sleep(window + 10*time.Millisecond)
+		if !c.Allow("cid", "UA-1234-1", "page") {
+			t.Error("hit after the window coalesced")
+		}
+	})
+
+	t.Run("three rapid hits", func(t *testing.T) {
+		c := newHitCoalescer(window, 0, testServer.logger)
+		var sent []bool
+		for i := 0; i < 3; i++ {
+			sent = append(sent, c.Allow("cid", "UA-1234-1", "page"))
+		}
+		if !sent[0] || sent[1] || sent[2] {
+			t.Errorf("sent = %v, want only the first", sent)
+		}
+		if got := c.Coalesced(); got != 2 {
+			t.Errorf("Coalesced() = %d, want 2", got)
+		}
+	})
+
+	t.Run("other client or page", func(t *testing.T) {
+		c := newHitCoalescer(window, 0, testServer.logger)
+		c.Allow("cid", "UA-1234-1", "page")
+		if !c.Allow("other", "UA-1234-1", "page") || !c.Allow("cid", "UA-1234-1", "other") || !c.Allow("cid", "UA-5678-1", "page") {
+			t.Error("hit for another client, account or page coalesced")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newHitCoalescer(0, 0, testServer.logger)
+		if !c.Allow("cid", "UA-1234-1", "page") || !c.Allow("cid", "UA-1234-1", "page") {
+			t.Error("hit coalesced with a zero window")
+		}
+	})
+
+	t.Run("max entries", func(t *testing.T) {
+		c := newHitCoalescer(time.Minute, 1, testServer.logger)
+		c.Allow("a", "UA-1234-1", "page")
+		c.Allow("b", "UA-1234-1", "page")
+		if !c.Allow("a", "UA-1234-1", "page") {
+			t.Error("hit of a forgotten client coalesced")
+		}
+	})
+}
+
+func TestCoalescedHitNotReported(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=1m")
+
+	get("/UA-1234-1/page", "Cookie", "cid=returning")
+	stub.next(t)
+	get("/UA-1234-1/page", "Cookie", "cid=returning")
+	stub.none(t)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxCollectBody bounds the body of a /collect/ request.
+const maxCollectBody = 16 << 10
+
+// collectOrigins are the -corsOrigins origins allowed to POST to /collect/,
+// or nil to allow any.
+var collectOrigins map[string]bool
+
+// collectFields are the body fields /collect/ accepts besides the forwarded
+// params: the page path and the shorthands the image beacon takes in its
+// query.
+var collectFields = map[string]bool{
+	"page": true, "event": true, "sig": true,
+	"utm_source": true, "utm_medium": true, "utm_campaign": true, "utm_term": true, "utm_content": true,
+}
+
+var (
+	// reservedPostFields are the GA fields a /collect/ body may not set, as
+	// the beacon sets them itself or they would change how the hit is
+	// counted.
+	reservedPostFields = regexp.MustCompile(`^(v|t|tid|cid|uip|sc|qt|z|dr)$`)
+
+	// gaParams matches the documented Measurement Protocol parameters, listed
+	// in static/ga-params.json.
+	gaParams = parseGAParams(embeddedAsset("static/ga-params.json"))
+)
+
+// parseGAParams parses the list of Measurement Protocol parameters into a
+// pattern matching any of them, <n> standing for an index from 1. It returns
+// nil, matching nothing, if the list is unusable.
+func parseGAParams(data []byte) *regexp.Regexp {
+	var list struct {
+		Params []string `json:"params"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil || len(list.Params) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no params listed")
+		}
+		embeddedAssetFailed("static/ga-params.json", err)
+		return nil
+	}
+	alternatives := make([]string, len(list.Params))
+	for i, param := range list.Params {
+		alternatives[i] = strings.ReplaceAll(regexp.QuoteMeta(param), "<n>", "[1-9][0-9]*")
+	}
+	return regexp.MustCompile("^(" + strings.Join(alternatives, "|") + ")$")
+}
+
+// validatePostFields drops the fields of a /collect/ body that are reserved
+// GA fields, or neither /collect/ fields nor documented Measurement Protocol
+// parameters, and returns an error naming them.
+func validatePostFields(fields map[string][]string) error {
+	var reserved, unknown []string
+	for key := range fields {
+		switch {
+		case reservedPostFields.MatchString(key):
+			reserved = append(reserved, key)
+		case collectFields[key] || gaParams != nil && gaParams.MatchString(key):
+			continue
+		default:
+			unknown = append(unknown, key)
+		}
+		delete(fields, key)
+	}
+	var problems []string
+	if len(reserved) > 0 {
+		sort.Strings(reserved)
+		problems = append(problems, "reserved fields "+strings.Join(reserved, ", "))
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		problems = append(problems, "unknown fields "+strings.Join(unknown, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// collectHandler serves /collect/<account>, for pages reporting hits from
+// JavaScript with fetch() or navigator.sendBeacon(). The body is a JSON
+// object, or a form, of the fields the image beacon takes in its query plus
+// page, the page path; sendBeacon's text/plain strings are read as JSON.
+// Reserved and unknown fields are dropped, or answered with a 400 under
+// -strictPostValidation. Without dl, the page URL is taken from the Referer
+// header. The hit then goes through the same checks as an image beacon hit,
+// and the response is a 204.
+func (s *server) collectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && collectOrigins != nil && !collectOrigins["*"] && !collectOrigins[origin] {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	account := strings.Trim(strings.TrimPrefix(r.URL.Path, "/collect/"), "/")
+	if account == "" || strings.Contains(account, "/") {
+		http.Error(w, "want /collect/<account>", http.StatusNotFound)
+		return
+	}
+
+	fields, err := parseCollectBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validatePostFields(fields); err != nil {
+		if strictPostValidation {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Warn("Dropping fields of a /collect/ request", "account", account, "err", err)
+	}
+	page := strings.TrimPrefix(fields.Get("page"), "/")
+	if page == "" {
+		http.Error(w, "missing page", http.StatusBadRequest)
+		return
+	}
+
+	query := url.Values{}
+	for key, values := range fields {
+		if key != "page" && (collectFields[key] || forwardedParams[key]) {
+			query[key] = values
+		}
+	}
+
+	// A fetch's Referer is the page itself, not the page's referrer.
+	if ref := r.Referer(); ref != "" && query.Get("dl") == "" {
+		query.Set("dl", ref)
+	}
+
+	beacon := r.Clone(r.Context())
+	beacon.Header.Del("Referer")
+	beacon.Method = http.MethodGet
+	beacon.Body = http.NoBody
+	beacon.URL.Path = "/" + account + "/" + page
+	beacon.URL.RawPath = ""
+	beacon.URL.RawQuery = query.Encode()
+	s.serveBeacon(w, beacon, EmptyEncoder{}, "/collect")
+}
+
+// parseCollectBody reads the fields of a /collect/ request body.
+func parseCollectBody(w http.ResponseWriter, r *http.Request) (url.Values, error) {
+	body := http.MaxBytesReader(w, r.Body, maxCollectBody)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		r.Body = body
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("invalid form: %v", err)
+		}
+		return r.PostForm, nil
+	}
+
+	raw := map[string]interface{}{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	fields := url.Values{}
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			fields.Set(key, v)
+		case json.Number:
+			fields.Set(key, v.String())
+		case bool:
+			if v {
+				fields.Set(key, "1")
+			} else {
+				fields.Set(key, "0")
+			}
+		default:
+			return nil, fmt.Errorf("field %s must be a string, number or boolean", key)
+		}
+	}
+	return fields, nil
+}
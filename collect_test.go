@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// post serves a /collect/ request with body of contentType.
+func post(target, contentType, body string) *httptest.ResponseRecorder {
+	return postTo(testServer, target, contentType, body)
+}
+
+func postTo(s *server, target, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.collectHandler(w, r)
+	return w
+}
+
+func TestCollectReservedFields(t *testing.T) {
+	reserved := url.Values{
+		"page": {"/page"},
+		"v":    {"2"},
+		"tid":  {"UA-9999-9"},
+		"cid":  {"injected"},
+		"uip":  {"203.0.113.7"},
+		"qt":   {"999999"},
+		"aip":  {"0"},
+		"cd1":  {"unknown field"},
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"form", "application/x-www-form-urlencoded", reserved.Encode()},
+		{"json", "application/json", `{"page":"/page","v":"2","tid":"UA-9999-9","cid":"injected","uip":"203.0.113.7","qt":999999,"aip":false,"cd1":"unknown field"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t)
+			if w := post("/collect/UA-1234-1", tt.contentType, tt.body); w.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want 204: %s", w.Code, w.Body)
+			}
+			form := stub.next(t).form()
+			for field, want := range map[string]string{"v": "1", "tid": "UA-1234-1", "uip": "192.0.2.1", "dp": "page"} {
+				if got := form.Get(field); got != want {
+					t.Errorf("%s = %q, want %q", field, got, want)
+				}
+			}
+			for _, field := range []string{"qt", "aip", "cd1"} {
+				if form.Has(field) {
+					t.Errorf("%s = %q taken from the body", field, form.Get(field))
+				}
+			}
+			if form.Get("cid") == "injected" {
+				t.Error("cid taken from the body")
+			}
+		})
+	}
+}
+
+func TestValidatePostFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields url.Values
+		kept   []string
+		err    string
+	}{
+		{"allowed", url.Values{"page": {"/docs"}, "event": {"docs/download"}, "utm_source": {"news"}, "dt": {"Docs"}, "dl": {"https://example.com/docs"}, "ul": {"en"}},
+			[]string{"dl", "dt", "event", "page", "ul", "utm_source"}, ""},
+		{"indexed", url.Values{"page": {"/docs"}, "cd12": {"team"}, "cm3": {"2"}, "cg1": {"docs"}, "pr2id": {"sku"}, "il1pi2cd3": {"x"}},
+			[]string{"cd12", "cg1", "cm3", "il1pi2cd3", "page", "pr2id"}, ""},
+		{"reserved", url.Values{"page": {"/docs"}, "v": {"2"}, "t": {"event"}, "tid": {"UA-9999-9"}, "cid": {"x"}, "uip": {"203.0.113.7"}, "sc": {"end"}, "qt": {"1"}, "z": {"1"}, "dr": {"https://example.com/"}},
+			[]string{"page"}, "reserved fields cid, dr, qt, sc, t, tid, uip, v, z"},
+		{"unknown", url.Values{"page": {"/docs"}, "dt": {"Docs"}, "referrer": {"x"}, "cd0": {"x"}, "cd": {"x"}, "DT": {"x"}},
+			[]string{"cd", "dt", "page"}, "unknown fields DT, cd0, referrer"},
+		{"both", url.Values{"page": {"/docs"}, "tid": {"UA-9999-9"}, "foo": {"bar"}},
+			[]string{"page"}, "reserved fields tid; unknown fields foo"},
+	}
+	for _, tt := range tests {
+		err := validatePostFields(tt.fields)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: validatePostFields() = %v, want %q", tt.name, err, tt.err)
+		}
+		var kept []string
+		for key := range tt.fields {
+			kept = append(kept, key)
+		}
+		sort.Strings(kept)
+		if strings.Join(kept, ",") != strings.Join(tt.kept, ",") {
+			t.Errorf("%s: kept %v, want %v", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+func TestParseGAParams(t *testing.T) {
+	if gaParams == nil {
+		t.Fatal("static/ga-params.json unusable")
+	}
+	pattern := parseGAParams([]byte(`{"params": ["dt", "cd<n>", "a.b"]}`))
+	for param, want := range map[string]bool{"dt": true, "cd1": true, "cd200": true, "cd": false, "cd01": false, "a.b": true, "axb": false, "xdt": false} {
+		if got := pattern.MatchString(param); got != want {
+			t.Errorf("pattern matches %s = %v, want %v", param, got, want)
+		}
+	}
+	for _, data := range []string{`not json`, `{"params": []}`} {
+		if pattern := parseGAParams([]byte(data)); pattern != nil {
+			t.Errorf("parseGAParams(%s) = %v, want nil", data, pattern)
+		}
+	}
+	// The lists above were not the embedded one, which is fine.
+	delete(embeddedAssetErrors, "static/ga-params.json")
+}
+
+func TestCollectPostValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		body   string
+		status int
+		warned bool
+	}{
+		{"valid", false, `{"page":"/docs","dt":"Docs"}`, http.StatusNoContent, false},
+		{"valid, strict", true, `{"page":"/docs","dt":"Docs"}`, http.StatusNoContent, false},
+		{"reserved", false, `{"page":"/docs","dt":"Docs","tid":"UA-9999-9","t":"exception"}`, http.StatusNoContent, true},
+		{"reserved, strict", true, `{"page":"/docs","dt":"Docs","tid":"UA-9999-9","t":"exception"}`, http.StatusBadRequest, false},
+		{"unknown", false, `{"page":"/docs","dt":"Docs","title":"Docs"}`, http.StatusNoContent, true},
+		{"unknown, strict", true, `{"page":"/docs","dt":"Docs","title":"Docs"}`, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, "-coalesceWindow=0", "-strictPostValidation="+strconv.FormatBool(tt.strict))
+			var log bytes.Buffer
+			w := postTo(newLoggingServer(&log), "/collect/UA-1234-1", "application/json", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusNoContent {
+				// The 400 names the offending fields, and nothing is reported.
+				if body := w.Body.String(); !strings.Contains(body, "reserved fields t, tid") && !strings.Contains(body, "unknown fields title") {
+					t.Errorf("body = %q, want the offending fields", body)
+				}
+				stub.none(t)
+				return
+			}
+			form := stub.next(t).form()
+			if form.Get("tid") != "UA-1234-1" || form.Get("t") != "pageview" || form.Get("dt") != "Docs" {
+				t.Errorf("hit = %s, want the pageview with only the valid fields", form.Encode())
+			}
+			hitWorkers.Stop(context.Background())
+			if warned := strings.Contains(log.String(), "Dropping fields of a /collect/ request"); warned != tt.warned {
+				t.Errorf("warned = %v, want %v: %s", warned, tt.warned, log.String())
+			}
+		})
+	}
+}
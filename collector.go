@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/irvinlim/ga-beacon/beacon"
+)
+
+var (
+	// gaClient is shared by all requests to the GA collector so connections
+	// are reused.
+	gaClient = newGAClient(false)
+
+	// Requests sent to the GA collector, by negotiated protocol.
+	h2RequestsSent atomic.Int64
+	h1RequestsSent atomic.Int64
+)
+
+// newGAClient returns a client for the GA collector. With forceHTTP2 it only
+// offers h2 during the TLS handshake; otherwise HTTP/2 is disabled entirely.
+// -gaMaxIdleConns idle connections are kept for workers to reuse, at most
+// -gaMaxConns are open at once (0 for no limit), and requests time out after
+// -gaTimeout even without a context deadline. HTTPS_PROXY and friends are
+// honored.
+func newGAClient(forceHTTP2 bool) *http.Client {
+	return beacon.NewClient(beacon.ClientOptions{
+		Timeout:      gaTimeout,
+		MaxIdleConns: gaMaxIdleConns,
+		MaxConns:     gaMaxConns,
+		ForceHTTP2:   forceHTTP2,
+	})
+}
+
+// countProto records which protocol a GA collector response came over.
+func countProto(resp *http.Response) {
+	if resp.ProtoMajor == 2 {
+		h2RequestsSent.Add(1)
+	} else {
+		h1RequestsSent.Add(1)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// newTLSCollector starts an HTTPS collector offering HTTP/2 and returns it
+// with a GA client trusting its certificate.
+func newTLSCollector(tb testing.TB, forceHTTP2 bool) (*httptest.Server, *http.Client) {
+	tb.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	tb.Cleanup(srv.Close)
+
+	client := newGAClient(forceHTTP2)
+	transport := client.Transport.(*http.Transport)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+	transport.TLSClientConfig.RootCAs.AddCert(srv.Certificate())
+	return srv, client
+}
+
+func TestGAClientProtocol(t *testing.T) {
+	tests := []struct {
+		forceHTTP2 bool
+		wantMajor  int
+	}{
+		{false, 1},
+		{true, 2},
+	}
+	for _, tt := range tests {
+		srv, client := newTLSCollector(t, tt.forceHTTP2)
+		h1, h2 := h1RequestsSent.Load(), h2RequestsSent.Load()
+		resp, err := client.Post(srv.URL+"/collect", "application/x-www-form-urlencoded", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != tt.wantMajor {
+			t.Errorf("forceHTTP2=%v: response over %s, want HTTP/%d", tt.forceHTTP2, resp.Proto, tt.wantMajor)
+		}
+		countProto(resp)
+		if tt.wantMajor == 2 && h2RequestsSent.Load() != h2+1 || tt.wantMajor == 1 && h1RequestsSent.Load() != h1+1 {
+			t.Errorf("forceHTTP2=%v: request not counted for HTTP/%d", tt.forceHTTP2, tt.wantMajor)
+		}
+	}
+}
+
+func TestGAClientHTTP2Transport(t *testing.T) {
+	transport := newGAClient(true).Transport.(*http.Transport)
+	if !transport.ForceAttemptHTTP2 {
+		t.Error("ForceAttemptHTTP2 is off with -gaHTTP2")
+	}
+	if protos := transport.TLSClientConfig.NextProtos; len(protos) != 1 || protos[0] != "h2" {
+		t.Errorf("NextProtos = %q, want only h2", protos)
+	}
+
+	transport = newGAClient(false).Transport.(*http.Transport)
+	if transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+		t.Error("TLSNextProto is not an empty map without -gaHTTP2, which leaves HTTP/2 enabled")
+	}
+	if cfg := transport.TLSClientConfig; cfg != nil && slices.Contains(cfg.NextProtos, "h2") {
+		t.Errorf("NextProtos = %q without -gaHTTP2, want no h2", cfg.NextProtos)
+	}
+}
+
+func BenchmarkGAClient(b *testing.B) {
+	for _, tt := range []struct {
+		name       string
+		forceHTTP2 bool
+	}{{"http1", false}, {"http2", true}} {
+		b.Run(tt.name, func(b *testing.B) {
+			srv, client := newTLSCollector(b, tt.forceHTTP2)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Post(srv.URL+"/collect", "application/x-www-form-urlencoded", nil)
+					if err != nil {
+						b.Fatal(err)
+					}
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const envPrefix = "GA_BEACON_"
+
+// secretFlags are masked by -printConfig.
+var secretFlags = map[string]bool{"ga4APISecret": true, "metricsToken": true, "matomoToken": true, "adminToken": true, "signingKey": true, "mirrorToken": true, "statsToken": true, "otlpHeaders": true}
+
+// envName returns the environment variable for a flag, e.g. GA_BEACON_LISTEN_PORT
+// for -listenPort and GA_BEACON_MAX_CONNS_PER_IP for -maxConnsPerIP.
+func envName(flagName string) string {
+	runes := []rune(flagName)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return envPrefix + b.String()
+}
+
+// applyEnvFlags sets every flag not given on the command line from its
+// environment variable, if that is set.
+func applyEnvFlags(fs *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+			}
+		}
+	})
+	return err
+}
+
+// parseConfigFile parses a -config file: flat YAML mapping flag names to
+// values, one per line.
+//
+//	# comments and blank lines are ignored
+//	listenPort: 8080
+//	redirectURL: "https://example.com/"
+//
+// Nested mappings and lists are not supported; list-valued flags take the
+// same comma-separated string as on the command line.
+func parseConfigFile(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("line %d: nested values are not supported", n)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want name: value", n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("line %d: unterminated quote", n)
+			}
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// pinnedFlags are the flags given on the command line or in the
+// environment, which the -config file does not override, also on reload.
+var pinnedFlags = map[string]bool{}
+
+// readConfigFile reads and parses the -config file at path, rejecting
+// settings fs has no flag for.
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name := range values {
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+	}
+	return values, nil
+}
+
+// applyConfigFile sets every flag not given on the command line or in the
+// environment from the -config file at path.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	values, err := readConfigFile(fs, path)
+	if err != nil {
+		return err
+	}
+
+	fs.Visit(func(f *flag.Flag) { pinnedFlags[f.Name] = true })
+	for name, value := range values {
+		if pinnedFlags[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// printConfig writes the resolved flag values as JSON, with secrets masked.
+func printConfig(fs *flag.FlagSet) error {
+	config := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "********"
+		}
+		config[f.Name] = v
+	})
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(config)
+}
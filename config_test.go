@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFlags returns a flag set with a few flags like the server's.
+func testFlags() (*flag.FlagSet, *int) {
+	fs := flag.NewFlagSet("ga-beacon", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	port := fs.Int("listenPort", 8080, "")
+	fs.String("ga4APISecret", "", "")
+	fs.Int("maxConnsPerIP", 20, "")
+	return fs, port
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		flag, want string
+	}{
+		{"listenPort", "GA_BEACON_LISTEN_PORT"},
+		{"maxConnsPerIP", "GA_BEACON_MAX_CONNS_PER_IP"},
+		{"ga4APISecret", "GA_BEACON_GA4_API_SECRET"},
+		{"redirectURL", "GA_BEACON_REDIRECT_URL"},
+		{"trustProxy", "GA_BEACON_TRUST_PROXY"},
+		{"debug", "GA_BEACON_DEBUG"},
+	}
+	for _, tt := range tests {
+		if got := envName(tt.flag); got != tt.want {
+			t.Errorf("envName(%q) = %s, want %s", tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestApplyEnvFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want int
+	}{
+		{"default", nil, "", 8080},
+		{"environment", nil, "9090", 9090},
+		{"command line wins", []string{"-listenPort=8081"}, "9090", 8081},
+		{"command line default wins", []string{"-listenPort=8080"}, "9090", 8080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("GA_BEACON_LISTEN_PORT", tt.env)
+			}
+			fs, port := testFlags()
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyEnvFlags(fs); err != nil {
+				t.Fatal(err)
+			}
+			if *port != tt.want {
+				t.Errorf("listenPort = %d, want %d", *port, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnvFlagsInvalid(t *testing.T) {
+	t.Setenv("GA_BEACON_LISTEN_PORT", "ninety")
+	fs, _ := testFlags()
+	fs.Parse(nil)
+	err := applyEnvFlags(fs)
+	if err == nil || !strings.Contains(err.Error(), "GA_BEACON_LISTEN_PORT") {
+		t.Errorf("applyEnvFlags() = %v, want an error naming the variable", err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	t.Setenv("GA_BEACON_LISTEN_PORT", "9090")
+	t.Setenv("GA_BEACON_GA4_API_SECRET", "s3cret")
+	fs, _ := testFlags()
+	fs.Parse(nil)
+	if err := applyEnvFlags(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep(t, &os.Stdout)
+	os.Stdout = w
+	err = printConfig(fs)
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(r)
+
+	var config map[string]string
+	if err := json.Unmarshal(out, &config); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if config["listenPort"] != "9090" || config["maxConnsPerIP"] != "20" {
+		t.Errorf("config = %v, want the resolved values", config)
+	}
+	if config["ga4APISecret"] != "********" || strings.Contains(string(out), "s3cret") {
+		t.Errorf("config = %s, want the secret masked", out)
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]string
+		err  string
+	}{
+		{"values", "# the beacon\n---\nlistenPort: 8080\n\nredirectURL: https://example.com/\n", map[string]string{"listenPort": "8080", "redirectURL": "https://example.com/"}, ""},
+		{"comment after a value", "listenPort: 8080 # the default\n", map[string]string{"listenPort": "8080"}, ""},
+		{"double quotes", `ga4APISecret: "s3 cret # not a comment\t"` + "\n", map[string]string{"ga4APISecret": "s3 cret # not a comment\t"}, ""},
+		{"single quotes", "ga4APISecret: 'it''s'\n", map[string]string{"ga4APISecret": "it's"}, ""},
+		{"empty", "ga4APISecret:\n", map[string]string{"ga4APISecret": ""}, ""},
+		{"nested", "listen:\n  port: 8080\n", nil, "line 2: nested values are not supported"},
+		{"list", "allowedIDs:\n- UA-1234-1\n", nil, "line 2: nested values are not supported"},
+		{"no colon", "listenPort 8080\n", nil, "line 1: want name: value"},
+		{"set twice", "listenPort: 8080\nlistenPort: 9090\n", nil, "line 2: listenPort is set twice"},
+		{"unterminated single quote", "ga4APISecret: 's3cret\n", nil, "line 1: unterminated quote"},
+		{"bad double quotes", `ga4APISecret: "s3cret` + "\n", nil, "line 1: invalid syntax"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfigFile([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("parseConfigFile() = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfigFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeConfig writes a -config file and returns its path.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ga-beacon.yaml")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	path := writeConfig(t, "listenPort: 9000\nmaxConnsPerIP: 5\n")
+	tests := []struct {
+		name      string
+		args      []string
+		env       string
+		wantPort  string
+		wantConns string
+	}{
+		{"file", nil, "", "9000", "5"},
+		{"command line wins", []string{"-listenPort=8081"}, "", "8081", "5"},
+		{"command line default wins", []string{"-listenPort=8080"}, "", "8080", "5"},
+		{"environment wins", nil, "9090", "9090", "5"},
+		{"command line wins over both", []string{"-listenPort=8081"}, "9090", "8081", "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &pinnedFlags)
+			pinnedFlags = map[string]bool{}
+			if tt.env != "" {
+				t.Setenv("GA_BEACON_LISTEN_PORT", tt.env)
+			}
+			fs, _ := testFlags()
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyEnvFlags(fs); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyConfigFile(fs, path); err != nil {
+				t.Fatal(err)
+			}
+			if got := fs.Lookup("listenPort").Value.String(); got != tt.wantPort {
+				t.Errorf("listenPort = %s, want %s", got, tt.wantPort)
+			}
+			if got := fs.Lookup("maxConnsPerIP").Value.String(); got != tt.wantConns {
+				t.Errorf("maxConnsPerIP = %s, want %s", got, tt.wantConns)
+			}
+			// Reloads keep what the command line and environment set, too.
+			if pinned := tt.args != nil || tt.env != ""; pinnedFlags["listenPort"] != pinned || pinnedFlags["maxConnsPerIP"] {
+				t.Errorf("pinned flags = %v, want listenPort pinned: %v", pinnedFlags, pinned)
+			}
+		})
+	}
+}
+
+func TestApplyConfigFileInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unknown setting", "listenPort: 9000\nlistenPrt: 9000\n", `unknown setting "listenPrt"`},
+		{"bad value", "listenPort: ninety\n", "listenPort: parse error"},
+		{"bad syntax", "listenPort 9000\n", "line 1: want name: value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &pinnedFlags)
+			pinnedFlags = map[string]bool{}
+			path := writeConfig(t, tt.data)
+			fs, port := testFlags()
+			fs.Parse(nil)
+			err := applyConfigFile(fs, path)
+			if err == nil || !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("applyConfigFile() = %v, want an error naming the file and %q", err, tt.err)
+			}
+			if tt.name == "unknown setting" && *port != 8080 {
+				t.Errorf("listenPort = %d, want nothing applied from an invalid file", *port)
+			}
+		})
+	}
+
+	fs, _ := testFlags()
+	if err := applyConfigFile(fs, filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("applyConfigFile() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/irvinlim/ga-beacon/beacon"
+)
+
+// cookieConfig controls the cookie carrying the client ID.
+type cookieConfig struct {
+	name   string
+	maxAge time.Duration // 0 for a session cookie
+	domain string
+	secure bool
+	// sameSite is the cookie's SameSite attribute. Beacons are almost always
+	// loaded cross-site, which browsers only send the cookie for with
+	// SameSite=None, and that requires Secure.
+	sameSite http.SameSite
+}
+
+var cidCookie = &cookieConfig{name: "cid", secure: true, sameSite: http.SameSiteNoneMode}
+
+// parseSameSite parses a -cookieSameSite value.
+func parseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return http.SameSiteNoneMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	default:
+		return 0, fmt.Errorf("unknown SameSite mode %q (want none, lax or strict)", s)
+	}
+}
+
+// setCIDHeaders sets the CID response header, its CID-Cache-Control companion
+// and the client ID cookie. A shared cache would serve the visitor's cookie to
+// others, so a publicly cacheable badge is downgraded to private: browsers
+// still cache it, shared caches no longer do.
+func setCIDHeaders(w http.ResponseWriter, cid string, cookiePath string, cfg *cookieConfig) {
+	w.Header().Set("CID", cid)
+	w.Header().Set("CID-Cache-Control", "private, no-cache")
+	cookie := &http.Cookie{
+		Name:     cfg.name,
+		Value:    cid,
+		Path:     cookiePath,
+		Domain:   cfg.domain,
+		HttpOnly: true,
+		Secure:   cfg.secure,
+		SameSite: cfg.sameSite,
+	}
+	if cfg.maxAge > 0 {
+		cookie.MaxAge = int(cfg.maxAge.Seconds())
+		cookie.Expires = time.Now().Add(cfg.maxAge).UTC()
+	}
+	http.SetCookie(w, cookie)
+
+	if cc, ok := strings.CutPrefix(w.Header().Get("Cache-Control"), "public"); ok {
+		w.Header().Set("Cache-Control", "private"+cc)
+	}
+}
+
+// anonymousCIDs derives client IDs for -cookieless from a keyed hash of the
+// visitor's IP address and User-Agent. The key is random, kept only in
+// memory and replaced every UTC day, so a visitor keeps the same client ID
+// for at most a day and the ID cannot be traced back to the IP address.
+type anonymousCIDs struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	day  string
+	salt []byte
+}
+
+var cookielessCIDs = &anonymousCIDs{now: time.Now}
+
+// CID returns the client ID of the visitor with the given IP address and
+// User-Agent for today.
+func (a *anonymousCIDs) CID(ip, userAgent string) (string, error) {
+	salt, err := a.currentSalt(a.now().UTC().Format("2006-01-02"))
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip + "\x00" + userAgent))
+	return beacon.FormatUUID(mac.Sum(nil)[:16]), nil
+}
+
+func (a *anonymousCIDs) currentSalt(day string) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.day != day {
+		salt := make([]byte, 32)
+		if _, err := crand.Read(salt); err != nil {
+			return nil, err
+		}
+		a.day, a.salt = day, salt
+	}
+	return a.salt, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cidCookieFrom returns the client ID cookie set by w, or nil.
+func cidCookieFrom(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cidCookie.name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSetCIDHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	setCIDHeaders(w, "1234.5678", "/UA-1234-1", &cookieConfig{name: "cid", secure: true, sameSite: http.SameSiteNoneMode})
+
+	if got := w.Header().Get("CID"); got != "1234.5678" {
+		t.Errorf("CID = %q, want 1234.5678", got)
+	}
+	if got := w.Header().Get("CID-Cache-Control"); got != "private, no-cache" {
+		t.Errorf("CID-Cache-Control = %q, want private, no-cache", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=60" {
+		t.Errorf("Cache-Control = %q, want the badge with the cookie kept out of shared caches", got)
+	}
+	cookie := cidCookieFrom(w)
+	if cookie == nil {
+		t.Fatal("no cid cookie set")
+	}
+	if cookie.Value != "1234.5678" || cookie.Path != "/UA-1234-1" {
+		t.Errorf("cookie = %s, want cid=1234.5678 on /UA-1234-1", cookie)
+	}
+}
+
+func TestSetCIDHeadersCacheControl(t *testing.T) {
+	tests := []struct {
+		cacheControl, want string
+	}{
+		{"public, max-age=60", "private, max-age=60"},
+		{"public, no-cache", "private, no-cache"},
+		{"private, no-store", "private, no-store"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if tt.cacheControl != "" {
+			w.Header().Set("Cache-Control", tt.cacheControl)
+		}
+		setCIDHeaders(w, "1234.5678", "/UA-1234-1", &cookieConfig{name: "cid", secure: true, sameSite: http.SameSiteNoneMode})
+		if got := w.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("Cache-Control %q with the cookie = %q, want %q", tt.cacheControl, got, tt.want)
+		}
+	}
+}
+
+func TestNewCIDHeaders(t *testing.T) {
+	newTestBeacon(t)
+
+	w := get("/UA-1234-1/page")
+	cid := w.Header().Get("CID")
+	if cid == "" {
+		t.Fatal("no CID header on a new client ID")
+	}
+	if got := w.Header().Get("CID-Cache-Control"); got != "private, no-cache" {
+		t.Errorf("CID-Cache-Control = %q, want private, no-cache", got)
+	}
+	if cookie := cidCookieFrom(w); cookie == nil || cookie.Value != cid {
+		t.Errorf("cookie = %v, want cid=%s", cookie, cid)
+	}
+
+	// A returning visitor keeps their client ID.
+	w = get("/UA-1234-1/page", "Cookie", "cid="+cid)
+	if got := w.Header().Get("CID"); got != cid {
+		t.Errorf("CID = %q for a returning visitor, want %q", got, cid)
+	}
+	if !strings.Contains(w.Header().Get("Set-Cookie"), cid) {
+		t.Errorf("Set-Cookie = %q, want the cookie renewed", w.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestCIDCookieAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *cookieConfig
+		want []string
+		not  []string
+	}{
+		// main sets these up from the default flags and from -insecureCookie.
+		{"default", &cookieConfig{name: "cid", secure: true, sameSite: http.SameSiteNoneMode},
+			[]string{"HttpOnly", "Secure", "SameSite=None"}, []string{"SameSite=Lax"}},
+		{"insecureCookie", &cookieConfig{name: "cid", sameSite: http.SameSiteLaxMode},
+			[]string{"HttpOnly", "SameSite=Lax"}, []string{"Secure", "SameSite=None"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBeacon(t)
+			cidCookie = tt.cfg
+			w := get("/UA-1234-1/page")
+			header := w.Header().Get("Set-Cookie")
+			attrs := map[string]bool{}
+			for _, attr := range strings.Split(header, ";") {
+				attrs[strings.TrimSpace(attr)] = true
+			}
+			for _, attr := range tt.want {
+				if !attrs[attr] {
+					t.Errorf("Set-Cookie = %q, want %s", header, attr)
+				}
+			}
+			for _, attr := range tt.not {
+				if attrs[attr] {
+					t.Errorf("Set-Cookie = %q, want no %s", header, attr)
+				}
+			}
+		})
+	}
+}
+
+func TestAnonymousCIDs(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 1, 0, time.UTC)
+	a := &anonymousCIDs{now: func() time.Time { return now }}
+	cid := func(ip, ua string) string {
+		t.Helper()
+		id, err := a.CID(ip, ua)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	first := cid("198.51.100.7", "Firefox")
+	if len(first) != 36 || strings.Count(first, "-") != 4 {
+		t.Errorf("CID = %q, want a UUID", first)
+	}
+	now = now.Add(24*time.Hour - 2*time.Second) // 23:59:59, still the same UTC day
+	if got := cid("198.51.100.7", "Firefox"); got != first {
+		t.Errorf("CID = %s later that day, want %s", got, first)
+	}
+	if got := cid("198.51.100.8", "Firefox"); got == first {
+		t.Error("another IP address got the same CID")
+	}
+	if got := cid("198.51.100.7", "Chrome"); got == first {
+		t.Error("another User-Agent got the same CID")
+	}
+	// The IP address and User-Agent are kept apart in the hash.
+	if cid("198.51.100.7", "1Firefox") == cid("198.51.100.71", "Firefox") {
+		t.Error("shifting a character from the User-Agent to the IP address kept the CID")
+	}
+
+	now = now.Add(2 * time.Second) // the next UTC day
+	next := cid("198.51.100.7", "Firefox")
+	if next == first {
+		t.Error("CID unchanged after the salt rotated")
+	}
+	if got := cid("198.51.100.7", "Firefox"); got != next {
+		t.Errorf("CID = %s, want %s until the next rotation", got, next)
+	}
+
+	// The salt is random, so another process derives other IDs.
+	other := &anonymousCIDs{now: func() time.Time { return now }}
+	if id, _ := other.CID("198.51.100.7", "Firefox"); id == next {
+		t.Error("two salts derived the same CID")
+	}
+}
+
+func TestCookielessHits(t *testing.T) {
+	stub := newTestBeacon(t, "-cookieless", "-coalesceWindow=0")
+	var cids []string
+	for _, header := range [][]string{
+		{"User-Agent", "Firefox"},
+		{"User-Agent", "Firefox", "Cookie", "cid=35009a79-1a05-49d7-b876-2b884d0f825b"},
+		{"User-Agent", "Chrome"},
+	} {
+		w := get("/UA-1234-1/page", header...)
+		if got := w.Header().Values("Set-Cookie"); len(got) != 0 {
+			t.Errorf("Set-Cookie = %q with -cookieless, want none", got)
+		}
+		if got := w.Header().Get("CID"); got != "" {
+			t.Errorf("CID header = %q with -cookieless, want none", got)
+		}
+		cids = append(cids, stub.next(t).form().Get("cid"))
+	}
+	if cids[0] == "" || cids[1] != cids[0] {
+		t.Errorf("cids = %q, want the same visitor's hits to share one, ignoring a cid cookie", cids)
+	}
+	if cids[2] == cids[0] {
+		t.Errorf("cids = %q, want another User-Agent to get its own", cids)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// counterStore is set when -enableCounter is enabled.
+var counterStore CounterStore
+
+// CounterStore keeps the hit counts shown by ?count badges. Besides the
+// total of a key, it keeps its count of each UTC day under the partition
+// key <key>#<YYYY-MM-DD>, for -counterRetention.
+type CounterStore interface {
+	// Increment adds one to the count for key and to today's partition of
+	// it, and returns the new count.
+	Increment(key string) (int64, error)
+	// Get returns the count for key, 0 if it has never been incremented.
+	Get(key string) (int64, error)
+	// GetRange returns the sum of the daily counts for key from the UTC day
+	// of from to that of to, both included.
+	GetRange(key string, from, to time.Time) (int64, error)
+	// Prune deletes the daily counts of the days before the UTC day of
+	// before.
+	Prune(before time.Time) error
+}
+
+const (
+	// counterSaveInterval is how often a memory store with -counterFile is
+	// written out.
+	counterSaveInterval = 30 * time.Second
+	// counterPruneInterval is how often daily counts past
+	// -counterRetention are pruned.
+	counterPruneInterval = time.Hour
+	// maxCounterRangeDays is the longest range GetRange is asked for.
+	maxCounterRangeDays = 366
+)
+
+// counterDayPartition matches the daily partition keys of a CounterStore,
+// capturing the day.
+var counterDayPartition = regexp.MustCompile(`#(\d{4}-\d{2}-\d{2})$`)
+
+// counterDayKey returns the partition key of key for the UTC day of t.
+func counterDayKey(key string, t time.Time) string {
+	return key + "#" + t.UTC().Format("2006-01-02")
+}
+
+// counterDays returns the UTC days from from to to, both included, as
+// YYYY-MM-DD.
+func counterDays(from, to time.Time) []string {
+	var days []string
+	to = to.UTC()
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, day.Format("2006-01-02"))
+	}
+	return days
+}
+
+// pruneCounters prunes the daily counts, or unique visitor sketches, older
+// than retention every interval, logging failures to logger.
+func pruneCounters(logger *slog.Logger, store interface{ Prune(time.Time) error }, retention, interval time.Duration) {
+	for {
+		if err := store.Prune(time.Now().Add(-retention)); err != nil {
+			logger.Error("Cannot prune daily hit counts", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// errCounterFull is returned by a memory store asked to count a new key
+// past -counterMaxKeys.
+var errCounterFull = errors.New("counter store is full")
+
+// newCounterStore returns the store for -counterBackend. A memory store is
+// loaded from and saved to file, if set, and counts up to maxKeys pages. A
+// Redis store expires daily counts after retention, if set.
+func newCounterStore(backend, redisAddr, file string, maxKeys int, retention time.Duration) (CounterStore, error) {
+	switch backend {
+	case "memory":
+		if file != "" {
+			return loadMemoryCounterStore(file, maxKeys)
+		}
+		return newMemoryCounterStore(maxKeys), nil
+	case "redis":
+		return &redisCounterStore{addr: redisAddr, timeout: time.Second, retention: retention}, nil
+	}
+	return nil, fmt.Errorf("unknown counter backend %q (want memory or redis)", backend)
+}
+
+// memoryCounterStore keeps counts in process memory, the totals and the
+// daily partitions in the same map. Without a file they reset on restart;
+// with one they are saved to it as JSON periodically and on shutdown. Pages
+// are counted by anyone requesting them, so at most maxKeys are, to bound
+// both the memory and the file.
+type memoryCounterStore struct {
+	mu      sync.Mutex
+	counts  map[string]int64
+	pages   int // keys in counts that are not daily partitions
+	maxKeys int
+	path    string
+	dirty   bool
+}
+
+func newMemoryCounterStore(maxKeys int) *memoryCounterStore {
+	return &memoryCounterStore{counts: map[string]int64{}, maxKeys: maxKeys}
+}
+
+// loadMemoryCounterStore returns a memory store saved to path, starting from
+// the counts already in it. A missing file starts from zero.
+func loadMemoryCounterStore(path string, maxKeys int) (*memoryCounterStore, error) {
+	s := newMemoryCounterStore(maxKeys)
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.counts); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for key := range s.counts {
+		if !counterDayPartition.MatchString(key) {
+			s.pages++
+		}
+	}
+	return s, nil
+}
+
+func (s *memoryCounterStore) Increment(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.counts[key]; !ok {
+		if s.pages >= s.maxKeys {
+			return 0, errCounterFull
+		}
+		s.pages++
+	}
+	s.counts[key]++
+	s.counts[counterDayKey(key, time.Now())]++
+	s.dirty = true
+	return s.counts[key], nil
+}
+
+func (s *memoryCounterStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[key], nil
+}
+
+func (s *memoryCounterStore) GetRange(key string, from, to time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, day := range counterDays(from, to) {
+		n += s.counts[key+"#"+day]
+	}
+	return n, nil
+}
+
+func (s *memoryCounterStore) Prune(before time.Time) error {
+	oldest := before.UTC().Format("2006-01-02")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.counts {
+		if m := counterDayPartition.FindStringSubmatch(key); m != nil && m[1] < oldest {
+			delete(s.counts, key)
+			s.dirty = true
+		}
+	}
+	return nil
+}
+
+// Save writes the counts to the store's file if they changed since the last
+// save. The file is replaced atomically.
+func (s *memoryCounterStore) Save() error {
+	s.mu.Lock()
+	if s.path == "" || !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.counts)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true // retry on the next save
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// run saves the counts every interval, logging failures to logger.
+func (s *memoryCounterStore) run(interval time.Duration, logger *slog.Logger) {
+	for range time.Tick(interval) {
+		if err := s.Save(); err != nil {
+			logger.Error("Cannot save hit counts", "path", s.path, "err", err)
+		}
+	}
+}
+
+// redisCounterKeyPrefix namespaces the beacon's keys in a shared Redis.
+const redisCounterKeyPrefix = "gabeacon:count:"
+
+// redisCounterStore keeps counts in Redis with INCR and GET. It speaks just
+// enough RESP for those commands and EXPIRE over a single connection,
+// redialed after any error. Daily partitions are given an expiry of
+// retention when they are created, so Redis prunes them itself.
+type redisCounterStore struct {
+	addr      string
+	timeout   time.Duration
+	retention time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func (s *redisCounterStore) Increment(key string) (int64, error) {
+	n, err := s.do("INCR", redisCounterKeyPrefix+key)
+	if err != nil {
+		return 0, err
+	}
+	day := redisCounterKeyPrefix + counterDayKey(key, time.Now())
+	created, err := s.do("INCR", day)
+	if err == nil && created == 1 && s.retention > 0 {
+		// A day's count is kept for the retention after the day ends.
+		_, err = s.do("EXPIRE", day, strconv.FormatInt(int64((s.retention+24*time.Hour).Seconds()), 10))
+	}
+	return n, err
+}
+
+func (s *redisCounterStore) Get(key string) (int64, error) {
+	return s.do("GET", redisCounterKeyPrefix+key)
+}
+
+func (s *redisCounterStore) GetRange(key string, from, to time.Time) (int64, error) {
+	var total int64
+	for _, day := range counterDays(from, to) {
+		n, err := s.do("GET", redisCounterKeyPrefix+key+"#"+day)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Prune does nothing: daily partitions expire after the retention.
+func (s *redisCounterStore) Prune(before time.Time) error { return nil }
+
+// do sends a command and parses its integer, bulk string or nil reply as a
+// count.
+func (s *redisCounterStore) do(args ...string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+		if err != nil {
+			return 0, err
+		}
+		s.conn, s.rd = conn, bufio.NewReader(conn)
+	}
+	n, err := s.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		s.conn.Close()
+		s.conn, s.rd = nil, nil
+	}
+	return n, err
+}
+
+// redisError is an error reply; the connection is still usable after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (s *redisCounterStore) roundTrip(args []string) (int64, error) {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	var cmd bytes.Buffer
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := s.conn.Write(cmd.Bytes()); err != nil {
+		return 0, err
+	}
+
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return 0, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '-':
+		return 0, redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return 0, err
+		}
+		if size < 0 {
+			return 0, nil // nil reply: key not set
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(s.rd, value); err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(string(value[:size]), 10, 64)
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// hitsHandler serves /api/v1/hits/<account>/<page>: the ?count of the page
+// as JSON, in total or, with ?from= and ?to= (YYYY-MM-DD, UTC days, both
+// included), over a range of up to 366 days. to defaults to today and from
+// to 365 days before to.
+func (s *server) hitsHandler(w http.ResponseWriter, r *http.Request) {
+	account, page, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/hits/"), "/")
+	if !ok || account == "" || page == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !accountAllowed(account) {
+		http.Error(w, "account not allowed", http.StatusForbidden)
+		return
+	}
+	page = normalizePage(s.logger, page)
+	key := account + "/" + page
+	query := r.URL.Query()
+
+	resp := struct {
+		Account string `json:"account"`
+		Page    string `json:"page"`
+		From    string `json:"from,omitempty"`
+		To      string `json:"to,omitempty"`
+		Hits    int64  `json:"hits"`
+	}{Account: account, Page: page}
+	var err error
+	if query.Get("from") == "" && query.Get("to") == "" {
+		resp.Hits, err = counterStore.Get(key)
+	} else {
+		from, to, rerr := parseCounterRange(query.Get("from"), query.Get("to"), time.Now())
+		if rerr != nil {
+			http.Error(w, rerr.Error(), http.StatusBadRequest)
+			return
+		}
+		resp.From, resp.To = from.Format("2006-01-02"), to.Format("2006-01-02")
+		resp.Hits, err = counterStore.GetRange(key, from, to)
+	}
+	if err != nil {
+		s.logger.Error("Cannot read hit count", "key", key, "err", err)
+		http.Error(w, "cannot read hit count", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// parseCounterRange parses the ?from= and ?to= days of hitsHandler, either
+// of which may be empty.
+func parseCounterRange(fromParam, toParam string, now time.Time) (from, to time.Time, err error) {
+	to = now.UTC().Truncate(24 * time.Hour)
+	if toParam != "" {
+		if to, err = time.Parse("2006-01-02", toParam); err != nil {
+			return from, to, fmt.Errorf("to must be a date as YYYY-MM-DD, got %s", strconv.Quote(toParam))
+		}
+	}
+	from = to.AddDate(0, 0, 1-maxCounterRangeDays)
+	if fromParam != "" {
+		if from, err = time.Parse("2006-01-02", fromParam); err != nil {
+			return from, to, fmt.Errorf("from must be a date as YYYY-MM-DD, got %s", strconv.Quote(fromParam))
+		}
+	}
+	switch {
+	case from.After(to):
+		return from, to, errors.New("from is after to")
+	case to.Sub(from) >= maxCounterRangeDays*24*time.Hour:
+		return from, to, fmt.Errorf("the range is longer than %d days", maxCounterRangeDays)
+	}
+	return from, to, nil
+}
+
+// countBadge renders the ?count badge for n. ?label= and ?color= apply as
+// for other rendered badges.
+func countBadge(n int64, label, color string) badgeImage {
+	if label == "" {
+		label = "views"
+	}
+	return renderBadge(label, formatCount(n), color)
+}
+
+// streamedCountWidth is the width of the message box of a streamed ?count
+// badge, which is drawn before the count is read: wide enough for counts up
+// to 999 999 999. Longer counts are squeezed into it.
+var streamedCountWidth = textWidth(formatCount(999999999)) + badgeTextPadding
+
+// streamCountBadge serves the ?count badge for key in two chunks. The first,
+// flushed before the count is read, holds the badge's frame and label; the
+// second holds the count, in the badge's last element. If the count cannot
+// be read, the badge shows "?", as the regular badge can no longer be served.
+func (s *server) streamCountBadge(w http.ResponseWriter, flusher http.Flusher, key string, tracked bool, referer string, query url.Values) {
+	label := query.Get("label")
+	if label == "" {
+		label = "views"
+	}
+	labelWidth := textWidth(label) + badgeTextPadding
+	w.Header().Set("Content-Type", "image/svg+xml")
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20">`+
+		`<g shape-rendering="crispEdges"><path fill="#555" d="M0 0h%dv20H0z"/><path fill="%s" d="M%d 0h%dv20H%dz"/></g>`+
+		`<g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">`+
+		`<text x="%g" y="14">%s</text>`,
+		labelWidth+streamedCountWidth, labelWidth, badgeFill(query.Get("color")), labelWidth, streamedCountWidth, labelWidth,
+		float64(labelWidth)/2, template.HTMLEscapeString(label))
+	flusher.Flush()
+
+	message := "?"
+	if n, ok := s.pageCount(key, tracked, referer); ok {
+		message = formatCount(n)
+	}
+	var squeeze string
+	if room := streamedCountWidth - badgeTextPadding; textWidth(message) > room {
+		squeeze = fmt.Sprintf(` textLength="%d" lengthAdjust="spacingAndGlyphs"`, room)
+	}
+	fmt.Fprintf(w, `<text x="%g" y="14"%s>%s</text></g></svg>`, float64(labelWidth)+float64(streamedCountWidth)/2, squeeze, message)
+}
+
+// formatCount groups the digits of n in threes, separated by spaces.
+func formatCount(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// day returns the instant of the given UTC day, hour and minute.
+func day(year int, month time.Month, d, hour, min int) time.Time {
+	return time.Date(year, month, d, hour, min, 0, 0, time.UTC)
+}
+
+// seededCounter returns a memory store with daily counts of UA-1234-1/page
+// around the turn of 2026.
+func seededCounter() *memoryCounterStore {
+	s := newMemoryCounterStore(100)
+	s.counts = map[string]int64{
+		"UA-1234-1/page":             31,
+		"UA-1234-1/page#2025-12-31":  1,
+		"UA-1234-1/page#2026-01-01":  2,
+		"UA-1234-1/page#2026-01-31":  4,
+		"UA-1234-1/page#2026-02-01":  8,
+		"UA-1234-1/page#2026-03-15":  16,
+		"UA-1234-1/other#2026-01-01": 100,
+	}
+	s.pages = 1
+	return s
+}
+
+func TestCounterDays(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []string
+	}{
+		{"same instant", day(2026, 1, 1, 0, 0), day(2026, 1, 1, 0, 0), []string{"2026-01-01"}},
+		{"end of day", day(2026, 1, 1, 0, 0), day(2026, 1, 1, 23, 59), []string{"2026-01-01"}},
+		{"next midnight", day(2026, 1, 1, 23, 59), day(2026, 1, 2, 0, 0), []string{"2026-01-01", "2026-01-02"}},
+		{"across months", day(2026, 1, 30, 12, 0), day(2026, 2, 2, 12, 0), []string{"2026-01-30", "2026-01-31", "2026-02-01", "2026-02-02"}},
+		{"across years", day(2025, 12, 31, 0, 0), day(2026, 1, 1, 0, 0), []string{"2025-12-31", "2026-01-01"}},
+		{"other time zone", time.Date(2026, 1, 1, 0, 30, 0, 0, time.FixedZone("CET", 3600)), day(2026, 1, 1, 0, 0), []string{"2025-12-31", "2026-01-01"}},
+		{"from after to", day(2026, 1, 2, 0, 0), day(2026, 1, 1, 0, 0), nil},
+	}
+	for _, tt := range tests {
+		if got := counterDays(tt.from, tt.to); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: counterDays() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryCounterGetRange(t *testing.T) {
+	s := seededCounter()
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int64
+	}{
+		{"one day", day(2026, 1, 1, 0, 0), day(2026, 1, 1, 0, 0), 2},
+		{"one day at its end", day(2026, 1, 1, 23, 59), day(2026, 1, 1, 23, 59), 2},
+		{"day without hits", day(2026, 1, 2, 0, 0), day(2026, 1, 2, 0, 0), 0},
+		{"January", day(2026, 1, 1, 0, 0), day(2026, 1, 31, 0, 0), 6},
+		{"January ending late", day(2026, 1, 1, 0, 0), day(2026, 1, 31, 23, 59), 6},
+		{"before the first of February", day(2026, 1, 1, 0, 0), day(2026, 2, 1, 0, 0).Add(-time.Nanosecond), 6},
+		{"from the last of December", day(2025, 12, 31, 0, 0), day(2026, 1, 1, 0, 0), 3},
+		{"several months", day(2025, 12, 31, 0, 0), day(2026, 3, 15, 0, 0), 31},
+		{"February to March", day(2026, 2, 1, 0, 0), day(2026, 3, 31, 0, 0), 24},
+	}
+	for _, tt := range tests {
+		got, err := s.GetRange("UA-1234-1/page", tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: GetRange() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryCounterPrune(t *testing.T) {
+	s := seededCounter()
+	if err := s.Prune(day(2026, 1, 31, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for key, kept := range map[string]bool{
+		"UA-1234-1/page":             true,
+		"UA-1234-1/page#2025-12-31":  false,
+		"UA-1234-1/page#2026-01-01":  false,
+		"UA-1234-1/other#2026-01-01": false,
+		"UA-1234-1/page#2026-01-31":  true,
+		"UA-1234-1/page#2026-02-01":  true,
+	} {
+		if _, ok := s.counts[key]; ok != kept {
+			t.Errorf("%s kept: %v, want %v", key, ok, kept)
+		}
+	}
+	if n, _ := s.GetRange("UA-1234-1/page", day(2025, 12, 1, 0, 0), day(2026, 3, 31, 0, 0)); n != 28 {
+		t.Errorf("GetRange() after pruning = %d, want 28", n)
+	}
+	if n, _ := s.Get("UA-1234-1/page"); n != 31 {
+		t.Errorf("Get() after pruning = %d, want the total of 31 kept", n)
+	}
+}
+
+func TestMemoryCounterIncrement(t *testing.T) {
+	s := newMemoryCounterStore(1)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Increment("UA-1234-1/page"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	if n, _ := s.GetRange("UA-1234-1/page", now, now); n != 2 {
+		t.Errorf("today's count = %d, want 2", n)
+	}
+	if _, ok := s.counts[counterDayKey("UA-1234-1/page", now)]; !ok {
+		t.Error("no partition for today")
+	}
+	if _, err := s.Increment("UA-1234-1/other"); err != errCounterFull {
+		t.Errorf("Increment() of a second page = %v, want errCounterFull; partitions must not count as pages", err)
+	}
+}
+
+func TestParseCounterRange(t *testing.T) {
+	now := day(2026, 10, 14, 15, 30)
+	tests := []struct {
+		from, to         string
+		wantFrom, wantTo time.Time
+		wantErr          bool
+	}{
+		{"", "", day(2025, 10, 14, 0, 0), day(2026, 10, 14, 0, 0), false},
+		{"2026-01-01", "2026-01-31", day(2026, 1, 1, 0, 0), day(2026, 1, 31, 0, 0), false},
+		{"2026-01-01", "2026-01-01", day(2026, 1, 1, 0, 0), day(2026, 1, 1, 0, 0), false},
+		{"", "2026-03-01", day(2025, 3, 1, 0, 0), day(2026, 3, 1, 0, 0), false},
+		{"2026-01-01", "2026-12-31", day(2026, 1, 1, 0, 0), day(2026, 12, 31, 0, 0), false},
+		{"2026-01-02", "2026-01-01", time.Time{}, time.Time{}, true},
+		{"2025-01-01", "2026-01-01", day(2025, 1, 1, 0, 0), day(2026, 1, 1, 0, 0), false},
+		{"2024-12-31", "2026-01-01", time.Time{}, time.Time{}, true},
+		{"01/01/2026", "", time.Time{}, time.Time{}, true},
+		{"", "tomorrow", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		from, to, err := parseCounterRange(tt.from, tt.to, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCounterRange(%q, %q) error = %v, want error: %v", tt.from, tt.to, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (!from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo)) {
+			t.Errorf("parseCounterRange(%q, %q) = %v, %v, want %v, %v", tt.from, tt.to, from, to, tt.wantFrom, tt.wantTo)
+		}
+	}
+}
+
+func TestHitsHandlerRange(t *testing.T) {
+	newTestBeacon(t)
+	counterStore = seededCounter()
+	tests := []struct {
+		target string
+		status int
+		hits   int64
+	}{
+		{"/api/v1/hits/UA-1234-1/page", http.StatusOK, 31},
+		{"/api/v1/hits/UA-1234-1/page?from=2026-01-01&to=2026-01-31", http.StatusOK, 6},
+		{"/api/v1/hits/UA-1234-1/page?from=2025-12-31&to=2026-03-15", http.StatusOK, 31},
+		{"/api/v1/hits/UA-1234-1/page?from=2026-01-31&to=2026-01-01", http.StatusBadRequest, 0},
+		{"/api/v1/hits/UA-1234-1/page?from=january", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		testServer.hitsHandler(w, httptest.NewRequest("GET", tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.target, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Hits int64 `json:"hits"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Hits != tt.hits {
+			t.Errorf("%s: hits = %d, want %d", tt.target, resp.Hits, tt.hits)
+		}
+	}
+}
+
+// fakeRedis is a Redis server keeping string values in memory, speaking
+// RESP for INCR, GET and EXPIRE.
+type fakeRedis struct {
+	net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{Listener: l, values: map[string]string{}, expires: map[string]string{}}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(rd, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(rd, "$%d\r\n", &size); err != nil {
+				return
+			}
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(rd, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		io.WriteString(conn, r.reply(args))
+	}
+}
+
+func (r *fakeRedis) reply(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case args[0] == "INCR" && len(args) == 2:
+		n, err := strconv.ParseInt(r.values[args[1]], 10, 64)
+		if err != nil && r.values[args[1]] != "" {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		r.values[args[1]] = strconv.FormatInt(n+1, 10)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case args[0] == "GET" && len(args) == 2:
+		v, ok := r.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case args[0] == "EXPIRE" && len(args) == 3:
+		r.expires[args[1]] = args[2]
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestCounterStores(t *testing.T) {
+	redis := newFakeRedis(t)
+	stores := map[string]CounterStore{
+		"memory": newMemoryCounterStore(100),
+		"redis":  &redisCounterStore{addr: redis.Addr().String(), timeout: time.Second, retention: 24 * time.Hour},
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			if n, err := s.Get("UA-1234-1/page"); err != nil || n != 0 {
+				t.Errorf("Get() of a new page = %d, %v, want 0", n, err)
+			}
+			for want := int64(1); want <= 3; want++ {
+				if n, err := s.Increment("UA-1234-1/page"); err != nil || n != want {
+					t.Errorf("Increment() = %d, %v, want %d", n, err, want)
+				}
+			}
+			if n, err := s.Get("UA-1234-1/page"); err != nil || n != 3 {
+				t.Errorf("Get() = %d, %v, want 3", n, err)
+			}
+			now := time.Now()
+			if n, err := s.GetRange("UA-1234-1/page", now, now); err != nil || n != 3 {
+				t.Errorf("today's count = %d, %v, want 3", n, err)
+			}
+			if n, _ := s.Get("UA-1234-1/other"); n != 0 {
+				t.Errorf("Get() of another page = %d, want 0", n)
+			}
+		})
+	}
+
+	today := redisCounterKeyPrefix + counterDayKey("UA-1234-1/page", time.Now())
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	if redis.values[redisCounterKeyPrefix+"UA-1234-1/page"] != "3" || redis.expires[today] != "172800" {
+		t.Errorf("redis has %v expiring %v, want the total and today's count, expiring after the retention", redis.values, redis.expires)
+	}
+}
+
+func TestRedisCounterErrors(t *testing.T) {
+	redis := newFakeRedis(t)
+	s := &redisCounterStore{addr: redis.Addr().String(), timeout: time.Second}
+	redis.mu.Lock()
+	redis.values[redisCounterKeyPrefix+"UA-1234-1/page"] = "not a number"
+	redis.mu.Unlock()
+	if _, err := s.Increment("UA-1234-1/page"); err == nil || !strings.HasPrefix(err.Error(), "redis: ERR") {
+		t.Errorf("Increment() of a non-integer = %v, want the error reply", err)
+	}
+	if _, err := s.Get("UA-1234-1/page"); err == nil {
+		t.Error("Get() of a non-integer succeeded")
+	}
+	if n, err := s.Increment("UA-1234-1/other"); err != nil || n != 1 {
+		t.Errorf("Increment() after error replies = %d, %v, want the connection still usable", n, err)
+	}
+
+	redis.Close()
+	down := &redisCounterStore{addr: redis.Addr().String(), timeout: 100 * time.Millisecond}
+	if _, err := down.Get("UA-1234-1/page"); err == nil {
+		t.Error("Get() from a closed server succeeded")
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{7, "7"},
+		{999, "999"},
+		{1000, "1 000"},
+		{1234, "1 234"},
+		{1234567, "1 234 567"},
+	}
+	for _, tt := range tests {
+		if got := formatCount(tt.n); got != tt.want {
+			t.Errorf("formatCount(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCountBadgeServed(t *testing.T) {
+	stub := newTestBeacon(t, "-enableCounter", "-coalesceWindow=0")
+	counterStore = newMemoryCounterStore(100)
+	counterStore.(*memoryCounterStore).counts["UA-1234-1/page"] = 1232
+
+	for _, want := range []string{"1 233", "1 234"} {
+		w := get("/UA-1234-1/page?count")
+		if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+			t.Errorf("Content-Type = %s, want image/svg+xml", ct)
+		}
+		if body := w.Body.String(); !strings.Contains(body, "views") || !strings.Contains(body, want) {
+			t.Errorf("badge %s, want views: %s", body, want)
+		}
+		stub.next(t)
+	}
+
+	w := get("/UA-1234-1/page?count&label=downloads")
+	if !strings.Contains(w.Body.String(), "downloads") || !strings.Contains(w.Body.String(), "1 235") {
+		t.Errorf("badge %s, want downloads: 1 235", w.Body)
+	}
+}
+
+// flushRecorder records what has been written when each Flush is called.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (w *flushRecorder) Flush() {
+	w.flushed = append(w.flushed, w.Body.String())
+	w.ResponseRecorder.Flush()
+}
+
+func TestStreamedCountBadge(t *testing.T) {
+	stub := newTestBeacon(t, "-enableCounter", "-coalesceWindow=0", "-streamingBadge")
+	counts := newMemoryCounterStore(2)
+	counts.counts["UA-1234-1/page"] = 1232
+	counts.counts["UA-1234-1/big"] = 1234567889
+	counts.pages = 2
+	counterStore = counts
+	stream := func(target string) *flushRecorder {
+		t.Helper()
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		testServer.handler(w, httptest.NewRequest("GET", target, nil))
+		stub.next(t)
+		return w
+	}
+
+	w := stream("/UA-1234-1/page?count&label=downloads")
+	if len(w.flushed) == 0 {
+		t.Fatal("badge not flushed")
+	}
+	first, body := w.flushed[0], w.Body.String()
+	if !strings.Contains(first, "downloads") || strings.Contains(first, "1 233") || strings.Contains(first, "</svg>") {
+		t.Errorf("first chunk %s, want the frame and label without the count", first)
+	}
+	if rest, ok := strings.CutPrefix(body, first); !ok || !strings.Contains(rest, ">1 233</text>") || !strings.HasSuffix(rest, "</svg>") {
+		t.Errorf("badge %s, want the count after the first chunk", body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("Content-Type = %s, want image/svg+xml", ct)
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), new(struct{})); err != nil {
+		t.Errorf("streamed badge is not XML: %v: %s", err, body)
+	}
+
+	// Counts wider than the message box are squeezed into it, and a count
+	// that can't be read shows as "?".
+	if body := stream("/UA-1234-1/big?count").Body.String(); !strings.Contains(body, `lengthAdjust="spacingAndGlyphs">1 234 567 890</text>`) {
+		t.Errorf("badge %s, want 1 234 567 890 squeezed", body)
+	}
+	if body := stream("/UA-1234-1/new?count").Body.String(); !strings.Contains(body, ">?</text>") {
+		t.Errorf("badge %s of a page the full counter can't count, want ?", body)
+	}
+
+	// Writers that cannot flush get the whole regular count badge.
+	rec := httptest.NewRecorder()
+	testServer.handler(struct{ http.ResponseWriter }{rec}, httptest.NewRequest("GET", "/UA-1234-1/page?count", nil))
+	stub.next(t)
+	if want := countBadge(1234, "", "").data; rec.Body.String() != string(want) {
+		t.Errorf("badge %s without a Flusher, want the buffered badge %s", rec.Body, want)
+	}
+}
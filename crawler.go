@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// crawlerUAs holds the lowercase User-Agent substrings of known crawlers.
+	crawlerUAs = parseCrawlerList(embeddedAsset("static/crawlers.txt"))
+
+	// crawlerPattern is the -botRegexp expression, matched in addition to
+	// crawlerUAs. It is nil when the flag is empty.
+	crawlerPattern *regexp.Regexp
+
+	// botHits counts requests from crawlers, whatever -botAction does with
+	// them.
+	botHits atomic.Int64
+)
+
+// validBotAction checks the -botAction value.
+func validBotAction(action string) error {
+	switch action {
+	case "drop", "tag", "count":
+		return nil
+	}
+	return fmt.Errorf("unknown bot action %q (want drop, tag or count)", action)
+}
+
+// parseCrawlerList parses one UA substring per line, skipping blank lines and
+// # comments.
+func parseCrawlerList(data []byte) []string {
+	var list []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, strings.ToLower(line))
+	}
+	return list
+}
+
+// loadCrawlerList replaces the built-in crawler list with the one in path.
+func loadCrawlerList(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	crawlerUAs = parseCrawlerList(data)
+	return nil
+}
+
+// isCrawler reports whether ua belongs to a known crawler or link unfurler,
+// or matches -botRegexp.
+func isCrawler(ua string) bool {
+	if crawlerPattern != nil && crawlerPattern.MatchString(ua) {
+		return true
+	}
+	ua = strings.ToLower(ua)
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	for _, bot := range crawlerUAs {
+		if strings.Contains(ua, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback reports whether host is a loopback IP address.
+func isLoopback(host string) bool {
+	ip := parseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIsCrawler(t *testing.T) {
+	tests := []struct {
+		ua      string
+		crawler bool
+	}{
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; Googlebot/2.1; +http://www.google.com/bot.html) Chrome/120.0.6099.216 Safari/537.36", true},
+		{"Googlebot-Image/1.0", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", true},
+		{"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)", true},
+		{"DuckDuckBot/1.1; (+http://duckduckgo.com/duckduckbot.html)", true},
+		{"Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)", true},
+		{"Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)", true},
+		{"Sogou web spider/4.0(+http://www.sogou.com/docs/help/webmasters.htm#07)", true},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_5) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.1 Safari/605.1.15 (Applebot/0.1; +http://www.apple.com/go/applebot)", true},
+		{"Mozilla/5.0 (compatible; PetalBot;+https://webmaster.petalsearch.com/site/petalbot)", true},
+		{"Mozilla/5.0 (compatible; AhrefsBot/7.0; +http://ahrefs.com/robot/)", true},
+		{"Mozilla/5.0 (compatible; SemrushBot/7~bl; +http://www.semrush.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; MJ12bot/v1.4.8; http://mj12bot.com/)", true},
+		{"Mozilla/5.0 (compatible; DotBot/1.2; +https://opensiteexplorer.org/dotbot; help@moz.com)", true},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", true},
+		{"Twitterbot/1.0", true},
+		{"LinkedInBot/1.0 (compatible; Mozilla/5.0; Apache-HttpClient +http://www.linkedin.com)", true},
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", true},
+		{"Slack-ImgProxy (+https://api.slack.com/robots)", true},
+		{"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)", true},
+		{"TelegramBot (like TwitterBot)", true},
+		{"WhatsApp/2.23.20.0 A", true},
+		{"Mozilla/5.0 (Windows NT 6.1; WOW64) SkypeUriPreview Preview/0.5", true},
+		{"Pinterestbot/1.0 (+http://www.pinterest.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; redditbot/1.0; +http://www.reddit.com/feedback)", true},
+		{"Mozilla/5.0 (compatible; Embedly/0.2; +http://support.embed.ly/)", true},
+
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36", false},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4.1 Safari/605.1.15", false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0", false},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.2478.51", false},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.6367.82 Mobile Safari/537.36", false},
+		// GitHub's image proxy fetches badges for real README visitors.
+		{"github-camo (876de43e)", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isCrawler(tt.ua); got != tt.crawler {
+			t.Errorf("isCrawler(%q) = %v, want %v", tt.ua, got, tt.crawler)
+		}
+	}
+}
+
+func TestCrawlerHitsNotReported(t *testing.T) {
+	const googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	tests := []struct {
+		name     string
+		args     []string
+		ua       string
+		reported bool
+	}{
+		{"browser", nil, "Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0", true},
+		{"crawler", nil, googlebot, false},
+		{"filtering off", []string{"-filterCrawlers=false"}, googlebot, true},
+		{"tagged", []string{"-botAction=tag", "-botDimension=3"}, googlebot, true},
+		{"bot regexp", []string{"-botRegexp=(?i)^curl/"}, "curl/8.5.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			keep(t, &crawlerPattern)
+			if botRegexp != "" {
+				crawlerPattern = regexp.MustCompile(botRegexp)
+			}
+			w := get("/UA-1234-1/page", "User-Agent", tt.ua)
+			if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), badgeImages[""].data) {
+				t.Errorf("status %d, body %.40q..., want the badge served normally", w.Code, w.Body)
+			}
+			if tt.reported {
+				stub.next(t)
+			} else {
+				stub.none(t)
+			}
+		})
+	}
+}
+
+func TestLoadCrawlerList(t *testing.T) {
+	keep(t, &crawlerUAs)
+	path := filepath.Join(t.TempDir(), "bots.txt")
+	os.WriteFile(path, []byte("# in-house monitors\nUptimeChecker\n\n  status-probe  \n"), 0644)
+	if err := loadCrawlerList(path); err != nil {
+		t.Fatal(err)
+	}
+	for ua, want := range map[string]bool{
+		"Mozilla/5.0 (compatible; uptimechecker/1.0)": true,
+		"Status-Probe/2": true,
+		"Mozilla/5.0 (compatible; Googlebot/2.1)": false,
+	} {
+		if got := isCrawler(ua); got != want {
+			t.Errorf("isCrawler(%q) with the file's list = %v, want %v", ua, got, want)
+		}
+	}
+	if err := loadCrawlerList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loadCrawlerList() of a missing file succeeded")
+	}
+}
+
+func TestBotDebugParam(t *testing.T) {
+	tests := []struct {
+		remote string
+		logged bool
+	}{
+		{"127.0.0.1:1234", true},
+		{"[::1]:1234", true},
+		{"192.0.2.1:1234", false},
+	}
+	for _, tt := range tests {
+		newTestBeacon(t)
+		var log bytes.Buffer
+		r := httptest.NewRequest("GET", "/UA-1234-1/page?bot=1", nil)
+		r.RemoteAddr = tt.remote
+		r.Header.Set("User-Agent", "Twitterbot/1.0")
+		newLoggingServer(&log).handler(httptest.NewRecorder(), r)
+		logged := strings.Contains(log.String(), `msg="Bot check"`)
+		if logged != tt.logged {
+			t.Errorf("from %s: bot check logged: %v, want %v", tt.remote, logged, tt.logged)
+		}
+		if tt.logged && !strings.Contains(log.String(), "crawler=true") {
+			t.Errorf("from %s: logged %s, want the crawler verdict", tt.remote, log.String())
+		}
+	}
+}
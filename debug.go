@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxV1PayloadBytes is the largest v1 hit the collector accepts.
+	maxV1PayloadBytes = 8192
+
+	maxGA4Events      = 25
+	maxGA4Params      = 25
+	maxGA4NameLength  = 40
+	maxGA4ValueLength = 100
+)
+
+var (
+	ga4NamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+	// ga4ReservedPrefixes and ga4ReservedNames can't be used as event names.
+	ga4ReservedPrefixes = []string{"_", "firebase_", "ga_", "google_", "gtag."}
+	ga4ReservedNames    = map[string]bool{
+		"ad_activeview": true, "ad_click": true, "ad_exposure": true, "ad_query": true, "ad_reward": true,
+		"adunit_exposure": true, "app_clear_data": true, "app_exception": true, "app_install": true,
+		"app_remove": true, "app_store_refund": true, "app_update": true, "app_upgrade": true,
+		"error": true, "first_open": true, "first_visit": true, "in_app_purchase": true,
+		"notification_dismiss": true, "notification_foreground": true, "notification_open": true,
+		"notification_receive": true, "os_update": true, "session_start": true, "user_engagement": true,
+	}
+
+	// ga4ValueLengths are the GA4 params allowed longer values than
+	// maxGA4ValueLength.
+	ga4ValueLengths = map[string]int{"page_location": 1000, "page_title": 300, "page_referrer": 420}
+)
+
+// debugReport is the body of a /debug/ response: the hit the beacon would
+// report and what is wrong with it, if anything.
+type debugReport struct {
+	*HitResult
+	// NotTracked lists why the hit would not be reported.
+	NotTracked  []string       `json:"not_tracked,omitempty"`
+	Collector   string         `json:"collector"`
+	Protocol    string         `json:"protocol,omitempty"`
+	URL         string         `json:"url,omitempty"`
+	ContentType string         `json:"content_type,omitempty"`
+	Payload     interface{}    `json:"payload,omitempty"`
+	Valid       bool           `json:"valid"`
+	Messages    []debugMessage `json:"messages,omitempty"`
+}
+
+// debugMessage is a problem found with a hit, by the beacon or by GA's
+// validation server.
+type debugMessage struct {
+	Source  string `json:"source"` // beacon or ga
+	Level   string `json:"level"`  // error, warning or info
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// DebugEncoder serves the debugReport of a /debug/ request as JSON.
+type DebugEncoder struct{}
+
+func (DebugEncoder) EncodeResponse(w http.ResponseWriter, result *HitResult) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result.debug)
+}
+
+// debugHandler serves /debug/<account>/<page>, which takes the same query
+// and headers as a beacon. It builds the hit the beacon would report and
+// answers with it as JSON, checked against the Measurement Protocol rules
+// and, unless -dryRun is set, by GA's validation server. Nothing is
+// recorded: the hit is neither reported nor counted.
+func (s *server) debugHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/debug/"), "/")
+	if !strings.Contains(path, "/") {
+		http.Error(w, "want /debug/<account>/<page>", http.StatusNotFound)
+		return
+	}
+	beacon := r.Clone(r.Context())
+	beacon.URL.Path = "/" + path
+	beacon.URL.RawPath = ""
+	s.serveBeacon(w, beacon, DebugEncoder{}, "/debug")
+}
+
+// newDebugReport describes job, which would not be reported for the reasons
+// in skipped that are true.
+func newDebugReport(ctx context.Context, result *HitResult, job hitJob, skipped map[string]bool) *debugReport {
+	report := &debugReport{
+		HitResult: result,
+		Collector: collectorNameFor(job.params[0]),
+	}
+	for reason, skip := range skipped {
+		if skip {
+			report.NotTracked = append(report.NotTracked, reason)
+		}
+	}
+	sort.Strings(report.NotTracked)
+
+	if report.Collector != "ga" {
+		report.Messages = append(report.Messages, debugMessage{"beacon", "info", "",
+			fmt.Sprintf("payloads are only shown for the ga collector, not %s", report.Collector)})
+		report.Valid = true
+		return report
+	}
+	protocol := selectProtocol(job.params[0], gaProtocol)
+	report.Protocol = string(protocol)
+	payload, err := payloadBuilders[protocol].Build(job)
+	if err != nil {
+		report.Messages = append(report.Messages, debugMessage{"beacon", "error", "", err.Error()})
+		return report
+	}
+	report.URL = redactSecret(payload.url)
+	report.ContentType = payload.contentType
+
+	if protocol == ProtocolV1 {
+		values, _ := url.ParseQuery(payload.body)
+		fields := map[string]string{}
+		for key := range values {
+			fields[key] = values.Get(key)
+		}
+		report.Payload = fields
+		report.Messages = append(report.Messages, validateV1Payload(values, len(payload.body))...)
+	} else {
+		report.Payload = json.RawMessage(payload.body)
+		report.Messages = append(report.Messages, validateGA4Payload([]byte(payload.body))...)
+	}
+
+	if dryRun {
+		report.Messages = append(report.Messages, debugMessage{"beacon", "info", "", "dry run, not asking GA's validation server"})
+	} else {
+		report.Messages = append(report.Messages, validateWithGA(ctx, protocol, payload)...)
+	}
+
+	report.Valid = true
+	for _, m := range report.Messages {
+		if m.Level == "error" {
+			report.Valid = false
+		}
+	}
+	return report
+}
+
+// redactSecret hides the api_secret param of a GA4 collector URL.
+func redactSecret(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	if query.Get("api_secret") == "" {
+		return rawURL
+	}
+	query.Set("api_secret", "REDACTED")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactURLError hides the api_secret in the URL of the *url.Error err
+// wraps, as http.Client returns, so that err can be logged.
+func redactURLError(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		uerr.URL = redactSecret(uerr.URL)
+	}
+	return err
+}
+
+// validateV1Payload checks a v1 hit against the Measurement Protocol
+// parameter reference.
+//
+// GA Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/v1/parameters
+func validateV1Payload(payload url.Values, size int) []debugMessage {
+	var messages []debugMessage
+	fail := func(field, format string, args ...interface{}) {
+		messages = append(messages, debugMessage{"beacon", "error", field, fmt.Sprintf(format, args...)})
+	}
+
+	for _, field := range []string{"v", "tid", "t"} {
+		if payload.Get(field) == "" {
+			fail(field, "missing required field %s", field)
+		}
+	}
+	if payload.Get("cid") == "" && payload.Get("uid") == "" {
+		fail("cid", "one of cid or uid is required")
+	}
+	for _, field := range hitRequiredFields[payload.Get("t")] {
+		if payload.Get(field) == "" {
+			fail(field, "%s hits require %s", payload.Get("t"), field)
+		}
+	}
+	if size > maxV1PayloadBytes {
+		fail("", "payload is %d bytes, more than the %d the collector accepts", size, maxV1PayloadBytes)
+	}
+
+	keys := make([]string, 0, len(payload))
+	for key := range payload {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := payload.Get(key)
+		if validate, ok := paramValidators[key]; ok {
+			if err := validate(value); err != nil {
+				fail(key, "%v", err)
+			}
+			continue
+		}
+		switch {
+		case key == "ev" || key == "utt":
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				fail(key, "%s must be a non-negative integer, got %s", key, strconv.Quote(value))
+			}
+		case strings.HasPrefix(key, "cd") && isIndex(key[2:]):
+			if len(value) > maxDimensionLength {
+				fail(key, "custom dimension longer than %d bytes", maxDimensionLength)
+			}
+		case strings.HasPrefix(key, "cm") && isIndex(key[2:]):
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				fail(key, "custom metric must be a number, got %s", strconv.Quote(value))
+			}
+		}
+	}
+	return messages
+}
+
+// isIndex reports whether s is a custom dimension or metric index, 1 to 200.
+func isIndex(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 1 && n <= 200 && strconv.Itoa(n) == s
+}
+
+// validateGA4Payload checks a GA4 hit against the Measurement Protocol
+// limits on events and their params.
+//
+// GA4 Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/ga4/sending-events#limitations
+func validateGA4Payload(body []byte) []debugMessage {
+	var messages []debugMessage
+	fail := func(field, format string, args ...interface{}) {
+		messages = append(messages, debugMessage{"beacon", "error", field, fmt.Sprintf(format, args...)})
+	}
+
+	var hit struct {
+		ClientID string `json:"client_id"`
+		Events   []struct {
+			Name   string                 `json:"name"`
+			Params map[string]interface{} `json:"params"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(body, &hit); err != nil {
+		fail("", "invalid JSON: %v", err)
+		return messages
+	}
+	if hit.ClientID == "" {
+		fail("client_id", "missing required field client_id")
+	}
+	if len(hit.Events) == 0 || len(hit.Events) > maxGA4Events {
+		fail("events", "want 1 to %d events, got %d", maxGA4Events, len(hit.Events))
+	}
+	for i, event := range hit.Events {
+		field := fmt.Sprintf("events[%d].name", i)
+		if err := validGA4Name(event.Name); err != nil {
+			fail(field, "event name: %v", err)
+		} else if ga4ReservedNames[event.Name] {
+			fail(field, "event name %s is reserved", strconv.Quote(event.Name))
+		}
+		for _, prefix := range ga4ReservedPrefixes {
+			if strings.HasPrefix(event.Name, prefix) {
+				fail(field, "event names can't start with %s", prefix)
+			}
+		}
+		if len(event.Params) > maxGA4Params {
+			fail(fmt.Sprintf("events[%d].params", i), "more than %d params", maxGA4Params)
+		}
+		for name, value := range event.Params {
+			field := fmt.Sprintf("events[%d].params.%s", i, name)
+			if err := validGA4Name(name); err != nil {
+				fail(field, "param name: %v", err)
+			}
+			max, ok := ga4ValueLengths[name]
+			if !ok {
+				max = maxGA4ValueLength
+			}
+			if s, ok := value.(string); ok && len([]rune(s)) > max {
+				fail(field, "value longer than %d characters", max)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].Field < messages[j].Field })
+	return messages
+}
+
+// validGA4Name checks the name of a GA4 event or param.
+func validGA4Name(name string) error {
+	if len(name) > maxGA4NameLength {
+		return fmt.Errorf("longer than %d characters", maxGA4NameLength)
+	}
+	if !ga4NamePattern.MatchString(name) {
+		return fmt.Errorf("%s must start with a letter and only contain letters, digits and underscores", strconv.Quote(name))
+	}
+	return nil
+}
+
+// validateWithGA sends payload to GA's validation server, which checks hits
+// without recording them, and returns what it found.
+//
+// v1 reference: https://developers.google.com/analytics/devguides/collection/protocol/v1/validating-hits
+// GA4 reference: https://developers.google.com/analytics/devguides/collection/protocol/ga4/validating-events
+func validateWithGA(ctx context.Context, protocol ProtocolVersion, payload gaRequest) []debugMessage {
+	debugURL := strings.Replace(payload.url, "/collect", "/debug/collect", 1)
+	if protocol == ProtocolGA4 {
+		debugURL = strings.Replace(payload.url, "/mp/collect", "/debug/mp/collect", 1)
+	}
+	unreachable := func(err error) []debugMessage {
+		return []debugMessage{{"beacon", "warning", "", fmt.Sprintf("cannot ask GA's validation server: %v", err)}}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", debugURL, strings.NewReader(payload.body))
+	if err != nil {
+		return unreachable(err)
+	}
+	req.Header.Set("Content-Type", payload.contentType)
+	resp, err := gaClient.Do(req)
+	if err != nil {
+		return unreachable(redactURLError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return unreachable(fmt.Errorf("%s returned %s", redactSecret(debugURL), resp.Status))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return unreachable(err)
+	}
+
+	var messages []debugMessage
+	if protocol == ProtocolGA4 {
+		var result struct {
+			ValidationMessages []struct {
+				FieldPath      string `json:"fieldPath"`
+				Description    string `json:"description"`
+				ValidationCode string `json:"validationCode"`
+			} `json:"validationMessages"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return unreachable(fmt.Errorf("cannot decode answer: %v", err))
+		}
+		for _, m := range result.ValidationMessages {
+			messages = append(messages, debugMessage{"ga", "error", m.FieldPath, m.Description})
+		}
+		return messages
+	}
+
+	var result struct {
+		HitParsingResult []struct {
+			ParserMessage []struct {
+				MessageType string `json:"messageType"`
+				Description string `json:"description"`
+				Parameter   string `json:"parameter"`
+			} `json:"parserMessage"`
+		} `json:"hitParsingResult"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return unreachable(fmt.Errorf("cannot decode answer: %v", err))
+	}
+	for _, hit := range result.HitParsingResult {
+		for _, m := range hit.ParserMessage {
+			level := strings.ToLower(m.MessageType)
+			if level == "warn" {
+				level = "warning"
+			}
+			messages = append(messages, debugMessage{"ga", level, m.Parameter, m.Description})
+		}
+	}
+	return messages
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxDimensionLength is the most bytes GA keeps of a custom dimension value.
+const maxDimensionLength = 150
+
+// customFieldPattern matches the custom dimension and metric fields,
+// cd1..cd200 and cm1..cm200.
+var customFieldPattern = regexp.MustCompile(`^c[dm]([1-9][0-9]?|1[0-9][0-9]|200)$`)
+
+// customFieldMapping fills a custom dimension or metric from a part of the
+// beacon request.
+type customFieldMapping struct {
+	field  string // cd<n> or cm<n>
+	source string // header, query or path
+	key    string // the header or query param name, or the path segment
+	index  int    // 1-based, for source path
+}
+
+// customFieldMappings are the -customFields mappings, in flag order.
+var customFieldMappings []customFieldMapping
+
+// parseCustomFieldMappings parses -customFields: comma-separated
+// field=source:key pairs such as cd1=header:X-Team, cd2=path:2 or
+// cm1=query:price. Path segments count from 1 and are those of the page
+// path, after the account.
+func parseCustomFieldMappings(s string) ([]customFieldMapping, error) {
+	var mappings []customFieldMapping
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		field, spec, ok := strings.Cut(pair, "=")
+		source, key, ok2 := strings.Cut(spec, ":")
+		if !ok || !ok2 || key == "" {
+			return nil, fmt.Errorf("malformed mapping %q, want field=source:key", pair)
+		}
+		if !customFieldPattern.MatchString(field) {
+			return nil, fmt.Errorf("%s: not a custom dimension or metric (cd1..cd200, cm1..cm200)", field)
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("%s is mapped twice", field)
+		}
+		seen[field] = true
+
+		m := customFieldMapping{field: field, source: source, key: key}
+		switch source {
+		case "header":
+			m.key = http.CanonicalHeaderKey(key)
+		case "query":
+		case "path":
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s: path segment must be a number from 1, not %q", field, key)
+			}
+			m.index = n
+		default:
+			return nil, fmt.Errorf("%s: unknown source %q (want header, query or path)", field, source)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// customFieldValues extracts the -customFields values from the beacon request
+// r for page. Missing values are left out, as are metrics that are not
+// numbers; dimensions are cut to what GA keeps.
+func customFieldValues(logger *slog.Logger, r *http.Request, page string) map[string]string {
+	if len(customFieldMappings) == 0 {
+		return nil
+	}
+	query := r.URL.Query()
+	values := map[string]string{}
+	for _, m := range customFieldMappings {
+		var value string
+		switch m.source {
+		case "header":
+			value = r.Header.Get(m.key)
+		case "query":
+			value = query.Get(m.key)
+		case "path":
+			value = pathSegment(page, m.index)
+		}
+		if value == "" {
+			continue
+		}
+		if strings.HasPrefix(m.field, "cm") {
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				logger.Debug("Not reporting non-numeric custom metric", "field", m.field, "value", value)
+				continue
+			}
+		} else if len(value) > maxDimensionLength {
+			value = truncateUTF8(value, maxDimensionLength)
+		}
+		values[m.field] = value
+	}
+	return values
+}
+
+// pathSegment returns the nth segment of page, counting from 1, or "" if it
+// has fewer.
+func pathSegment(page string, n int) string {
+	segments := strings.Split(strings.Trim(page, "/"), "/")
+	if n < 1 || n > len(segments) {
+		return ""
+	}
+	return segments[n-1]
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && s[n]&0xc0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseCustomFieldMappings(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []customFieldMapping
+		err  string
+	}{
+		{"", nil, ""},
+		{"cd1=header:x-team, cd2=path:2,,cm200=query:price", []customFieldMapping{
+			{field: "cd1", source: "header", key: "X-Team"},
+			{field: "cd2", source: "path", key: "2", index: 2},
+			{field: "cm200", source: "query", key: "price"},
+		}, ""},
+		{"cd1", nil, `malformed mapping "cd1"`},
+		{"cd1=header", nil, `malformed mapping "cd1=header"`},
+		{"cd1=header:", nil, `malformed mapping "cd1=header:"`},
+		{"cd0=query:x", nil, "cd0: not a custom dimension or metric"},
+		{"cd201=query:x", nil, "cd201: not a custom dimension or metric"},
+		{"cd01=query:x", nil, "cd01: not a custom dimension or metric"},
+		{"dp=query:x", nil, "dp: not a custom dimension or metric"},
+		{"cd1=query:x,cd1=header:X-Team", nil, "cd1 is mapped twice"},
+		{"cd1=path:0", nil, `cd1: path segment must be a number from 1, not "0"`},
+		{"cd1=path:first", nil, `cd1: path segment must be a number from 1, not "first"`},
+		{"cd1=cookie:team", nil, `cd1: unknown source "cookie"`},
+	}
+	for _, tt := range tests {
+		got, err := parseCustomFieldMappings(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseCustomFieldMappings(%q) = %v, want an error with %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCustomFieldMappings(%q): %v", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCustomFieldMappings(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCustomFieldValues(t *testing.T) {
+	long := strings.Repeat("é", 100) // 200 bytes
+	tests := []struct {
+		name    string
+		fields  string
+		target  string
+		header  []string
+		page    string
+		want    map[string]string
+		wantNil bool
+	}{
+		{"none", "", "/UA-1234-1/docs", nil, "docs", nil, true},
+		{"header", "cd1=header:X-Team", "/UA-1234-1/docs", []string{"X-Team", "docs-team"}, "docs", map[string]string{"cd1": "docs-team"}, false},
+		{"query", "cd3=query:lang", "/UA-1234-1/docs?lang=go", nil, "docs", map[string]string{"cd3": "go"}, false},
+		{"path", "cd2=path:2", "/UA-1234-1/docs/intro/setup", nil, "docs/intro/setup", map[string]string{"cd2": "intro"}, false},
+		{"missing", "cd1=header:X-Team,cd2=path:4,cd3=query:lang", "/UA-1234-1/docs", nil, "docs", map[string]string{}, false},
+		{"metric", "cm1=query:price", "/UA-1234-1/docs?price=9.99", nil, "docs", map[string]string{"cm1": "9.99"}, false},
+		{"non-numeric metric", "cm1=query:price,cd1=query:price", "/UA-1234-1/docs?price=free", nil, "docs", map[string]string{"cd1": "free"}, false},
+		{"long dimension", "cd1=header:X-Team", "/UA-1234-1/docs", []string{"X-Team", long}, "docs", map[string]string{"cd1": long[:150]}, false},
+		{"long metric", "cm1=query:n", "/UA-1234-1/docs?n=1" + strings.Repeat("0", 160), nil, "docs", map[string]string{"cm1": "1" + strings.Repeat("0", 160)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &customFieldMappings)
+			var err error
+			if customFieldMappings, err = parseCustomFieldMappings(tt.fields); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", tt.target, nil)
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			got := customFieldValues(testServer.logger, r, tt.page)
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("customFieldValues() = %v, want nil", got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("customFieldValues() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"docs", 150, "docs"},
+		{"docs", 4, "docs"},
+		{"docs", 2, "do"},
+		{"héllo", 2, "h"},  // é is 2 bytes
+		{"héllo", 3, "hé"}, // cut right after it
+		{"日本語", 4, "日"},    // 3-byte runes
+		{"日本語", 2, ""},
+		{"🚀x", 3, ""}, // a 4-byte rune
+		{"🚀x", 4, "🚀"},
+		{"", 0, ""},
+	}
+	for _, tt := range tests {
+		got := truncateUTF8(tt.s, tt.n)
+		if got != tt.want || len(got) > tt.n || !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+	// At the 150 bytes GA keeps, a multi-byte rune straddling the limit is
+	// dropped whole.
+	s := strings.Repeat("a", 149) + "é"
+	if got := truncateUTF8(s, maxDimensionLength); got != strings.Repeat("a", 149) {
+		t.Errorf("truncateUTF8() = %d bytes, want the 149 before é", len(got))
+	}
+}
+
+func TestCustomFieldHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	keep(t, &customFieldMappings)
+	var err error
+	if customFieldMappings, err = parseCustomFieldMappings("cd1=header:X-Team,cd2=path:1,cm1=query:price"); err != nil {
+		t.Fatal(err)
+	}
+
+	get("/UA-1234-1/docs/intro?price=free", "X-Team", "docs")
+	form := stub.next(t).form()
+	if form.Get("cd1") != "docs" || form.Get("cd2") != "docs" || form.Has("cm1") {
+		t.Errorf("hit = %s, want cd1 and cd2 reported and the non-numeric cm1 dropped", form.Encode())
+	}
+}
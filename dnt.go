@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// dntSuppressedHits counts hits not reported because of -respectDNT.
+var dntSuppressedHits atomic.Int64
+
+// optedOut reports whether r carries DNT: 1 or Sec-GPC: 1 and -respectDNT is
+// set, in which case its hit must not be reported.
+func optedOut(r *http.Request) bool {
+	if !respectDNT {
+		return false
+	}
+	if strings.TrimSpace(r.Header.Get("DNT")) != "1" && strings.TrimSpace(r.Header.Get("Sec-GPC")) != "1" {
+		return false
+	}
+	dntSuppressedHits.Add(1)
+	return true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// HitResult describes the outcome of a beacon request.
+type HitResult struct {
+	Tracked bool   `json:"tracked"`
+	CID     string `json:"cid"`
+	Account string `json:"account"`
+	Page    string `json:"page"`
+	// GAStatus is the collector's status code. Hits are reported
+	// asynchronously, so it is only known for hits reported inline.
+	GAStatus int    `json:"ga_status,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	image badgeImage
+	debug *debugReport // for DebugEncoder
+}
+
+// ResponseEncoder writes the response to a beacon request.
+type ResponseEncoder interface {
+	EncodeResponse(w http.ResponseWriter, result *HitResult) error
+}
+
+// responseEncoders maps the names accepted by ?enc= and
+// -defaultResponseEncoding to their encoders.
+var responseEncoders = map[string]ResponseEncoder{
+	"image": ImageEncoder{},
+	"json":  JSONEncoder{},
+	"empty": EmptyEncoder{},
+}
+
+// ImageEncoder serves the badge or pixel selected for the request.
+type ImageEncoder struct{}
+
+func (ImageEncoder) EncodeResponse(w http.ResponseWriter, result *HitResult) error {
+	w.Header().Set("Content-Type", result.image.contentType)
+	_, err := w.Write(result.image.data)
+	return err
+}
+
+// JSONEncoder serves the HitResult as JSON.
+type JSONEncoder struct{}
+
+func (JSONEncoder) EncodeResponse(w http.ResponseWriter, result *HitResult) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// EmptyEncoder answers with 204 No Content.
+type EmptyEncoder struct{}
+
+func (EmptyEncoder) EncodeResponse(w http.ResponseWriter, result *HitResult) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// responseEncoderFor returns the encoder selected by ?enc=, if allowed, or
+// the default one.
+func responseEncoderFor(query url.Values) (ResponseEncoder, error) {
+	name := defaultResponseEncoding
+	if allowEncParam && query.Get("enc") != "" {
+		name = query.Get("enc")
+	}
+	enc, ok := responseEncoders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown response encoding %q", name)
+	}
+	return enc, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseEncoders(t *testing.T) {
+	result := &HitResult{Tracked: true, CID: "cid-1", Account: "UA-1234-1", Page: "page", image: badgeImages[""]}
+	tests := []struct {
+		name        string
+		encoder     ResponseEncoder
+		status      int
+		contentType string
+		body        string
+	}{
+		{"image", ImageEncoder{}, http.StatusOK, "image/svg+xml", string(badgeImages[""].data)},
+		{"json", JSONEncoder{}, http.StatusOK, "application/json", `{"tracked":true,"cid":"cid-1","account":"UA-1234-1","page":"page"}` + "\n"},
+		{"empty", EmptyEncoder{}, http.StatusNoContent, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if err := tt.encoder.EncodeResponse(w, result); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status || w.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: status %d, Content-Type %q, want %d, %q", tt.name, w.Code, w.Header().Get("Content-Type"), tt.status, tt.contentType)
+		}
+		if w.Body.String() != tt.body {
+			t.Errorf("%s: body = %.60q, want %.60q", tt.name, w.Body, tt.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	JSONEncoder{}.EncodeResponse(w, &HitResult{Account: "UA-1234-1", Page: "page", GAStatus: 502, Error: "hit queue is full"})
+	if want := `{"tracked":false,"cid":"","account":"UA-1234-1","page":"page","ga_status":502,"error":"hit queue is full"}` + "\n"; w.Body.String() != want {
+		t.Errorf("failed hit encoded as %s, want %s", w.Body, want)
+	}
+}
+
+func TestResponseEncoding(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		target      string
+		status      int
+		contentType string
+	}{
+		{"default", nil, "/UA-1234-1/page", http.StatusOK, "image/svg+xml"},
+		{"json by default", []string{"-defaultResponseEncoding=json"}, "/UA-1234-1/page", http.StatusOK, "application/json"},
+		{"empty by default", []string{"-defaultResponseEncoding=empty"}, "/UA-1234-1/page", http.StatusNoContent, ""},
+		{"param not allowed", nil, "/UA-1234-1/page?enc=json", http.StatusOK, "image/svg+xml"},
+		{"json param", []string{"-allowEncParam"}, "/UA-1234-1/page?enc=json", http.StatusOK, "application/json"},
+		{"empty param", []string{"-allowEncParam"}, "/UA-1234-1/page?enc=empty", http.StatusNoContent, ""},
+		{"image param", []string{"-allowEncParam", "-defaultResponseEncoding=json"}, "/UA-1234-1/page?enc=image", http.StatusOK, "image/svg+xml"},
+		{"unknown param", []string{"-allowEncParam"}, "/UA-1234-1/page?enc=xml", http.StatusBadRequest, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			w := get(tt.target)
+			if w.Code != tt.status || w.Header().Get("Content-Type") != tt.contentType {
+				t.Fatalf("status %d, Content-Type %q, want %d, %q", w.Code, w.Header().Get("Content-Type"), tt.status, tt.contentType)
+			}
+			switch tt.contentType {
+			case "application/json":
+				var result HitResult
+				if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+					t.Fatal(err)
+				}
+				if !result.Tracked || result.CID == "" || result.Account != "UA-1234-1" || result.Page != "page" {
+					t.Errorf("result = %+v, want a tracked hit of UA-1234-1/page", result)
+				}
+			case "image/svg+xml":
+				if !bytes.HasPrefix(w.Body.Bytes(), []byte("<svg")) {
+					t.Errorf("body = %.40q..., want the badge", w.Body)
+				}
+			case "":
+				if w.Body.Len() != 0 {
+					t.Errorf("body = %q, want none", w.Body)
+				}
+			}
+			if tt.status == http.StatusBadRequest {
+				stub.none(t)
+			} else if hit := stub.next(t).form(); hit.Get("dp") != "page" {
+				t.Errorf("hit = %v, want it reported whatever the encoding", hit)
+			}
+		})
+	}
+}
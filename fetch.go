@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxConcurrentFetches bounds the thumbnails and icons fetched at once.
+	// Requests finding no free slot get the plain badge.
+	maxConcurrentFetches = 8
+	maxFetchRedirects    = 5
+)
+
+var (
+	fetchSlots = make(chan struct{}, maxConcurrentFetches)
+
+	errTooManyFetches = errors.New("too many fetches in flight")
+
+	// fetchClient fetches the pages, thumbnails and icons named by visitors'
+	// requests. It only connects to public addresses, checked after DNS
+	// resolution so that no host name can lead it to the beacon's own
+	// network, follows only https redirects, and bypasses HTTPS_PROXY so the
+	// check applies to the real destination.
+	fetchClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: publicAddressOnly,
+			}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %q is not https", req.URL)
+			}
+			return nil
+		},
+	}
+
+	// sharedAddressSpace is 100.64.0.0/10, used for carrier-grade NAT and by
+	// some clouds for internal services.
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// publicAddressOnly is a net.Dialer Control hook refusing connections to
+// loopback, private, link-local (which holds cloud metadata services),
+// shared, multicast and unspecified addresses.
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", ip)
+	}
+	return nil
+}
+
+// fetchLimited GETs rawURL with fetchClient and returns its body, failing if
+// it is larger than limit bytes or if maxConcurrentFetches are in flight.
+func fetchLimited(ctx context.Context, rawURL string, limit int64) ([]byte, string, error) {
+	select {
+	case fetchSlots <- struct{}{}:
+		defer func() { <-fetchSlots }()
+	default:
+		return nil, "", errTooManyFetches
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned %s", rawURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > limit {
+		return nil, "", fmt.Errorf("%s is larger than %d bytes", rawURL, limit)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
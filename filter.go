@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+
+	"github.com/google/cel-go/cel"
+)
+
+// hitFilter is the compiled -hitFilterExpr program, or nil if hits are never
+// filtered.
+var hitFilter cel.Program
+
+// compileHitFilter compiles a CEL expression over the ip, ua, path, account
+// and hit_type variables. The expression must evaluate to a bool.
+func compileHitFilter(expr string) (cel.Program, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("ip", cel.StringType),
+		cel.Variable("ua", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("account", cel.StringType),
+		cel.Variable("hit_type", cel.StringType),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, iss := env.Compile(expr)
+	if iss != nil && iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if !reflect.DeepEqual(ast.OutputType(), cel.BoolType) {
+		return nil, fmt.Errorf("hit filter must evaluate to bool, got %v", ast.OutputType())
+	}
+	return env.Program(ast)
+}
+
+// filterHit reports whether the hit matches the hit filter and should not be
+// reported to GA. Evaluation errors let the hit through.
+func filterHit(logger *slog.Logger, ip, ua, path, account, hitType string) bool {
+	if hitFilter == nil {
+		return false
+	}
+
+	out, _, err := hitFilter.Eval(map[string]interface{}{
+		"ip":       ip,
+		"ua":       ua,
+		"path":     path,
+		"account":  account,
+		"hit_type": hitType,
+	})
+	if err != nil {
+		logger.Error("Cannot evaluate hit filter", "err", err)
+		return false
+	}
+	drop, _ := out.Value().(bool)
+	return drop
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFilterHit(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		ip   string
+		ua   string
+		want bool
+	}{
+		{"ua match", `ua.contains("monitor")`, "192.0.2.1", "uptime-monitor/1.0", true},
+		{"ua no match", `ua.contains("monitor")`, "192.0.2.1", "Mozilla/5.0", false},
+		{"ip prefix match", `ip.startsWith("10.")`, "10.1.2.3", "Mozilla/5.0", true},
+		{"ip prefix no match", `ip.startsWith("10.")`, "192.0.2.1", "Mozilla/5.0", false},
+		{"either", `ua.contains("monitor") || ip.startsWith("10.")`, "10.1.2.3", "Mozilla/5.0", true},
+		{"both", `ua.contains("monitor") && ip.startsWith("10.")`, "10.1.2.3", "Mozilla/5.0", false},
+		{"path and account", `account == "UA-1234-1" && path.startsWith("internal/")`, "192.0.2.1", "Mozilla/5.0", true},
+		{"hit type", `hit_type == "event"`, "192.0.2.1", "Mozilla/5.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &hitFilter)
+			var err error
+			if hitFilter, err = compileHitFilter(tt.expr); err != nil {
+				t.Fatalf("compileHitFilter(%q): %v", tt.expr, err)
+			}
+			if got := filterHit(testServer.logger, tt.ip, tt.ua, "internal/page", "UA-1234-1", "pageview"); got != tt.want {
+				t.Errorf("filterHit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileHitFilterInvalid(t *testing.T) {
+	for _, expr := range []string{
+		`ua.contains("bot"`,
+		`referer.contains("x")`,
+		`ua`,
+		`ua && ip`,
+	} {
+		if _, err := compileHitFilter(expr); err == nil {
+			t.Errorf("compileHitFilter(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestHitFilterDropsHit(t *testing.T) {
+	stub := newTestBeacon(t)
+	keep(t, &hitFilter)
+	var err error
+	if hitFilter, err = compileHitFilter(`ua.contains("monitor")`); err != nil {
+		t.Fatal(err)
+	}
+
+	w := get("/UA-1234-1/page", "User-Agent", "uptime-monitor/1.0")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("filtered hit got %d %q, want the badge", w.Code, w.Header().Get("Content-Type"))
+	}
+	stub.none(t)
+
+	get("/UA-1234-1/page", "User-Agent", "Mozilla/5.0")
+	stub.next(t)
+}
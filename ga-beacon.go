@@ -2,167 +2,1178 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"html/template"
-	"io/ioutil"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
-	l "github.com/op/go-logging"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-const beaconURL = "http://www.google-analytics.com/collect"
+const (
+	maxResponseDelay = 30 * time.Second
+
+	maxCorrelationIDLength = 36
+	defaultRedirectURL     = "https://github.com/irvinlim/ga-beacon"
+)
 
 var (
-	pixel        = mustReadFile("static/pixel.gif")
-	badge        = mustReadFile("static/badge.svg")
-	badgeGif     = mustReadFile("static/badge.gif")
-	badgeFlat    = mustReadFile("static/badge-flat.svg")
-	badgeFlatGif = mustReadFile("static/badge-flat.gif")
-	pageTemplate = template.Must(template.New("page").ParseFiles("page.html"))
-	logger       = l.Logger{}
-
-	listenAddr string
-	listenPort int
+	pixel        = embeddedAssetOr("static/pixel.gif", fallbackPixel)
+	badge        = embeddedAsset("static/badge.svg")
+	badgeGif     = embeddedAsset("static/badge.gif")
+	badgeFlat    = embeddedAsset("static/badge-flat.svg")
+	badgeFlatGif = embeddedAsset("static/badge-flat.gif")
+	pageTemplate = embeddedPageTemplate()
+
+	// Query params that only select the badge style. Responses to requests
+	// carrying nothing else are safe to keep in shared caches.
+	cacheableQueryParams = map[string]bool{
+		"pixel":       true,
+		"gif":         true,
+		"flat":        true,
+		"flat-gif":    true,
+		"label":       true,
+		"color":       true,
+		"message":     true,
+		"icon":        true,
+		"icon-width":  true,
+		"icon-height": true,
+		"sig":         true,
+	}
+
+	listenAddr      string
+	listenPort      int
+	listenUnix      string
+	listenUnixMode  string
+	responseDelay   time.Duration
+	allowDelayParam bool
+
+	gaWorkers             int
+	gaQueueDepth          int
+	backpressureThreshold float64
+	backpressureDelay     time.Duration
+	maxConnsPerIP         int
+	exemptIPs             string
+	dropPolicy            string
+	highPriorityAccounts  string
+	allowPriorityParam    bool
+
+	correlationIDDimension  int
+	gaAnonymizeIP           bool
+	omitClientIP            bool
+	respectDNT              bool
+	forwardParams           string
+	accountIPModeList       string
+	sampleRate              float64
+	accountSampleRateList   string
+	sampleWeightMetric      int
+	hitFilterExpr           string
+	gaTimeout               time.Duration
+	gaMaxIdleConns          int
+	gaMaxConns              int
+	gaBudget                time.Duration
+	collectorTimeout        time.Duration
+	gaMaxAttempts           int
+	breakerThreshold        int
+	breakerCooldown         time.Duration
+	gaBatch                 bool
+	batchInterval           time.Duration
+	gaEndpoint              string
+	collectorURL            string
+	collectorRegion         string
+	dryRun                  bool
+	defaultCollector        string
+	mirrorList              string
+	hitStoreBackend         string
+	sqlitePath              string
+	clickhouseURL           string
+	clickhouseTable         string
+	statsToken              string
+	mirrorToken             string
+	mirrorTimeout           time.Duration
+	accountCollectors       string
+	matomoURL               string
+	accountBadgeList        string
+	accountDefaultPageList  string
+	matomoToken             string
+	fanoutList              string
+	plausibleURL            string
+	enableCounter           bool
+	streamingBadge          bool
+	counterBackend          string
+	redisAddr               string
+	counterFile             string
+	counterMaxKeys          int
+	counterRetention        time.Duration
+	enableUnique            bool
+	enableGSCPing           bool
+	gscPingURL              string
+	uniqueMaxKeys           int
+	spoolFile               string
+	spoolMaxSize            int64
+	spoolMaxAge             time.Duration
+	gaHTTP2                 bool
+	enableScriptBeacon      bool
+	negotiateFormat         bool
+	inferHitSource          bool
+	normalizeCase           string
+	noTrailingSlash         bool
+	pathRewriteFile         string
+	geoipDB                 string
+	reportGeoID             bool
+	geoCountryDimension     int
+	geoRegionDimension      int
+	geoCityDimension        int
+	blockCountries          string
+	allowCountries          string
+	runSelfTest             selfTestMode = "true"
+	skipSelfTest            bool
+	enableThumbnails        bool
+	enableDebugEndpoint     bool
+	thumbnailCacheDir       string
+	thumbnailCacheTTL       time.Duration
+	maxPathDepth            int
+	minPathDepth            int
+	metricsToken            string
+	signingKey              string
+	adminToken              string
+	badgeCacheSeconds       int
+	badgeLabelSegment       int
+	overrideBadgeDir        string
+	staticDir               string
+	skipIntegrityCheck      bool
+	disabledBadgeVariant    string
+	accessLog               bool
+	accessLogFormat         string
+	accessLogFile           string
+	accessLogMaxMB          int64
+	accessLogMaxFiles       int
+	securityHeaders         bool
+	gzipResponses           bool
+	gaProtocolFlag          string
+	iconAllowlist           string
+	allowEncParam           bool
+	defaultResponseEncoding string
+	trustProxy              bool
+	trustedProxies          string
+	filterCrawlers          bool
+	botUAFile               string
+	botRegexp               string
+	botAction               string
+	botDimension            int
+	parseUserAgent          bool
+	browserDimension        int
+	osDimension             int
+	deviceDimension         int
+	defaultDataSource       string
+	customFieldList         string
+	rateLimitRPS            float64
+	rateLimitBurst          int
+	ipv6PrefixLength        int
+	accountRateLimitRPS     float64
+	accountRateLimitBurst   int
+	rateLimitAction         string
+	tlsCert                 string
+	tlsKey                  string
+	tlsAutoDomain           string
+	redirectURL             string
+	corsOrigins             string
+	strictPostValidation    bool
+	insecureCookie          bool
+	cookieName              string
+	cookieMaxAge            time.Duration
+	cookieSameSite          string
+	cookieSecure            bool
+	cookieDomain            string
+	cookieless              bool
+	printConfigAndExit      bool
+	configFile              string
+	validateAndExit         bool
+	logLevel                string
+	logFormat               string
+	tlsCacheDir             string
+	certWarnDays            int
+	certCriticalDays        int
+	certWebhookURL          string
+	gaProtocol              ProtocolVersion
+	ga4APISecret            string
+	ga4DedupeWindow         time.Duration
+	cidEntropy              string
+	allowHeaderParams       bool
+	forwardRequestHeaders   bool
+	coalesceWindow          time.Duration
+	coalesceMaxEntries      int
+
+	allowedIDs               string
+	allowedAccountsURL       string
+	allowlistRefreshInterval time.Duration
+	tenantsFile              string
+
+	otlpEndpoint    string
+	otlpHeaders     string
+	otlpServiceName string
+	otlpSampleRatio float64
+	otlpLogHits     bool
+
+	hitWorkers   *hitWorkerPool
+	highPriority map[string]bool
+	hitCoalesce  *hitCoalescer
 )
 
 func init() {
 	flag.StringVar(&listenAddr, "listenAddr", "", "IP address to listen on")
 	flag.IntVar(&listenPort, "listenPort", 8080, "Port to listen on")
+	flag.StringVar(&listenUnix, "listenUnix", "", "Unix socket to listen on instead of -listenAddr and -listenPort, e.g. for nginx; a socket passed by systemd socket activation takes precedence over both")
+	flag.StringVar(&listenUnixMode, "listenUnixMode", "0660", "Permissions of the -listenUnix socket, in octal")
+	flag.DurationVar(&responseDelay, "responseDelay", 0, "Delay before writing each beacon response, for testing slow clients")
+	flag.BoolVar(&allowDelayParam, "allowDelayParam", false, "Allow ?delay= to override -responseDelay per request (development only)")
+	flag.IntVar(&gaWorkers, "gaWorkers", 4, "Number of workers reporting hits to the GA collector")
+	flag.IntVar(&gaQueueDepth, "gaQueueDepth", 1000, "Maximum number of hits waiting to be reported")
+	flag.IntVar(&maxConnsPerIP, "maxConnsPerIP", 20, "Maximum number of open connections per client IP (0 for no limit)")
+	flag.StringVar(&exemptIPs, "exemptIPs", "", "Comma-separated IPs and CIDR ranges exempt from connection limits, e.g. monitoring")
+	flag.StringVar(&dropPolicy, "dropPolicy", "newest", "What to drop when the hit queue is full: newest (the incoming hit) or low-first (lower priority queued hits first)")
+	flag.StringVar(&highPriorityAccounts, "highPriorityAccounts", "", "Comma-separated tracking IDs whose hits are reported first and wait up to 1s for room in a full queue instead of being dropped")
+	flag.BoolVar(&allowPriorityParam, "allowPriorityParam", false, "Allow ?priority=low to lower the priority of a hit")
+	flag.Float64Var(&backpressureThreshold, "backpressureThreshold", 0.9, "Hit queue fill ratio above which new connections are slowed down")
+	flag.DurationVar(&backpressureDelay, "backpressureDelay", 100*time.Millisecond, "Delay applied to each new connection while under backpressure")
+	flag.BoolVar(&gaAnonymizeIP, "gaAnonymizeIP", false, "Anonymize client IPs: send aip=1 and truncate uip (last IPv4 octet, last 80 IPv6 bits) before it leaves the server. Applies to the IP chosen by -trustProxy")
+	flag.StringVar(&forwardParams, "forwardParams", "", "Comma-separated Measurement Protocol fields forwarded from the query in addition to the built-in ones (dt, dr, dl, dh, sc, z, event, timing and exception fields), e.g. cd1,cm1,ul")
+	flag.BoolVar(&respectDNT, "respectDNT", false, "Don't report hits from requests with DNT: 1 or Sec-GPC: 1; the image is still served, as chosen by -disabledBadgeVariant")
+	flag.BoolVar(&omitClientIP, "omitClientIP", false, "Never send the client IP to the collector (and send aip=1); takes precedence over -gaAnonymizeIP")
+	flag.Float64Var(&sampleRate, "sampleRate", 1, "Share of visitors, by client ID, whose hits are reported, e.g. 0.1 for one in ten; the others still get their badge")
+	flag.StringVar(&accountSampleRateList, "accountSampleRates", "", "Comma-separated account=rate pairs overriding -sampleRate per account, e.g. UA-XXXXX-X=0.1")
+	flag.IntVar(&sampleWeightMetric, "sampleWeightMetric", -1, "GA custom metric index receiving the number of hits each sampled hit stands for, 1/rate (-1 to disable); GA4 hits of sampled accounts always get a sample_weight param")
+	flag.StringVar(&accountIPModeList, "accountIPModes", "", "Comma-separated account=mode pairs overriding -gaAnonymizeIP and -omitClientIP per account; mode is full, anonymize or omit")
+	flag.DurationVar(&gaTimeout, "gaTimeout", 3*time.Second, "Timeout for a single GA collector request")
+	flag.IntVar(&gaMaxIdleConns, "gaMaxIdleConns", 64, "Idle connections to the collector kept for reuse")
+	flag.IntVar(&gaMaxConns, "gaMaxConns", 0, "Maximum connections open to the collector at once (0 for no limit)")
+	flag.DurationVar(&gaBudget, "gaBudget", 10*time.Second, "Total time allowed for reporting a hit to GA, including retries")
+	flag.DurationVar(&collectorTimeout, "collectorTimeout", 30*time.Second, "Deadline for reporting a hit to all its collectors, -fanout destinations and mirrors; calls still running then are cancelled")
+	flag.IntVar(&gaMaxAttempts, "gaMaxAttempts", 0, "Most attempts per hit on network errors and 5xx responses (0 to retry until -gaBudget is spent)")
+	flag.IntVar(&breakerThreshold, "breakerThreshold", 5, "Consecutive failed hits after which nothing is sent to the collector for -breakerCooldown (0 to disable)")
+	flag.DurationVar(&breakerCooldown, "breakerCooldown", 30*time.Second, "How long the circuit breaker stays open before a probe hit is let through")
+	flag.StringVar(&cidEntropy, "cidEntropy", "crypto", "Entropy source for new client IDs: crypto, math (fast, not for security-sensitive deployments) or uuid")
+	flag.BoolVar(&allowHeaderParams, "allowHeaderParams", false, "Read the tracking ID, page, hit type and user ID from X-Beacon-TID, X-Beacon-Page, X-Beacon-HitType and X-Beacon-UID headers")
+	flag.BoolVar(&forwardRequestHeaders, "forwardRequestHeaders", true, "Report the Referer header as the document referrer (dr) and the first Accept-Language as the user language (ul), unless the query sets them")
+	flag.DurationVar(&coalesceWindow, "coalesceWindow", 3*time.Second, "Report only the first of repeated hits for the same client and page within this window (0 to disable)")
+	flag.IntVar(&coalesceMaxEntries, "coalesceMaxEntries", 100000, "Most recent hits -coalesceWindow remembers; the least recently seen are forgotten first (0 for no limit)")
+	flag.StringVar(&allowedIDs, "allowedIDs", "", "Comma-separated tracking IDs allowed to use this beacon; others get a 403 (empty allows all)")
+	flag.StringVar(&allowedAccountsURL, "allowedAccountsURL", "", "URL returning a JSON array of tracking IDs allowed to use this beacon")
+	flag.DurationVar(&allowlistRefreshInterval, "allowlistRefreshInterval", 5*time.Minute, "How often to refresh the allowlist from -allowedAccountsURL")
+	flag.StringVar(&otlpEndpoint, "otlpEndpoint", "", "OTLP/HTTP endpoint to export traces of requests and hit deliveries to, e.g. http://localhost:4318")
+	flag.StringVar(&otlpHeaders, "otlpHeaders", "", "Comma-separated name=value headers sent to -otlpEndpoint, e.g. an authorization token")
+	flag.StringVar(&otlpServiceName, "otlpServiceName", "ga-beacon", "Service name traces are exported under")
+	flag.Float64Var(&otlpSampleRatio, "otlpSampleRatio", 1, "Share of traces exported to -otlpEndpoint, unless the caller's traceparent decides")
+	flag.BoolVar(&otlpLogHits, "otlpLogHits", false, "Also export each reported hit as an OTLP log record to -otlpEndpoint")
+	flag.StringVar(&tenantsFile, "tenantsFile", "", "JSON file of the tenants of a shared beacon, with their key, tracking IDs, daily quota and collector; only their tracking IDs are served")
+	flag.BoolVar(&negotiateFormat, "negotiateFormat", false, "Pick the default badge format, SVG or GIF, from the Accept header by q-value (explicit style params still win)")
+	flag.BoolVar(&inferHitSource, "inferHitSource", false, "Infer the hit source (badge, email or api) when the X-Beacon-Source header is absent")
+	flag.StringVar(&normalizeCase, "normalizeCase", "none", "Case normalization of page paths reported to GA: lower, upper or none")
+	flag.BoolVar(&noTrailingSlash, "noTrailingSlash", false, "Strip trailing slashes from page paths reported to GA")
+	flag.StringVar(&pathRewriteFile, "pathRewriteFile", "", "File of rewrite rules for page paths reported to GA, one regular expression and replacement per line")
+	flag.StringVar(&geoipDB, "geoipDB", "", "Path to a MaxMind GeoIP2/GeoLite2 database, reloaded when the file changes")
+	flag.BoolVar(&reportGeoID, "geoid", false, "Report the client's country, looked up in -geoipDB, as the geoid field")
+	flag.IntVar(&geoCountryDimension, "geoCountryDimension", -1, "GA custom dimension index receiving the client's country code from -geoipDB (-1 to disable)")
+	flag.IntVar(&geoRegionDimension, "geoRegionDimension", -1, "GA custom dimension index receiving the client's region from -geoipDB, which must be a City database (-1 to disable)")
+	flag.IntVar(&geoCityDimension, "geoCityDimension", -1, "GA custom dimension index receiving the client's city from -geoipDB, which must be a City database (-1 to disable)")
+	flag.StringVar(&blockCountries, "blockCountries", "", "Comma-separated country codes whose hits are not reported (requires -geoipDB)")
+	flag.StringVar(&allowCountries, "allowCountries", "", "Comma-separated country codes whose hits are the only ones reported; takes precedence over -blockCountries (requires -geoipDB)")
+	flag.Var(&runSelfTest, "selfTest", "Check assets, templates and client ID generation before serving, and probe the collectors; with -selfTest=strict, an unreachable collector also stops the beacon from starting")
+	flag.BoolVar(&skipSelfTest, "skipSelfTest", false, "Skip the startup self-test, e.g. where GA is not reachable at startup")
+	flag.BoolVar(&enableDebugEndpoint, "enableDebugEndpoint", false, "Serve /debug/<account>/<page>, showing the hit a beacon would report and its validation results as JSON, without reporting it")
+	flag.BoolVar(&enableThumbnails, "enableThumbnails", false, "Serve the referring page's og:image instead of a badge for ?thumbnail")
+	flag.StringVar(&thumbnailCacheDir, "thumbnailCacheDir", filepath.Join(os.TempDir(), "ga-beacon-thumbnails"), "Directory caching fetched thumbnails, created if missing")
+	flag.DurationVar(&thumbnailCacheTTL, "thumbnailCacheTTL", 24*time.Hour, "How long cached thumbnails are served before being fetched again")
+	flag.IntVar(&maxPathDepth, "maxPathDepth", 20, "Maximum number of segments in a page path")
+	flag.IntVar(&minPathDepth, "minPathDepth", 0, "Minimum number of segments in a page path")
+	flag.StringVar(&metricsToken, "metricsToken", "", "Bearer token required to read /metrics and /metrics/json")
+	flag.StringVar(&signingKey, "signingKey", "", "Secret beacon URLs must be signed with (see ga-beacon sign); hits without a valid ?sig are not reported, but still get the badge")
+	flag.StringVar(&adminToken, "adminToken", "", "Bearer token required by the /admin/ API; the API is disabled without one")
+	flag.IntVar(&badgeLabelSegment, "badgeLabelSegment", 0, "Show this segment of the page path (1-based) as the badge label when there is no ?label, so the badges of several pages tell apart; 0 keeps the default badge")
+	flag.IntVar(&badgeCacheSeconds, "badgeCacheSeconds", 60, "Seconds browsers and image proxies may cache a badge whose query only selects its style; 0 makes them revalidate it with its ETag on every view, so each view is reported but only costs a 304")
+	flag.StringVar(&overrideBadgeDir, "overrideBadgeDir", "", "Directory with custom badge files (badge.svg, badge-flat.svg, badge.gif, badge-flat.gif, pixel.gif) replacing the built-in ones")
+	flag.StringVar(&staticDir, "staticDir", "", "Directory laid out like the repo (page.html, static/badge.svg, static/crawlers.txt, ...) whose files replace the embedded assets of the same path")
+	flag.BoolVar(&skipIntegrityCheck, "skipIntegrityCheck", false, "Skip verifying badge assets against static/assets.sha256 at startup")
+	flag.StringVar(&disabledBadgeVariant, "disabledBadgeVariant", "same", "Image served when tracking is suppressed for privacy reasons: same, grey or blank")
+	flag.StringVar(&gaProtocolFlag, "gaProtocol", "auto", "Measurement Protocol to report hits with: v1, ga4 or auto (ga4 for G- IDs, v1 otherwise)")
+	flag.StringVar(&ga4APISecret, "ga4APISecret", "", "Measurement Protocol API secret for reporting GA4 hits, unless given by the api_secret query param")
+	flag.DurationVar(&ga4DedupeWindow, "ga4DedupeWindow", 5*time.Second, "GA4 hits of a visitor to a page within the same window of this length get the same event_id, so GA4 deduplicates retries (0 to send no event_id)")
+	flag.StringVar(&iconAllowlist, "iconAllowlist", "", "Comma-separated hosts badge icons (?icon=<https url>) may be loaded from")
+	flag.BoolVar(&allowEncParam, "allowEncParam", false, "Let beacon URLs pick the response encoding with ?enc=image|json|empty")
+	flag.StringVar(&defaultResponseEncoding, "defaultResponseEncoding", "image", "Response encoding for beacon requests: image, json or empty (204)")
+	flag.BoolVar(&filterCrawlers, "filterCrawlers", true, "Do not report hits from known crawlers and link unfurlers (Googlebot, Slackbot, ...)")
+	flag.StringVar(&botUAFile, "botUAFile", "", "File of crawler User-Agent substrings, one per line, replacing the built-in list")
+	flag.StringVar(&botRegexp, "botRegexp", "", "Regular expression matched against the User-Agent to detect crawlers, in addition to the substring list, e.g. (?i)feed|rss")
+	flag.StringVar(&botAction, "botAction", "drop", "What to do with hits from crawlers: drop them, tag them with -botDimension, or only count them in gabeacon_bot_hits_total")
+	flag.StringVar(&customFieldList, "customFields", "", "Comma-separated field=source:key mappings filling GA custom dimensions and metrics from the request, e.g. cd1=header:X-Team,cd2=path:1,cm1=query:price; source is header, query or path (1-based segment of the page path). Universal Analytics only")
+	flag.IntVar(&botDimension, "botDimension", -1, "GA custom dimension index set to \"bot\" on crawler hits with -botAction=tag")
+	flag.Float64Var(&rateLimitRPS, "rateLimitRPS", 10, "Hits per second reported per client IP; hits over the limit get a 429 and are not reported (0 to disable)")
+	flag.IntVar(&rateLimitBurst, "rateLimitBurst", 20, "Hits a client IP may send at once before -rateLimitRPS applies")
+	flag.IntVar(&ipv6PrefixLength, "ipv6PrefixLength", 64, "IPv6 clients are rate limited and counted against -maxConnsPerIP by their network of this many bits, as each usually has a /64 to pick addresses from")
+	flag.Float64Var(&accountRateLimitRPS, "accountRateLimitRPS", 0, "Hits per second reported per tracking ID (0 to disable)")
+	flag.IntVar(&accountRateLimitBurst, "accountRateLimitBurst", 100, "Hits a tracking ID may receive at once before -accountRateLimitRPS applies")
+	flag.StringVar(&rateLimitAction, "rateLimitAction", "reject", "What hits over a rate limit get: reject (the badge with a 429) or suppress (the badge with a 200); they are not reported either way")
+	flag.BoolVar(&trustProxy, "trustProxy", false, "Take the client IP from X-Forwarded-For / X-Real-IP (only behind a proxy that sets them)")
+	flag.StringVar(&trustedProxies, "trustedProxies", "", "Comma-separated IPs and CIDR ranges of proxies whose X-Forwarded-For / Forwarded / X-Real-IP headers are believed; takes precedence over -trustProxy")
+	flag.StringVar(&logLevel, "logLevel", "info", "Minimum level logged: debug, info, warn or error")
+	flag.StringVar(&logFormat, "logFormat", "auto", "Log format: json, text, or auto (text on a terminal, JSON otherwise)")
+	flag.BoolVar(&printConfigAndExit, "printConfig", false, "Print the resolved configuration as JSON and exit. Every flag can also be set with a GA_BEACON_<FLAG_NAME> environment variable, e.g. GA_BEACON_LISTEN_PORT; flags given on the command line win")
+	flag.StringVar(&configFile, "config", "", "YAML file of flag name: value settings; the command line and GA_BEACON_* variables take precedence")
+	flag.BoolVar(&validateAndExit, "validate", false, "Check the configuration and exit without serving")
+	flag.BoolVar(&insecureCookie, "insecureCookie", false, "Set the cid cookie with SameSite=Lax and without Secure, for testing over plain HTTP; overrides -cookieSameSite and -cookieSecure")
+	flag.StringVar(&cookieName, "cookieName", "cid", "Name of the client ID cookie")
+	flag.DurationVar(&cookieMaxAge, "cookieMaxAge", 0, "Lifetime of the client ID cookie, e.g. 8760h; 0 sets a session cookie")
+	flag.StringVar(&cookieSameSite, "cookieSameSite", "none", "SameSite attribute of the client ID cookie: none, lax or strict. none requires -cookieSecure")
+	flag.BoolVar(&cookieSecure, "cookieSecure", true, "Set the Secure attribute on the client ID cookie")
+	flag.StringVar(&cookieDomain, "cookieDomain", "", "Domain attribute of the client ID cookie; empty scopes it to the beacon's host")
+	flag.BoolVar(&cookieless, "cookieless", false, "Set no cookie; derive the client ID from a hash of the client IP and User-Agent, salted with a random key replaced daily")
+	flag.StringVar(&corsOrigins, "corsOrigins", "", "Comma-separated origins (or *) allowed to fetch beacons cross-origin and to POST to /collect/; empty adds no CORS headers and lets any origin POST")
+	flag.BoolVar(&strictPostValidation, "strictPostValidation", false, "Answer POSTs to /collect/ with reserved GA fields (v, t, tid, cid, uip, sc, qt, z, dr) or fields that are not Measurement Protocol parameters with a 400, instead of dropping those fields with a warning")
+	flag.StringVar(&redirectURL, "redirectURL", defaultRedirectURL, "Where requests for / are redirected")
+	flag.StringVar(&tlsCert, "tlsCert", "", "TLS certificate file; serves HTTPS when set together with -tlsKey")
+	flag.StringVar(&tlsKey, "tlsKey", "", "TLS private key file")
+	flag.StringVar(&tlsAutoDomain, "tlsAutoDomain", "", "Comma-separated domains to obtain Let's Encrypt certificates for and serve HTTPS with (instead of -tlsCert)")
+	flag.StringVar(&tlsCacheDir, "tlsCacheDir", "autocert-cache", "Directory caching certificates obtained for -tlsAutoDomain")
+	flag.IntVar(&certWarnDays, "certWarnDays", 30, "Log a warning when the TLS certificate expires within this many days")
+	flag.IntVar(&certCriticalDays, "certCriticalDays", 7, "Log an error when the TLS certificate expires within this many days")
+	flag.StringVar(&certWebhookURL, "certWebhookURL", "", "URL notified with a JSON POST when the TLS certificate enters the critical window")
+	flag.BoolVar(&accessLog, "accessLog", false, "Write an access log line per request, to stdout unless -accessLogFile is set")
+	flag.StringVar(&accessLogFormat, "accessLogFormat", "common", "Access log format: common, combined (common plus Referer and User-Agent) or json")
+	flag.StringVar(&accessLogFile, "accessLogFile", "", "File the access log is appended to instead of stdout; SIGHUP reopens it, for logrotate")
+	flag.Int64Var(&accessLogMaxMB, "accessLogMaxMB", 0, "Rotate -accessLogFile once it grows past this many megabytes (0 to leave rotation to logrotate)")
+	flag.IntVar(&accessLogMaxFiles, "accessLogMaxFiles", 5, "Rotated -accessLogFile files kept, as <file>.1 (newest) to <file>.N")
+	flag.BoolVar(&securityHeaders, "securityHeaders", false, "Add X-Content-Type-Options, X-Frame-Options and Referrer-Policy headers to responses")
+	flag.BoolVar(&gzipResponses, "gzip", false, "Compress responses for clients accepting gzip")
+	flag.BoolVar(&enableScriptBeacon, "enableScriptBeacon", false, "Answer beacons loaded from <script> tags (?js or Accept: text/javascript) with JavaScript")
+	flag.BoolVar(&gaBatch, "gaBatch", false, "Send Universal Analytics hits to the collector's /batch endpoint, up to 20 per request")
+	flag.DurationVar(&batchInterval, "batchInterval", 500*time.Millisecond, "With -gaBatch, the longest a hit waits for its batch to fill")
+	flag.StringVar(&collectorURL, "collectorURL", "", "Base URL of the collector hits are sent to, e.g. a proxy, a Measurement Protocol compatible server or a mock; hits go to /collect and /mp/collect under it (default GA's collector for -collectorRegion)")
+	flag.StringVar(&collectorRegion, "collectorRegion", "global", "GA collector hits are sent to without -collectorURL: global, or eu to have them processed in the EU")
+	flag.StringVar(&gaEndpoint, "gaEndpoint", "", "Universal Analytics collector URL, overriding the /collect of -collectorURL")
+	flag.BoolVar(&dryRun, "dryRun", false, "Log hit payloads instead of sending them; nothing is sent to GA (development only)")
+	flag.StringVar(&defaultCollector, "collector", "ga", "Analytics backend hits are reported to: ga, matomo, plausible, local (the -hitStore database), or none to only -mirror them")
+	flag.StringVar(&hitStoreBackend, "hitStore", "", "Database the local collector (-collector local) keeps hits in, shown on /stats/<account>: sqlite or clickhouse")
+	flag.StringVar(&sqlitePath, "sqlitePath", "hits.db", "SQLite database file for -hitStore=sqlite, also keeping the pages -enableGSCPing pinged")
+	flag.StringVar(&clickhouseURL, "clickhouseURL", "http://localhost:8123/", "ClickHouse HTTP interface for -hitStore=clickhouse; credentials go in the URL, e.g. ?user=...&password=...")
+	flag.StringVar(&clickhouseTable, "clickhouseTable", "hits", "ClickHouse table for -hitStore=clickhouse, created if missing")
+	flag.StringVar(&statsToken, "statsToken", "", "Token required to view /stats/ pages, as a bearer token or ?token=; empty makes them public")
+	flag.StringVar(&mirrorList, "mirror", "", "Comma-separated sinks every reported hit is also published to as JSON: a webhook URL, kafka+https://<rest-proxy>/<topic> or pubsub://<project>/<topic>")
+	flag.StringVar(&mirrorToken, "mirrorToken", "", "Bearer token sent to -mirror webhooks")
+	flag.DurationVar(&mirrorTimeout, "mirrorTimeout", 5*time.Second, "Timeout of each -mirror request")
+	flag.StringVar(&accountCollectors, "accountCollectors", "", "Comma-separated account=collector pairs overriding -collector per account, e.g. UA-1234-1=ga,example.com=plausible")
+	flag.StringVar(&accountBadgeList, "accountBadges", "", "Comma-separated account=variant pairs choosing the badge (badge, pixel, gif, flat, flat-gif) served when the URL selects none, e.g. UA-1234-1=flat")
+	flag.StringVar(&accountDefaultPageList, "accountDefaultPages", "", "Comma-separated account=page pairs; a bare /account request then reports that page instead of showing the account page")
+	flag.StringVar(&matomoURL, "matomoURL", "", "Matomo tracking endpoint, e.g. https://matomo.example.com/matomo.php (required for the matomo collector)")
+	flag.StringVar(&fanoutList, "fanout", "", "Comma-separated account=destinations pairs reporting each hit for the account also to the +-separated [collector:]account destinations, e.g. UA-1234-1=G-ABC123+matomo:5")
+	flag.StringVar(&matomoToken, "matomoToken", "", "Matomo token_auth; needed for Matomo to accept the client IP")
+	flag.StringVar(&plausibleURL, "plausibleURL", defaultPlausibleURL, "Plausible events API endpoint")
+	flag.BoolVar(&enableCounter, "enableCounter", false, "Serve a badge showing the page's hit count for ?count")
+	flag.BoolVar(&streamingBadge, "streamingBadge", false, "Stream ?count badges: send the badge frame and label first, and the count once it is read (connections that cannot be flushed get the whole badge)")
+	flag.StringVar(&counterBackend, "counterBackend", "memory", "Where -enableCounter keeps counts: memory (reset on restart unless -counterFile is set) or redis")
+	flag.StringVar(&counterFile, "counterFile", "", "JSON file the memory counter backend loads counts from and saves them to every 30s and on shutdown")
+	flag.IntVar(&counterMaxKeys, "counterMaxKeys", 100000, "Most pages the memory counter backend counts; new pages past it get the regular badge")
+	flag.DurationVar(&counterRetention, "counterRetention", 365*24*time.Hour, "How long -enableCounter keeps the daily counts served by /api/v1/hits (0 to keep them forever)")
+	flag.BoolVar(&enableUnique, "enableUnique", false, "Count each page's unique visitors per day for /api/v1/unique, in memory for 30 days")
+	flag.BoolVar(&enableGSCPing, "enableGSCPing", false, "Ping -gscPingURL with the Referer of the first ?count hit of each page, at most once a minute (requires -enableCounter)")
+	flag.StringVar(&gscPingURL, "gscPingURL", "", "Sitemap ping endpoint for -enableGSCPing, sent GET <url>?sitemap=<page URL>")
+	flag.IntVar(&uniqueMaxKeys, "uniqueMaxKeys", 1000, "Most pages -enableUnique counts visitors of; each takes up to 500 KiB")
+	flag.StringVar(&spoolFile, "spoolFile", "", "File to keep hits the collector could not take, replayed every 30s (empty to drop them)")
+	flag.Int64Var(&spoolMaxSize, "spoolMaxSize", 64<<20, "Most bytes -spoolFile may hold; hits beyond it are dropped (0 for no limit)")
+	flag.DurationVar(&spoolMaxAge, "spoolMaxAge", 4*time.Hour, "Spooled hits older than this are dropped instead of replayed; GA ignores v1 hits queued for over 4h")
+	flag.StringVar(&redisAddr, "redisAddr", "localhost:6379", "Redis address for -counterBackend=redis")
+	flag.BoolVar(&gaHTTP2, "gaHTTP2", false, "Force HTTP/2 when talking to the GA collector over HTTPS (HTTP/2 is disabled otherwise)")
+	flag.StringVar(&hitFilterExpr, "hitFilterExpr", "", `CEL expression over ip, ua, path, account and hit_type; matching hits are not reported (e.g. ua.contains("bot") || ip.startsWith("10."))`)
+	flag.BoolVar(&parseUserAgent, "parseUserAgent", false, "Parse the User-Agent of hits to report their browser, OS and device class: as the device of GA4 hits, and in -browserDimension, -osDimension and -deviceDimension")
+	flag.IntVar(&browserDimension, "browserDimension", -1, "GA custom dimension index receiving the client's browser with -parseUserAgent (-1 to disable)")
+	flag.IntVar(&osDimension, "osDimension", -1, "GA custom dimension index receiving the client's operating system with -parseUserAgent (-1 to disable)")
+	flag.IntVar(&deviceDimension, "deviceDimension", -1, "GA custom dimension index receiving the client's device class (desktop, mobile, tablet or bot) with -parseUserAgent (-1 to disable)")
+	flag.StringVar(&defaultDataSource, "defaultDataSource", "", "Data source (ds) reported for hits without one from X-Beacon-Source or -inferHitSource, e.g. beacon")
+	flag.IntVar(&correlationIDDimension, "correlationIDDimension", -1, "GA custom dimension index receiving the X-Correlation-ID/X-Request-ID header (-1 to disable)")
 }
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:]))
+	}
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "check" {
+		checkMode, args = true, args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	configErr := applyEnvFlags(flag.CommandLine)
+	if configErr == nil && configFile != "" {
+		configErr = applyConfigFile(flag.CommandLine, configFile)
+	}
+	s := &server{logger: slog.Default()}
+	logger, err := newLogger(logLevel, logFormat)
+	if err != nil {
+		s.fatal("Invalid logging configuration", "err", err)
+	}
+	s.logger = logger
+	for path, err := range embeddedAssetErrors {
+		s.logger.Error("Embedded asset unavailable, serving a fallback", "asset", path, "err", err)
+		degradedMode.Store(true)
+	}
+	if configErr != nil {
+		s.fatal("Invalid configuration", "err", configErr)
+	}
+	if printConfigAndExit {
+		printConfig(flag.CommandLine)
+		return
+	}
 
 	if listenAddr == "" {
 		listenAddr = "0.0.0.0"
 	}
 
-	addr := fmt.Sprintf("%s:%d", listenAddr, listenPort)
-	server := &http.Server{
+	gaClient = newGAClient(gaHTTP2)
+
+	sameSite, err := parseSameSite(cookieSameSite)
+	if err != nil {
+		s.fatal("Invalid -cookieSameSite", "err", err)
+	}
+	if insecureCookie {
+		sameSite, cookieSecure = http.SameSiteLaxMode, false
+	}
+	if sameSite == http.SameSiteNoneMode && !cookieSecure {
+		s.fatal("-cookieSameSite none requires -cookieSecure; use -insecureCookie for plain HTTP")
+	}
+	if cookieName == "" || strings.ContainsAny(cookieName, " ;=,\t") {
+		s.fatal("Invalid -cookieName", "cookieName", cookieName)
+	}
+	if cookieMaxAge < 0 {
+		s.fatal("-cookieMaxAge must not be negative")
+	}
+	cidCookie = &cookieConfig{name: cookieName, maxAge: cookieMaxAge, domain: cookieDomain, secure: cookieSecure, sameSite: sameSite}
+
+	if badgeLabelSegment < 0 {
+		s.fatal("-badgeLabelSegment must not be negative")
+	}
+	if badgeCacheSeconds < 0 {
+		s.fatal("-badgeCacheSeconds must not be negative")
+	}
+	switch disabledBadgeVariant {
+	case "same", "grey", "blank":
+	default:
+		s.fatal("Invalid -disabledBadgeVariant", "value", disabledBadgeVariant)
+	}
+	if err := loadAssets(s.logger); err != nil {
+		s.fatal("Cannot load assets", "err", err)
+	}
+
+	if gaProtocol, err = parseProtocolVersion(gaProtocolFlag); err != nil {
+		s.fatal("Invalid -gaProtocol", "err", err)
+	}
+
+	if _, ok := responseEncoders[defaultResponseEncoding]; !ok {
+		s.fatal("Invalid -defaultResponseEncoding", "value", defaultResponseEncoding)
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		s.fatal("-tlsCert and -tlsKey must be set together")
+	}
+	if u, err := url.Parse(redirectURL); err != nil || !u.IsAbs() || u.Host == "" {
+		s.fatal("Invalid -redirectURL: must be an absolute URL", "value", redirectURL)
+	}
+	if otlpEndpoint != "" {
+		if u, err := url.Parse(otlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			s.fatal("Invalid -otlpEndpoint: must be an http or https URL", "value", otlpEndpoint)
+		}
+		if otlpSampleRatio < 0 || otlpSampleRatio > 1 {
+			s.fatal("-otlpSampleRatio must be between 0 and 1", "value", otlpSampleRatio)
+		}
+		header, err := parseOTLPHeaders(otlpHeaders)
+		if err != nil {
+			s.fatal("Invalid -otlpHeaders", "err", err)
+		}
+		if !checkMode {
+			tracer = newOTLPExporter(otlpEndpoint, header, otlpServiceName, s.logger)
+		}
+	} else if otlpLogHits {
+		s.fatal("-otlpLogHits requires -otlpEndpoint")
+	}
+	if collectorURL != "" && collectorRegion != "global" {
+		s.fatal("-collectorURL and -collectorRegion can't be set together")
+	}
+	base, err := collectorBase()
+	if err != nil {
+		s.fatal("Invalid collector", "err", err)
+	}
+	if gaEndpoint == "" {
+		gaEndpoint = base + "/collect"
+	}
+	ga4Endpoint = base + "/mp/collect"
+	if u, err := url.Parse(gaEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		s.fatal("Invalid -gaEndpoint: must be an http or https URL", "value", gaEndpoint)
+	}
+	if collectorTimeout <= 0 {
+		s.fatal("-collectorTimeout must be positive", "value", collectorTimeout)
+	}
+	if ga4DedupeWindow < 0 {
+		s.fatal("-ga4DedupeWindow must not be negative", "value", ga4DedupeWindow)
+	}
+	if dryRun {
+		s.logger.Warn("Dry run: hits are logged, not sent to GA")
+	}
+	if mirrors, err = parseMirrors(mirrorList); err != nil {
+		s.fatal("Invalid -mirror", "err", err)
+	}
+	mirrorClient.Timeout = mirrorTimeout
+	if _, ok := collectors[defaultCollector]; !ok {
+		s.fatal("Invalid -collector", "value", defaultCollector)
+	}
+	if hitStoreBackend != "" {
+		dsn := sqlitePath
+		if hitStoreBackend == "clickhouse" {
+			dsn = clickhouseURL
+		}
+		if hitStorage, err = newHitStore(hitStoreBackend, dsn, clickhouseTable); err != nil {
+			s.fatal("Cannot open -hitStore", "backend", hitStoreBackend, "err", err)
+		}
+	}
+	if accountCollectorNames, err = parseAccountCollectors(accountCollectors); err != nil {
+		s.fatal("Invalid -accountCollectors", "err", err)
+	}
+	if err := addForwardParams(forwardParams); err != nil {
+		s.fatal("Invalid -forwardParams", "err", err)
+	}
+	if accountIPModes, err = parseAccountMap(accountIPModeList, validIPMode); err != nil {
+		s.fatal("Invalid -accountIPModes", "err", err)
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		s.fatal("Invalid -sampleRate: must be above 0 and at most 1", "value", sampleRate)
+	}
+	if accountSampleRates, err = parseSampleRates(accountSampleRateList); err != nil {
+		s.fatal("Invalid -accountSampleRates", "err", err)
+	}
+	if accountBadges, err = parseAccountMap(accountBadgeList, validBadgeVariant); err != nil {
+		s.fatal("Invalid -accountBadges", "err", err)
+	}
+	if accountDefaultPages, err = parseAccountMap(accountDefaultPageList, maxPrintable(2048)); err != nil {
+		s.fatal("Invalid -accountDefaultPages", "err", err)
+	}
+	if fanoutDestinations, err = parseFanout(fanoutList); err != nil {
+		s.fatal("Invalid -fanout", "err", err)
+	}
+	if usesCollector("matomo") && matomoURL == "" {
+		s.fatal("The matomo collector requires -matomoURL")
+	}
+	if usesCollector("local") && hitStorage == nil {
+		s.fatal("The local collector requires -hitStore")
+	}
+	if enableCounter {
+		if counterMaxKeys < 1 {
+			s.fatal("-counterMaxKeys must be at least 1", "value", counterMaxKeys)
+		}
+		if counterRetention != 0 && counterRetention < 24*time.Hour {
+			s.fatal("-counterRetention must be at least a day, or 0", "value", counterRetention)
+		}
+		if counterStore, err = newCounterStore(counterBackend, redisAddr, counterFile, counterMaxKeys, counterRetention); err != nil {
+			s.fatal("Cannot set up the hit counter", "backend", counterBackend, "err", err)
+		}
+		if counterRetention > 0 {
+			go pruneCounters(s.logger, counterStore, counterRetention, counterPruneInterval)
+		}
+		if store, ok := counterStore.(*memoryCounterStore); ok && counterFile != "" {
+			go store.run(counterSaveInterval, s.logger)
+		}
+	}
+
+	if enableUnique {
+		if uniqueMaxKeys < 1 {
+			s.fatal("-uniqueMaxKeys must be at least 1", "value", uniqueMaxKeys)
+		}
+		uniqueVisitors = newUniqueStore(uniqueMaxKeys)
+		go pruneCounters(s.logger, uniqueVisitors, (maxUniqueDays-1)*24*time.Hour, counterPruneInterval)
+	}
+
+	if enableGSCPing {
+		if counterStore == nil {
+			s.fatal("-enableGSCPing requires -enableCounter")
+		}
+		db, err := sql.Open("sqlite", sqlitePath)
+		if err != nil {
+			s.fatal("Cannot open -sqlitePath", "path", sqlitePath, "err", err)
+		}
+		db.SetMaxOpenConns(1)
+		if pagePings, err = newPageObserver(gscPingURL, db, gscPingInterval, s.logger); err != nil {
+			s.fatal("Cannot set up sitemap pings", "err", err)
+		}
+	}
+
+	if tlsCert != "" && tlsAutoDomain != "" {
+		s.fatal("-tlsCert and -tlsAutoDomain are mutually exclusive")
+	}
+
+	iconHosts = map[string]bool{}
+	for _, host := range strings.Split(iconAllowlist, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			iconHosts[host] = true
+		}
+	}
+
+	if botRegexp != "" {
+		if crawlerPattern, err = regexp.Compile(botRegexp); err != nil {
+			s.fatal("Invalid -botRegexp", "err", err)
+		}
+	}
+	if err := validBotAction(botAction); err != nil {
+		s.fatal("Invalid -botAction", "err", err)
+	}
+	if customFieldMappings, err = parseCustomFieldMappings(customFieldList); err != nil {
+		s.fatal("Invalid -customFields", "err", err)
+	}
+	if botAction == "tag" && botDimension <= 0 {
+		s.fatal("-botAction=tag requires -botDimension")
+	}
+
+	if err := validateNormalizeCase(normalizeCase); err != nil {
+		s.fatal("Invalid -normalizeCase", "err", err)
+	}
+	if pathRewriteFile != "" {
+		if err := reloadPathRewrites(); err != nil {
+			s.fatal("Invalid -pathRewriteFile", "err", err)
+		}
+	}
+
+	if cidGenerator, err = newCIDGenerator(cidEntropy); err != nil {
+		s.fatal("Invalid -cidEntropy", "err", err)
+	}
+
+	if (browserDimension > 0 || osDimension > 0 || deviceDimension > 0) && !parseUserAgent {
+		s.fatal("-browserDimension, -osDimension and -deviceDimension require -parseUserAgent")
+	}
+	if geoEnrichment() && geoipDB == "" {
+		s.fatal("-geoid and the -geo*Dimension flags require -geoipDB")
+	}
+	if geoipDB != "" {
+		geoip = openGeoIP(geoipDB, geoRegionDimension > 0 || geoCityDimension > 0, s.logger)
+		defer geoip.Close()
+		go geoip.run(geoipReloadInterval)
+	}
+	blockedCountries = parseCountries(blockCountries)
+	allowedCountries = parseCountries(allowCountries)
+	// Country restrictions can't degrade gracefully: without the database
+	// they would block everything or nothing.
+	if (blockedCountries != nil || allowedCountries != nil) && !geoip.Loaded() {
+		s.fatal("-blockCountries and -allowCountries require a readable -geoipDB", "path", geoipDB)
+	}
+
+	if hitFilterExpr != "" {
+		if hitFilter, err = compileHitFilter(hitFilterExpr); err != nil {
+			s.fatal("Invalid hit filter expression", "err", err)
+		}
+	}
+
+	staticAllowlist.Store(parseAllowedIDs(allowedIDs))
+	if allowedAccountsURL != "" {
+		allowlistSource = newAllowlistFetcher(allowedAccountsURL, s.logger)
+		if err := allowlistSource.refresh(); err != nil {
+			s.fatal("Could not load the initial allowlist", "err", err)
+		}
+		go allowlistSource.run(allowlistRefreshInterval)
+	}
+	if tenantsFile != "" {
+		if err := reloadTenants(); err != nil {
+			s.fatal("Could not load the tenants file", "err", err)
+		}
+	}
+
+	if runSelfTest != "false" && !skipSelfTest && !checkMode {
+		if err := s.selfTest(); err != nil {
+			s.logger.Error("Self-test failed", "err", err)
+			os.Exit(2)
+		}
+		s.logger.Info("Self-test passed")
+	}
+
+	registerMetrics()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/preview", s.previewHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/metrics/json", s.metricsJSONHandler)
+	mux.HandleFunc("/admin/", s.adminHandler)
+	mux.HandleFunc("/collect/", s.collectHandler)
+	if hitStorage != nil {
+		mux.HandleFunc("/stats/", s.statsHandler)
+	}
+	if counterStore != nil {
+		mux.HandleFunc("/api/v1/hits/", s.hitsHandler)
+	}
+	if uniqueVisitors != nil {
+		mux.HandleFunc("/api/v1/unique/", s.uniqueHandler)
+	}
+	if enableDebugEndpoint {
+		mux.HandleFunc("/debug/", s.debugHandler)
+	}
+	mux.HandleFunc("/", s.handler)
+
+	addr := net.JoinHostPort(listenAddr, strconv.Itoa(listenPort))
+	builder := NewServerBuilder(&Config{
 		Addr:         addr,
-		Handler:      http.HandlerFunc(handler),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  15 * time.Second,
+	}).With(WithMetrics())
+	if tracer != nil {
+		builder.With(WithTracing())
+	}
+	if accessLog {
+		if _, ok := accessLogFormats[accessLogFormat]; !ok {
+			s.fatal("Invalid -accessLogFormat", "value", accessLogFormat)
+		}
+		var w io.Writer = os.Stdout
+		if accessLogFile != "" {
+			if accessLogWriter, err = openRotatingFile(accessLogFile, accessLogMaxMB<<20, accessLogMaxFiles, s.logger); err != nil {
+				s.fatal("Cannot open -accessLogFile", "err", err)
+			}
+			defer accessLogWriter.Close()
+			w = accessLogWriter
+		}
+		builder.With(WithAccessLog(w, accessLogFormat))
+	} else if accessLogFile != "" {
+		s.fatal("-accessLogFile requires -accessLog")
+	}
+	if corsOrigins != "" {
+		builder.With(WithCORSMiddleware(strings.Split(corsOrigins, ",")))
+		collectOrigins = map[string]bool{}
+		for _, origin := range strings.Split(corsOrigins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				collectOrigins[origin] = true
+			}
+		}
+	}
+	if securityHeaders {
+		builder.With(WithSecurityHeaders())
+	}
+	if gzipResponses {
+		builder.With(WithGZIP())
+	}
+	httpServer := builder.With(WithHandler(mux)).Build()
+
+	if dropPolicy != "newest" && dropPolicy != "low-first" {
+		s.fatal("Invalid -dropPolicy", "value", dropPolicy)
+	}
+	highPriority = map[string]bool{}
+	for _, id := range strings.Split(highPriorityAccounts, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			highPriority[id] = true
+		}
+	}
+	if gaWorkers < 1 {
+		s.fatal("-gaWorkers must be at least 1", "value", gaWorkers)
+	}
+	if gaQueueDepth < 1 {
+		s.fatal("-gaQueueDepth must be at least 1", "value", gaQueueDepth)
+	}
+	hitWorkers = newHitWorkerPool(gaWorkers, gaQueueDepth, dropPolicy, s.logger)
+	hitCoalesce = newHitCoalescer(coalesceWindow, coalesceMaxEntries, s.logger)
+	if gaBatch {
+		hitBatcher = newBatchDispatcher(batchInterval, s.logger)
+	}
+	if spoolFile != "" {
+		if spoolMaxAge <= 0 {
+			s.fatal("-spoolMaxAge must be positive", "value", spoolMaxAge)
+		}
+		if hitSpool, err = openSpool(spoolFile, spoolMaxSize, spoolMaxAge, s.logger); err != nil {
+			s.fatal("Cannot open -spoolFile", "err", err)
+		}
+		go hitSpool.run(spoolReplayInterval)
+	}
+	switch rateLimitAction {
+	case "reject", "suppress":
+	default:
+		s.fatal("Invalid -rateLimitAction", "value", rateLimitAction)
+	}
+	if ipv6PrefixLength < 1 || ipv6PrefixLength > 128 {
+		s.fatal("Invalid -ipv6PrefixLength: must be from 1 to 128", "value", ipv6PrefixLength)
+	}
+	ipRateLimiter = newRateLimiter(rateLimitRPS, rateLimitBurst)
+	accountRateLimiter = newRateLimiter(accountRateLimitRPS, accountRateLimitBurst)
+
+	if exemptNets, err = parseIPList(exemptIPs); err != nil {
+		s.fatal("Invalid -exemptIPs", "err", err)
+	}
+	if trustedProxyNets, err = parseIPList(trustedProxies); err != nil {
+		s.fatal("Invalid -trustedProxies", "err", err)
+	}
+	if checkMode {
+		os.Exit(runCheck())
+	}
+	if validateAndExit {
+		s.logger.Info("Configuration is valid")
+		return
+	}
+
+	listener, listening, err := openListener(s.logger, addr)
+	if err != nil {
+		s.fatal("Could not listen", "addr", listening, "err", err)
+	}
+	// Connections over a Unix socket all come from the proxy in front.
+	if maxConnsPerIP > 0 && listener.Addr().Network() == "tcp" {
+		limiter := newPerIPConnLimiter(listener, int64(maxConnsPerIP), s.logger)
+		metrics.CounterFunc("gabeacon_conns_rejected_total", "Connections refused over -maxConnsPerIP.", nil, limiter.Rejected)
+		listener = limiter
+	}
+	listener = &backpressureListener{
+		Listener:  listener,
+		pool:      hitWorkers,
+		threshold: backpressureThreshold,
+		delay:     backpressureDelay,
+		logger:    s.logger,
 	}
 
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	s.reloadOnSIGHUP()
 
 	go func() {
 		<-quit
-		logger.Infof("Server is shutting down...")
+		s.logger.Info("Server is shutting down")
+		shuttingDown.Store(true)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
-		server.SetKeepAlivesEnabled(false)
-		if err := server.Shutdown(ctx); err != nil {
-			logger.Fatalf("Could not gracefully shutdown the server: %v", err)
+		httpServer.SetKeepAlivesEnabled(false)
+		if err := httpServer.Shutdown(ctx); err != nil {
+			s.fatal("Could not gracefully shutdown the server", "err", err)
+		}
+		hitWorkers.Stop(ctx)
+		if hitBatcher != nil {
+			hitBatcher.Stop(ctx)
+		}
+		if tracer != nil {
+			tracer.Stop(ctx)
+		}
+		if hitStorage != nil {
+			hitStorage.Close()
+		}
+		if store, ok := counterStore.(*memoryCounterStore); ok {
+			if err := store.Save(); err != nil {
+				s.logger.Error("Cannot save hit counts", "path", store.path, "err", err)
+			}
 		}
 		close(done)
 	}()
 
-	logger.Infof("Server listening on %s", addr)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Fatalf("Could not listen on %s: %v", addr, err)
+	if tlsCert != "" {
+		go (&certMonitor{
+			certFile:     tlsCert,
+			warnDays:     certWarnDays,
+			criticalDays: certCriticalDays,
+			webhookURL:   certWebhookURL,
+			logger:       s.logger,
+		}).run(certCheckInterval)
+	}
+
+	s.logger.Info("Server listening", "addr", listening)
+	serve := func() error { return httpServer.Serve(listener) }
+	switch {
+	case tlsCert != "":
+		serve = func() error { return httpServer.ServeTLS(listener, tlsCert, tlsKey) }
+	case tlsAutoDomain != "":
+		// Certificates are obtained through the TLS-ALPN-01 challenge on
+		// this listener, so no plain HTTP port is needed.
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(tlsAutoDomain, ",")...),
+			Cache:      autocert.DirCache(tlsCacheDir),
+		}
+		httpServer.TLSConfig = certManager.TLSConfig()
+		serve = func() error { return httpServer.ServeTLS(listener, "", "") }
+	}
+	if err := serve(); err != nil && err != http.ErrServerClosed {
+		s.fatal("Could not listen", "addr", listening, "err", err)
 	}
 
 	<-done
-	logger.Infof("Server stopped")
+	s.logger.Info("Server stopped")
 }
 
-func mustReadFile(path string) []byte {
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		panic(err)
+// pageCountBadge returns the ?count badge for key, counting this hit if it is
+// tracked, or fallback if the count cannot be read.
+func (s *server) pageCountBadge(key string, tracked bool, referer string, query url.Values, fallback badgeImage) badgeImage {
+	n, ok := s.pageCount(key, tracked, referer)
+	if !ok {
+		return fallback
 	}
-	return b
+	return countBadge(n, query.Get("label"), query.Get("color"))
 }
 
-func generateUUID(cid *string) error {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
-	if err != nil {
-		return err
+// pageCount returns the hit count for key, counting this hit if it is
+// tracked. The first hit counted has its referer passed to -enableGSCPing.
+// On a store error it logs and returns false.
+func (s *server) pageCount(key string, tracked bool, referer string) (int64, bool) {
+	var n int64
+	var err error
+	if tracked {
+		n, err = counterStore.Increment(key)
+	} else {
+		n, err = counterStore.Get(key)
+	}
+	if errors.Is(err, errCounterFull) {
+		s.logger.Debug("Not counting new page", "key", key, "err", err)
+		return 0, false
+	} else if err != nil {
+		s.logger.Warn("Cannot read hit count", "key", key, "err", err)
+		return 0, false
 	}
+	if tracked && n == 1 && pagePings != nil {
+		pagePings.FirstHit(referer)
+	}
+	return n, true
+}
 
-	b[8] = (b[8] | 0x80) & 0xBF // what's the purpose ?
-	b[6] = (b[6] | 0x40) & 0x4F // what's the purpose ?
-	*cid = hex.EncodeToString(b)
-	return nil
+// correlationIDFrom returns the request's X-Correlation-ID or X-Request-ID
+// header, or an empty string if neither is set to a valid ID (at most 36
+// printable ASCII characters).
+func (s *server) correlationIDFrom(r *http.Request) string {
+	id := r.Header.Get("X-Correlation-ID")
+	if id == "" {
+		id = r.Header.Get("X-Request-ID")
+	}
+	if id == "" {
+		return ""
+	}
+
+	if len(id) > maxCorrelationIDLength {
+		s.logger.Debug("Ignoring overlong correlation ID", "max_length", maxCorrelationIDLength)
+		return ""
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x20 || id[i] > 0x7e {
+			s.logger.Debug("Ignoring correlation ID with non-printable characters")
+			return ""
+		}
+	}
+	return id
 }
 
-func log(ua string, ip string, cid string, values url.Values) error {
-	req, _ := http.NewRequest("POST", beaconURL, strings.NewReader(values.Encode()))
-	req.Header.Add("User-Agent", ua)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+func log(ctx context.Context, job hitJob, payload gaRequest) error {
+	breaker := breakerFor(payload.url, job.logger)
+	if !breaker.Allow() {
+		if spoolHit(job, payload) {
+			hitsSpooled.Inc()
+		} else {
+			hitsErrored.Inc()
+		}
+		job.logger.Debug("Not reporting hit", "err", errCircuitOpen, "url", redactSecret(payload.url), "request_id", job.requestID)
+		return errCircuitOpen
+	}
+	ctx, sp := startSpan(ctx, "POST", spanClient)
+	sp.Set("url.full", redactSecret(payload.url))
+	attempts := 0
+	err := budgetedRetry(ctx, job.logger, gaBudget, func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, "POST", payload.url, strings.NewReader(payload.body))
+		req.Header.Add("User-Agent", job.ua)
+		req.Header.Add("Content-Type", payload.contentType)
+		for key, values := range payload.header {
+			req.Header[key] = values
+		}
+		if sp != nil {
+			req.Header.Set("traceparent", sp.traceparent())
+		}
+		attempts++
+
+		start := time.Now()
+		resp, err := gaClient.Do(req)
+		gaRequestDuration.ObserveSince(start)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		countProto(resp)
+		sp.Set("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("collector returned %s", resp.Status)
+		}
 
-	c := &http.Client{}
-	if resp, err := c.Do(req); err != nil {
-		logger.Errorf("GA collector POST error: %s", err.Error())
-		return err
+		job.logger.Debug("Hit reported", "status", resp.StatusCode, "proto", resp.Proto, "tid", job.params[0], "path", job.params[1], "cid", job.cid, "ip", job.ip, "source", job.source, "request_id", job.requestID, "payload", payload.body)
+		return nil
+	})
+	breaker.Record(err == nil)
+	err = redactURLError(err)
+	sp.Set("beacon.attempts", attempts)
+	sp.End(err)
+	if err != nil && spoolHit(job, payload) {
+		hitsSpooled.Inc()
+		job.logger.Warn("Collector POST failed, hit spooled", "url", redactSecret(payload.url), "err", err, "tid", job.params[0], "cid", job.cid, "request_id", job.requestID)
+	} else if err != nil {
+		hitsErrored.Inc()
+		job.logger.Error("Collector POST failed", "url", redactSecret(payload.url), "err", err, "tid", job.params[0], "cid", job.cid, "request_id", job.requestID)
 	} else {
-		logger.Debugf("GA collector status: %v, cid: %v, ip: %s", resp.Status, cid, ip)
-		logger.Debugf("Reported payload: %v", values)
+		hitsLogged.Inc()
+	}
+	return err
+}
+
+// logHit reports a hit to the account's collector and to its -fanout
+// destinations, returning the first error.
+func logHit(ctx context.Context, job hitJob) error {
+	err := collectorFor(job.params[0]).Collect(ctx, job)
+	jobs, targets := fanoutJobs(job)
+	for i, fanned := range jobs {
+		if ferr := targets[i].Collect(ctx, fanned); err == nil {
+			err = ferr
+		}
+	}
+	mirrorHit(ctx, job)
+	return err
+}
+
+// hitPriorityFor returns the queue priority of a hit for account.
+func hitPriorityFor(account string, query url.Values) hitPriority {
+	if highPriority[account] {
+		return priorityHigh
+	}
+	if allowPriorityParam && query.Get("priority") == "low" {
+		return priorityLow
 	}
-	return nil
+	return priorityNormal
 }
 
-func logHit(params []string, query url.Values, ua string, ip string, cid string) error {
-	// 1) Initialize default values from path structure
-	// 2) Allow query param override to report arbitrary values to GA
-	//
-	// GA Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/v1/reference
+// responseDelayFor returns how long the beacon response should be held back,
+// capped at maxResponseDelay.
+func responseDelayFor(query url.Values) time.Duration {
+	delay := responseDelay
+	if allowDelayParam {
+		if d, err := time.ParseDuration(query.Get("delay")); err == nil {
+			delay = d
+		}
+	}
+	if delay > maxResponseDelay {
+		delay = maxResponseDelay
+	}
+	return delay
+}
 
-	payload := url.Values{
-		"v":   {"1"},        // protocol version = 1
-		"t":   {"pageview"}, // hit type
-		"tid": {params[0]},  // tracking / property ID
-		"cid": {cid},        // unique client ID (server generated UUID)
-		"dp":  {params[1]},  // page path
-		"uip": {ip},         // IP address of the user
+// isCacheable reports whether every param in query belongs to cacheableSet.
+func isCacheable(query url.Values, cacheableSet map[string]bool) bool {
+	for key := range query {
+		if !cacheableSet[key] {
+			return false
+		}
 	}
+	return true
+}
 
-	for key, val := range query {
-		payload[key] = val
+// setCacheHeaders marks an image response as publicly cacheable when the
+// query only selects a badge style, and as private otherwise. Anything
+// per-user (uid, cid, dl, ...) must never end up in a shared cache, so other
+// responses, which can carry the client ID, are always private, and
+// setCIDHeaders makes cacheable badges private once it sets the cookie.
+func setCacheHeaders(w http.ResponseWriter, query url.Values, image bool) {
+	now := time.Now().UTC()
+	if image && isCacheable(query, cacheableQueryParams) {
+		if badgeCacheSeconds > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", badgeCacheSeconds))
+		} else {
+			w.Header().Set("Cache-Control", "public, no-cache")
+		}
+		w.Header().Set("Expires", now.Add(time.Duration(badgeCacheSeconds)*time.Second).Format(http.TimeFormat))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Expires", now.Format(http.TimeFormat))
 	}
+	// The CID header is derived from the cookie, so caches must key on it.
+	w.Header().Add("Vary", "Cookie")
+}
 
-	return log(ua, ip, cid, payload)
+func (s *server) handler(w http.ResponseWriter, r *http.Request) {
+	s.serveBeacon(w, r, nil, "")
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+// serveBeacon handles a beacon request, answering with forced if it is not
+// nil instead of the encoder the request selects. The client ID cookie is
+// scoped to cookiePrefix followed by the account path.
+func (s *server) serveBeacon(w http.ResponseWriter, r *http.Request, forced ResponseEncoder, cookiePrefix string) {
 	params := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
 	query, _ := url.ParseQuery(r.URL.RawQuery)
 	refOrg := r.Header.Get("Referer")
+	correlationID := s.correlationIDFrom(r)
+	requestID := correlationID
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
 
 	// / -> redirect
 	if len(params[0]) == 0 {
-		http.Redirect(w, r, "https://github.com/irvinlim/ga-beacon", http.StatusFound)
+		http.Redirect(w, r, redirectURL, http.StatusFound)
 		return
 	}
 
 	// activate referrer path if ?useReferer is used and if referer exists
 	if _, ok := query["useReferer"]; ok {
 		if len(refOrg) != 0 {
-			referer := strings.Replace(strings.Replace(refOrg, "http://", "", 1), "https://", "", 1)
+			referer, err := refererPath(refOrg)
+			if err != nil {
+				s.logger.Debug("Rejected referer", "referer", refOrg, "err", err)
+				http.Error(w, "invalid referer", http.StatusBadRequest)
+				return
+			}
 			if len(referer) != 0 {
 				// if the useReferer is present and the referer information exists
 				//  the path is ignored and the beacon referer information is used instead.
-				params = strings.SplitN(strings.Trim(r.URL.Path, "/")+"/"+referer, "/", 2)
+				// The account always comes from the request path.
+				if len(params) > 1 {
+					referer = params[1] + "/" + referer
+				}
+				params = []string{params[0], referer}
 			}
 		}
 	}
+
+	// Signatures cover the account and page of the URL, so that a signed
+	// ?useReferer badge counts on every page it is embedded in. Headers may
+	// not change what a signed URL reports to.
+	unsigned := signingKey != "" && !validSignature(signedPath(r.URL.Path, query), query.Get("sig"))
+	if allowHeaderParams {
+		embedded := strings.Join(params, "/")
+		var err error
+		if params, err = applyHeaderParams(s.logger, r, params, query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if signingKey != "" && strings.Join(params, "/") != embedded {
+			unsigned = true
+		}
+	}
+
+	if !accountAllowed(params[0]) {
+		s.logger.Debug("Rejecting request for account not in allowlist", "account", params[0])
+		http.Error(w, "account not allowed", http.StatusForbidden)
+		return
+	}
+	tenant, registered := lookupTenant(params[0])
+	if !registered {
+		s.logger.Debug("Rejecting request for account of no tenant", "account", params[0])
+		http.Error(w, "account not registered", http.StatusForbidden)
+		return
+	}
+
+	if page, ok := accountDefaultPages[params[0]]; ok && len(params) == 1 {
+		params = []string{params[0], strings.TrimPrefix(page, "/")}
+	}
+
 	// /account -> account template
 	if len(params) == 1 {
 		templateParams := struct {
@@ -172,51 +1183,297 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			Account: params[0],
 			Referer: refOrg,
 		}
-		if err := pageTemplate.ExecuteTemplate(w, "page.html", templateParams); err != nil {
+		assetsMu.RLock()
+		page := pageTemplate
+		assetsMu.RUnlock()
+		if err := page.ExecuteTemplate(w, "page.html", templateParams); err != nil {
 			http.Error(w, "could not show account page", 500)
-			logger.Errorf("Cannot execute template: %v", err)
+			s.logger.Error("Cannot execute template", "err", err)
 		}
 		return
 	}
 
 	// /account/page -> GIF + log pageview to GA collector
+	if depth := pathDepth(params[1]); depth > maxPathDepth {
+		s.logger.Info("Rejecting page path, too deep", "page", params[1], "max_depth", maxPathDepth)
+		http.Error(w, "page path too deep", http.StatusRequestURITooLong)
+		return
+	} else if depth < minPathDepth {
+		s.logger.Info("Rejecting page path, too shallow", "page", params[1], "min_depth", minPathDepth)
+		http.Error(w, "page path too shallow", http.StatusBadRequest)
+		return
+	}
+
+	script := forced == nil && wantsScript(r, query)
+	if script && !validCallback(query.Get("callback")) {
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+
+	encoder, err := responseEncoderFor(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if forced != nil {
+		encoder = forced
+	}
+
+	iconURL := query.Get("icon")
+	var iconWidth, iconHeight int
+	if iconURL != "" {
+		if iconWidth, iconHeight, err = iconSize(query); err == nil {
+			err = checkIconURL(iconURL)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateBadgeText(query.Get("label"), query.Get("message"), query.Get("color")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if badgeLabelSegment > 0 && query.Get("label") == "" {
+		if label := pathSegment(params[1], badgeLabelSegment); label != "" {
+			query.Set("label", truncateUTF8(label, maxLabelLength))
+		}
+	}
+
+	clientIP := realIP(r, trustProxy)
 	var cid string
-	if cookie, err := r.Cookie("cid"); err != nil {
-		if err := generateUUID(&cid); err != nil {
-			logger.Debugf("Failed to generate client UUID: %v", err)
+	if cookieless {
+		var err error
+		if cid, err = cookielessCIDs.CID(clientIP, r.Header.Get("User-Agent")); err != nil {
+			s.logger.Debug("Failed to derive cookieless client ID", "err", err, "request_id", requestID)
+		}
+	} else if cookie, err := r.Cookie(cidCookie.name); err != nil {
+		var err error
+		if cid, err = cidGenerator.Generate(); err != nil {
+			s.logger.Debug("Failed to generate client UUID", "err", err, "request_id", requestID)
 		} else {
-			logger.Debugf("Generated new client UUID: %v", cid)
-			http.SetCookie(w, &http.Cookie{Name: "cid", Value: cid, Path: fmt.Sprint("/", params[0])})
+			s.logger.Debug("Generated new client UUID", "cid", cid, "request_id", requestID)
 		}
 	} else {
 		cid = cookie.Value
-		logger.Debugf("Existing CID found: %v", cid)
-	}
-
-	if len(cid) != 0 {
-		var cacheUntil = time.Now().Format(http.TimeFormat)
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
-		w.Header().Set("Expires", cacheUntil)
-		w.Header().Set("CID", cid)
-
-		logHit(params, query, r.Header.Get("User-Agent"), r.RemoteAddr, cid)
-	}
-
-	// Write out GIF pixel or badge, based on presence of "pixel" param.
-	if _, ok := query["pixel"]; ok {
-		w.Header().Set("Content-Type", "image/gif")
-		w.Write(pixel)
-	} else if _, ok := query["gif"]; ok {
-		w.Header().Set("Content-Type", "image/gif")
-		w.Write(badgeGif)
-	} else if _, ok := query["flat"]; ok {
-		w.Header().Set("Content-Type", "image/svg+xml")
-		w.Write(badgeFlat)
-	} else if _, ok := query["flat-gif"]; ok {
-		w.Header().Set("Content-Type", "image/gif")
-		w.Write(badgeFlatGif)
-	} else {
-		w.Header().Set("Content-Type", "image/svg+xml")
-		w.Write(badge)
+		s.logger.Debug("Existing CID found", "cid", cid, "request_id", requestID)
+	}
+
+	if event := query.Get("event"); event != "" {
+		fields, err := parseEventParam(event)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Del("event")
+		for key, val := range fields {
+			query[key] = val
+		}
+	}
+	applyRequestParams(r, query)
+
+	if err := validateHitFields(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if selectProtocol(params[0], gaProtocol) == ProtocolGA4 {
+		if _, err := userProperties(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	hitType := query.Get("t")
+	if hitType == "" {
+		hitType = "pageview"
+	}
+	filtered := filterHit(s.logger, clientIP, r.Header.Get("User-Agent"), params[1], params[0], hitType)
+	if filtered {
+		s.logger.Debug("Hit matched the hit filter, not reporting", "account", params[0], "page", params[1])
+	}
+	bot := filterCrawlers && isCrawler(r.Header.Get("User-Agent"))
+	if bot {
+		botHits.Add(1)
+	}
+	crawler := bot && botAction == "drop"
+	if query.Get("bot") == "1" && isLoopback(hostOnly(r.RemoteAddr)) {
+		s.logger.Info("Bot check", "account", params[0], "page", params[1], "ua", r.Header.Get("User-Agent"), "crawler", bot, "hit_filter", filtered)
+	}
+
+	_, image := encoder.(ImageEncoder)
+	setCacheHeaders(w, query, image && !script)
+	if enableScriptBeacon {
+		w.Header().Add("Vary", "Accept")
+	}
+	if respectDNT {
+		w.Header().Add("Vary", "DNT, Sec-GPC")
+	}
+	page := normalizePage(s.logger, params[1])
+	suppressed := countryRestricted(s.logger, clientIP) || optedOut(r)
+	// Visitors who opted out, or whose country is restricted, get no client
+	// ID cookie either.
+	if len(cid) != 0 && !cookieless && !suppressed {
+		setCIDHeaders(w, cid, fmt.Sprint(cookiePrefix, "/", params[0]), cidCookie)
+	}
+
+	// Over the rate limit, the badge is still served (with a 429 unless
+	// -rateLimitAction is suppress) so it keeps rendering, but the hit is not
+	// reported.
+	rateLimited := !ipInNets(clientIP, exemptNets) && !ipRateLimiter.Allow(clientKey(clientIP)) ||
+		!accountRateLimiter.Allow(params[0])
+	if rateLimited && rateLimitAction == "reject" {
+		w = &statusOverrideWriter{ResponseWriter: w, status: http.StatusTooManyRequests}
+	}
+
+	if unsigned {
+		unsignedHits.Add(1)
+		s.logger.Debug("Not reporting hit without a valid signature", "path", r.URL.Path, "request_id", requestID)
+	}
+
+	// Debug requests only show the hit, so they must not count towards
+	// -coalesceWindow either.
+	_, debug := forced.(DebugEncoder)
+	sampled := len(cid) != 0 && sampledOut(cid, params[0])
+	keyless := !tenant.validKey(query.Get("key"))
+	tracked := len(cid) != 0 && !filtered && !crawler && !suppressed && !rateLimited && !unsigned && !keyless && !sampled &&
+		(debug || hitCoalesce.Allow(cid, params[0], page))
+	// Only hits that are reported use up the tenant's quota. Over it, the
+	// badge is served like over a rate limit.
+	overQuota := tenant.overQuota(tracked && !debug)
+	tracked = tracked && !overQuota
+	if overQuota && rateLimitAction == "reject" {
+		w = &statusOverrideWriter{ResponseWriter: w, status: http.StatusTooManyRequests}
+	}
+	result := &HitResult{Tracked: tracked, CID: cid, Account: params[0], Page: page}
+	job := hitJob{
+		params:        []string{params[0], page},
+		query:         query,
+		ua:            r.Header.Get("User-Agent"),
+		ip:            clientIP,
+		cid:           cid,
+		correlationID: correlationID,
+		requestID:     requestID,
+		source:        hitSource(r),
+		priority:      hitPriorityFor(params[0], query),
+		bot:           bot && botAction == "tag",
+		customFields:  customFieldValues(s.logger, r, page),
+		client:        clientInfoFor(r.Header.Get("User-Agent")),
+		hitTime:       hitTimeFor(s.logger, query, time.Now()),
+		host:          r.Host,
+		ctx:           r.Context(),
+		logger:        s.logger,
+	}
+	switch {
+	case debug:
+		result.debug = newDebugReport(r.Context(), result, job, map[string]bool{
+			"no client ID":                    len(cid) == 0,
+			"matched the hit filter":          filtered,
+			"crawler":                         crawler,
+			"opted out or country restricted": suppressed,
+			"rate limited":                    rateLimited,
+			"no valid signature":              unsigned,
+			"no valid tenant key":             keyless,
+			"over the tenant's daily quota":   overQuota,
+			"sampled out":                     sampled,
+		})
+	case !tracked:
+		hitsSkipped.Inc()
+	default:
+		countAccountHit(params[0])
+		if uniqueVisitors != nil {
+			if err := uniqueVisitors.Add(params[0]+"/"+page, cid, time.Now()); err != nil {
+				s.logger.Debug("Not counting unique visitors of new page", "account", params[0], "page", page, "err", err)
+			}
+		}
+		if !hitWorkers.Enqueue(job) {
+			result.Error = "hit queue is full"
+		}
+	}
+
+	// Hold the response back if a delay is configured. The hit has already
+	// been queued, so GA still records it at the correct time.
+	if delay := responseDelayFor(query); delay > 0 && !debug {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if script {
+		writeScript(w, query.Get("callback"), tracked)
+		return
+	}
+
+	if _, ok := encoder.(ImageEncoder); !ok {
+		if err := encoder.EncodeResponse(w, result); err != nil {
+			s.logger.Error("Cannot encode response", "err", err)
+		}
+		return
+	}
+
+	if _, ok := query["thumbnail"]; ok && enableThumbnails && refOrg != "" {
+		if data, contentType, err := cachedThumbnail(s.logger, refOrg); err != nil {
+			s.logger.Debug("No thumbnail, serving badge", "page", refOrg, "err", err)
+		} else {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Write(data)
+			badgeServed("thumbnail")
+			return
+		}
+	}
+
+	// Write out GIF pixel or badge, based on the style params in the query
+	// or, failing that, the Accept header.
+	variant := badgeVariantFor(query)
+	if variant == "" {
+		variant = accountBadgeVariant(params[0])
+	}
+	if variant == "" && negotiateFormat {
+		variant = negotiateBadgeVariant(r)
+		w.Header().Add("Vary", "Accept")
+	}
+	assetsMu.RLock()
+	img, staticModTime := badgeImages[variant], badgeModTime
+	assetsMu.RUnlock()
+	served := variant
+	if suppressed {
+		img = disabledBadge(variant)
+	} else if _, ok := query["count"]; ok && counterStore != nil {
+		// Icons are embedded into the whole badge, so a badge with one is
+		// not streamed.
+		if flusher, ok := w.(http.Flusher); ok && streamingBadge && iconURL == "" {
+			s.streamCountBadge(w, flusher, params[0]+"/"+page, tracked, r.Header.Get("Referer"), query)
+			badgeServed("count")
+			return
+		}
+		img = s.pageCountBadge(params[0]+"/"+page, tracked, r.Header.Get("Referer"), query, img)
+		served = "count"
+	} else if wantsRenderedBadge(variant, query) {
+		img = renderVariantBadge(variant, query.Get("label"), query.Get("message"), query.Get("color"))
+		served = "rendered"
+	}
+	if iconURL != "" && img.contentType == "image/svg+xml" {
+		icon, err := fetchAndEmbedIcon(iconURL, iconTimeout)
+		if err != nil {
+			s.logger.Warn("Cannot embed icon", "icon", iconURL, "err", err)
+			http.Error(w, "cannot embed icon", http.StatusBadRequest)
+			return
+		}
+		img = withIcon(img, icon, iconWidth, iconHeight)
+	}
+	// Static badges change only when the assets are reloaded; dynamic ones
+	// are validated by their ETag alone.
+	var modTime time.Time
+	if served == variant {
+		modTime = staticModTime
+	}
+	if _, overridden := w.(*statusOverrideWriter); !overridden && badgeNotModified(w, r, img, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		badgeServed(served)
+		return
 	}
+	result.image = img
+	encoder.EncodeResponse(w, result)
+	badgeServed(served)
 }
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves the requests of the tests, logging nowhere. Tests that
+// check what is logged make a server of their own with newLoggingServer.
+var testServer = &server{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+// newLoggingServer returns a server logging to buf as text.
+func newLoggingServer(buf *bytes.Buffer) *server {
+	return &server{logger: slog.New(slog.NewTextHandler(buf, nil))}
+}
+
+func TestMain(m *testing.M) {
+	if err := loadAssets(testServer.logger); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// stubHit is a request received by a gaStub.
+type stubHit struct {
+	path   string
+	query  url.Values
+	header http.Header
+	body   string
+}
+
+// form parses the body of a Universal Analytics hit.
+func (h stubHit) form() url.Values {
+	values, _ := url.ParseQuery(h.body)
+	return values
+}
+
+// gaStub is a collector recording the hits POSTed to it.
+type gaStub struct {
+	*httptest.Server
+	hits chan stubHit
+
+	mu     sync.Mutex
+	status int
+}
+
+func newGAStub(t *testing.T) *gaStub {
+	t.Helper()
+	stub := &gaStub{hits: make(chan stubHit, 100), status: http.StatusOK}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		stub.hits <- stubHit{path: r.URL.Path, query: r.URL.Query(), header: r.Header.Clone(), body: string(body)}
+		stub.mu.Lock()
+		status := stub.status
+		stub.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// respond makes the stub answer with status from now on.
+func (s *gaStub) respond(status int) {
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+}
+
+// next returns the next hit the stub receives.
+func (s *gaStub) next(t *testing.T) stubHit {
+	t.Helper()
+	select {
+	case hit := <-s.hits:
+		return hit
+	case <-time.After(5 * time.Second):
+		t.Fatal("no hit reached the collector")
+		return stubHit{}
+	}
+}
+
+// none checks that the stub receives no hit for a while.
+func (s *gaStub) none(t *testing.T) {
+	t.Helper()
+	select {
+	case hit := <-s.hits:
+		t.Fatalf("unexpected hit reached the collector: %s %s", hit.path, hit.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// setFlags sets flags as given on the command line, e.g. "-gaWorkers=1", and
+// restores the previous values when t ends.
+func setFlags(t *testing.T, args ...string) {
+	t.Helper()
+	saved := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != saved[f.Name] {
+				f.Value.Set(saved[f.Name])
+			}
+		})
+	})
+	for _, arg := range args {
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			value = "true"
+		}
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("-%s: %v", name, err)
+		}
+	}
+}
+
+// keep restores *p to its current value when t ends.
+func keep[T any](t *testing.T, p *T) {
+	old := *p
+	t.Cleanup(func() { *p = old })
+}
+
+// newTestBeacon sets up what main would for serving beacons with the given
+// flags, reporting hits to a gaStub, and undoes it when t ends.
+func newTestBeacon(t *testing.T, args ...string) *gaStub {
+	t.Helper()
+	stub := newGAStub(t)
+	setFlags(t, append([]string{"-collectorURL=" + stub.URL}, args...)...)
+	keep(t, &gaEndpoint)
+	keep(t, &ga4Endpoint)
+	keep(t, &gaProtocol)
+	keep(t, &gaClient)
+	keep(t, &cidCookie)
+	keep(t, &cidGenerator)
+	keep(t, &accountCollectorNames)
+	keep(t, &fanoutDestinations)
+	keep(t, &ipRateLimiter)
+	keep(t, &accountRateLimiter)
+	keep(t, &exemptNets)
+	keep(t, &trustedProxyNets)
+	keep(t, &highPriority)
+	keep(t, &hitCoalesce)
+	keep(t, &hitWorkers)
+	keep(t, &counterStore)
+	allowlist := staticAllowlist.Load()
+	t.Cleanup(func() { staticAllowlist.Store(allowlist) })
+
+	base, err := collectorBase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gaEndpoint == "" {
+		gaEndpoint = base + "/collect"
+	}
+	ga4Endpoint = base + "/mp/collect"
+	if gaProtocol, err = parseProtocolVersion(gaProtocolFlag); err != nil {
+		t.Fatal(err)
+	}
+	gaClient = newGAClient(gaHTTP2)
+	sameSite, err := parseSameSite(cookieSameSite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insecureCookie {
+		sameSite, cookieSecure = http.SameSiteLaxMode, false
+	}
+	cidCookie = &cookieConfig{name: cookieName, maxAge: cookieMaxAge, domain: cookieDomain, secure: cookieSecure, sameSite: sameSite}
+	if cidGenerator, err = newCIDGenerator(cidEntropy); err != nil {
+		t.Fatal(err)
+	}
+	if accountCollectorNames, err = parseAccountCollectors(accountCollectors); err != nil {
+		t.Fatal(err)
+	}
+	if fanoutDestinations, err = parseFanout(fanoutList); err != nil {
+		t.Fatal(err)
+	}
+	staticAllowlist.Store(parseAllowedIDs(allowedIDs))
+	ipRateLimiter = newRateLimiter(rateLimitRPS, rateLimitBurst)
+	accountRateLimiter = newRateLimiter(accountRateLimitRPS, accountRateLimitBurst)
+	if exemptNets, err = parseIPList(exemptIPs); err != nil {
+		t.Fatal(err)
+	}
+	if trustedProxyNets, err = parseIPList(trustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	highPriority = map[string]bool{}
+	for _, id := range strings.Split(highPriorityAccounts, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			highPriority[id] = true
+		}
+	}
+	hitCoalesce = newHitCoalescer(coalesceWindow, coalesceMaxEntries, testServer.logger)
+	hitWorkers = newHitWorkerPool(gaWorkers, gaQueueDepth, dropPolicy, testServer.logger)
+	pool := hitWorkers
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		pool.Stop(ctx)
+	})
+	return stub
+}
+
+// get serves a GET of target with the beacon handler of testServer.
+func get(target string, header ...string) *httptest.ResponseRecorder {
+	return getFrom(testServer, target, header...)
+}
+
+// getFrom serves a GET of target with the beacon handler of s.
+func getFrom(s *server, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.handler(w, r)
+	return w
+}
+
+func TestResponseDelay(t *testing.T) {
+	stub := newTestBeacon(t, "-responseDelay=100ms")
+
+	start := time.Now()
+	w := get("/UA-1234-1/delayed")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("response took %v, want at least 100ms", elapsed)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", w.Code)
+	}
+	// The hit is queued before the delay.
+	stub.next(t)
+}
+
+func TestResponseDelayFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		delay      time.Duration
+		allowParam bool
+		query      string
+		want       time.Duration
+	}{
+		{"none", 0, false, "", 0},
+		{"flag", 100 * time.Millisecond, false, "", 100 * time.Millisecond},
+		{"param ignored", 0, false, "delay=500ms", 0},
+		{"param", 0, true, "delay=500ms", 500 * time.Millisecond},
+		{"invalid param", 100 * time.Millisecond, true, "delay=soon", 100 * time.Millisecond},
+		{"capped", 0, true, "delay=1h", maxResponseDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &responseDelay)
+			keep(t, &allowDelayParam)
+			responseDelay, allowDelayParam = tt.delay, tt.allowParam
+			query, _ := url.ParseQuery(tt.query)
+			if got := responseDelayFor(query); got != tt.want {
+				t.Errorf("responseDelayFor(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	newTestBeacon(t, "-badgeCacheSeconds=60")
+
+	tests := []struct {
+		name       string
+		query      string
+		cookieless bool
+		want       string
+	}{
+		// The client ID cookie keeps even style-only badges out of shared
+		// caches.
+		{"no params", "", false, "private, max-age=60"},
+		{"all cacheable", "?flat&label=docs", false, "private, max-age=60"},
+		{"no params, cookieless", "", true, "public, max-age=60"},
+		{"all cacheable, cookieless", "?flat&label=docs", true, "public, max-age=60"},
+		{"mixed", "?pixel&uid=42", false, "private, no-store"},
+		{"mixed, cookieless", "?pixel&uid=42", true, "private, no-store"},
+		{"all private", "?cid=1.2&dl=https://example.com/", false, "private, no-store"},
+		{"json", "?flat&enc=json", false, "private, no-store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &allowEncParam)
+			allowEncParam = true
+			setFlags(t, "-cookieless="+strconv.FormatBool(tt.cookieless))
+			w := get("/UA-1234-1/page" + tt.query)
+			if got := w.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+			if got := w.Header().Get("Set-Cookie"); tt.cookieless != (got == "") {
+				t.Errorf("Set-Cookie = %q, cookieless %v", got, tt.cookieless)
+			}
+			if vary := w.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Cookie") {
+				t.Errorf("Vary = %q, want it to list Cookie", vary)
+			}
+		})
+	}
+}
+
+func TestBadgeRevalidation(t *testing.T) {
+	stub := newTestBeacon(t, "-badgeCacheSeconds=0", "-coalesceWindow=0")
+	w := get("/UA-1234-1/page")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("status = %d, ETag %q, Last-Modified %q, want the badge with both", w.Code, etag, w.Header().Get("Last-Modified"))
+	}
+	if got := w.Header().Get("Cache-Control"); !strings.Contains(got, "no-cache") {
+		t.Errorf("Cache-Control = %q, want revalidation on every view with -badgeCacheSeconds=0", got)
+	}
+	stub.next(t)
+
+	lastModified := w.Header().Get("Last-Modified")
+	tests := []struct {
+		name   string
+		query  string
+		header []string
+		want   int
+	}{
+		{"ETag", "", []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"weak ETag", "", []string{"If-None-Match", "W/" + etag}, http.StatusNotModified},
+		{"ETag in a list", "", []string{"If-None-Match", `"0123456789abcdef", ` + etag}, http.StatusNotModified},
+		{"any ETag", "", []string{"If-None-Match", "*"}, http.StatusNotModified},
+		{"other ETag", "", []string{"If-None-Match", `"0123456789abcdef"`}, http.StatusOK},
+		{"other badge", "?pixel", []string{"If-None-Match", etag}, http.StatusOK},
+		{"not modified since", "", []string{"If-Modified-Since", lastModified}, http.StatusNotModified},
+		{"modified since", "", []string{"If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+		{"ETag wins over the date", "", []string{"If-None-Match", `"0123456789abcdef"`, "If-Modified-Since", lastModified}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get("/UA-1234-1/page"+tt.query, tt.header...)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != etag) {
+				t.Errorf("304 with %d bytes and ETag %q, want no body and the ETag", w.Body.Len(), w.Header().Get("ETag"))
+			}
+			if tt.want == http.StatusOK && w.Body.Len() == 0 {
+				t.Error("200 without the badge")
+			}
+			// The view is reported whether or not the badge is sent.
+			if got := stub.next(t).form().Get("tid"); got != "UA-1234-1" {
+				t.Errorf("tid = %s, want UA-1234-1", got)
+			}
+		})
+	}
+}
+
+func TestBadgeRevalidationOverRateLimit(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0", "-rateLimitRPS=0.001", "-rateLimitBurst=1")
+	etag := get("/UA-1234-1/page").Header().Get("ETag")
+	stub.next(t)
+
+	// A 429 is not turned into a 304, so clients see the hit was refused,
+	// and the hit is not reported.
+	w := get("/UA-1234-1/page", "If-None-Match", etag)
+	if w.Code != http.StatusTooManyRequests || w.Body.Len() == 0 {
+		t.Errorf("status = %d with %d bytes, want the badge with a 429", w.Code, w.Body.Len())
+	}
+	stub.none(t)
+}
+
+func TestIsCacheable(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"pixel", true},
+		{"gif&flat", true},
+		{"flat-gif&uid=1", false},
+		{"dl=x", false},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		if got := isCacheable(query, cacheableQueryParams); got != tt.want {
+			t.Errorf("isCacheable(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCorrelationIDFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   string
+	}{
+		{"absent", nil, ""},
+		{"correlation ID", []string{"X-Correlation-ID", "abc-123"}, "abc-123"},
+		{"request ID", []string{"X-Request-ID", "req-1"}, "req-1"},
+		{"correlation ID first", []string{"X-Request-ID", "req-1", "X-Correlation-ID", "abc-123"}, "abc-123"},
+		{"36 bytes", []string{"X-Request-ID", strings.Repeat("a", 36)}, strings.Repeat("a", 36)},
+		{"too long", []string{"X-Request-ID", strings.Repeat("a", 37)}, ""},
+		{"non-ASCII", []string{"X-Request-ID", "idé"}, ""},
+		{"control character", []string{"X-Request-ID", "id\x01"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/UA-1234-1/page", nil)
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			if got := testServer.correlationIDFrom(r); got != tt.want {
+				t.Errorf("correlationIDFrom() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCorrelationIDDimension(t *testing.T) {
+	stub := newTestBeacon(t, "-correlationIDDimension=200")
+
+	w := get("/UA-1234-1/page", "X-Correlation-ID", "abc-123")
+	if got := w.Header().Get("X-Request-ID"); got != "abc-123" {
+		t.Errorf("X-Request-ID = %q, want abc-123", got)
+	}
+	if got := stub.next(t).form().Get("cd200"); got != "abc-123" {
+		t.Errorf("cd200 = %q, want abc-123", got)
+	}
+
+	get("/UA-1234-1/page", "X-Correlation-ID", strings.Repeat("a", 37))
+	if form := stub.next(t).form(); form.Has("cd200") {
+		t.Errorf("cd200 = %q for an invalid ID, want none", form.Get("cd200"))
+	}
+}
+
+func TestRootRedirect(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want string
+	}{
+		{"default", nil, "", defaultRedirectURL},
+		{"flag", []string{"-redirectURL=https://example.com/beacon"}, "", "https://example.com/beacon"},
+		{"environment", nil, "https://env.example.com/", "https://env.example.com/"},
+		{"flag over environment", []string{"-redirectURL=https://example.com/beacon"}, "https://env.example.com/", "https://example.com/beacon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBeacon(t)
+			keep(t, &redirectURL)
+			fs := flag.NewFlagSet("ga-beacon", flag.ContinueOnError)
+			fs.StringVar(&redirectURL, "redirectURL", defaultRedirectURL, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if tt.env != "" {
+				t.Setenv("GA_BEACON_REDIRECT_URL", tt.env)
+			}
+			if err := applyEnvFlags(fs); err != nil {
+				t.Fatal(err)
+			}
+
+			w := get("/")
+			if w.Code != http.StatusFound {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusFound)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
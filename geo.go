@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	maxGeoCacheEntries = 100000
+
+	// geoipReloadInterval is how often -geoipDB is checked for a new
+	// version, or for a database that was missing.
+	geoipReloadInterval = time.Minute
+)
+
+var (
+	// geoip is the -geoipDB database, or nil without the flag.
+	geoip *geoipDatabase
+
+	// Country codes from -blockCountries and -allowCountries, or nil.
+	blockedCountries map[string]bool
+	allowedCountries map[string]bool
+
+	countryBlockedHits atomic.Int64
+	countryAllowedHits atomic.Int64
+
+	geoCacheMu sync.Mutex
+	geoCache   = map[string]geoLocation{}
+)
+
+// geoLocation is where a client IP is, as far as the database knows.
+type geoLocation struct {
+	Country string // ISO 3166-1 alpha-2 code
+	Region  string // first subdivision, in English
+	City    string // in English
+}
+
+// geoipDatabase is a MaxMind database file, reloaded when it changes. While
+// the file is missing or unreadable, lookups find nothing and hits are
+// reported without location.
+//
+// The file is read into memory rather than mapped, so that a replaced
+// reader can be left to the garbage collector while lookups still use it;
+// closing a mapped one under them would crash the process.
+type geoipDatabase struct {
+	path string
+	// city is set when region or city dimensions are wanted, which takes a
+	// City database rather than a Country one.
+	city   bool
+	logger *slog.Logger
+
+	reader atomic.Pointer[geoip2.Reader]
+
+	mu      sync.Mutex // serializes reload
+	modTime time.Time  // of the open file
+}
+
+// openGeoIP opens path. A missing or broken database is not an error: it is
+// logged and retried by run.
+func openGeoIP(path string, city bool, logger *slog.Logger) *geoipDatabase {
+	db := &geoipDatabase{path: path, city: city, logger: logger}
+	if err := db.reload(); err != nil {
+		logger.Warn("GeoIP database unavailable, hits are reported without location until it loads", "path", path, "err", err)
+	}
+	return db
+}
+
+// reload reads the database again if the file changed since it was last
+// read.
+func (db *geoipDatabase) reload() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(db.modTime) && db.reader.Load() != nil {
+		return nil
+	}
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	reader, err := geoip2.FromBytes(data)
+	if err != nil {
+		return err
+	}
+	db.modTime = info.ModTime()
+	db.reader.Store(reader)
+	geoCacheMu.Lock()
+	geoCache = map[string]geoLocation{}
+	geoCacheMu.Unlock()
+	db.logger.Info("Loaded GeoIP database", "path", db.path)
+	return nil
+}
+
+// run checks for a new database every interval.
+func (db *geoipDatabase) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := db.reload(); err != nil {
+			db.logger.Warn("Cannot reload GeoIP database", "path", db.path, "err", err)
+		}
+	}
+}
+
+// Loaded reports whether a database is open.
+func (db *geoipDatabase) Loaded() bool {
+	return db != nil && db.reader.Load() != nil
+}
+
+// Close drops the loaded database.
+func (db *geoipDatabase) Close() {
+	db.reader.Store(nil)
+}
+
+func (db *geoipDatabase) lookup(ip net.IP) (geoLocation, error) {
+	reader := db.reader.Load()
+	if reader == nil {
+		return geoLocation{}, fmt.Errorf("no database loaded")
+	}
+	if !db.city {
+		record, err := reader.Country(ip)
+		if err != nil {
+			return geoLocation{}, err
+		}
+		return geoLocation{Country: record.Country.IsoCode}, nil
+	}
+	record, err := reader.City(ip)
+	if err != nil {
+		return geoLocation{}, err
+	}
+	loc := geoLocation{Country: record.Country.IsoCode, City: record.City.Names["en"]}
+	if len(record.Subdivisions) > 0 {
+		loc.Region = record.Subdivisions[0].Names["en"]
+	}
+	return loc, nil
+}
+
+// parseCountries parses a comma-separated list of ISO 3166-1 alpha-2 codes.
+func parseCountries(list string) map[string]bool {
+	var countries map[string]bool
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			if countries == nil {
+				countries = map[string]bool{}
+			}
+			countries[code] = true
+		}
+	}
+	return countries
+}
+
+// subnetKey returns the /24 (IPv4) or /64 (IPv6) network of ip, which is
+// assumed to share a single country.
+func subnetKey(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// lookupGeo returns where ip is, with empty fields for what is unknown.
+func lookupGeo(ip net.IP) geoLocation {
+	if !geoip.Loaded() {
+		return geoLocation{}
+	}
+	key := subnetKey(ip)
+	geoCacheMu.Lock()
+	loc, ok := geoCache[key]
+	geoCacheMu.Unlock()
+	if ok {
+		return loc
+	}
+
+	loc, err := geoip.lookup(ip)
+	if err != nil {
+		geoip.logger.Debug("GeoIP lookup failed", "ip", ip, "err", err)
+		return geoLocation{}
+	}
+
+	geoCacheMu.Lock()
+	if len(geoCache) >= maxGeoCacheEntries {
+		geoCache = map[string]geoLocation{}
+	}
+	geoCache[key] = loc
+	geoCacheMu.Unlock()
+	return loc
+}
+
+// applyGeo adds the location of ip to a v1 payload: the country as geoid with
+// -geoid, and -geoCountryDimension, -geoRegionDimension and
+// -geoCityDimension.
+func applyGeo(payload url.Values, ip string) {
+	if !geoEnrichment() {
+		return
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return
+	}
+	loc := lookupGeo(parsed)
+	if reportGeoID && loc.Country != "" {
+		payload.Set("geoid", loc.Country)
+	}
+	for _, d := range []struct {
+		index int
+		value string
+	}{
+		{geoCountryDimension, loc.Country},
+		{geoRegionDimension, loc.Region},
+		{geoCityDimension, loc.City},
+	} {
+		if d.index > 0 && d.value != "" {
+			payload.Set(fmt.Sprintf("cd%d", d.index), d.value)
+		}
+	}
+}
+
+// geoEnrichment reports whether hits get location fields.
+func geoEnrichment() bool {
+	return reportGeoID || geoCountryDimension > 0 || geoRegionDimension > 0 || geoCityDimension > 0
+}
+
+// countryRestricted reports whether hits from host must not be reported
+// because of -blockCountries or -allowCountries. -allowCountries takes
+// precedence when both are set.
+func countryRestricted(logger *slog.Logger, host string) bool {
+	if allowedCountries == nil && blockedCountries == nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	country := lookupGeo(ip).Country
+	var blocked bool
+	if allowedCountries != nil {
+		blocked = !allowedCountries[country]
+	} else {
+		blocked = blockedCountries[country]
+	}
+
+	if blocked {
+		countryBlockedHits.Add(1)
+		logger.Debug("Not reporting hit from blocked country", "ip", host, "country", country)
+	} else {
+		countryAllowedHits.Add(1)
+	}
+	return blocked
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// fakeGeoIP makes the client IPs in the /24 networks of locations resolve to
+// their countries. The loaded reader is empty: it is never asked, since the
+// lookups all hit the cache.
+func fakeGeoIP(t *testing.T, locations map[string]string) {
+	keep(t, &geoip)
+	geoip = &geoipDatabase{logger: testServer.logger}
+	geoip.reader.Store(&geoip2.Reader{})
+
+	geoCacheMu.Lock()
+	geoCache = map[string]geoLocation{}
+	for ip, country := range locations {
+		geoCache[subnetKey(net.ParseIP(ip))] = geoLocation{Country: country}
+	}
+	geoCacheMu.Unlock()
+	t.Cleanup(func() {
+		geoCacheMu.Lock()
+		geoCache = map[string]geoLocation{}
+		geoCacheMu.Unlock()
+	})
+}
+
+func TestCountryRestriction(t *testing.T) {
+	tests := []struct {
+		name     string
+		block    string
+		allow    string
+		country  string
+		reported bool
+	}{
+		{"no flags", "", "", "DE", true},
+		{"blocked", "fr, DE", "", "DE", false},
+		{"not blocked", "DE", "", "US", true},
+		{"allowed", "", "US,CA", "US", true},
+		{"not allowed", "", "US", "DE", false},
+		{"unknown country not allowed", "", "US", "", false},
+		{"allow wins over block", "DE", "DE", "DE", true},
+		{"block ignored with allow", "US", "DE", "US", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t)
+			fakeGeoIP(t, map[string]string{"192.0.2.1": tt.country})
+			keep(t, &blockedCountries)
+			keep(t, &allowedCountries)
+			blockedCountries, allowedCountries = parseCountries(tt.block), parseCountries(tt.allow)
+			blocked, allowed := countryBlockedHits.Load(), countryAllowedHits.Load()
+
+			w := get("/UA-1234-1/page")
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+				t.Errorf("response = %d %s, want the badge either way", w.Code, w.Header().Get("Content-Type"))
+			}
+			if tt.reported {
+				stub.next(t)
+			} else {
+				stub.none(t)
+			}
+
+			var wantBlocked, wantAllowed int64
+			if tt.block != "" || tt.allow != "" {
+				if tt.reported {
+					wantAllowed = 1
+				} else {
+					wantBlocked = 1
+				}
+			}
+			gotBlocked, gotAllowed := countryBlockedHits.Load()-blocked, countryAllowedHits.Load()-allowed
+			if gotBlocked != wantBlocked || gotAllowed != wantAllowed {
+				t.Errorf("blocked, allowed hits counted = %d, %d, want %d, %d", gotBlocked, gotAllowed, wantBlocked, wantAllowed)
+			}
+		})
+	}
+}
+
+func TestSubnetKey(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.0"},
+		{"192.0.2.254", "192.0.2.0"},
+		{"::ffff:192.0.2.9", "192.0.2.0"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::"},
+	}
+	for _, tt := range tests {
+		if got := subnetKey(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("subnetKey(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestParseCountries(t *testing.T) {
+	got := parseCountries(" de,US, ,fr")
+	if len(got) != 3 || !got["DE"] || !got["US"] || !got["FR"] {
+		t.Errorf("parseCountries() = %v, want DE, US and FR", got)
+	}
+	if got := parseCountries(""); got != nil {
+		t.Errorf("parseCountries(\"\") = %v, want nil", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// gifBadgeHeight and gifBadgeBaseline match the SVG badges.
+const (
+	gifBadgeHeight   = 20
+	gifBadgeBaseline = 14
+)
+
+var gifLabelColor = color.RGBA{0x55, 0x55, 0x55, 0xff}
+
+// renderGIFBadge draws what renderBadge would show as a GIF, for the gif
+// and flat-gif variants, in a 7x13 bitmap font. Only ASCII text is drawn.
+func renderGIFBadge(label, message, fill string) badgeImage {
+	label, message = renderedBadgeText(label, message)
+	key := badgeText{label, message, badgeFill(fill), true}
+
+	renderedBadgesMu.Lock()
+	defer renderedBadgesMu.Unlock()
+	if img, ok := renderedBadges[key]; ok {
+		return img
+	}
+
+	face := basicfont.Face7x13
+	labelWidth := font.MeasureString(face, label).Ceil() + badgeTextPadding
+	messageWidth := font.MeasureString(face, message).Ceil() + badgeTextPadding
+	width := labelWidth + messageWidth
+
+	palette := color.Palette{gifLabelColor, parseHexColor(key.color), color.White}
+	dst := image.NewPaletted(image.Rect(0, 0, width, gifBadgeHeight), palette)
+	draw.Draw(dst, image.Rect(0, 0, labelWidth, gifBadgeHeight), image.NewUniform(palette[0]), image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(labelWidth, 0, width, gifBadgeHeight), image.NewUniform(palette[1]), image.Point{}, draw.Src)
+	d := &font.Drawer{Dst: dst, Src: image.White, Face: face}
+	d.Dot = fixed.P(badgeTextPadding/2, gifBadgeBaseline)
+	d.DrawString(label)
+	d.Dot = fixed.P(labelWidth+badgeTextPadding/2, gifBadgeBaseline)
+	d.DrawString(message)
+
+	var b bytes.Buffer
+	gif.Encode(&b, dst, nil)
+	img := badgeImage{"image/gif", b.Bytes()}
+
+	if len(renderedBadges) >= maxRenderedBadges {
+		renderedBadges = map[badgeText]badgeImage{}
+	}
+	renderedBadges[key] = img
+	return img
+}
+
+// parseHexColor parses a #rgb or #rrggbb badgeFill value, falling back to
+// the default badge color.
+func parseHexColor(s string) color.RGBA {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if len(s) != 6 || err != nil {
+		return parseHexColor(defaultBadgeColor)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
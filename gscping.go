@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// pagePings is set when -enableGSCPing is enabled.
+var pagePings *pageObserver
+
+const (
+	// gscPingInterval is the least time between two sitemap pings.
+	gscPingInterval = time.Minute
+	// gscPingQueueSize is how many new pages may wait for their ping;
+	// pages seen past it are not pinged.
+	gscPingQueueSize = 1000
+)
+
+// pageObserver pings -gscPingURL with the URL of each page a counter sees
+// its first hit on, at most once per interval. Pinged URLs are kept in the
+// gsc_pings table of db, if set, so that they are not pinged again after a
+// restart.
+type pageObserver struct {
+	pingURL  *url.URL
+	db       *sql.DB
+	interval time.Duration
+	client   *http.Client
+	logger   *slog.Logger
+
+	pinged  sync.Map // page URL -> struct{}
+	pending chan string
+}
+
+// newPageObserver returns an observer pinging pingURL, loading the URLs
+// already pinged from db if it is not nil.
+func newPageObserver(pingURL string, db *sql.DB, interval time.Duration, logger *slog.Logger) (*pageObserver, error) {
+	u, err := url.Parse(pingURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("-gscPingURL must be an http or https URL, not %q", pingURL)
+	}
+	o := &pageObserver{
+		pingURL:  u,
+		db:       db,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+		pending:  make(chan string, gscPingQueueSize),
+	}
+	if db != nil {
+		if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS gsc_pings (url TEXT PRIMARY KEY, time INTEGER NOT NULL)`); err != nil {
+			return nil, err
+		}
+		rows, err := db.Query(`SELECT url FROM gsc_pings`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var pageURL string
+			if err := rows.Scan(&pageURL); err != nil {
+				return nil, err
+			}
+			o.pinged.Store(pageURL, struct{}{})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	go o.run()
+	return o, nil
+}
+
+// FirstHit queues a ping for the page a counter got its first hit from, as
+// named by the hit's Referer. Pages without an http or https referrer, and
+// those pinged before, are skipped.
+func (o *pageObserver) FirstHit(referer string) {
+	u, err := url.Parse(referer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return
+	}
+	u.Fragment = ""
+	pageURL := u.String()
+	if _, pinged := o.pinged.LoadOrStore(pageURL, struct{}{}); pinged {
+		return
+	}
+	select {
+	case o.pending <- pageURL:
+	default:
+		o.pinged.Delete(pageURL)
+		o.logger.Warn("Too many new pages waiting for a sitemap ping, not pinging", "url", pageURL)
+	}
+}
+
+// run sends the queued pings, waiting the interval after each.
+func (o *pageObserver) run() {
+	for pageURL := range o.pending {
+		if err := o.ping(pageURL); err != nil {
+			o.logger.Warn("Sitemap ping failed", "url", pageURL, "err", err)
+		} else if o.db != nil {
+			if _, err := o.db.Exec(`INSERT OR IGNORE INTO gsc_pings (url, time) VALUES (?, ?)`, pageURL, time.Now().Unix()); err != nil {
+				o.logger.Error("Cannot record sitemap ping", "url", pageURL, "err", err)
+			}
+		}
+		time.Sleep(o.interval)
+	}
+}
+
+// ping sends GET <pingURL>?sitemap=<pageURL>.
+func (o *pageObserver) ping(pageURL string) error {
+	u := *o.pingURL
+	query := u.Query()
+	query.Set("sitemap", pageURL)
+	u.RawQuery = query.Encode()
+	resp, err := o.client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("ping returned %s", resp.Status)
+	}
+	o.logger.Debug("Sitemap pinged", "url", pageURL)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pingServer returns the URL of a sitemap ping endpoint and the sitemap
+// params of the pings it gets.
+func pingServer(t *testing.T) (string, <-chan string) {
+	pings := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings <- r.URL.Query().Get("sitemap")
+	}))
+	t.Cleanup(s.Close)
+	return s.URL + "/ping", pings
+}
+
+// nextPing returns the next ping, failing t if none comes within wait.
+func nextPing(t *testing.T, pings <-chan string, wait time.Duration) string {
+	t.Helper()
+	select {
+	case ping := <-pings:
+		return ping
+	case <-time.After(wait):
+		t.Fatal("no sitemap ping")
+		return ""
+	}
+}
+
+// noPing fails t if a ping comes within 200ms.
+func noPing(t *testing.T, pings <-chan string) {
+	t.Helper()
+	select {
+	case ping := <-pings:
+		t.Errorf("unexpected sitemap ping for %s", ping)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPageObserverFirstHit(t *testing.T) {
+	pingURL, pings := pingServer(t)
+	newTestBeacon(t, "-enableCounter", "-coalesceWindow=0")
+	counterStore = newMemoryCounterStore(100)
+	keep(t, &pagePings)
+	var err error
+	if pagePings, err = newPageObserver(pingURL, nil, 0, testServer.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	get("/UA-1234-1/page?count", "Referer", "https://example.com/readme?tab=1#top")
+	if got := nextPing(t, pings, time.Second); got != "https://example.com/readme?tab=1" {
+		t.Errorf("pinged %s, want the first hit's referrer without its fragment", got)
+	}
+	get("/UA-1234-1/page?count", "Referer", "https://example.com/readme?tab=1")
+	get("/UA-1234-1/page?count", "Referer", "https://example.com/other")
+	get("/UA-1234-1/uncounted", "Referer", "https://example.com/uncounted")
+	noPing(t, pings)
+
+	get("/UA-1234-1/other?count", "Referer", "https://example.com/readme?tab=1")
+	get("/UA-1234-1/unreferred?count")
+	get("/UA-1234-1/local?count", "Referer", "file:///readme.html")
+	noPing(t, pings)
+}
+
+func TestPageObserverRateLimit(t *testing.T) {
+	pingURL, pings := pingServer(t)
+	o, err := newPageObserver(pingURL, nil, 300*time.Millisecond, testServer.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for _, page := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"} {
+		o.FirstHit(page)
+	}
+	for i, want := range []string{"https://example.com/a", "https://example.com/b", "https://example.com/c"} {
+		if got := nextPing(t, pings, time.Second); got != want {
+			t.Errorf("ping %d for %s, want %s", i+1, got, want)
+		}
+		if elapsed, least := time.Since(start), time.Duration(i)*300*time.Millisecond; elapsed < least {
+			t.Errorf("ping %d after %v, want at least %v", i+1, elapsed, least)
+		}
+	}
+}
+
+func TestPageObserverPersisted(t *testing.T) {
+	pingURL, pings := pingServer(t)
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "hits.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	o, err := newPageObserver(pingURL, db, 0, testServer.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.FirstHit("https://example.com/a")
+	nextPing(t, pings, time.Second)
+	for deadline := time.Now().Add(time.Second); ; {
+		var n int
+		if db.QueryRow(`SELECT COUNT(*) FROM gsc_pings`).Scan(&n); n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ping not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restarted, err := newPageObserver(pingURL, db, 0, testServer.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.FirstHit("https://example.com/a")
+	noPing(t, pings)
+	restarted.FirstHit("https://example.com/b")
+	if got := nextPing(t, pings, time.Second); got != "https://example.com/b" {
+		t.Errorf("pinged %s after a restart, want only the new page", got)
+	}
+}
+
+func TestNewPageObserverURL(t *testing.T) {
+	for _, pingURL := range []string{"", "ping", "ftp://example.com/ping", "https:///ping"} {
+		if _, err := newPageObserver(pingURL, nil, 0, testServer.logger); err == nil {
+			t.Errorf("newPageObserver(%q) accepted an invalid ping URL", pingURL)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const reachableTTL = 30 * time.Second
+
+var (
+	startTime = time.Now()
+
+	// shuttingDown is set once the server starts shutting down, so probes
+	// take it out of rotation while in-flight requests finish.
+	shuttingDown atomic.Bool
+
+	reachableMu    sync.Mutex
+	reachableCache = map[string]reachability{} // by endpoint
+)
+
+// reachability is the result of probing a collector endpoint.
+type reachability struct {
+	reachable bool
+	checked   time.Time
+}
+
+// healthStatus is the body of /healthz and /readyz.
+type healthStatus struct {
+	Status        string          `json:"status"`
+	UptimeSeconds int64           `json:"uptime_seconds"`
+	Degraded      bool            `json:"degraded,omitempty"`
+	GAReachable   *bool           `json:"ga_reachable,omitempty"`
+	Collectors    map[string]bool `json:"collectors,omitempty"` // reachability by collector
+	QueueFill     *float64        `json:"queue_fill,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	status.UptimeSeconds = int64(time.Since(startTime).Seconds())
+	status.Degraded = degradedMode.Load()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// healthzHandler serves the liveness probe: 200 unless the server is
+// shutting down.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{Status: "shutting_down"})
+		return
+	}
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyzHandler serves the readiness probe, which also requires the hit
+// queue to be filled no more than -backpressureThreshold and, unless -dryRun
+// is set, the configured collectors to be reachable. With -spoolFile an
+// unreachable collector is only reported in the body: its hits are spooled
+// and replayed, so the beacon stays ready.
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{Status: "shutting_down"})
+		return
+	}
+	if fill := hitWorkers.QueueFillPct(); fill > backpressureThreshold {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{Status: "queue_saturated", QueueFill: &fill})
+		return
+	}
+	if dryRun {
+		writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+		return
+	}
+	status := healthStatus{Status: "ok", Collectors: map[string]bool{}}
+	for name, endpoint := range collectorEndpoints() {
+		reachable := collectorReachable(s.logger, name, endpoint)
+		status.Collectors[name] = reachable
+		if name == "ga" {
+			status.GAReachable = &reachable
+		}
+		if !reachable {
+			status.Status = "collector_unreachable"
+		}
+	}
+	if status.Status != "ok" && hitSpool == nil {
+		writeHealth(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeHealth(w, http.StatusOK, status)
+}
+
+// collectorEndpoints returns the URL to probe of each configured collector
+// that reports hits over HTTP.
+func collectorEndpoints() map[string]string {
+	endpoints := map[string]string{}
+	if usesCollector("ga") {
+		endpoints["ga"] = gaEndpoint
+	}
+	if usesCollector("matomo") {
+		endpoints["matomo"] = matomoURL
+	}
+	if usesCollector("plausible") {
+		endpoints["plausible"] = plausibleURL
+	}
+	return endpoints
+}
+
+// collectorReachable sends a HEAD request to the endpoint of the collector
+// name, caching the result for 30s. Any HTTP response counts as reachable.
+func collectorReachable(logger *slog.Logger, name, endpoint string) bool {
+	reachableMu.Lock()
+	defer reachableMu.Unlock()
+	if r, ok := reachableCache[endpoint]; ok && time.Since(r.checked) < reachableTTL {
+		return r.reachable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gaTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "HEAD", endpoint, nil)
+	resp, err := gaClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	} else {
+		logger.Warn("Collector unreachable", "collector", name, "err", redactURLError(err))
+	}
+	reachableCache[endpoint] = reachability{err == nil, time.Now()}
+	return err == nil
+}
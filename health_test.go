@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// probe calls h and decodes the health status it returns.
+func probe(t *testing.T, h http.HandlerFunc, path string) (int, healthStatus) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", path, nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s Content-Type = %q, want application/json", path, ct)
+	}
+	var status healthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("%s body %q: %v", path, w.Body, err)
+	}
+	return w.Code, status
+}
+
+// resetReachable empties the collector reachability cache before and after t.
+func resetReachable(t *testing.T) {
+	reachableMu.Lock()
+	reachableCache = map[string]reachability{}
+	reachableMu.Unlock()
+	t.Cleanup(func() {
+		reachableMu.Lock()
+		reachableCache = map[string]reachability{}
+		reachableMu.Unlock()
+	})
+}
+
+func TestHealthz(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	if code, status := probe(t, healthzHandler, "/healthz"); code != http.StatusOK || status.Status != "ok" {
+		t.Errorf("/healthz = %d %q, want 200 ok", code, status.Status)
+	}
+
+	shuttingDown.Store(true)
+	for path, h := range map[string]http.HandlerFunc{"/healthz": healthzHandler, "/readyz": testServer.readyzHandler} {
+		if code, status := probe(t, h, path); code != http.StatusServiceUnavailable || status.Status != "shutting_down" {
+			t.Errorf("%s while shutting down = %d %q, want 503 shutting_down", path, code, status.Status)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	newTestBeacon(t)
+	resetReachable(t)
+	code, status := probe(t, testServer.readyzHandler, "/readyz")
+	if code != http.StatusOK || status.Status != "ok" || status.GAReachable == nil || !*status.GAReachable {
+		t.Errorf("/readyz = %d %+v, want 200 with GA reachable", code, status)
+	}
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	gaEndpoint = down.URL
+	code, status = probe(t, testServer.readyzHandler, "/readyz")
+	if code != http.StatusServiceUnavailable || status.Status != "collector_unreachable" || status.GAReachable == nil || *status.GAReachable {
+		t.Errorf("/readyz = %d %+v with GA down, want 503 collector_unreachable", code, status)
+	}
+	if status.Collectors["ga"] {
+		t.Errorf("collectors = %v, want ga unreachable", status.Collectors)
+	}
+
+	setFlags(t, "-dryRun")
+	if code, _ := probe(t, testServer.readyzHandler, "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz = %d with -dryRun, want 200 without probing", code)
+	}
+}
+
+func TestCollectorReachableCached(t *testing.T) {
+	resetReachable(t)
+	var probes int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		if r.Method != "HEAD" {
+			t.Errorf("probe method = %s, want HEAD", r.Method)
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	url := s.URL
+	if !collectorReachable(testServer.logger, "ga", url) {
+		t.Error("collector answering 405 unreachable, want any response to count")
+	}
+	s.Close()
+	if !collectorReachable(testServer.logger, "ga", url) {
+		t.Error("cached result not used within 30s")
+	}
+	if probes != 1 {
+		t.Errorf("collector probed %d times, want 1", probes)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	maxIconSize     = 50 << 10
+	maxIconDim      = 24
+	defaultIconDim  = 14
+	iconTimeout     = 3 * time.Second
+	iconCacheTTL    = time.Hour
+	iconLeftPadding = 3
+)
+
+var (
+	// iconHosts holds the hosts -iconAllowlist permits ?icon= to load from.
+	iconHosts map[string]bool
+
+	iconContentTypes = map[string]bool{
+		"image/svg+xml": true,
+		"image/png":     true,
+	}
+
+	iconCache   = map[string]cachedIcon{}
+	iconCacheMu sync.Mutex
+
+	svgWidthPattern = regexp.MustCompile(`(\swidth=")[0-9.]+(")`)
+)
+
+// iconSVGTemplate places an icon on a strip to the left of a badge's content, which it
+// shifts right to make room.
+var iconSVGTemplate = template.Must(template.New("icon").Parse(
+	`{{.Open}}<rect width="{{.Shift}}" height="{{.BadgeHeight}}" fill="#555"/>` +
+		`<image href="{{.Icon}}" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"/>` +
+		`<g transform="translate({{.Shift}},0)">{{.Content}}</g></svg>`))
+
+type cachedIcon struct {
+	dataURI string
+	fetched time.Time
+}
+
+// errIconNotAllowed is returned for icon URLs that are not https or whose
+// host is not on -iconAllowlist.
+var errIconNotAllowed = errors.New("icon URL is not allowed")
+
+// checkIconURL reports whether iconURL may be fetched.
+func checkIconURL(iconURL string) error {
+	u, err := url.Parse(iconURL)
+	if err != nil || u.Scheme != "https" || !iconHosts[strings.ToLower(u.Hostname())] {
+		return errIconNotAllowed
+	}
+	return nil
+}
+
+// fetchAndEmbedIcon returns iconURL as a data URI for embedding in a badge.
+// The icon must be an SVG or PNG of at most 50KB on an allowed https host.
+// Icons are cached by URL for an hour.
+func fetchAndEmbedIcon(iconURL string, timeout time.Duration) (string, error) {
+	if err := checkIconURL(iconURL); err != nil {
+		return "", err
+	}
+
+	iconCacheMu.Lock()
+	cached, ok := iconCache[iconURL]
+	iconCacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < iconCacheTTL {
+		return cached.dataURI, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, contentType, err := fetchLimited(ctx, iconURL, maxIconSize)
+	if err != nil {
+		return "", err
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !iconContentTypes[mediaType] {
+		return "", fmt.Errorf("icon has unsupported content type %q", contentType)
+	}
+
+	dataURI := "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	iconCacheMu.Lock()
+	for u, c := range iconCache {
+		if time.Since(c.fetched) >= iconCacheTTL {
+			delete(iconCache, u)
+		}
+	}
+	iconCache[iconURL] = cachedIcon{dataURI, time.Now()}
+	iconCacheMu.Unlock()
+	return dataURI, nil
+}
+
+// iconSize returns the icon dimensions requested by ?icon-width and
+// ?icon-height.
+func iconSize(query url.Values) (int, int, error) {
+	dims := [2]int{defaultIconDim, defaultIconDim}
+	for i, param := range []string{"icon-width", "icon-height"} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxIconDim {
+			return 0, 0, fmt.Errorf("%s must be between 1 and %d", param, maxIconDim)
+		}
+		dims[i] = n
+	}
+	return dims[0], dims[1], nil
+}
+
+// withIcon returns a copy of an SVG badge with icon drawn on its left side.
+// Other images are returned unchanged.
+func withIcon(img badgeImage, icon string, width, height int) badgeImage {
+	if img.contentType != "image/svg+xml" {
+		return img
+	}
+	badgeWidth, badgeHeight := img.size()
+	svg := string(img.data)
+	open := strings.Index(svg, ">") + 1
+	end := strings.LastIndex(svg, "</svg>")
+	if open <= 0 || end < open || badgeWidth == 0 {
+		return img
+	}
+
+	shift := width + 2*iconLeftPadding
+	openTag := svgWidthPattern.ReplaceAllString(svg[:open], "${1}"+strconv.Itoa(badgeWidth+shift)+"${2}")
+
+	var b bytes.Buffer
+	iconSVGTemplate.Execute(&b, struct {
+		Open, Icon, Content        string
+		X, Y, Width, Height, Shift int
+		BadgeHeight                int
+	}{openTag, icon, svg[open:end], iconLeftPadding, (badgeHeight - height) / 2, width, height, shift, badgeHeight})
+	return badgeImage{"image/svg+xml", b.Bytes()}
+}
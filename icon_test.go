@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// allowIcons lets ?icon= load from s, with an empty icon cache, until t
+// ends.
+func allowIcons(t *testing.T, s *ogServer) {
+	keep(t, &iconHosts)
+	keep(t, &iconCache)
+	u, _ := url.Parse(s.URL)
+	iconHosts = map[string]bool{u.Hostname(): true}
+	iconCache = map[string]cachedIcon{}
+}
+
+func TestFetchAndEmbedIcon(t *testing.T) {
+	s := newOGServer(t)
+	allowIcons(t, s)
+	tests := []struct {
+		name    string
+		iconURL string
+		want    string
+	}{
+		{"png", s.URL + imageURL("image/png", len(testPNG)), "data:image/png;base64," + base64.StdEncoding.EncodeToString(testPNG)},
+		{"svg", s.URL + imageURL("image/svg+xml", len(testPNG)), "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(testPNG)},
+		{"content type params", s.URL + imageURL("image/png; charset=binary", len(testPNG)), "data:image/png;base64,"},
+		{"largest icon", s.URL + imageURL("image/png", maxIconSize), "data:image/png;base64,"},
+		{"icon too large", s.URL + imageURL("image/png", maxIconSize+1), ""},
+		{"jpeg", s.URL + imageURL("image/jpeg", len(testPNG)), ""},
+		{"html", s.page(""), ""},
+		{"http", strings.Replace(s.URL, "https:", "http:", 1) + imageURL("image/png", len(testPNG)), ""},
+		{"host not allowed", "https://example.com" + imageURL("image/png", len(testPNG)), ""},
+		{"not a URL", "%zz", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fetchAndEmbedIcon(tt.iconURL, iconTimeout)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("fetchAndEmbedIcon() = %.40q..., want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("fetchAndEmbedIcon() = %.40q..., want %.40q...", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchAndEmbedIconCached(t *testing.T) {
+	s := newOGServer(t)
+	allowIcons(t, s)
+	iconURL := s.URL + imageURL("image/png", len(testPNG))
+	for i := 0; i < 2; i++ {
+		if _, err := fetchAndEmbedIcon(iconURL, iconTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.requests.Load(); got != 1 {
+		t.Errorf("site got %d requests for the same icon, want 1 then the cache", got)
+	}
+}
+
+func TestIconSize(t *testing.T) {
+	tests := []struct {
+		query         string
+		width, height int
+		wantErr       bool
+	}{
+		{"", defaultIconDim, defaultIconDim, false},
+		{"icon-width=20", 20, defaultIconDim, false},
+		{"icon-width=24&icon-height=24", 24, 24, false},
+		{"icon-height=1", defaultIconDim, 1, false},
+		{"icon-width=25", 0, 0, true},
+		{"icon-height=0", 0, 0, true},
+		{"icon-width=-1", 0, 0, true},
+		{"icon-width=wide", 0, 0, true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		width, height, err := iconSize(query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("iconSize(%s) error = %v, want error: %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if width != tt.width || height != tt.height {
+			t.Errorf("iconSize(%s) = %dx%d, want %dx%d", tt.query, width, height, tt.width, tt.height)
+		}
+	}
+}
+
+func TestBadgeIcon(t *testing.T) {
+	s := newOGServer(t)
+	newTestBeacon(t)
+	allowIcons(t, s)
+	icon := url.QueryEscape(s.URL + imageURL("image/png", len(testPNG)))
+
+	w := get("/UA-1234-1/page?icon=" + icon + "&icon-width=20&icon-height=16")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("status = %d, Content-Type = %q, want an SVG badge", w.Code, w.Header().Get("Content-Type"))
+	}
+	plainWidth, _ := badgeImages[""].size()
+	if width, _ := (badgeImage{"image/svg+xml", w.Body.Bytes()}).size(); width != plainWidth+20+2*iconLeftPadding {
+		t.Errorf("badge width = %d, want the badge's widened by the icon and its padding", width)
+	}
+	if !strings.Contains(w.Body.String(), `<image href="data:image/png;base64,`+base64.StdEncoding.EncodeToString(testPNG)+`" x="3"`) ||
+		!strings.Contains(w.Body.String(), `width="20" height="16"/>`) {
+		t.Errorf("badge = %s, want the icon embedded on its left", w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"host not allowed", "/UA-1234-1/page?icon=" + url.QueryEscape("https://example.com/logo.png")},
+		{"icon too large", "/UA-1234-1/page?icon=" + url.QueryEscape(s.URL+imageURL("image/png", maxIconSize+1))},
+		{"not an image", "/UA-1234-1/page?icon=" + url.QueryEscape(s.page(""))},
+		{"icon too wide", "/UA-1234-1/page?icon=" + icon + "&icon-width=25"},
+	}
+	for _, tt := range tests {
+		if w := get(tt.target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", tt.name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// exemptNets are the -exemptIPs networks, which are never throttled.
+	exemptNets []*net.IPNet
+
+	// trustedProxyNets are the -trustedProxies networks, whose forwarding
+	// headers are believed.
+	trustedProxyNets []*net.IPNet
+)
+
+// hostOnly strips the port from a host:port address such as r.RemoteAddr,
+// and the brackets around an IPv6 host with it.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// parseIP parses an IP address as found in addresses and forwarding headers:
+// possibly bracketed, and for IPv6 possibly with a %zone, which is dropped.
+// It returns nil if s is not an IP address.
+func parseIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), "[]")
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(s)
+}
+
+// normalizeIP returns the canonical form of an IP address, so each client is
+// known by one string: IPv4 addresses mapped to IPv6 (::ffff:192.0.2.1, from
+// dual-stack listeners) become plain IPv4, and IPv6 addresses are
+// lowercased and compressed. Anything else is returned as is.
+func normalizeIP(s string) string {
+	if ip := parseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// clientKey returns the key clients are rate limited and counted against
+// -maxConnsPerIP by: their IPv4 address, or their IPv6 network of
+// -ipv6PrefixLength bits, as each IPv6 client usually has a whole /64 of
+// addresses to pick from.
+func clientKey(host string) string {
+	ip := parseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6PrefixLength, 128)).String() + "/" + strconv.Itoa(ipv6PrefixLength)
+}
+
+// parseIPList parses a comma-separated list of IP addresses and CIDR ranges.
+func parseIPList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := parseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipInNets reports whether host is an IP address inside one of nets.
+func ipInNets(host string, nets []*net.IPNet) bool {
+	ip := parseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP returns the client's IP address, the host part of r.RemoteAddr
+// unless a proxy is trusted to say otherwise:
+//
+//   - With -trustedProxies, or behind a Unix socket, forwarding headers are
+//     only read from a peer in those networks. The client is the rightmost
+//     hop in X-Forwarded-For (or Forwarded) that is not itself a trusted
+//     proxy, then X-Real-IP.
+//   - With trustProxy, any peer is believed. The client is the leftmost
+//     public hop, then X-Real-IP. Only enable it behind a proxy that sets
+//     these headers, since clients can forge them.
+//
+// The address is returned normalized with normalizeIP.
+func realIP(r *http.Request, trustProxy bool) string {
+	remote := normalizeIP(hostOnly(r.RemoteAddr))
+	// Peers on a Unix socket (-listenUnix, systemd) have no IP address: they
+	// are the proxy in front and always trusted.
+	unixPeer := net.ParseIP(remote) == nil
+	switch {
+	case len(trustedProxyNets) > 0 || unixPeer:
+		if !unixPeer && !ipInNets(remote, trustedProxyNets) {
+			return remote
+		}
+		hops := forwardedFor(r)
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !ipInNets(hops[i].String(), trustedProxyNets) {
+				return hops[i].String()
+			}
+		}
+	case trustProxy:
+		for _, ip := range forwardedFor(r) {
+			if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() {
+				return ip.String()
+			}
+		}
+	default:
+		return remote
+	}
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return remote
+}
+
+// forwardedFor returns the client chain from X-Forwarded-For or, if that is
+// absent, the for= parameters of the RFC 7239 Forwarded header, leftmost
+// first. Entries that are not IP addresses ("unknown", obfuscated
+// identifiers) are skipped.
+func forwardedFor(r *http.Request) []net.IP {
+	var entries []string
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, header := range xff {
+			entries = append(entries, strings.Split(header, ",")...)
+		}
+	} else {
+		for _, header := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(header, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						entries = append(entries, strings.Trim(value, `"`))
+					}
+				}
+			}
+		}
+	}
+
+	var ips []net.IP
+	for _, entry := range entries {
+		if ip := parseIP(hostOnly(strings.TrimSpace(entry))); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// How much of the client IP is passed on to the collector.
+const (
+	ipModeFull      = "full"
+	ipModeAnonymize = "anonymize" // truncated with anonymizeIP
+	ipModeOmit      = "omit"      // not sent at all
+)
+
+// accountIPModes maps accounts to their IP mode, overriding -gaAnonymizeIP
+// and -omitClientIP. Set from -accountIPModes.
+var accountIPModes map[string]string
+
+// validIPMode checks an -accountIPModes value.
+func validIPMode(mode string) error {
+	switch mode {
+	case ipModeFull, ipModeAnonymize, ipModeOmit:
+		return nil
+	}
+	return fmt.Errorf("unknown IP mode %q (want full, anonymize or omit)", mode)
+}
+
+// ipModeFor returns the IP mode for hits to account.
+func ipModeFor(account string) string {
+	if mode, ok := accountIPModes[account]; ok {
+		return mode
+	}
+	switch {
+	case omitClientIP:
+		return ipModeOmit
+	case gaAnonymizeIP:
+		return ipModeAnonymize
+	}
+	return ipModeFull
+}
+
+// reportedIP returns the client IP to send with job, or "" if its account
+// omits it.
+func reportedIP(job hitJob) string {
+	switch ipModeFor(job.params[0]) {
+	case ipModeOmit:
+		return ""
+	case ipModeAnonymize:
+		return anonymizeIP(job.ip)
+	}
+	return job.ip
+}
+
+// anonymizeIP zeroes the host part of ip the way GA's aip=1 does: the last
+// octet of an IPv4 address and the last 80 bits of an IPv6 one. Values that
+// are not IP addresses are dropped.
+func anonymizeIP(ip string) string {
+	parsed := parseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remote     string
+		header     []string
+		trustProxy bool
+		proxies    string
+		want       string
+	}{
+		{"no flag, no header", "203.0.113.7:1234", nil, false, "", "203.0.113.7"},
+		{"no flag, forged header", "203.0.113.7:1234", []string{"X-Forwarded-For", "198.51.100.1", "X-Real-IP", "198.51.100.2"}, false, "", "203.0.113.7"},
+		{"IPv6 peer", "[2001:db8::1]:1234", nil, false, "", "2001:db8::1"},
+		{"trusted, no header", "10.0.0.1:1234", nil, true, "", "10.0.0.1"},
+		{"single hop", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.1"}, true, "", "198.51.100.1"},
+		{"multi-hop", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.1, 203.0.113.50, 10.0.0.2"}, true, "", "198.51.100.1"},
+		{"private hops skipped", "10.0.0.1:1234", []string{"X-Forwarded-For", "192.168.1.5, 127.0.0.1, fe80::1, 198.51.100.1"}, true, "", "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"X-Forwarded-For", "10.1.1.1", "X-Forwarded-For", "198.51.100.1"}, true, "", "198.51.100.1"},
+		{"hop with port", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.1:4711"}, true, "", "198.51.100.1"},
+		{"garbage hops", "10.0.0.1:1234", []string{"X-Forwarded-For", "unknown, not-an-ip, 198.51.100.1"}, true, "", "198.51.100.1"},
+		{"all private, X-Real-IP", "10.0.0.1:1234", []string{"X-Forwarded-For", "192.168.1.5", "X-Real-IP", "198.51.100.2"}, true, "", "198.51.100.2"},
+		{"X-Real-IP only", "10.0.0.1:1234", []string{"X-Real-IP", "198.51.100.2"}, true, "", "198.51.100.2"},
+		{"invalid X-Real-IP", "10.0.0.1:1234", []string{"X-Real-IP", "localhost"}, true, "", "10.0.0.1"},
+		{"Forwarded", "10.0.0.1:1234", []string{"Forwarded", `for="[2001:db8::2]:4711";proto=https, for=10.0.0.2`}, true, "", "2001:db8::2"},
+		{"trusted proxy, rightmost untrusted hop", "10.0.0.1:1234", []string{"X-Forwarded-For", "198.51.100.1, 203.0.113.50, 10.0.0.2"}, false, "10.0.0.0/8", "203.0.113.50"},
+		{"untrusted peer", "203.0.113.7:1234", []string{"X-Forwarded-For", "198.51.100.1"}, true, "10.0.0.0/8", "203.0.113.7"},
+		{"only trusted hops, X-Real-IP", "10.0.0.1:1234", []string{"X-Forwarded-For", "10.0.0.2", "X-Real-IP", "198.51.100.2"}, false, "10.0.0.0/8", "198.51.100.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &trustedProxyNets)
+			var err error
+			if trustedProxyNets, err = parseIPList(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/UA-1234-1/page", nil)
+			r.RemoteAddr = tt.remote
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Add(tt.header[i], tt.header[i+1])
+			}
+			if got := realIP(r, tt.trustProxy); got != tt.want {
+				t.Errorf("realIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIPReported(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no flag", nil, "192.0.2.1"},
+		{"trustProxy", []string{"-trustProxy"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.1, 10.0.0.2")
+			if got := stub.next(t).form().Get("uip"); got != tt.want {
+				t.Errorf("uip = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"1.2.3.4", "1.2.3.0"},
+		{"203.0.113.255", "203.0.113.0"},
+		{"1.2.3.0", "1.2.3.0"},
+		{"::ffff:1.2.3.4", "1.2.3.0"},
+		{"2001:db8:85a3:1234:5678:8a2e:370:7334", "2001:db8:85a3::"},
+		{"2001:db8:85a3::1", "2001:db8:85a3::"},
+		{"::1", "::"},
+		{"not-an-ip", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := anonymizeIP(tt.ip); got != tt.want {
+			t.Errorf("anonymizeIP(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAnonymizedIPReported(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		xff     string
+		wantAIP string
+		wantUIP string
+	}{
+		{"neither", nil, "198.51.100.17", "", "192.0.2.1"},
+		{"anonymize", []string{"-gaAnonymizeIP"}, "198.51.100.17", "1", "192.0.2.0"},
+		{"trustProxy", []string{"-trustProxy"}, "198.51.100.17", "", "198.51.100.17"},
+		{"both", []string{"-gaAnonymizeIP", "-trustProxy"}, "198.51.100.17", "1", "198.51.100.0"},
+		{"both, IPv6", []string{"-gaAnonymizeIP", "-trustProxy"}, "2001:db8:85a3:1234::17", "1", "2001:db8:85a3::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			get("/UA-1234-1/page", "X-Forwarded-For", tt.xff)
+			form := stub.next(t).form()
+			if got := form.Get("aip"); got != tt.wantAIP {
+				t.Errorf("aip = %q, want %q", got, tt.wantAIP)
+			}
+			if got := form.Get("uip"); got != tt.wantUIP {
+				t.Errorf("uip = %q, want %q", got, tt.wantUIP)
+			}
+		})
+	}
+}
+
+func TestHostOnly(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"[fe80::1%eth0]:1234", "fe80::1%eth0"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		if got := hostOnly(tt.addr); got != tt.want {
+			t.Errorf("hostOnly(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		ip, want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]", "192.0.2.1"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{" 2001:db8::1 ", "2001:db8::1"},
+		{"unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := normalizeIP(tt.ip); got != tt.want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		host   string
+		prefix int
+		want   string
+	}{
+		{"192.0.2.1", 64, "192.0.2.1"},
+		{"::ffff:192.0.2.1", 64, "192.0.2.1"},
+		{"2001:db8:1:2:aaaa:bbbb:cccc:dddd", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::1", 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", 64, "2001:db8:1:3::/64"},
+		{"2001:db8:1:2::1", 48, "2001:db8:1::/48"},
+		{"2001:db8:1:2::1", 128, "2001:db8:1:2::1/128"},
+		{"not-an-ip", 64, "not-an-ip"},
+	}
+	keep(t, &ipv6PrefixLength)
+	for _, tt := range tests {
+		ipv6PrefixLength = tt.prefix
+		if got := clientKey(tt.host); got != tt.want {
+			t.Errorf("clientKey(%q) with /%d = %q, want %q", tt.host, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestIPInNetsMixedStack(t *testing.T) {
+	nets, err := parseIPList("192.0.2.0/24, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]bool{
+		"192.0.2.7":        true,
+		"::ffff:192.0.2.7": true,
+		"[2001:db8::7]":    true,
+		"2001:DB8::7":      true,
+		"fe80::1%eth0":     false,
+		"198.51.100.1":     false,
+		"2001:db9::1":      false,
+		"garbage":          false,
+	} {
+		if got := ipInNets(host, nets); got != want {
+			t.Errorf("ipInNets(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestMixedStackHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	for remote, want := range map[string]string{
+		"192.0.2.7:1234":          "192.0.2.7",
+		"[::ffff:192.0.2.7]:1234": "192.0.2.7",
+		"[2001:DB8::7]:1234":      "2001:db8::7",
+		"[fe80::7%eth0]:1234":     "fe80::7",
+	} {
+		r := httptest.NewRequest("GET", "/UA-1234-1/page", nil)
+		r.RemoteAddr = remote
+		testServer.handler(httptest.NewRecorder(), r)
+		if got := stub.next(t).form().Get("uip"); got != want {
+			t.Errorf("from %s: uip = %q, want %q", remote, got, want)
+		}
+	}
+}
+
+func TestMixedStackRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		remotes []string
+		status  []int
+	}{
+		{"IPv4 and mapped IPv4", []string{"192.0.2.7:1", "[::ffff:192.0.2.7]:2"}, []int{200, 429}},
+		{"same /64", []string{"[2001:db8:1:2::1]:1", "[2001:db8:1:2:ffff::9]:2"}, []int{200, 429}},
+		{"other /64", []string{"[2001:db8:1:2::1]:1", "[2001:db8:1:3::1]:2"}, []int{200, 200}},
+		{"IPv4 and IPv6", []string{"192.0.2.7:1", "[2001:db8:1:2::1]:2"}, []int{200, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBeacon(t, "-rateLimitRPS=0.001", "-rateLimitBurst=1", "-coalesceWindow=0")
+			for i, remote := range tt.remotes {
+				r := httptest.NewRequest("GET", "/UA-1234-1/page", nil)
+				r.RemoteAddr = remote
+				w := httptest.NewRecorder()
+				testServer.handler(w, r)
+				if w.Code != tt.status[i] {
+					t.Errorf("hit from %s: status = %d, want %d", remote, w.Code, tt.status[i])
+				}
+			}
+		})
+	}
+}
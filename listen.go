@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListenFDsStart is the first file descriptor systemd passes with
+// socket activation.
+const systemdListenFDsStart = 3
+
+// openListener returns the listener to serve on and a description of it for
+// the logs: the socket systemd passed if the process was socket-activated,
+// otherwise -listenUnix if set, otherwise a TCP listener on addr.
+func openListener(logger *slog.Logger, addr string) (net.Listener, string, error) {
+	if l, err := systemdListener(logger); l != nil || err != nil {
+		return l, "systemd socket", err
+	}
+	if listenUnix != "" {
+		l, err := listenUnixSocket(listenUnix, listenUnixMode)
+		return l, "unix:" + listenUnix, err
+	}
+	l, err := net.Listen("tcp", addr)
+	return l, addr, err
+}
+
+// systemdListener returns the first socket passed with systemd socket
+// activation, or nil if there is none. See sd_listen_fds(3).
+func systemdListener(logger *slog.Logger) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// Child processes must not think the sockets are theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		logger.Warn("systemd passed several sockets, serving on the first", "sockets", n)
+	}
+
+	f := os.NewFile(systemdListenFDsStart, "systemd socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %w", err)
+	}
+	return l, nil
+}
+
+// listenUnixSocket listens on the Unix socket at path, replacing a stale
+// socket left by an earlier run, and sets its permissions to mode.
+func listenUnixSocket(path string, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -listenUnixMode %q", mode)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, fs.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevelVar is the level of the logger newLogger returns, changeable at
+// runtime from the admin API.
+var logLevelVar = new(slog.LevelVar)
+
+// newLogger returns a logger writing to stderr at level in format: json,
+// text, or auto for text when stderr is a terminal and JSON otherwise so log
+// aggregators can parse it.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", level)
+	}
+
+	switch format {
+	case "auto":
+		format = "json"
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			format = "text"
+		}
+	case "json", "text":
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want json, text or auto)", format)
+	}
+
+	logLevelVar.Set(lvl)
+	opts := &slog.HandlerOptions{Level: logLevelVar}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	}
+	return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+}
+
+// newRequestID returns a random ID for correlating the log lines of a
+// request that carries no X-Correlation-ID or X-Request-ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// checkMode is set by `ga-beacon check`, which reports on the configuration
+// instead of serving.
+var checkMode bool
+
+// fatal logs msg at error level and exits. In check mode it is reported as
+// the failed config check.
+func (s *server) fatal(msg string, args ...any) {
+	if checkMode {
+		var b strings.Builder
+		b.WriteString(msg)
+		for i := 0; i+1 < len(args); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		}
+		fmt.Printf("FAIL  config: %s\n", b.String())
+		os.Exit(1)
+	}
+	s.logger.Error(msg, args...)
+	os.Exit(1)
+}
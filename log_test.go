@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// captureStderr points os.Stderr at a file for the loggers newLogger returns
+// while t runs, and returns a function reading what was written to it.
+func captureStderr(t *testing.T) func() []byte {
+	f, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep(t, &os.Stderr)
+	os.Stderr = f
+	level := logLevelVar.Level()
+	t.Cleanup(func() {
+		logLevelVar.Set(level)
+		f.Close()
+	})
+	return func() []byte {
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	output := captureStderr(t)
+	for _, bad := range [][2]string{{"verbose", "json"}, {"info", "xml"}} {
+		if _, err := newLogger(bad[0], bad[1]); err == nil {
+			t.Errorf("newLogger(%q, %q) succeeded", bad[0], bad[1])
+		}
+	}
+
+	l, err := newLogger("warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("shown", "status", 500)
+	var line map[string]any
+	if err := json.Unmarshal(output(), &line); err != nil {
+		t.Fatalf("output %q is not one JSON line: %v", output(), err)
+	}
+	if line["msg"] != "shown" || line["level"] != "WARN" || line["status"] != float64(500) {
+		t.Errorf("logged %v, want only the warning with its status", line)
+	}
+}
+
+func TestHitLoggedAsJSON(t *testing.T) {
+	output := captureStderr(t)
+	stub := newTestBeacon(t)
+	logger, err := newLogger("debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := getFrom(&server{logger: logger}, "/UA-1234-1/page")
+	cid := w.Header().Get("CID")
+	stub.next(t)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		scanner := bufio.NewScanner(bytes.NewReader(output()))
+		for scanner.Scan() {
+			var line map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("log line %q is not JSON: %v", scanner.Text(), err)
+			}
+			if line["msg"] != "Hit reported" {
+				continue
+			}
+			if line["cid"] != cid || line["status"] != float64(200) || line["tid"] != "UA-1234-1" {
+				t.Errorf("logged %v, want cid %s, status 200 and tid UA-1234-1", line, cid)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no hit reported in the log: %s", output())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
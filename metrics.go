@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// defaultDurationBuckets are histogram buckets for latencies, in seconds.
+var defaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics is the registry served on /metrics and /metrics/json. It is
+// client_golang's default registry, so the Go runtime and process metrics are
+// served too.
+var metrics = newMetricsRegistry(prometheus.DefaultRegisterer, prometheus.DefaultGatherer)
+
+var (
+	// Hits by outcome: reported to GA, not reported (filtered, rate limited,
+	// coalesced, ...), failed to report or kept in -spoolFile for later.
+	hitsTotal   = metrics.CounterVec("gabeacon_hits_total", "Hits by outcome.", "status")
+	hitsLogged  = hitsTotal.With("logged")
+	hitsSkipped = hitsTotal.With("skipped")
+	hitsErrored = hitsTotal.With("error")
+	hitsSpooled = hitsTotal.With("spooled")
+
+	// gaRequestDuration times requests to the GA collector, observing each
+	// retry attempt separately.
+	gaRequestDuration = metrics.Histogram("gabeacon_ga_request_duration_seconds", "Duration of each attempt to send hits to a collector.", defaultDurationBuckets)
+
+	badgesServed = metrics.CounterVec("gabeacon_badges_served_total", "Image responses by kind.", "variant")
+)
+
+// MetricsRegistry registers the server's client_golang metrics and keeps track
+// of when they last changed, for /metrics/json.
+type MetricsRegistry struct {
+	prometheus.Registerer
+	prometheus.Gatherer
+
+	lastUpdated atomic.Int64
+}
+
+// NewMetricsRegistry returns a registry of its own, without the Go runtime
+// and process metrics.
+func NewMetricsRegistry() *MetricsRegistry {
+	r := prometheus.NewRegistry()
+	return newMetricsRegistry(r, r)
+}
+
+func newMetricsRegistry(r prometheus.Registerer, g prometheus.Gatherer) *MetricsRegistry {
+	m := &MetricsRegistry{Registerer: r, Gatherer: g}
+	m.touch()
+	return m
+}
+
+func (m *MetricsRegistry) touch() {
+	m.lastUpdated.Store(time.Now().UnixNano())
+}
+
+// register registers c, or returns the collector already registered with the
+// same metrics.
+func (m *MetricsRegistry) register(c prometheus.Collector) prometheus.Collector {
+	if err := m.Register(c); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			return registered.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+// replace registers c in place of the collector registered with the same
+// metrics, if any.
+func (m *MetricsRegistry) replace(c prometheus.Collector) {
+	m.Unregister(c)
+	m.MustRegister(c)
+	m.touch()
+}
+
+// Counter returns the counter with the given name, creating it if needed.
+func (m *MetricsRegistry) Counter(name, help string) *Counter {
+	c := m.register(prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help}))
+	return &Counter{counter: c.(prometheus.Counter), registry: m}
+}
+
+// CounterVec returns the counters with the given name told apart by labels,
+// creating them if needed.
+func (m *MetricsRegistry) CounterVec(name, help string, labels ...string) *CounterVec {
+	v := m.register(prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels))
+	return &CounterVec{vec: v.(*prometheus.CounterVec), registry: m}
+}
+
+// CounterFunc registers a counter whose value is read from fn, replacing the
+// one registered with the same name and labels.
+func (m *MetricsRegistry) CounterFunc(name, help string, labels prometheus.Labels, fn func() int64) {
+	m.replace(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help, ConstLabels: labels}, func() float64 { return float64(fn()) }))
+}
+
+// GaugeFunc registers a gauge whose value is read from fn, replacing the one
+// registered with the same name.
+func (m *MetricsRegistry) GaugeFunc(name, help string, fn func() float64) {
+	m.replace(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn))
+}
+
+// Histogram returns the histogram with the given name, creating it with
+// buckets if needed.
+func (m *MetricsRegistry) Histogram(name, help string, buckets []float64) *Histogram {
+	h := m.register(prometheus.NewHistogram(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}))
+	return &Histogram{histogram: h.(prometheus.Histogram), registry: m}
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	counter  prometheus.Counter
+	registry *MetricsRegistry
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(n int64) {
+	c.counter.Add(float64(n))
+	c.registry.touch()
+}
+
+func (c *Counter) Value() int64 {
+	var m dto.Metric
+	c.counter.Write(&m)
+	return int64(m.GetCounter().GetValue())
+}
+
+// CounterVec is a family of counters told apart by label values.
+type CounterVec struct {
+	vec      *prometheus.CounterVec
+	registry *MetricsRegistry
+}
+
+// With returns the counter with the given label values, in the order the
+// labels were registered in.
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{counter: v.vec.WithLabelValues(values...), registry: v.registry}
+}
+
+// Histogram counts observations into buckets with the given upper bounds.
+type Histogram struct {
+	histogram prometheus.Histogram
+	registry  *MetricsRegistry
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.histogram.Observe(v)
+	h.registry.touch()
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) snapshot() histogramSnapshot {
+	var m dto.Metric
+	h.histogram.Write(&m)
+	return snapshotOf(m.GetHistogram())
+}
+
+type histogramSnapshot struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// snapshotOf converts the cumulative buckets of h to counts per bucket.
+func snapshotOf(h *dto.Histogram) histogramSnapshot {
+	s := histogramSnapshot{count: h.GetSampleCount(), sum: h.GetSampleSum()}
+	var cumulative uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), +1) {
+			continue
+		}
+		s.buckets = append(s.buckets, b.GetUpperBound())
+		s.counts = append(s.counts, b.GetCumulativeCount()-cumulative)
+		cumulative = b.GetCumulativeCount()
+	}
+	s.counts = append(s.counts, s.count-cumulative)
+	return s
+}
+
+// quantile estimates the q-quantile by interpolating linearly inside the
+// bucket it falls in. Observations above the last bucket are reported as the
+// last bucket's upper bound.
+func (s histogramSnapshot) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := q * float64(s.count)
+	var cumulative uint64
+	for i, n := range s.counts {
+		if float64(cumulative+n) < rank || n == 0 {
+			cumulative += n
+			continue
+		}
+		if i == len(s.buckets) {
+			return s.buckets[len(s.buckets)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = s.buckets[i-1]
+		}
+		return lower + (s.buckets[i]-lower)*(rank-float64(cumulative))/float64(n)
+	}
+	return s.buckets[len(s.buckets)-1]
+}
+
+// seriesName names a metric of family name by its labels, e.g.
+// `gabeacon_hits_total{status="logged"}`.
+func seriesName(name string, labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l.GetName(), l.GetValue())
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snapshot gathers the current values of all counters, gauges and
+// histograms, by series.
+func (m *MetricsRegistry) snapshot() (map[string]int64, map[string]float64, map[string]histogramSnapshot, error) {
+	families, err := m.Gather()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	counters := map[string]int64{}
+	gauges := map[string]float64{}
+	histograms := map[string]histogramSnapshot{}
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			name := seriesName(f.GetName(), metric.GetLabel())
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				counters[name] = int64(metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				gauges[name] = metric.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				histograms[name] = snapshotOf(metric.GetHistogram())
+			}
+		}
+	}
+	return counters, gauges, histograms, nil
+}
+
+type histogramJSON struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// MarshalJSON encodes the metrics as counters, gauges and histogram
+// percentiles.
+func (m *MetricsRegistry) MarshalJSON() ([]byte, error) {
+	counters, gauges, histograms, err := m.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	out := struct {
+		Counters   map[string]int64         `json:"counters"`
+		Gauges     map[string]float64       `json:"gauges"`
+		Histograms map[string]histogramJSON `json:"histograms"`
+	}{counters, map[string]float64{}, map[string]histogramJSON{}}
+
+	for name, v := range gauges {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			out.Gauges[name] = v
+		}
+	}
+	for name, h := range histograms {
+		out.Histograms[name] = histogramJSON{
+			Count: h.count,
+			Sum:   h.sum,
+			P50:   h.quantile(.50),
+			P95:   h.quantile(.95),
+			P99:   h.quantile(.99),
+		}
+	}
+	return json.Marshal(out)
+}
+
+// LastUpdated returns when a metric last changed.
+func (m *MetricsRegistry) LastUpdated() time.Time {
+	return time.Unix(0, m.lastUpdated.Load())
+}
+
+// metricsAuthorized checks the bearer token required by -metricsToken.
+func metricsAuthorized(r *http.Request) bool {
+	if metricsToken == "" {
+		return true
+	}
+	want := "Bearer " + metricsToken
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) == 1
+}
+
+// promHandler serves the metrics of client_golang's default registry.
+var promHandler = promhttp.Handler()
+
+// metricsHandler serves /metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	promHandler.ServeHTTP(w, r)
+}
+
+// metricsJSONHandler serves /metrics/json, pretty-printed with ?pretty=1.
+func (s *server) metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	if !metricsAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body []byte
+	var err error
+	if r.URL.Query().Get("pretty") == "1" {
+		body, err = json.MarshalIndent(metrics, "", "  ")
+	} else {
+		body, err = json.Marshal(metrics)
+	}
+	if err != nil {
+		http.Error(w, "could not encode metrics", http.StatusInternalServerError)
+		s.logger.Error("Cannot encode metrics", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Last-Modified", metrics.LastUpdated().UTC().Format(http.TimeFormat))
+	w.Write(body)
+}
+
+var inFlightRequests atomic.Int64
+
+// instrument counts and times every request served by h.
+func instrument(h http.Handler) http.Handler {
+	requests := metrics.Counter("gabeacon_requests_total", "Requests served.")
+	duration := metrics.Histogram("gabeacon_handler_duration_seconds", "Duration of serving a request.", defaultDurationBuckets)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlightRequests.Add(1)
+		defer func() {
+			inFlightRequests.Add(-1)
+			requests.Inc()
+			duration.ObserveSince(start)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// badgeServed counts an image response by kind: a badge variant, "count" or
+// "thumbnail".
+func badgeServed(kind string) {
+	if kind == "" {
+		kind = "badge"
+	}
+	badgesServed.With(kind).Inc()
+}
+
+// registerMetrics exposes the counters kept by the other subsystems.
+func registerMetrics() {
+	metrics.GaugeFunc("gabeacon_in_flight_requests", "Requests being served.", func() float64 { return float64(inFlightRequests.Load()) })
+	metrics.GaugeFunc("gabeacon_degraded", "1 if embedded assets are broken and fallbacks are served.", func() float64 {
+		if degradedMode.Load() {
+			return 1
+		}
+		return 0
+	})
+	metrics.GaugeFunc("gabeacon_queue_depth", "Hits queued for the workers.", func() float64 { return float64(hitWorkers.QueueLen()) })
+	metrics.GaugeFunc("gabeacon_queue_fill_percent", "How full the hit queue is.", func() float64 { return hitWorkers.QueueFillPct() * 100 })
+	for _, p := range []hitPriority{priorityLow, priorityNormal, priorityHigh} {
+		p := p
+		metrics.CounterFunc("gabeacon_hits_dropped_total", "Hits dropped because the queue was full, by priority.", prometheus.Labels{"priority": p.String()}, func() int64 { return hitWorkers.Dropped(p) })
+	}
+	metrics.CounterFunc("gabeacon_ga_requests_total", "Requests sent to GA, by HTTP version.", prometheus.Labels{"proto": "h1"}, h1RequestsSent.Load)
+	metrics.CounterFunc("gabeacon_ga_requests_total", "Requests sent to GA, by HTTP version.", prometheus.Labels{"proto": "h2"}, h2RequestsSent.Load)
+	metrics.CounterFunc("gabeacon_allowlist_fetch_errors_total", "Failed fetches of -allowedAccountsURL.", nil, allowlistFetchErrors.Load)
+	metrics.CounterFunc("gabeacon_country_blocked_hits_total", "Hits not reported for their country.", nil, countryBlockedHits.Load)
+	metrics.CounterFunc("gabeacon_country_allowed_hits_total", "Hits reported after checking their country.", nil, countryAllowedHits.Load)
+	metrics.CounterFunc("gabeacon_dnt_suppressed_hits_total", "Hits not reported for Do Not Track.", nil, dntSuppressedHits.Load)
+	metrics.CounterFunc("gabeacon_bot_hits_total", "Requests from crawlers.", nil, botHits.Load)
+	metrics.CounterFunc("gabeacon_circuit_rejected_hits_total", "Hits not sent while a collector's circuit was open.", nil, circuitRejectedHits.Load)
+	metrics.GaugeFunc("gabeacon_circuit_open_collectors", "Collectors whose circuit is open.", func() float64 { return float64(openBreakers()) })
+	metrics.CounterFunc("gabeacon_spool_dropped_hits_total", "Hits not spooled because -spoolMaxSize was reached.", nil, spoolDropped.Load)
+	metrics.CounterFunc("gabeacon_spool_expired_hits_total", "Spooled hits dropped after -spoolMaxAge.", nil, spoolExpired.Load)
+	metrics.GaugeFunc("gabeacon_spool_bytes", "Size of -spoolFile.", func() float64 {
+		if hitSpool == nil {
+			return 0
+		}
+		return float64(hitSpool.Size())
+	})
+	metrics.CounterFunc("gabeacon_rate_limited_hits_total", "Hits over a rate limit, by limit.", prometheus.Labels{"scope": "ip"}, func() int64 { return ipRateLimiter.Limited() })
+	metrics.CounterFunc("gabeacon_rate_limited_hits_total", "Hits over a rate limit, by limit.", prometheus.Labels{"scope": "account"}, func() int64 { return accountRateLimiter.Limited() })
+	metrics.CounterFunc("gabeacon_rate_limited_total", "Hits over a rate limit.", nil, func() int64 { return ipRateLimiter.Limited() + accountRateLimiter.Limited() })
+	metrics.CounterFunc("gabeacon_unsigned_hits_total", "Hits not reported for a missing or invalid signature.", nil, unsignedHits.Load)
+	metrics.CounterFunc("gabeacon_coalesced_hits_total", "Hits not reported as repeats within -coalesceWindow.", nil, func() int64 { return hitCoalesce.Coalesced() })
+	if tlsCert != "" {
+		metrics.GaugeFunc("gabeacon_cert_expiry_timestamp_seconds", "When the -tlsCert certificate expires.", func() float64 { return float64(certNotAfter.Load()) })
+		metrics.GaugeFunc("gabeacon_cert_expiry_days", "Days until the -tlsCert certificate expires.", func() float64 {
+			return time.Until(time.Unix(certNotAfter.Load(), 0)).Hours() / 24
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerTestMetrics registers the metrics main does, reading the globals
+// newTestBeacon sets up.
+func registerTestMetrics(t *testing.T) {
+	registerMetrics()
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewMetricsRegistry().Histogram("test_seconds", "", []float64{1, 2, 4})
+	if got := h.snapshot().quantile(.5); got != 0 {
+		t.Errorf("p50 of an empty histogram = %g, want 0", got)
+	}
+	for i := 0; i < 50; i++ {
+		h.Observe(.5)
+	}
+	for i := 0; i < 40; i++ {
+		h.Observe(1.5)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(3)
+	}
+
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{.25, .5},
+		{.50, 1},
+		{.70, 1.5},
+		{.95, 3},
+		{.99, 3.8},
+	}
+	s := h.snapshot()
+	for _, tt := range tests {
+		if got := s.quantile(tt.q); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("quantile(%g) = %g, want %g", tt.q, got, tt.want)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		h.Observe(10)
+	}
+	if got := h.snapshot().quantile(.99); got != 4 {
+		t.Errorf("p99 above the last bucket = %g, want its bound 4", got)
+	}
+}
+
+func TestMetricsRegistryJSON(t *testing.T) {
+	m := NewMetricsRegistry()
+	m.Counter("hits_total", "").Add(3)
+	m.CounterFunc("dropped_total", "", nil, func() int64 { return 7 })
+	m.GaugeFunc("in_flight", "", func() float64 { return 2.5 })
+	m.GaugeFunc("broken", "", math.NaN)
+	h := m.Histogram("duration_seconds", "", []float64{1, 2})
+	h.Observe(.5)
+	h.Observe(1.5)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Counters   map[string]int64         `json:"counters"`
+		Gauges     map[string]float64       `json:"gauges"`
+		Histograms map[string]histogramJSON `json:"histograms"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("%v: %s", err, data)
+	}
+	if got.Counters["hits_total"] != 3 || got.Counters["dropped_total"] != 7 {
+		t.Errorf("counters = %v, want hits_total 3 and dropped_total 7", got.Counters)
+	}
+	if len(got.Gauges) != 1 || got.Gauges["in_flight"] != 2.5 {
+		t.Errorf("gauges = %v, want in_flight 2.5 and no NaN", got.Gauges)
+	}
+	d := got.Histograms["duration_seconds"]
+	if d.Count != 2 || d.Sum != 2 || d.P50 != 1 || d.P99 < 1 || d.P99 > 2 {
+		t.Errorf("duration_seconds = %+v, want 2 observations summing to 2, p50 1 and p99 in (1, 2]", d)
+	}
+}
+
+func TestMetricsJSONHandler(t *testing.T) {
+	before := metrics.LastUpdated()
+	hitsLogged.Inc()
+
+	w := httptest.NewRecorder()
+	testServer.metricsJSONHandler(w, httptest.NewRequest("GET", "/metrics/json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	modified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil || modified.Before(before.Truncate(time.Second)) {
+		t.Errorf("Last-Modified = %q, want the last update, at or after %v", w.Header().Get("Last-Modified"), before)
+	}
+	var got map[string]map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"counters", "gauges", "histograms"} {
+		if _, ok := got[section]; !ok {
+			t.Errorf("no %s in %s", section, w.Body)
+		}
+	}
+	if got["counters"][`gabeacon_hits_total{status="logged"}`] == nil {
+		t.Errorf("counters = %v, want the logged hits", got["counters"])
+	}
+	if strings.Contains(w.Body.String(), "\n") {
+		t.Error("output pretty-printed without ?pretty=1")
+	}
+
+	w = httptest.NewRecorder()
+	testServer.metricsJSONHandler(w, httptest.NewRequest("GET", "/metrics/json?pretty=1", nil))
+	if !strings.Contains(w.Body.String(), "\n  \"counters\": {") {
+		t.Errorf("body = %.40q..., want it pretty-printed with ?pretty=1", w.Body)
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	setFlags(t, "-metricsToken=s3cret")
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer guess", http.StatusUnauthorized},
+		{"not bearer", "s3cret", http.StatusUnauthorized},
+		{"token", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		for path, h := range map[string]http.HandlerFunc{"/metrics": metricsHandler, "/metrics/json": testServer.metricsJSONHandler} {
+			r := httptest.NewRequest("GET", path, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s with %s: status = %d, want %d", path, tt.name, w.Code, tt.want)
+			}
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	hitsLogged.Inc()
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", got)
+	}
+	for _, want := range []string{
+		"# HELP gabeacon_hits_total Hits by outcome.\n# TYPE gabeacon_hits_total counter\n",
+		`gabeacon_hits_total{status="logged"} `,
+		"# TYPE gabeacon_ga_request_duration_seconds histogram\n",
+		"\ngo_goroutines ",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics has no %q", want)
+		}
+	}
+}
+
+// scrapeMetrics returns the samples /metrics serves, by series.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics status = %d, want 200", w.Code)
+	}
+	samples := map[string]float64{}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		series, value, ok := strings.Cut(line, " ")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("/metrics line %q: %v", line, err)
+		}
+		samples[series] = v
+	}
+	return samples
+}
+
+func TestMetricsAfterBeacons(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0", "-rateLimitRPS=0.001", "-rateLimitBurst=3", "-trustProxy",
+		"-gaMaxAttempts=1", "-breakerThreshold=0")
+	registerTestMetrics(t)
+	before := scrapeMetrics(t)
+
+	for i := 0; i < 2; i++ {
+		get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.1")
+		stub.next(t)
+	}
+	stub.respond(http.StatusInternalServerError)
+	get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.1")
+	stub.next(t)
+	if w := get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d for the fourth hit, want 429", w.Code)
+	}
+
+	want := map[string]float64{
+		`gabeacon_hits_total{status="logged"}`:         2,
+		`gabeacon_hits_total{status="error"}`:          1,
+		`gabeacon_hits_total{status="skipped"}`:        1,
+		`gabeacon_rate_limited_total`:                  1,
+		`gabeacon_rate_limited_hits_total{scope="ip"}`: 1,
+		`gabeacon_ga_request_duration_seconds_count`:   3,
+	}
+	// Workers count a hit after the collector has answered it.
+	deadline := time.Now().Add(time.Second)
+	for {
+		after, settled := scrapeMetrics(t), true
+		for series, delta := range want {
+			if after[series]-before[series] != delta {
+				settled = false
+			}
+		}
+		if settled {
+			break
+		}
+		if time.Now().After(deadline) {
+			for series, delta := range want {
+				if got := after[series] - before[series]; got != delta {
+					t.Errorf("%s went up by %g, want %g", series, got, delta)
+				}
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pubsubPublishURL = "https://pubsub.googleapis.com/v1/projects/%s/topics/%s:publish"
+
+	// gceTokenURL is the metadata server endpoint handing out access tokens
+	// for the service account of the GCE instance, GKE pod or Cloud Run
+	// service the beacon runs as.
+	gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+var (
+	// mirrors are the -mirror sinks every reported hit is also published to.
+	mirrors []mirrorSink
+
+	mirrorClient = &http.Client{Timeout: 5 * time.Second}
+
+	hitsMirroredTotal = metrics.CounterVec("gabeacon_mirrored_hits_total", "Hits published to the -mirror sinks, by result.", "result")
+	hitsMirrored      = hitsMirroredTotal.With("ok")
+	hitsMirrorFailed  = hitsMirroredTotal.With("error")
+)
+
+// mirroredHit is the JSON message a hit is mirrored as.
+type mirroredHit struct {
+	Time         time.Time         `json:"time"`
+	Account      string            `json:"account"`
+	Page         string            `json:"page"`
+	Type         string            `json:"type"`
+	ClientID     string            `json:"cid"`
+	IP           string            `json:"ip,omitempty"`
+	UserAgent    string            `json:"user_agent,omitempty"`
+	Source       string            `json:"source,omitempty"`
+	Bot          bool              `json:"bot,omitempty"`
+	Params       map[string]string `json:"params,omitempty"`
+	CustomFields map[string]string `json:"custom_fields,omitempty"`
+	RequestID    string            `json:"request_id,omitempty"`
+}
+
+// newMirroredHit describes job for the mirrors. The IP address is the one
+// the collector gets, after the account's IP mode.
+func newMirroredHit(job hitJob) mirroredHit {
+	hit := mirroredHit{
+		Time:         time.Now().UTC(),
+		Account:      job.params[0],
+		Page:         job.params[1],
+		Type:         "pageview",
+		ClientID:     job.cid,
+		IP:           reportedIP(job),
+		UserAgent:    job.ua,
+		Source:       job.source,
+		Bot:          job.bot,
+		CustomFields: job.customFields,
+		RequestID:    job.requestID,
+	}
+	forwarded := forwardedQuery(job.logger, job.query)
+	if t := forwarded.Get("t"); t != "" {
+		hit.Type = t
+	}
+	for key := range forwarded {
+		if key == "t" {
+			continue
+		}
+		if hit.Params == nil {
+			hit.Params = map[string]string{}
+		}
+		hit.Params[key] = forwarded.Get(key)
+	}
+	return hit
+}
+
+// mirrorSink publishes mirrored hits somewhere.
+type mirrorSink interface {
+	Publish(ctx context.Context, message []byte) error
+	String() string
+}
+
+// parseMirrors parses -mirror, a comma-separated list of sinks:
+//
+//	https://example.com/hits       POST each hit as JSON to a webhook
+//	kafka+https://proxy:8082/topic produce to a topic through a Kafka REST Proxy
+//	pubsub://project/topic         publish to a Google Cloud Pub/Sub topic
+func parseMirrors(s string) ([]mirrorSink, error) {
+	var sinks []mirrorSink
+	for _, raw := range strings.Split(s, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https":
+			sinks = append(sinks, webhookSink{url: raw})
+		case "kafka+http", "kafka+https":
+			topic := strings.Trim(u.Path, "/")
+			if u.Host == "" || topic == "" || strings.Contains(topic, "/") {
+				return nil, fmt.Errorf("%s: want kafka+http(s)://proxy/topic", raw)
+			}
+			u.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+			u.Path = "/topics/" + topic
+			sinks = append(sinks, kafkaRESTSink{url: u.String()})
+		case "pubsub":
+			topic := strings.Trim(u.Path, "/")
+			if u.Host == "" || topic == "" || strings.Contains(topic, "/") {
+				return nil, fmt.Errorf("%s: want pubsub://project/topic", raw)
+			}
+			sinks = append(sinks, &pubsubSink{
+				url:    fmt.Sprintf(pubsubPublishURL, url.PathEscape(u.Host), url.PathEscape(topic)),
+				tokens: &gceTokenSource{url: gceTokenURL},
+			})
+		default:
+			return nil, fmt.Errorf("%s: unknown mirror scheme %q", raw, u.Scheme)
+		}
+	}
+	return sinks, nil
+}
+
+// mirrorHit publishes job to every -mirror sink. Failures are logged and
+// counted but do not fail the hit, which the collector has already taken.
+func mirrorHit(ctx context.Context, job hitJob) {
+	if len(mirrors) == 0 {
+		return
+	}
+	message, err := json.Marshal(newMirroredHit(job))
+	if err != nil {
+		job.logger.Error("Cannot encode mirrored hit", "err", err, "request_id", job.requestID)
+		return
+	}
+	for _, sink := range mirrors {
+		if dryRun {
+			job.logger.Info("Dry run, not mirroring hit", "mirror", sink.String(), "message", string(message), "request_id", job.requestID)
+			continue
+		}
+		if err := sink.Publish(ctx, message); err != nil {
+			hitsMirrorFailed.Inc()
+			job.logger.Warn("Cannot mirror hit", "mirror", sink.String(), "err", err, "request_id", job.requestID)
+			continue
+		}
+		hitsMirrored.Inc()
+	}
+}
+
+// postJSON POSTs body to rawURL and fails on any non-2xx answer.
+func postJSON(ctx context.Context, rawURL, contentType string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", rawURL, resp.Status)
+	}
+	return nil
+}
+
+// webhookSink POSTs each hit to a URL, with -mirrorToken as a bearer token
+// if set.
+type webhookSink struct {
+	url string
+}
+
+func (s webhookSink) Publish(ctx context.Context, message []byte) error {
+	var header http.Header
+	if mirrorToken != "" {
+		header = http.Header{"Authorization": {"Bearer " + mirrorToken}}
+	}
+	return postJSON(ctx, s.url, "application/json", message, header)
+}
+
+func (s webhookSink) String() string { return s.url }
+
+// kafkaRESTSink produces each hit as a JSON record through the Confluent
+// REST Proxy API.
+//
+// REST Proxy reference: https://docs.confluent.io/platform/current/kafka-rest/api.html
+type kafkaRESTSink struct {
+	url string // the proxy's /topics/<topic> endpoint
+}
+
+func (s kafkaRESTSink) Publish(ctx context.Context, message []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]json.RawMessage{{"value": message}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.url, "application/vnd.kafka.json.v2+json", body, nil)
+}
+
+func (s kafkaRESTSink) String() string { return s.url }
+
+// pubsubSink publishes each hit as a message through the Pub/Sub REST API,
+// authenticated as the service account of the machine the beacon runs on.
+//
+// Pub/Sub reference: https://cloud.google.com/pubsub/docs/reference/rest/v1/projects.topics/publish
+type pubsubSink struct {
+	url    string
+	tokens *gceTokenSource
+}
+
+func (s *pubsubSink) Publish(ctx context.Context, message []byte) error {
+	token, err := s.tokens.Token(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get access token: %w", err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"messages": []map[string]string{{"data": base64.StdEncoding.EncodeToString(message)}},
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.url, "application/json", body, http.Header{"Authorization": {"Bearer " + token}})
+}
+
+func (s *pubsubSink) String() string { return s.url }
+
+// gceTokenSource fetches access tokens from the metadata server and caches
+// them until shortly before they expire.
+type gceTokenSource struct {
+	url string // the token endpoint, gceTokenURL
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (ts *gceTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Until(ts.expires) > time.Minute {
+		return ts.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("cannot decode token: %v", err)
+	}
+	ts.token = token.AccessToken
+	ts.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
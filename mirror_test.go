@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mirrorRequest is a request received by a test mirror.
+type mirrorRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newTestMirror starts a mirror answering status and returns the requests it
+// receives.
+func newTestMirror(t *testing.T, status int) (*httptest.Server, chan mirrorRequest) {
+	t.Helper()
+	requests := make(chan mirrorRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- mirrorRequest{path: r.URL.Path, header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+// nextMirrored waits for the mirror to receive a request.
+func nextMirrored(t *testing.T, requests chan mirrorRequest) mirrorRequest {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing mirrored")
+		return mirrorRequest{}
+	}
+}
+
+func TestParseMirrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{"", nil, ""},
+		{"https://example.com/hits, http://localhost:8080/hits", []string{"https://example.com/hits", "http://localhost:8080/hits"}, ""},
+		{"kafka+https://proxy:8082/beacon-hits", []string{"https://proxy:8082/topics/beacon-hits"}, ""},
+		{"pubsub://my-project/beacon-hits", []string{"https://pubsub.googleapis.com/v1/projects/my-project/topics/beacon-hits:publish"}, ""},
+		{"kafka+https://proxy:8082/", nil, "want kafka+http(s)://proxy/topic"},
+		{"kafka+https://proxy:8082/a/b", nil, "want kafka+http(s)://proxy/topic"},
+		{"pubsub://my-project", nil, "want pubsub://project/topic"},
+		{"ftp://example.com/hits", nil, `unknown mirror scheme "ftp"`},
+		{"https://example.com/%zz", nil, "invalid URL escape"},
+	}
+	for _, tt := range tests {
+		sinks, err := parseMirrors(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseMirrors(%q) = %v, want an error with %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMirrors(%q): %v", tt.in, err)
+			continue
+		}
+		var got []string
+		for _, sink := range sinks {
+			got = append(got, sink.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("parseMirrors(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	srv, requests := newTestMirror(t, http.StatusAccepted)
+	setFlags(t, "-mirrorToken=t0ken")
+
+	if err := (webhookSink{url: srv.URL + "/hits"}).Publish(context.Background(), []byte(`{"page":"docs"}`)); err != nil {
+		t.Fatal(err)
+	}
+	req := nextMirrored(t, requests)
+	if req.path != "/hits" || string(req.body) != `{"page":"docs"}` || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("webhook got %s (%s): %s, want the message as JSON", req.path, req.header.Get("Content-Type"), req.body)
+	}
+	if got := req.header.Get("Authorization"); got != "Bearer t0ken" {
+		t.Errorf("Authorization = %q, want the -mirrorToken", got)
+	}
+
+	setFlags(t, "-mirrorToken=")
+	(webhookSink{url: srv.URL + "/hits"}).Publish(context.Background(), []byte(`{}`))
+	if req := nextMirrored(t, requests); req.header.Get("Authorization") != "" {
+		t.Errorf("Authorization = %q without -mirrorToken, want none", req.header.Get("Authorization"))
+	}
+}
+
+func TestKafkaRESTSink(t *testing.T) {
+	srv, requests := newTestMirror(t, http.StatusOK)
+	sinks, err := parseMirrors("kafka+" + srv.URL + "/beacon-hits")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sinks[0].Publish(context.Background(), []byte(`{"page":"docs"}`)); err != nil {
+		t.Fatal(err)
+	}
+	req := nextMirrored(t, requests)
+	if req.path != "/topics/beacon-hits" || req.header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("proxy got %s (%s), want /topics/beacon-hits as Kafka JSON", req.path, req.header.Get("Content-Type"))
+	}
+	if string(req.body) != `{"records":[{"value":{"page":"docs"}}]}` {
+		t.Errorf("body = %s, want the message as the one record's value", req.body)
+	}
+}
+
+func TestPubsubSink(t *testing.T) {
+	srv, requests := newTestMirror(t, http.StatusOK)
+	tokens := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token": "ya29.t0ken", "expires_in": 3600}`))
+	}))
+	t.Cleanup(metadata.Close)
+	sink := &pubsubSink{url: srv.URL + "/publish", tokens: &gceTokenSource{url: metadata.URL}}
+
+	for i := 0; i < 2; i++ {
+		if err := sink.Publish(context.Background(), []byte(`{"page":"docs"}`)); err != nil {
+			t.Fatal(err)
+		}
+		req := nextMirrored(t, requests)
+		if got := req.header.Get("Authorization"); got != "Bearer ya29.t0ken" {
+			t.Errorf("Authorization = %q, want the metadata server's token", got)
+		}
+		var body struct {
+			Messages []struct {
+				Data string `json:"data"`
+			} `json:"messages"`
+		}
+		json.Unmarshal(req.body, &body)
+		if len(body.Messages) != 1 {
+			t.Fatalf("body = %s, want one message", req.body)
+		}
+		if data, _ := base64.StdEncoding.DecodeString(body.Messages[0].Data); string(data) != `{"page":"docs"}` {
+			t.Errorf("message data = %q, want the hit", data)
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("%d tokens fetched, want the first one cached", tokens)
+	}
+
+	metadata.Close()
+	failing := &pubsubSink{url: srv.URL + "/publish", tokens: &gceTokenSource{url: metadata.URL}}
+	if err := failing.Publish(context.Background(), []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "cannot get access token") {
+		t.Errorf("Publish() = %v without a metadata server, want a token error", err)
+	}
+}
+
+func TestMirrorHit(t *testing.T) {
+	srv, requests := newTestMirror(t, http.StatusOK)
+	keep(t, &mirrors)
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	var err error
+	if mirrors, err = parseMirrors(srv.URL + "/hits"); err != nil {
+		t.Fatal(err)
+	}
+	mirrored := hitsMirrored.Value()
+
+	get("/UA-1234-1/docs?t=event&ec=docs&ea=download", "User-Agent", "Firefox")
+	form := stub.next(t).form()
+	var hit mirroredHit
+	if req := nextMirrored(t, requests); json.Unmarshal(req.body, &hit) != nil {
+		t.Fatalf("mirror got %s, want a mirrored hit", req.body)
+	}
+	if hit.Account != "UA-1234-1" || hit.Page != "docs" || hit.Type != "event" || hit.ClientID != form.Get("cid") || hit.UserAgent != "Firefox" {
+		t.Errorf("mirrored %+v, want the event of cid %s", hit, form.Get("cid"))
+	}
+	if hit.Params["ec"] != "docs" || hit.Params["ea"] != "download" || hit.Params["t"] != "" {
+		t.Errorf("params = %v, want the forwarded ones but t", hit.Params)
+	}
+	if time.Since(hit.Time) > time.Minute || hit.RequestID == "" {
+		t.Errorf("mirrored at %v as request %q, want now and the request ID", hit.Time, hit.RequestID)
+	}
+	// The worker counts the hit once the mirror has answered.
+	for deadline := time.Now().Add(5 * time.Second); hitsMirrored.Value() == mirrored && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hitsMirrored.Value() - mirrored; got != 1 {
+		t.Errorf("%d hits mirrored, want 1", got)
+	}
+}
+
+func TestMirrorHitFailure(t *testing.T) {
+	srv, requests := newTestMirror(t, http.StatusServiceUnavailable)
+	keep(t, &mirrors)
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	var err error
+	if mirrors, err = parseMirrors(srv.URL + "/hits"); err != nil {
+		t.Fatal(err)
+	}
+	failed, logged := hitsMirrorFailed.Value(), hitsLogged.Value()
+
+	get("/UA-1234-1/docs")
+	stub.next(t)
+	nextMirrored(t, requests)
+	for deadline := time.Now().Add(5 * time.Second); hitsMirrorFailed.Value() == failed && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hitsMirrorFailed.Value() - failed; got != 1 {
+		t.Errorf("%d failed mirrors counted, want 1", got)
+	}
+	// The collector has the hit, so a failed mirror does not fail it.
+	if got := hitsLogged.Value() - logged; got != 1 {
+		t.Errorf("%d hits logged, want 1", got)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/irvinlim/ga-beacon/beacon"
+)
+
+var (
+	trackingIDPattern = beacon.TrackingIDPattern
+
+	// Hit types accepted by the Measurement Protocol.
+	hitTypes = map[string]bool{
+		"pageview":    true,
+		"screenview":  true,
+		"event":       true,
+		"transaction": true,
+		"item":        true,
+		"social":      true,
+		"exception":   true,
+		"timing":      true,
+	}
+
+	// paramValidators check GA parameter values that callers may supply.
+	paramValidators = map[string]func(string) error{
+		"tid": func(v string) error {
+			if !trackingIDPattern.MatchString(v) {
+				return fmt.Errorf("invalid tracking ID %s", strconv.Quote(v))
+			}
+			return nil
+		},
+		"dp": maxPrintable(2048),
+		"t": func(v string) error {
+			if !hitTypes[v] {
+				return fmt.Errorf("invalid hit type %s", strconv.Quote(v))
+			}
+			return nil
+		},
+		"uid": validUserID,
+		"dt":  maxPrintable(1500),
+		"dr":  maxPrintable(2048),
+		"dl":  maxPrintable(2048),
+		"dh":  maxPrintable(100),
+		"ul":  validLanguage,
+		"cs":  maxPrintable(100),
+		"cm":  maxPrintable(50),
+		"cn":  maxPrintable(100),
+		"ck":  maxPrintable(500),
+		"cc":  maxPrintable(500),
+		"sc": func(v string) error {
+			if v != "start" && v != "end" {
+				return fmt.Errorf("session control must be start or end, got %s", strconv.Quote(v))
+			}
+			return nil
+		},
+		"ni": func(v string) error {
+			if v != "0" && v != "1" {
+				return fmt.Errorf("non-interaction must be 0 or 1, got %s", strconv.Quote(v))
+			}
+			return nil
+		},
+		"qt": validQueueTime,
+	}
+
+	// protectedParams are always set by the beacon and can't be added to
+	// forwardedParams with -forwardParams.
+	protectedParams = map[string]bool{
+		"v": true, "tid": true, "cid": true, "uip": true, "aip": true, "ds": true, "dp": true, "api_secret": true, "qt": true,
+	}
+
+	// beaconParams are query params the beacon itself reads. They are never
+	// forwarded, and not logged as dropped either.
+	beaconParams = map[string]bool{
+		"pixel": true, "gif": true, "flat": true, "flat-gif": true,
+		"label": true, "message": true, "color": true, "count": true,
+		"icon": true, "icon-width": true, "icon-height": true,
+		"useReferer": true, "thumbnail": true, "js": true, "callback": true,
+		"enc": true, "event": true, "delay": true, "priority": true, "bot": true,
+		"api_secret": true, "sig": true, "key": true, "ts": true,
+		"utm_source": true, "utm_medium": true, "utm_campaign": true, "utm_term": true, "utm_content": true,
+	}
+
+	// campaignParams maps the utm_* query params of a campaign link to their
+	// Measurement Protocol fields.
+	campaignParams = map[string]string{
+		"utm_source":   "cs",
+		"utm_medium":   "cm",
+		"utm_campaign": "cn",
+		"utm_term":     "ck",
+		"utm_content":  "cc",
+	}
+
+	languagePattern = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+
+	// forwardedParams are the query parameters passed through to the v1
+	// collector. The first group is for callers to set directly; the second is
+	// also filled in from ?event= and the X-Beacon-* headers. tid, cid and the
+	// rest of the payload always come from the beacon itself.
+	forwardedParams = map[string]bool{
+		"dt": true, // document title
+		"dr": true, // document referrer
+		"dl": true, // document location
+		"dh": true, // document host name
+		"sc": true, // session control
+		"ni": true, // non-interaction hit
+		"z":  true, // cache buster
+		"ul": true, // user language
+
+		// campaign fields, also filled in from utm_* params
+		"cs": true, // campaign source
+		"cm": true, // campaign medium
+		"cn": true, // campaign name
+		"ck": true, // campaign keyword
+		"cc": true, // campaign content
+
+		"t":   true,
+		"ec":  true,
+		"ea":  true,
+		"el":  true,
+		"ev":  true,
+		"uid": true,
+
+		// timing and exception fields, checked by validateHitFields
+		"utc": true, // user timing category
+		"utv": true, // user timing variable name
+		"utt": true, // user timing time, in ms
+		"utl": true, // user timing label
+		"exd": true, // exception description
+		"exf": true, // is exception fatal
+	}
+
+	// hitRequiredFields lists the fields each hit type can't be reported
+	// without.
+	hitRequiredFields = map[string][]string{
+		"event":  {"ec", "ea"},
+		"timing": {"utc", "utv", "utt"},
+	}
+
+	// beaconHeaders maps the X-Beacon-* request headers to GA parameters.
+	beaconHeaders = []struct {
+		header string
+		param  string
+	}{
+		{"X-Beacon-TID", "tid"},
+		{"X-Beacon-Page", "dp"},
+		{"X-Beacon-HitType", "t"},
+		{"X-Beacon-UID", "uid"},
+	}
+)
+
+// hitSources are the values accepted in the X-Beacon-Source header.
+var hitSources = map[string]bool{"api": true, "badge": true, "email": true}
+
+// hitSource returns where the hit came from, reported to GA as the data
+// source. The X-Beacon-Source header wins; otherwise the source is inferred
+// if -inferHitSource is set.
+func hitSource(r *http.Request) string {
+	if source := r.Header.Get("X-Beacon-Source"); hitSources[source] {
+		return source
+	}
+	if !inferHitSource {
+		return ""
+	}
+
+	path := strings.ToLower(r.URL.Path)
+	switch {
+	case strings.Contains(r.Header.Get("Accept"), "image/"):
+		return "badge"
+	case strings.HasSuffix(path, ".gif") || strings.HasSuffix(path, ".png"):
+		return "email"
+	default:
+		return "api"
+	}
+}
+
+// maxPrintable returns a validator accepting printable ASCII values of at
+// most n bytes.
+func maxPrintable(n int) func(string) error {
+	return func(v string) error {
+		if len(v) > n {
+			return fmt.Errorf("value longer than %d bytes", n)
+		}
+		for i := 0; i < len(v); i++ {
+			if v[i] < 0x20 || v[i] > 0x7e {
+				return fmt.Errorf("value %s contains non-printable characters", strconv.Quote(v))
+			}
+		}
+		return nil
+	}
+}
+
+// addForwardParams allows the comma-separated Measurement Protocol fields in
+// list to be forwarded from the query, in addition to forwardedParams.
+func addForwardParams(list string) error {
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		if protectedParams[key] {
+			return fmt.Errorf("%s is set by the beacon and can't be forwarded", key)
+		}
+		if beaconParams[key] {
+			return fmt.Errorf("%s is a beacon param and can't be forwarded", key)
+		}
+		forwardedParams[key] = true
+	}
+	return nil
+}
+
+// forwardedQuery returns the allowlisted params from query, dropping any
+// value that fails validation. What is dropped is logged to logger.
+func forwardedQuery(logger *slog.Logger, query url.Values) url.Values {
+	forwarded := url.Values{}
+	for key, val := range query {
+		if !forwardedParams[key] {
+			if !beaconParams[key] && !strings.HasPrefix(key, userPropertyPrefix) {
+				logger.Debug("Not forwarding param, not in the allowlist", "param", key)
+			}
+			continue
+		}
+		for _, v := range val {
+			if err := validateParam(key, v); err != nil {
+				logger.Debug("Not forwarding invalid param", "param", key, "err", err)
+				continue
+			}
+			forwarded.Add(key, v)
+		}
+	}
+	return forwarded
+}
+
+// validateParam checks value against the validator for the GA parameter key,
+// if there is one.
+func validateParam(key, value string) error {
+	if validate, ok := paramValidators[key]; ok {
+		return validate(value)
+	}
+	return nil
+}
+
+// applyHeaderParams applies X-Beacon-* headers. They override the tracking ID
+// and page taken from the URL path, but not forwarded parameters set in the
+// query.
+func applyHeaderParams(logger *slog.Logger, r *http.Request, params []string, query url.Values) ([]string, error) {
+	for _, h := range beaconHeaders {
+		value := r.Header.Get(h.header)
+		if value == "" {
+			continue
+		}
+		if err := validateParam(h.param, value); err != nil {
+			return params, fmt.Errorf("%s: %v", h.header, err)
+		}
+		if _, ok := query[h.param]; ok && forwardedParams[h.param] {
+			logger.Debug("Using param from query, ignoring header", "param", h.param, "header", h.header)
+			continue
+		}
+
+		logger.Debug("Using param from header", "param", h.param, "value", value, "header", h.header)
+		switch h.param {
+		case "tid":
+			params[0] = value
+		case "dp":
+			page := value
+			if len(page) > 0 && page[0] == '/' {
+				page = page[1:]
+			}
+			if len(params) == 1 {
+				params = append(params, page)
+			} else {
+				params[1] = page
+			}
+		default:
+			query.Set(h.param, value)
+		}
+	}
+	return params, nil
+}
+
+// applyRequestParams maps utm_* params onto the campaign fields and, with
+// -forwardRequestHeaders, fills dr from the Referer header and ul from
+// Accept-Language. Fields already set in the query win.
+func applyRequestParams(r *http.Request, query url.Values) {
+	for utm, field := range campaignParams {
+		if v := query.Get(utm); v != "" && query.Get(field) == "" {
+			query.Set(field, v)
+		}
+	}
+	if !forwardRequestHeaders {
+		return
+	}
+	if ref := r.Referer(); ref != "" && query.Get("dr") == "" {
+		query.Set("dr", ref)
+	}
+	if lang := preferredLanguage(r.Header.Get("Accept-Language")); lang != "" && query.Get("ul") == "" {
+		query.Set("ul", lang)
+	}
+}
+
+// preferredLanguage returns the first language of an Accept-Language header,
+// lowercased, e.g. "en-us" for "en-US,en;q=0.9".
+func preferredLanguage(header string) string {
+	lang, _, _ := strings.Cut(header, ",")
+	lang, _, _ = strings.Cut(lang, ";")
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if validLanguage(lang) != nil {
+		return ""
+	}
+	return lang
+}
+
+// validLanguage checks a ul value, a language tag of at most 20 characters.
+func validLanguage(v string) error {
+	if len(v) > 20 || !languagePattern.MatchString(v) {
+		return fmt.Errorf("invalid language %s", strconv.Quote(v))
+	}
+	return nil
+}
+
+// validateHitFields checks the hit type (?t=), that query has the fields it
+// requires and that numeric fields are well formed.
+func validateHitFields(query url.Values) error {
+	hitType := query.Get("t")
+	if hitType != "" {
+		if err := validateParam("t", hitType); err != nil {
+			return err
+		}
+	}
+	for _, field := range hitRequiredFields[hitType] {
+		if query.Get(field) == "" {
+			return fmt.Errorf("%s hits require %s", hitType, field)
+		}
+	}
+	for _, field := range []string{"ev", "utt"} {
+		if v := query.Get(field); v != "" {
+			if _, err := strconv.ParseUint(v, 10, 31); err != nil {
+				return fmt.Errorf("%s must be a non-negative integer, got %s", field, strconv.Quote(v))
+			}
+		}
+	}
+	if v := query.Get("exf"); v != "" && v != "0" && v != "1" {
+		return fmt.Errorf("exf must be 0 or 1, got %s", strconv.Quote(v))
+	}
+	return nil
+}
+
+// parseEventParam decomposes a ?event=category/action[/label[/value]] value
+// into the Measurement Protocol event fields:
+//
+//	category -> ec (required)
+//	action   -> ea (required)
+//	label    -> el
+//	value    -> ev (non-negative integer)
+//
+// See https://developers.google.com/analytics/devguides/collection/protocol/v1/parameters#events
+func parseEventParam(v string) (url.Values, error) {
+	parts := strings.SplitN(v, "/", 4)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("event must be category/action[/label[/value]], got %s", strconv.Quote(v))
+	}
+
+	fields := url.Values{"t": {"event"}, "ec": {parts[0]}, "ea": {parts[1]}}
+	if len(parts) > 2 && parts[2] != "" {
+		fields.Set("el", parts[2])
+	}
+	if len(parts) > 3 && parts[3] != "" {
+		n, err := strconv.ParseUint(parts[3], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("event value must be a non-negative integer, got %s", strconv.Quote(parts[3]))
+		}
+		fields.Set("ev", strconv.FormatUint(n, 10))
+	}
+	return fields, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHeaderParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		want   map[string]string
+	}{
+		{
+			"tracking ID",
+			"/UA-1234-1/page",
+			[]string{"X-Beacon-TID", "UA-5678-2"},
+			map[string]string{"tid": "UA-5678-2", "dp": "page"},
+		},
+		{
+			"page",
+			"/UA-1234-1/page",
+			[]string{"X-Beacon-Page", "/from/header"},
+			map[string]string{"tid": "UA-1234-1", "dp": "from/header"},
+		},
+		{
+			"page for a bare account",
+			"/UA-1234-1",
+			[]string{"X-Beacon-Page", "from/header"},
+			map[string]string{"dp": "from/header"},
+		},
+		{
+			"hit type",
+			"/UA-1234-1/page",
+			[]string{"X-Beacon-HitType", "screenview"},
+			map[string]string{"t": "screenview"},
+		},
+		{
+			"user ID",
+			"/UA-1234-1/page",
+			[]string{"X-Beacon-UID", "user-42"},
+			map[string]string{"uid": "user-42"},
+		},
+		{
+			"query wins over header",
+			"/UA-1234-1/page?uid=from-query&t=pageview",
+			[]string{"X-Beacon-UID", "from-header", "X-Beacon-HitType", "screenview"},
+			map[string]string{"uid": "from-query", "t": "pageview"},
+		},
+		{
+			"header wins over path",
+			"/UA-1234-1/path-page",
+			[]string{"X-Beacon-TID", "UA-5678-2", "X-Beacon-Page", "header-page"},
+			map[string]string{"tid": "UA-5678-2", "dp": "header-page"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, "-allowHeaderParams")
+			if w := get(tt.target, tt.header...); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			form := stub.next(t).form()
+			for field, want := range tt.want {
+				if got := form.Get(field); got != want {
+					t.Errorf("%s = %q, want %q", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderParamsInvalid(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+	}{
+		{"X-Beacon-TID", "not-a-tracking-id"},
+		{"X-Beacon-HitType", "click"},
+		{"X-Beacon-UID", "someone@example.com"},
+		{"X-Beacon-Page", strings.Repeat("a", 2049)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			stub := newTestBeacon(t, "-allowHeaderParams")
+			w := get("/UA-1234-1/page", tt.header, tt.value)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.header) {
+				t.Errorf("body = %q, want it to name %s", w.Body, tt.header)
+			}
+			stub.none(t)
+		})
+	}
+}
+
+func TestHeaderParamsDisabled(t *testing.T) {
+	stub := newTestBeacon(t)
+	get("/UA-1234-1/page", "X-Beacon-TID", "UA-5678-2")
+	if got := stub.next(t).form().Get("tid"); got != "UA-1234-1" {
+		t.Errorf("tid = %q without -allowHeaderParams, want the one in the path", got)
+	}
+}
+
+func TestHitSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		infer  bool
+		target string
+		header []string
+		want   string
+	}{
+		{"explicit", false, "/UA-1234-1/page", []string{"X-Beacon-Source", "email"}, "email"},
+		{"explicit wins over inference", true, "/UA-1234-1/page.gif", []string{"X-Beacon-Source", "api", "Accept", "image/*"}, "api"},
+		{"unknown header value", false, "/UA-1234-1/page", []string{"X-Beacon-Source", "print"}, ""},
+		{"not inferred", false, "/UA-1234-1/page", []string{"Accept", "image/*"}, ""},
+		{"inferred badge", true, "/UA-1234-1/page", []string{"Accept", "image/webp,image/*"}, "badge"},
+		{"inferred email gif", true, "/UA-1234-1/page.gif", nil, "email"},
+		{"inferred email png", true, "/UA-1234-1/PAGE.PNG", nil, "email"},
+		{"inferred api", true, "/UA-1234-1/page", []string{"Accept", "application/json"}, "api"},
+		{"inferred api without headers", true, "/UA-1234-1/page", nil, "api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &inferHitSource)
+			inferHitSource = tt.infer
+			r := httptest.NewRequest("GET", tt.target, nil)
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			if got := hitSource(r); got != tt.want {
+				t.Errorf("hitSource() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHitSourceReported(t *testing.T) {
+	stub := newTestBeacon(t, "-inferHitSource")
+	get("/UA-1234-1/page", "X-Beacon-Source", "badge")
+	if got := stub.next(t).form().Get("ds"); got != "badge" {
+		t.Errorf("ds = %q, want badge", got)
+	}
+
+	get("/UA-1234-1/other")
+	if got := stub.next(t).form().Get("ds"); got != "api" {
+		t.Errorf("ds = %q without X-Beacon-Source, want api", got)
+	}
+}
+
+func TestParseEventParam(t *testing.T) {
+	tests := []struct {
+		v    string
+		want map[string]string
+	}{
+		{"email/open", map[string]string{"t": "event", "ec": "email", "ea": "open"}},
+		{"email/open/", map[string]string{"t": "event", "ec": "email", "ea": "open"}},
+		{"newsletter/open/2024-05 issue", map[string]string{"t": "event", "ec": "newsletter", "ea": "open", "el": "2024-05 issue"}},
+		{"ui/button_click/signup/3", map[string]string{"t": "event", "ec": "ui", "ea": "button_click", "el": "signup", "ev": "3"}},
+		{"ui/button_click//0", map[string]string{"t": "event", "ec": "ui", "ea": "button_click", "ev": "0"}},
+		{"ui/click/a/b/c", nil},
+		{"email", nil},
+		{"/open", nil},
+		{"email/", nil},
+		{"ui/click/x/-1", nil},
+		{"ui/click/x/1.5", nil},
+		{"ui/click/x/99999999999", nil},
+	}
+	for _, tt := range tests {
+		fields, err := parseEventParam(tt.v)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseEventParam(%q) = %v, want an error", tt.v, fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEventParam(%q): %v", tt.v, err)
+			continue
+		}
+		if len(fields) != len(tt.want) {
+			t.Errorf("parseEventParam(%q) = %v, want %v", tt.v, fields, tt.want)
+		}
+		for key, want := range tt.want {
+			if got := fields.Get(key); got != want {
+				t.Errorf("parseEventParam(%q): %s = %q, want %q", tt.v, key, got, want)
+			}
+		}
+	}
+}
+
+func TestEventReported(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	w := get("/UA-1234-1/newsletter?event=email/open")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	form := stub.next(t).form()
+	for key, want := range map[string]string{"t": "event", "ec": "email", "ea": "open", "el": "", "ev": "", "event": ""} {
+		if got := form.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	w = get("/UA-1234-1/newsletter?event=email/open/june/2&pixel")
+	if ct := w.Header().Get("Content-Type"); ct != "image/gif" {
+		t.Errorf("Content-Type = %s with ?pixel, want image/gif", ct)
+	}
+	if form := stub.next(t).form(); form.Get("t") != "event" || form.Get("el") != "june" || form.Get("ev") != "2" {
+		t.Errorf("payload %v, want the event with its label and value", form)
+	}
+
+	if w := get("/UA-1234-1/newsletter?event=email"); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d for a malformed event, want 400", w.Code)
+	}
+	stub.none(t)
+}
+
+func TestQueryCannotOverridePayload(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	cookie := cidCookieFrom(get("/UA-1234-1/page"))
+	want := stub.next(t).form()
+
+	for _, override := range []string{
+		"tid=UA-9999-9", "tid=G-EVIL1234", "cid=attacker", "uip=203.0.113.66", "v=2",
+		"dp=admin", "ds=evil", "aip=0", "qt=1", "api_secret=s3cret",
+		"tid=UA-9999-9&tid=UA-1234-1",
+	} {
+		get("/UA-1234-1/page?"+override, "Cookie", cookie.Name+"="+cookie.Value)
+		form := stub.next(t).form()
+		for _, key := range []string{"tid", "cid", "uip", "v", "dp", "ds", "aip", "qt", "api_secret"} {
+			if strings.Join(form[key], ",") != strings.Join(want[key], ",") {
+				t.Errorf("?%s: %s = %q, want %q", override, key, form[key], want[key])
+			}
+		}
+	}
+}
+
+func TestForwardedQuery(t *testing.T) {
+	keep(t, &forwardedParams)
+	forwardedParams = maps.Clone(forwardedParams)
+
+	query := url.Values{
+		"dt": {"Read me"}, "dr": {"https://example.com/"}, "dl": {"https://example.com/readme"},
+		"dh": {"example.com"}, "sc": {"start"}, "z": {"12345"},
+		"tid": {"UA-9999-9"}, "cid": {"attacker"}, "foo": {"bar"}, "cd1": {"red"},
+		"pixel": {""}, "ni": {"2"},
+	}
+	got := forwardedQuery(testServer.logger, query)
+	want := url.Values{
+		"dt": {"Read me"}, "dr": {"https://example.com/"}, "dl": {"https://example.com/readme"},
+		"dh": {"example.com"}, "sc": {"start"}, "z": {"12345"},
+	}
+	if got.Encode() != want.Encode() {
+		t.Errorf("forwardedQuery() = %v, want %v", got, want)
+	}
+
+	if err := addForwardParams("cd1, ul"); err != nil {
+		t.Fatal(err)
+	}
+	if got := forwardedQuery(testServer.logger, query); got.Get("cd1") != "red" {
+		t.Errorf("forwardedQuery() = %v, want cd1 forwarded with -forwardParams", got)
+	}
+	for _, key := range []string{"tid", "cid", "api_secret", "pixel"} {
+		if err := addForwardParams(key); err == nil {
+			t.Errorf("addForwardParams(%q) succeeded", key)
+		}
+	}
+}
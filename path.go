@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// maxRefererPathLength caps the page path derived from ?useReferer, matching
+// the limit applied to ?dp.
+const maxRefererPathLength = 2048
+
+var (
+	// pathRewrites holds the rules of -pathRewriteFile. It is nil without
+	// one.
+	pathRewrites atomic.Pointer[[]pathRewrite]
+
+	pathsRewritten = metrics.Counter("gabeacon_page_paths_rewritten_total", "Page paths changed by -pathRewriteFile.")
+)
+
+// pathRewrite replaces the matches of pattern in a page path.
+type pathRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// canonicalizePath collapses repeated slashes and, with -noTrailingSlash,
+// strips trailing ones.
+func canonicalizePath(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	if noTrailingSlash && len(p) > 1 {
+		p = strings.TrimRight(p, "/")
+	}
+	return p
+}
+
+// normalizePage returns the page path reported to GA. It never affects which
+// response is served.
+func normalizePage(logger *slog.Logger, p string) string {
+	normalized := canonicalizePath(p)
+	switch normalizeCase {
+	case "lower":
+		normalized = strings.ToLower(normalized)
+	case "upper":
+		normalized = strings.ToUpper(normalized)
+	}
+	normalized = rewritePath(normalized)
+	if normalized != p {
+		logger.Debug("Normalized page path", "from", p, "to", normalized)
+	}
+	return normalized
+}
+
+// rewritePath applies the -pathRewriteFile rules to p in order, each to the
+// result of the one before. The rules see p with a leading slash.
+func rewritePath(p string) string {
+	rules := pathRewrites.Load()
+	if rules == nil {
+		return p
+	}
+	rewritten, slashed := p, !strings.HasPrefix(p, "/")
+	if slashed {
+		rewritten = "/" + p
+	}
+	for _, rule := range *rules {
+		rewritten = rule.pattern.ReplaceAllString(rewritten, rule.replacement)
+	}
+	if slashed {
+		rewritten = strings.TrimPrefix(rewritten, "/")
+	}
+	if rewritten != p {
+		pathsRewritten.Inc()
+	}
+	return canonicalizePath(rewritten)
+}
+
+// parsePathRewrites parses a -pathRewriteFile: one rule per line, a regular
+// expression and its replacement, in which $1 and ${name} stand for the
+// groups of the match.
+//
+//	# comments and blank lines are ignored
+//	^/([^/]+)/([^/]+)/issues/[0-9]+$  /$1/$2/issues/:id
+//	\.html$
+//
+// A rule without a replacement deletes what it matches.
+func parsePathRewrites(data []byte) ([]pathRewrite, error) {
+	var rules []pathRewrite
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: want a pattern and a replacement, got %d fields", n, len(fields))
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rule := pathRewrite{pattern: pattern}
+		if len(fields) == 2 {
+			rule.replacement = fields[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// reloadPathRewrites reads -pathRewriteFile, keeping the current rules if it
+// is invalid.
+func reloadPathRewrites() error {
+	data, err := os.ReadFile(pathRewriteFile)
+	if err != nil {
+		return err
+	}
+	rules, err := parsePathRewrites(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", pathRewriteFile, err)
+	}
+	pathRewrites.Store(&rules)
+	return nil
+}
+
+// pathDepth returns the number of segments in page path p, ignoring empty
+// segments from repeated or trailing slashes.
+func pathDepth(p string) int {
+	p = strings.Trim(canonicalizePath(p), "/")
+	if p == "" {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// refererPath turns a Referer header into the page path used by ?useReferer.
+// The scheme and query are dropped, the path is URL-decoded, and "." and ".."
+// segments are removed so the result can't climb above the account prefix.
+func refererPath(referer string) (string, error) {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return "", err
+	}
+	// u.Path is already decoded, so %2e%2e is seen as "..". A referer
+	// without a scheme ends up entirely in Path.
+	var segments []string
+	for _, s := range strings.Split(u.Host+"/"+u.Path, "/") {
+		switch s {
+		case "", ".", "..":
+			continue
+		}
+		segments = append(segments, s)
+	}
+	p := strings.Join(segments, "/")
+	if len(p) > maxRefererPathLength {
+		return "", fmt.Errorf("referer path longer than %d bytes", maxRefererPathLength)
+	}
+	if strings.IndexFunc(p, unicode.IsControl) >= 0 {
+		return "", errors.New("referer path contains control characters")
+	}
+	return p, nil
+}
+
+// validateNormalizeCase checks the -normalizeCase value.
+func validateNormalizeCase(mode string) error {
+	switch mode {
+	case "lower", "upper", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown case normalization %q", mode)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePage(t *testing.T) {
+	tests := []struct {
+		name            string
+		normalizeCase   string
+		noTrailingSlash bool
+		page            string
+		want            string
+	}{
+		{"none", "none", false, "Docs/README", "Docs/README"},
+		{"lower", "lower", false, "Docs/README", "docs/readme"},
+		{"upper", "upper", false, "Docs/readme", "DOCS/README"},
+		{"trailing slash kept", "none", false, "docs/", "docs/"},
+		{"trailing slash stripped", "none", true, "docs/", "docs"},
+		{"trailing slashes stripped", "none", true, "docs///", "docs"},
+		{"root kept", "none", true, "/", "/"},
+		{"double slash", "none", false, "docs//readme", "docs/readme"},
+		{"repeated slashes", "none", false, "docs////readme", "docs/readme"},
+		{"lower and stripped", "lower", true, "Docs//README/", "docs/readme"},
+		{"upper and collapsed", "upper", false, "docs//readme/", "DOCS/README/"},
+		{"all", "lower", true, "//Docs///README//", "/docs/readme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep(t, &normalizeCase)
+			keep(t, &noTrailingSlash)
+			normalizeCase, noTrailingSlash = tt.normalizeCase, tt.noTrailingSlash
+			if got := normalizePage(testServer.logger, tt.page); got != tt.want {
+				t.Errorf("normalizePage(%q) = %q, want %q", tt.page, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNormalizeCase(t *testing.T) {
+	for _, mode := range []string{"lower", "upper", "none"} {
+		if err := validateNormalizeCase(mode); err != nil {
+			t.Errorf("validateNormalizeCase(%q) = %v", mode, err)
+		}
+	}
+	if validateNormalizeCase("title") == nil {
+		t.Error("validateNormalizeCase accepted title")
+	}
+}
+
+func TestNormalizedPageReported(t *testing.T) {
+	stub := newTestBeacon(t, "-normalizeCase=lower", "-noTrailingSlash")
+	w := get("/UA-1234-1/Docs//README/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/svg+xml" {
+		t.Errorf("Content-Type = %q, want the badge served as without normalization", got)
+	}
+	if got := stub.next(t).form().Get("dp"); got != "docs/readme" {
+		t.Errorf("dp = %q, want docs/readme", got)
+	}
+}
+
+func TestPathDepth(t *testing.T) {
+	tests := []struct {
+		page string
+		want int
+	}{
+		{"", 0},
+		{"/", 0},
+		{"readme", 1},
+		{"docs/readme", 2},
+		{"docs/readme/", 2},
+		{"docs//readme", 2},
+		{"//docs///readme//", 2},
+	}
+	for _, tt := range tests {
+		if got := pathDepth(tt.page); got != tt.want {
+			t.Errorf("pathDepth(%q) = %d, want %d", tt.page, got, tt.want)
+		}
+	}
+}
+
+func TestPathDepthLimits(t *testing.T) {
+	deepest := strings.Repeat("a/", 20)
+	tests := []struct {
+		name   string
+		args   []string
+		target string
+		want   int
+	}{
+		{"max depth", nil, "/UA-1234-1/" + deepest, http.StatusOK},
+		{"over max depth", nil, "/UA-1234-1/" + deepest + "b", http.StatusRequestURITooLong},
+		{"lower max depth", []string{"-maxPathDepth=2"}, "/UA-1234-1/a/b/c", http.StatusRequestURITooLong},
+		{"repeated slashes", []string{"-maxPathDepth=2"}, "/UA-1234-1/a//b//", http.StatusOK},
+		{"min depth", []string{"-minPathDepth=2"}, "/UA-1234-1/a/b", http.StatusOK},
+		{"under min depth", []string{"-minPathDepth=2"}, "/UA-1234-1/a", http.StatusBadRequest},
+		{"repeated slashes under min depth", []string{"-minPathDepth=2"}, "/UA-1234-1/a//", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			w := get(tt.target)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK {
+				stub.next(t)
+			} else {
+				stub.none(t)
+			}
+		})
+	}
+}
+
+func TestRefererPath(t *testing.T) {
+	tests := []struct {
+		referer string
+		want    string
+		invalid bool
+	}{
+		{"https://example.com/docs/readme", "example.com/docs/readme", false},
+		{"https://example.com/docs/readme?tab=1#top", "example.com/docs/readme", false},
+		{"example.com/docs", "example.com/docs", false},
+		{"https://example.com", "example.com", false},
+		{"https://example.com//a///b/", "example.com/a/b", false},
+		{"evil.com/../../../../admin", "evil.com/admin", false},
+		{"https://evil.com/a/./b/../c", "evil.com/a/b/c", false},
+		{"https://evil.com/%2e%2e/%2E%2E/admin", "evil.com/admin", false},
+		{"https://evil.com/..%2f..%2fadmin", "evil.com/admin", false},
+		{"https://evil.com/%2e%2e%2fUA-9999-9", "evil.com/UA-9999-9", false},
+		{"/UA-9999-9/page", "UA-9999-9/page", false},
+		{"../../UA-9999-9", "UA-9999-9", false},
+		{"https://example.com/caf%C3%A9", "example.com/café", false},
+		{"https://example.com/" + strings.Repeat("a", maxRefererPathLength), "", true},
+		{"https://example.com/a%0d%0aSet-Cookie:x", "", true},
+		{"https://example.com/a%00b", "", true},
+		{"https://example.com/%zz", "", true},
+		{"http://[::1", "", true},
+	}
+	for _, tt := range tests {
+		got, err := refererPath(tt.referer)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("refererPath(%q) = %q, want an error", tt.referer, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("refererPath(%q) = %q, %v, want %q", tt.referer, got, err, tt.want)
+		}
+	}
+}
+
+func FuzzRefererPath(f *testing.F) {
+	for _, seed := range []string{
+		"https://example.com/docs/readme",
+		"evil.com/../../../../admin",
+		"https://evil.com/%2e%2e%2f%2e%2e/admin",
+		"/UA-9999-9/page",
+		"https://example.com/a%0d%0ab",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, referer string) {
+		p, err := refererPath(referer)
+		if err != nil {
+			return
+		}
+		if len(p) > maxRefererPathLength {
+			t.Errorf("refererPath(%q) is %d bytes long", referer, len(p))
+		}
+		for _, s := range strings.Split(p, "/") {
+			if s == "" && p != "" || s == "." || s == ".." {
+				t.Errorf("refererPath(%q) = %q has segment %q", referer, p, s)
+			}
+		}
+		if strings.ContainsAny(p, "\r\n\x00") {
+			t.Errorf("refererPath(%q) = %q has control characters", referer, p)
+		}
+	})
+}
+
+func TestUseRefererReported(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		referer string
+		status  int
+		dp      string
+	}{
+		{"page from referer", "/UA-1234-1?useReferer", "https://example.com/docs", http.StatusOK, "example.com/docs"},
+		{"prefixed by the path", "/UA-1234-1/blog?useReferer", "https://example.com/post", http.StatusOK, "blog/example.com/post"},
+		{"traversal", "/UA-1234-1?useReferer", "evil.com/../../../../admin", http.StatusOK, "evil.com/admin"},
+		{"tracking ID injection", "/UA-1234-1?useReferer", "/UA-9999-9/page", http.StatusOK, "UA-9999-9/page"},
+		{"too long", "/UA-1234-1?useReferer", "https://example.com/" + strings.Repeat("a", maxRefererPathLength), http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t)
+			w := get(tt.target, "Referer", tt.referer)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				stub.none(t)
+				return
+			}
+			form := stub.next(t).form()
+			if got := form.Get("tid"); got != "UA-1234-1" {
+				t.Errorf("tid = %s, want the account from the request path", got)
+			}
+			if got := form.Get("dp"); got != tt.dp {
+				t.Errorf("dp = %q, want %q", got, tt.dp)
+			}
+		})
+	}
+}
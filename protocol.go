@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/irvinlim/ga-beacon/beacon"
+)
+
+// collectorRegions are the base URLs of GA's collectors for
+// -collectorRegion. Hits to the EU collector are processed in the EU.
+var collectorRegions = map[string]string{
+	"global": "https://www.google-analytics.com",
+	"eu":     "https://region1.google-analytics.com",
+}
+
+// ga4Endpoint is the GA4 collector URL, set from -collectorURL or
+// -collectorRegion.
+var ga4Endpoint string
+
+// collectorBase returns the base URL of the collector hits are sent to:
+// -collectorURL if set, or GA's collector for -collectorRegion.
+func collectorBase() (string, error) {
+	if collectorURL == "" {
+		base, ok := collectorRegions[collectorRegion]
+		if !ok {
+			return "", fmt.Errorf("unknown -collectorRegion %q (want global or eu)", collectorRegion)
+		}
+		return base, nil
+	}
+	u, err := url.Parse(collectorURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return "", fmt.Errorf("-collectorURL must be an http or https URL without a query, not %q", collectorURL)
+	}
+	return strings.TrimSuffix(collectorURL, "/"), nil
+}
+
+// ProtocolVersion is the Measurement Protocol a hit is reported with.
+type ProtocolVersion string
+
+const (
+	ProtocolV1   ProtocolVersion = "v1"   // Universal Analytics
+	ProtocolGA4  ProtocolVersion = "ga4"  // Google Analytics 4
+	ProtocolAuto ProtocolVersion = "auto" // pick from the tracking ID prefix
+)
+
+func parseProtocolVersion(s string) (ProtocolVersion, error) {
+	switch v := ProtocolVersion(s); v {
+	case ProtocolV1, ProtocolGA4, ProtocolAuto:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown protocol %q (want v1, ga4 or auto)", s)
+}
+
+// selectProtocol returns the protocol to report hits for trackingID with.
+// Unless forced, G- measurement IDs go to GA4 and everything else
+// (UA-, GT-, AW-, ...) to v1.
+func selectProtocol(trackingID string, force ProtocolVersion) ProtocolVersion {
+	if force != ProtocolAuto {
+		return force
+	}
+	if strings.HasPrefix(trackingID, "G-") {
+		return ProtocolGA4
+	}
+	return ProtocolV1
+}
+
+// gaRequest is a hit encoded for a collector endpoint.
+type gaRequest struct {
+	url         string
+	contentType string
+	body        string
+	header      http.Header // extra request headers, if any
+}
+
+// PayloadBuilder encodes a hit for one protocol version.
+type PayloadBuilder interface {
+	Build(job hitJob) (gaRequest, error)
+}
+
+var payloadBuilders = map[ProtocolVersion]PayloadBuilder{
+	ProtocolV1:  v1PayloadBuilder{},
+	ProtocolGA4: ga4PayloadBuilder{},
+}
+
+// dataSource returns where job came from, falling back to
+// -defaultDataSource.
+func dataSource(job hitJob) string {
+	if job.source != "" {
+		return job.source
+	}
+	return defaultDataSource
+}
+
+type v1PayloadBuilder struct{}
+
+func (v1PayloadBuilder) Build(job hitJob) (gaRequest, error) {
+	// 1) Initialize default values from path structure
+	// 2) Pass through the allowlisted query params (see forwardedParams)
+	//
+	// GA Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/v1/reference
+
+	payload := beacon.Hit{
+		TrackingID: job.params[0],
+		ClientID:   job.cid,
+		Path:       job.params[1],
+		IP:         job.ip,
+	}.Values()
+
+	for key, val := range forwardedQuery(job.logger, job.query) {
+		payload[key] = val
+	}
+
+	if mode := ipModeFor(job.params[0]); mode != ipModeFull {
+		payload.Set("aip", "1") // anonymize IP on GA's side
+		if ip := reportedIP(job); ip != "" {
+			payload.Set("uip", ip) // and in transit
+		} else {
+			payload.Del("uip")
+		}
+	}
+
+	// The dimensions from dedicated flags take precedence over -customFields.
+	for field, value := range job.customFields {
+		payload.Set(field, value)
+	}
+	if correlationIDDimension > 0 && job.correlationID != "" {
+		payload.Set(fmt.Sprintf("cd%d", correlationIDDimension), job.correlationID)
+	}
+	if source := dataSource(job); source != "" {
+		payload.Set("ds", source)
+	}
+	if job.bot && botDimension > 0 {
+		payload.Set(fmt.Sprintf("cd%d", botDimension), "bot")
+	}
+	applyGeo(payload, job.ip)
+	applyClient(payload, job.client)
+	applySampleWeight(payload, job.params[0])
+	if qt := queueTime(job); qt > 0 {
+		payload.Set("qt", strconv.FormatInt(qt.Milliseconds(), 10))
+	}
+
+	return gaRequest{
+		url:         gaEndpointFor(job.params[0]),
+		contentType: "application/x-www-form-urlencoded",
+		body:        payload.Encode(),
+	}, nil
+}
+
+// ga4PayloadBuilder reports hits as page_view events, or as events named
+// after the action for ?event= hits (see ga4EventName). page_location is the
+// absolute URL of the page on the hit's dh, or on the host the beacon was
+// requested at. Forwarded v1 params with a GA4 equivalent are mapped onto it
+// (see ga4ParamNames), so a dl replaces page_location; the rest are dropped. ?up.<name>= params become user properties. The API secret is
+// taken from ?api_secret, falling back to -ga4APISecret.
+//
+// GA4 Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/ga4/reference
+type ga4PayloadBuilder struct{}
+
+const (
+	// userPropertyPrefix starts the ?up.<name>= params setting GA4 user
+	// properties.
+	userPropertyPrefix = "up."
+
+	maxUserProperties         = 25
+	maxUserPropertyValueBytes = 36
+)
+
+var (
+	// userPropertyName matches the user property names GA4 accepts.
+	userPropertyName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,24}$`)
+
+	invalidEventNameChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+const (
+	maxEventNameLength = 40
+	// fallbackEventName names GA4 events whose action cannot be made into a
+	// valid event name.
+	fallbackEventName = "beacon_event"
+)
+
+// ga4ParamNames maps forwarded v1 params to GA4 event params.
+var ga4ParamNames = map[string]string{
+	"dt": "page_title",
+	"dr": "page_referrer",
+	"dl": "page_location",
+}
+
+func (ga4PayloadBuilder) Build(job hitJob) (gaRequest, error) {
+	secret := job.query.Get("api_secret")
+	if secret == "" {
+		secret = ga4APISecret
+	}
+	if secret == "" {
+		return gaRequest{}, fmt.Errorf("cannot report %s hits with GA4: no api_secret param and -ga4APISecret is not set", job.params[0])
+	}
+
+	forwarded := forwardedQuery(job.logger, job.query)
+	host := forwarded.Get("dh")
+	if host == "" {
+		host = job.host
+	}
+	name := "page_view"
+	params := map[string]interface{}{}
+	if location := pageURL(job, forwarded, host); location != "" {
+		params["page_location"] = location
+	}
+	switch job.query.Get("t") {
+	case "event":
+		name = ga4EventName(job.query.Get("ea"))
+		if name != job.query.Get("ea") {
+			params["event_action"] = job.query.Get("ea")
+		}
+		params["event_category"] = job.query.Get("ec")
+		if label := job.query.Get("el"); label != "" {
+			params["event_label"] = label
+		}
+		if value, err := strconv.Atoi(job.query.Get("ev")); err == nil {
+			params["value"] = value
+		}
+	case "timing":
+		name = "timing_complete"
+		params["event_category"] = job.query.Get("utc")
+		params["name"] = job.query.Get("utv")
+		if value, err := strconv.Atoi(job.query.Get("utt")); err == nil {
+			params["value"] = value
+		}
+		if label := job.query.Get("utl"); label != "" {
+			params["event_label"] = label
+		}
+	case "exception":
+		name = "exception"
+		params["description"] = job.query.Get("exd")
+		params["fatal"] = job.query.Get("exf") == "1"
+	}
+	for key, name := range ga4ParamNames {
+		if v := forwarded.Get(key); v != "" {
+			params[name] = v
+		}
+	}
+	if job.correlationID != "" {
+		params["correlation_id"] = job.correlationID
+	}
+	if source := dataSource(job); source != "" {
+		params["hit_source"] = source
+	}
+	if job.bot {
+		params["traffic_type"] = "bot"
+	}
+	if weight := sampleWeight(job.params[0]); weight > 0 {
+		params["sample_weight"] = weight
+	}
+	// GA4 only counts users and engaged sessions for events with some
+	// engagement time. The beacon can't measure it, so interactive hits get
+	// the least there is.
+	if !nonInteraction(forwarded) {
+		params["engagement_time_msec"] = 1
+	}
+	if ga4DedupeWindow > 0 {
+		hitTime := job.hitTime
+		if hitTime.IsZero() {
+			hitTime = time.Now()
+		}
+		params["event_id"] = computeEventID(job.params[0], job.params[1], job.cid, hitTime)
+	}
+	hit := map[string]interface{}{
+		"client_id": job.cid,
+		"events": []map[string]interface{}{
+			{"name": name, "params": params},
+		},
+	}
+	if uid := forwarded.Get("uid"); uid != "" {
+		hit["user_id"] = uid
+	}
+	if props, err := userProperties(job.query); err != nil {
+		job.logger.Debug("Not sending invalid user properties", "tid", job.params[0], "err", err)
+	} else if len(props) > 0 {
+		hit["user_properties"] = props
+	}
+	if queueTime(job) > 0 {
+		hit["timestamp_micros"] = job.hitTime.UnixMicro()
+	}
+	if job.client != nil {
+		hit["device"] = ga4Device(job.client)
+	}
+	body, err := json.Marshal(hit)
+	if err != nil {
+		return gaRequest{}, err
+	}
+
+	return gaRequest{
+		url:         ga4Endpoint + "?" + url.Values{"measurement_id": {job.params[0]}, "api_secret": {secret}}.Encode(),
+		contentType: "application/json",
+		body:        string(body),
+	}, nil
+}
+
+// ga4EventName turns a v1 event action into a GA4 event name: letters,
+// digits and underscores, starting with a letter, at most 40 characters.
+// Other characters become underscores; an action not starting with a letter
+// gets fallbackEventName.
+func ga4EventName(action string) string {
+	name := invalidEventNameChars.ReplaceAllString(action, "_")
+	if len(name) > maxEventNameLength {
+		name = name[:maxEventNameLength]
+	}
+	if name == "" || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		return fallbackEventName
+	}
+	return name
+}
+
+// userProperties returns the GA4 user_properties set by the ?up.<name>=
+// params of query, failing on an invalid name, a value over 36 bytes or more
+// than 25 properties. v1 hits have no user properties, so the params are
+// ignored for them.
+func userProperties(query url.Values) (map[string]interface{}, error) {
+	props := map[string]interface{}{}
+	for key := range query {
+		name, ok := strings.CutPrefix(key, userPropertyPrefix)
+		if !ok {
+			continue
+		}
+		if !userPropertyName.MatchString(name) {
+			return nil, fmt.Errorf("invalid user property name %s", strconv.Quote(name))
+		}
+		value := query.Get(key)
+		if len(value) > maxUserPropertyValueBytes {
+			return nil, fmt.Errorf("user property %s is longer than %d bytes", name, maxUserPropertyValueBytes)
+		}
+		props[name] = map[string]string{"value": value}
+	}
+	if len(props) > maxUserProperties {
+		return nil, fmt.Errorf("%d user properties, at most %d are allowed", len(props), maxUserProperties)
+	}
+	return props, nil
+}
+
+// computeEventID returns the GA4 event_id of a hit made at t: the first 32
+// bits of the SHA-256 of account, page, cid and t truncated to
+// -ga4DedupeWindow. A retried hit, sent again within the window, gets the
+// same ID, so GA4 counts it once.
+func computeEventID(account, page, cid string, t time.Time) int64 {
+	h := sha256.New()
+	for _, field := range []string{account, page, cid} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	binary.Write(h, binary.BigEndian, t.Truncate(ga4DedupeWindow).UnixNano())
+	return int64(binary.BigEndian.Uint32(h.Sum(nil)))
+}
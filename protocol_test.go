@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAIPField(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantAIP string
+		wantUIP string
+	}{
+		{"disabled", nil, "", "192.0.2.1"},
+		{"enabled", []string{"-gaAnonymizeIP"}, "1", "192.0.2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			get("/UA-1234-1/page")
+			form := stub.next(t).form()
+			if got := form.Get("aip"); got != tt.wantAIP {
+				t.Errorf("aip = %q, want %q", got, tt.wantAIP)
+			}
+			if got := form.Get("uip"); got != tt.wantUIP {
+				t.Errorf("uip = %q, want %q", got, tt.wantUIP)
+			}
+		})
+	}
+}
+
+func TestUserProperties(t *testing.T) {
+	tooMany := url.Values{}
+	for i := 0; i <= maxUserProperties; i++ {
+		tooMany.Set(fmt.Sprintf("up.p%d", i), "v")
+	}
+	tests := []struct {
+		name    string
+		query   url.Values
+		want    int
+		wantErr bool
+	}{
+		{"none", url.Values{"ea": {"play"}}, 0, false},
+		{"valid", url.Values{"up.tier": {"premium"}, "up.plan_2": {"yearly"}}, 2, false},
+		{"longest name", url.Values{"up." + strings.Repeat("a", 25): {"v"}}, 1, false},
+		{"longest value", url.Values{"up.tier": {strings.Repeat("v", maxUserPropertyValueBytes)}}, 1, false},
+		{"name starting with a digit", url.Values{"up.1tier": {"premium"}}, 0, true},
+		{"name with a dash", url.Values{"up.sub-tier": {"premium"}}, 0, true},
+		{"empty name", url.Values{"up.": {"premium"}}, 0, true},
+		{"name too long", url.Values{"up." + strings.Repeat("a", 26): {"v"}}, 0, true},
+		{"value too long", url.Values{"up.tier": {strings.Repeat("v", maxUserPropertyValueBytes+1)}}, 0, true},
+		{"too many", tooMany, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			props, err := userProperties(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("userProperties() error = %v, want error: %v", err, tt.wantErr)
+			}
+			if len(props) != tt.want {
+				t.Errorf("userProperties() = %v, want %d properties", props, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserPropertiesReported(t *testing.T) {
+	stub := newTestBeacon(t, "-ga4APISecret=secret")
+	if w := get("/G-ABC123/page?up.tier=premium"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var hit struct {
+		UserProperties map[string]struct {
+			Value string `json:"value"`
+		} `json:"user_properties"`
+	}
+	if err := json.Unmarshal([]byte(stub.next(t).body), &hit); err != nil {
+		t.Fatal(err)
+	}
+	if got := hit.UserProperties["tier"].Value; got != "premium" || len(hit.UserProperties) != 1 {
+		t.Errorf("user_properties = %+v, want tier=premium", hit.UserProperties)
+	}
+}
+
+func TestUserPropertiesInvalid(t *testing.T) {
+	stub := newTestBeacon(t, "-ga4APISecret=secret")
+	if w := get("/G-ABC123/page?up.1tier=premium"); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	stub.none(t)
+}
+
+func TestUserPropertiesIgnoredForV1(t *testing.T) {
+	stub := newTestBeacon(t)
+	if w := get("/UA-1234-1/page?up.1tier=premium"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	hit := stub.next(t)
+	if strings.Contains(hit.body, "premium") {
+		t.Errorf("v1 payload %q carries the user property", hit.body)
+	}
+}
+
+func TestComputeEventID(t *testing.T) {
+	keep(t, &ga4DedupeWindow)
+	ga4DedupeWindow = 5 * time.Second
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	id := computeEventID("G-ABC123", "page", "cid", start)
+
+	tests := []struct {
+		name    string
+		account string
+		page    string
+		cid     string
+		t       time.Time
+		same    bool
+	}{
+		{"same time", "G-ABC123", "page", "cid", start, true},
+		{"same window", "G-ABC123", "page", "cid", start.Add(4999 * time.Millisecond), true},
+		{"next window", "G-ABC123", "page", "cid", start.Add(5 * time.Second), false},
+		{"previous window", "G-ABC123", "page", "cid", start.Add(-time.Millisecond), false},
+		{"other page", "G-ABC123", "other", "cid", start, false},
+		{"other client", "G-ABC123", "page", "other", start, false},
+		{"other account", "G-DEF456", "page", "cid", start, false},
+		{"fields run together", "G-ABC123", "pagec", "id", start, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeEventID(tt.account, tt.page, tt.cid, tt.t)
+			if (got == id) != tt.same {
+				t.Errorf("computeEventID() = %d, want the same as %d: %v", got, id, tt.same)
+			}
+		})
+	}
+}
+
+func TestComputeEventIDRange(t *testing.T) {
+	start := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		id := computeEventID("G-ABC123", fmt.Sprintf("page%d", i), "cid", start.Add(time.Duration(i)*time.Minute))
+		if id < 0 || id > math.MaxUint32 {
+			t.Fatalf("computeEventID() = %d, want a 32-bit unsigned integer", id)
+		}
+	}
+}
+
+func TestEventIDReported(t *testing.T) {
+	eventID := func(t *testing.T, stub *gaStub) (float64, bool) {
+		var hit struct {
+			Events []struct {
+				Params map[string]interface{} `json:"params"`
+			} `json:"events"`
+		}
+		if err := json.Unmarshal([]byte(stub.next(t).body), &hit); err != nil || len(hit.Events) != 1 {
+			t.Fatalf("payload is not one GA4 event: %v", err)
+		}
+		id, ok := hit.Events[0].Params["event_id"].(float64)
+		return id, ok
+	}
+
+	t.Run("window", func(t *testing.T) {
+		stub := newTestBeacon(t, "-ga4APISecret=secret", "-coalesceWindow=0", "-ga4DedupeWindow=1h")
+		get("/G-ABC123/page", "Cookie", "cid=returning")
+		first, ok := eventID(t, stub)
+		if !ok {
+			t.Fatal("no event_id in the GA4 payload")
+		}
+		get("/G-ABC123/page", "Cookie", "cid=returning")
+		if second, _ := eventID(t, stub); second != first {
+			t.Errorf("event_id = %v for a repeated hit, want %v", second, first)
+		}
+	})
+
+	t.Run("no window", func(t *testing.T) {
+		stub := newTestBeacon(t, "-ga4APISecret=secret", "-ga4DedupeWindow=0")
+		get("/G-ABC123/page")
+		if id, ok := eventID(t, stub); ok {
+			t.Errorf("event_id = %v with -ga4DedupeWindow=0, want none", id)
+		}
+	})
+}
+
+func TestSelectProtocol(t *testing.T) {
+	tests := []struct {
+		trackingID string
+		force      ProtocolVersion
+		want       ProtocolVersion
+	}{
+		{"G-ABC123", ProtocolAuto, ProtocolGA4},
+		{"UA-1234-1", ProtocolAuto, ProtocolV1},
+		{"GT-ABC123", ProtocolAuto, ProtocolV1},
+		{"AW-123456", ProtocolAuto, ProtocolV1},
+		{"g-abc123", ProtocolAuto, ProtocolV1},
+		{"G-ABC123", ProtocolV1, ProtocolV1},
+		{"UA-1234-1", ProtocolGA4, ProtocolGA4},
+		{"UA-1234-1", ProtocolV1, ProtocolV1},
+		{"G-ABC123", ProtocolGA4, ProtocolGA4},
+	}
+	for _, tt := range tests {
+		if got := selectProtocol(tt.trackingID, tt.force); got != tt.want {
+			t.Errorf("selectProtocol(%q, %s) = %s, want %s", tt.trackingID, tt.force, got, tt.want)
+		}
+	}
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	for _, s := range []string{"v1", "ga4", "auto"} {
+		if v, err := parseProtocolVersion(s); err != nil || string(v) != s {
+			t.Errorf("parseProtocolVersion(%q) = %q, %v", s, v, err)
+		}
+	}
+	for _, s := range []string{"", "v2", "GA4", "ua"} {
+		if _, err := parseProtocolVersion(s); err == nil {
+			t.Errorf("parseProtocolVersion(%q) accepted an unknown protocol", s)
+		}
+	}
+}
+
+func TestPayloadBuilderSelected(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		target   string
+		ga4      bool
+	}{
+		{"auto GA4", "auto", "/G-ABC123/page", true},
+		{"auto UA", "auto", "/UA-1234-1/page", false},
+		{"auto GT", "auto", "/GT-ABC123/page", false},
+		{"auto AW", "auto", "/AW-123456/page", false},
+		{"forced v1", "v1", "/G-ABC123/page", false},
+		{"forced GA4", "ga4", "/UA-1234-1/page", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, "-gaProtocol="+tt.protocol, "-ga4APISecret=secret")
+			if w := get(tt.target); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			hit := stub.next(t)
+			account := strings.Split(tt.target, "/")[1]
+			if tt.ga4 {
+				var event struct {
+					Events []struct {
+						Name string `json:"name"`
+					} `json:"events"`
+				}
+				if hit.path != "/mp/collect" || hit.query.Get("measurement_id") != account || hit.query.Get("api_secret") != "secret" {
+					t.Errorf("hit sent to %s?%s, want /mp/collect for %s", hit.path, hit.query.Encode(), account)
+				}
+				if err := json.Unmarshal([]byte(hit.body), &event); err != nil || len(event.Events) != 1 || event.Events[0].Name != "page_view" {
+					t.Errorf("GA4 body = %s, want a page_view event", hit.body)
+				}
+				if strings.Contains(hit.body, `"v"`) {
+					t.Errorf("GA4 body = %s carries a v field", hit.body)
+				}
+				return
+			}
+			form := hit.form()
+			if hit.path != "/collect" || form.Get("v") != "1" || form.Get("tid") != account {
+				t.Errorf("hit sent to %s with %v, want a v1 hit to /collect for %s", hit.path, form, account)
+			}
+		})
+	}
+}
+
+func TestGA4Routing(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		target     string
+		wantSecret string // empty for no hit
+	}{
+		{"flag secret", []string{"-ga4APISecret=flag-secret"}, "/G-ABC123/docs/page", "flag-secret"},
+		{"param secret", nil, "/G-ABC123/docs/page?api_secret=param-secret", "param-secret"},
+		{"param over flag", []string{"-ga4APISecret=flag-secret"}, "/G-ABC123/docs/page?api_secret=param-secret", "param-secret"},
+		{"no secret", nil, "/G-ABC123/docs/page", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, tt.args...)
+			if w := get(tt.target, "Cookie", "cid=returning"); w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want the badge whether or not the hit can be reported", w.Code)
+			}
+			if tt.wantSecret == "" {
+				stub.none(t)
+				return
+			}
+			hit := stub.next(t)
+			if hit.path != "/mp/collect" || hit.query.Get("measurement_id") != "G-ABC123" || hit.query.Get("api_secret") != tt.wantSecret {
+				t.Errorf("hit sent to %s?%s, want /mp/collect?measurement_id=G-ABC123&api_secret=%s", hit.path, hit.query.Encode(), tt.wantSecret)
+			}
+			if got := hit.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body struct {
+				ClientID string `json:"client_id"`
+				Events   []struct {
+					Name   string                 `json:"name"`
+					Params map[string]interface{} `json:"params"`
+				} `json:"events"`
+			}
+			if err := json.Unmarshal([]byte(hit.body), &body); err != nil {
+				t.Fatalf("%v: %s", err, hit.body)
+			}
+			if body.ClientID != "returning" || len(body.Events) != 1 || body.Events[0].Name != "page_view" || body.Events[0].Params["page_location"] != "https://example.com/docs/page" {
+				t.Errorf("body = %s, want a page_view of https://example.com/docs/page by the returning client", hit.body)
+			}
+			if strings.Contains(hit.body, tt.wantSecret) {
+				t.Errorf("body = %s carries the API secret", hit.body)
+			}
+		})
+	}
+
+	t.Run("universal analytics", func(t *testing.T) {
+		stub := newTestBeacon(t, "-ga4APISecret=flag-secret")
+		get("/UA-1234-1/docs/page", "Cookie", "cid=returning")
+		hit := stub.next(t)
+		form := hit.form()
+		if hit.path != "/collect" || form.Get("tid") != "UA-1234-1" || form.Get("cid") != "returning" || form.Get("dp") != "docs/page" {
+			t.Errorf("hit sent to %s with %v, want a v1 pageview on /collect", hit.path, form)
+		}
+		if form.Has("api_secret") || hit.query.Has("api_secret") {
+			t.Error("v1 hit carries the GA4 API secret")
+		}
+	})
+}
+
+func TestGA4PayloadBuild(t *testing.T) {
+	setFlags(t, "-ga4APISecret=flag-secret", "-ga4DedupeWindow=0")
+	keep(t, &ga4Endpoint)
+	ga4Endpoint = "https://collector.example.com/mp/collect"
+	made := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name     string
+		query    string
+		hitTime  time.Time
+		event    string
+		location string
+		params   map[string]interface{}
+		userID   string
+		queued   bool
+	}{
+		{"pageview", "", time.Time{}, "page_view", "https://beacon.example.com/docs/page", nil, "", false},
+		{"dh", "dh=docs.example.com", time.Time{}, "page_view", "https://docs.example.com/docs/page", nil, "", false},
+		{"dl", "dh=docs.example.com&dl=https://example.com/intro?x=1", time.Time{}, "page_view", "https://example.com/intro?x=1", nil, "", false},
+		{"title and referrer", "dt=Intro&dr=https://example.com/", time.Time{}, "page_view", "https://beacon.example.com/docs/page",
+			map[string]interface{}{"page_title": "Intro", "page_referrer": "https://example.com/"}, "", false},
+		{"event", "t=event&ec=docs&ea=download&el=pdf&ev=3", time.Time{}, "download", "https://beacon.example.com/docs/page",
+			map[string]interface{}{"event_category": "docs", "event_label": "pdf", "value": float64(3)}, "", false},
+		{"user", "uid=user-42", time.Time{}, "page_view", "https://beacon.example.com/docs/page", nil, "user-42", false},
+		{"queued", "", made, "page_view", "https://beacon.example.com/docs/page", nil, "", true},
+		{"non-interaction", "ni=1", time.Time{}, "page_view", "https://beacon.example.com/docs/page", map[string]interface{}{"engagement_time_msec": nil}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			job := hitJob{params: []string{"G-ABC123", "docs/page"}, query: query, cid: "cid-1", host: "beacon.example.com", hitTime: tt.hitTime, logger: testServer.logger}
+			req, err := ga4PayloadBuilder{}.Build(job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(req.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Host != "collector.example.com" || u.Query().Get("measurement_id") != "G-ABC123" || u.Query().Get("api_secret") != "flag-secret" {
+				t.Errorf("url = %s, want the GA4 endpoint with the measurement ID and API secret", req.url)
+			}
+			if req.contentType != "application/json" {
+				t.Errorf("content type = %s, want application/json", req.contentType)
+			}
+
+			var body struct {
+				ClientID        string `json:"client_id"`
+				UserID          string `json:"user_id"`
+				TimestampMicros int64  `json:"timestamp_micros"`
+				Events          []struct {
+					Name   string                 `json:"name"`
+					Params map[string]interface{} `json:"params"`
+				} `json:"events"`
+			}
+			if err := json.Unmarshal([]byte(req.body), &body); err != nil {
+				t.Fatalf("%v: %s", err, req.body)
+			}
+			if body.ClientID != "cid-1" || len(body.Events) != 1 || body.Events[0].Name != tt.event {
+				t.Fatalf("body = %s, want one %s event of cid-1", req.body, tt.event)
+			}
+			params := body.Events[0].Params
+			if params["page_location"] != tt.location {
+				t.Errorf("page_location = %v, want %s", params["page_location"], tt.location)
+			}
+			for name, want := range tt.params {
+				if got, ok := params[name]; want == nil && ok || want != nil && got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+			if body.UserID != tt.userID {
+				t.Errorf("user_id = %q, want %q", body.UserID, tt.userID)
+			}
+			if tt.queued != (body.TimestampMicros != 0) || tt.queued && body.TimestampMicros != made.UnixMicro() {
+				t.Errorf("timestamp_micros = %d, want %d if queued, otherwise none", body.TimestampMicros, made.UnixMicro())
+			}
+			if strings.Contains(req.body, "flag-secret") {
+				t.Errorf("body = %s carries the API secret", req.body)
+			}
+		})
+	}
+
+	setFlags(t, "-ga4APISecret=")
+	if _, err := (ga4PayloadBuilder{}).Build(hitJob{params: []string{"G-ABC123", "page"}, query: url.Values{}, logger: testServer.logger}); err == nil {
+		t.Error("Build() without an API secret succeeded")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdle is how long a key's bucket is kept after its last hit.
+const rateLimiterIdle = 10 * time.Minute
+
+var (
+	ipRateLimiter      *rateLimiter
+	accountRateLimiter *rateLimiter
+)
+
+// rateLimiter keeps a token bucket per key, e.g. per client IP or tracking
+// ID. A limiter with a zero rate allows everything.
+type rateLimiter struct {
+	rps   rate.Limit
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	limited atomic.Int64
+}
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	l := &rateLimiter{rps: rate.Limit(rps), burst: burst, buckets: map[string]*rateBucket{}}
+	if rps > 0 {
+		go l.sweep()
+	}
+	return l
+}
+
+// Allow reports whether a hit for key is within the limit.
+func (l *rateLimiter) Allow(key string) bool {
+	if l.rps <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	if !b.limiter.Allow() {
+		l.limited.Add(1)
+		return false
+	}
+	return true
+}
+
+// Limited returns how many hits have been over the limit.
+func (l *rateLimiter) Limited() int64 {
+	return l.limited.Load()
+}
+
+// sweep periodically forgets buckets of keys that have gone quiet.
+func (l *rateLimiter) sweep() {
+	for range time.Tick(rateLimiterIdle) {
+		now := time.Now()
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if now.Sub(b.lastSeen) >= rateLimiterIdle {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// statusOverrideWriter replaces the 200 OK of a response with status, leaving
+// headers and body untouched.
+type statusOverrideWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusOverrideWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK {
+		status = w.status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusOverrideWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusOverrideWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(0.001, 2)
+	for i, want := range []bool{true, true, false, false} {
+		if got := l.Allow("192.0.2.1"); got != want {
+			t.Errorf("hit %d allowed: %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.Allow("192.0.2.2") {
+		t.Error("other key limited")
+	}
+	if got := l.Limited(); got != 2 {
+		t.Errorf("Limited() = %d, want 2", got)
+	}
+
+	unlimited := newRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.Allow("192.0.2.1") {
+			t.Fatal("limiter with a zero rate limited a hit")
+		}
+	}
+}
+
+func TestRateLimitedHits(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		hits   []string // X-Forwarded-For of each hit to UA-1234-1, or "account" for one to UA-9999-9
+		status []int
+	}{
+		{"per IP", []string{"-rateLimitRPS=0.001", "-rateLimitBurst=2"},
+			[]string{"198.51.100.1", "198.51.100.1", "198.51.100.1", "198.51.100.2"},
+			[]int{200, 200, 429, 200}},
+		{"suppressed", []string{"-rateLimitRPS=0.001", "-rateLimitBurst=2", "-rateLimitAction=suppress"},
+			[]string{"198.51.100.1", "198.51.100.1", "198.51.100.1"},
+			[]int{200, 200, 200}},
+		{"exempt IP", []string{"-rateLimitRPS=0.001", "-rateLimitBurst=1", "-exemptIPs=198.51.100.0/24"},
+			[]string{"198.51.100.1", "198.51.100.1", "198.51.100.1"},
+			[]int{200, 200, 200}},
+		{"per account", []string{"-rateLimitRPS=0", "-accountRateLimitRPS=0.001", "-accountRateLimitBurst=2"},
+			[]string{"198.51.100.1", "198.51.100.2", "198.51.100.3", "account"},
+			[]int{200, 200, 429, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, append(tt.args, "-trustProxy", "-coalesceWindow=0")...)
+			for i, ip := range tt.hits {
+				target := "/UA-1234-1/page"
+				if ip == "account" {
+					target, ip = "/UA-9999-9/page", "198.51.100.9"
+				}
+				w := get(target, "X-Forwarded-For", ip)
+				if w.Code != tt.status[i] {
+					t.Errorf("hit %d: status = %d, want %d", i+1, w.Code, tt.status[i])
+				}
+				if w.Header().Get("Content-Type") != "image/svg+xml" || !bytes.Equal(w.Body.Bytes(), badgeImages[""].data) {
+					t.Errorf("hit %d: body = %.40q... of %s, want the badge still rendered", i+1, w.Body, w.Header().Get("Content-Type"))
+				}
+				limited := tt.status[i] == http.StatusTooManyRequests || tt.name == "suppressed" && i == 2
+				if limited {
+					stub.none(t)
+				} else {
+					stub.next(t)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitedMetrics(t *testing.T) {
+	newTestBeacon(t, "-rateLimitRPS=0.001", "-rateLimitBurst=1", "-accountRateLimitRPS=0.001", "-accountRateLimitBurst=2", "-trustProxy")
+	registerTestMetrics(t)
+	get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.1")
+	get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.1") // over the IP limit
+	get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.2")
+	get("/UA-1234-1/page", "X-Forwarded-For", "198.51.100.3") // over the account limit
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`gabeacon_rate_limited_hits_total{scope="ip"} 1`,
+		`gabeacon_rate_limited_hits_total{scope="account"} 1`,
+		`gabeacon_rate_limited_total 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("/metrics does not show %s", want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// reloadableFlags are the -config settings a reload applies. Changes to the
+// others take effect on the next restart.
+var reloadableFlags = map[string]bool{
+	"logLevel":         true,
+	"allowedIDs":       true,
+	"staticDir":        true,
+	"overrideBadgeDir": true,
+	"botUAFile":        true,
+}
+
+var (
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+
+	reloadsTotal  = metrics.CounterVec("gabeacon_reloads_total", "Configuration reloads, by result.", "result")
+	reloadsOK     = reloadsTotal.With("ok")
+	reloadsFailed = reloadsTotal.With("error")
+)
+
+// reloadOnSIGHUP reloads the configuration whenever the process gets SIGHUP.
+func (s *server) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.logger.Info("Reloading on SIGHUP")
+			s.reload()
+		}
+	}()
+}
+
+// reload re-reads the -config file, the badge assets, the allowlist, the
+// tenants, the path rewrite rules and the GeoIP database, and reopens the
+// access log, without interrupting requests being served. Whatever fails to
+// load or validate keeps its previous version.
+func (s *server) reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var errs []error
+	if err := s.reloadConfig(flag.CommandLine); err != nil {
+		errs = append(errs, err)
+	}
+	if allowlistSource != nil {
+		if err := allowlistSource.refresh(); err != nil {
+			errs = append(errs, fmt.Errorf("allowlist: %w", err))
+		}
+	}
+	if tenantsFile != "" {
+		if err := reloadTenants(); err != nil {
+			errs = append(errs, fmt.Errorf("tenants: %w", err))
+		}
+	}
+	if pathRewriteFile != "" {
+		if err := reloadPathRewrites(); err != nil {
+			errs = append(errs, fmt.Errorf("path rewrites: %w", err))
+		}
+	}
+	if geoip != nil {
+		if err := geoip.reload(); err != nil {
+			errs = append(errs, fmt.Errorf("GeoIP database: %w", err))
+		}
+	}
+	if accessLogWriter != nil {
+		if err := accessLogWriter.Reopen(); err != nil {
+			errs = append(errs, fmt.Errorf("access log: %w", err))
+		}
+	}
+
+	err := errors.Join(errs...)
+	if err != nil {
+		reloadsFailed.Inc()
+		s.logger.Error("Reload failed, keeping the previous configuration where it did", "err", err)
+		return err
+	}
+	reloadsOK.Inc()
+	s.logger.Info("Reloaded configuration")
+	return nil
+}
+
+// reloadConfig applies the reloadableFlags of the -config file, then reloads
+// the assets. Settings given on the command line or in the environment still
+// win, and a setting removed from the file returns to its default. Nothing is
+// changed if the file, the new settings or the assets they point to are
+// invalid.
+func (s *server) reloadConfig(fs *flag.FlagSet) error {
+	if configFile == "" {
+		if err := reloadAssets(s.logger); err != nil {
+			return fmt.Errorf("assets: %w", err)
+		}
+		return nil
+	}
+
+	values, err := readConfigFile(fs, configFile)
+	if err != nil {
+		return err
+	}
+	changed := map[string]string{}
+	var restart []string
+	for name := range reloadableFlags {
+		if pinnedFlags[name] {
+			continue
+		}
+		f := fs.Lookup(name)
+		value, ok := values[name]
+		if !ok {
+			value = f.DefValue
+		}
+		if value != f.Value.String() {
+			changed[name] = value
+		}
+	}
+	for name, value := range values {
+		if !reloadableFlags[name] && !pinnedFlags[name] && fs.Lookup(name).Value.String() != value {
+			restart = append(restart, name)
+		}
+	}
+
+	var level slog.Level
+	if v, ok := changed["logLevel"]; ok {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("%s: unknown log level %q (want debug, info, warn or error)", configFile, v)
+		}
+	}
+
+	previous := map[string]string{}
+	restore := func() {
+		for name, value := range previous {
+			fs.Set(name, value)
+		}
+	}
+	for name, value := range changed {
+		previous[name] = fs.Lookup(name).Value.String()
+		if err := fs.Set(name, value); err != nil {
+			restore()
+			return fmt.Errorf("%s: %s: %v", configFile, name, err)
+		}
+	}
+	if err := reloadAssets(s.logger); err != nil {
+		restore()
+		return fmt.Errorf("assets: %w", err)
+	}
+	if _, ok := changed["logLevel"]; ok {
+		logLevelVar.Set(level)
+	}
+	if _, ok := changed["allowedIDs"]; ok {
+		staticAllowlist.Store(parseAllowedIDs(allowedIDs))
+	}
+
+	for name, value := range changed {
+		s.logger.Info("Setting changed", "setting", name, "value", value)
+	}
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		s.logger.Warn("Settings changed in the config file take effect after a restart", "settings", restart)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+const retryBaseDelay = 100 * time.Millisecond
+
+// budgetedRetry calls fn until it succeeds, budget is spent or -gaMaxAttempts
+// attempts were made, backing off exponentially with jitter between
+// attempts. Each attempt gets a context bounded by gaTimeout and by whatever
+// is left of the budget. In the end, the last error is returned. Failed
+// attempts are logged to logger.
+func budgetedRetry(ctx context.Context, logger *slog.Logger, budget time.Duration, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		timeout := time.Until(deadline)
+		if timeout > gaTimeout {
+			timeout = gaTimeout
+		}
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, timeout)
+		err := fn(attemptCtx)
+		cancelAttempt()
+		if err == nil {
+			return nil
+		}
+
+		if gaMaxAttempts > 0 && attempt >= gaMaxAttempts {
+			return err
+		}
+		// Sleep between half and all of delay, so workers that failed
+		// together don't retry together.
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		remaining := time.Until(deadline)
+		if remaining <= sleep {
+			return err
+		}
+		logger.Debug("GA collector attempt failed, retrying", "attempt", attempt, "err", err, "budget_left", remaining.Round(time.Millisecond).String())
+
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
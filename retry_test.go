@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBudgetedRetryAgainstFailingCollector(t *testing.T) {
+	const budget = 500 * time.Millisecond
+	stub := newTestBeacon(t, "-gaBudget=500ms", "-breakerThreshold=0")
+	stub.respond(http.StatusInternalServerError)
+
+	start := time.Now()
+	err := log(context.Background(), testJob("UA-1234-1", priorityNormal), gaRequest{
+		url:         gaEndpoint,
+		contentType: "application/x-www-form-urlencoded",
+		body:        "v=1",
+	})
+	elapsed := time.Since(start)
+	if err == nil {
+		t.Fatal("log() succeeded against a collector returning 500")
+	}
+	if elapsed > budget+200*time.Millisecond {
+		t.Errorf("reporting took %v, want at most %v", elapsed, budget+200*time.Millisecond)
+	}
+	if attempts := len(stub.hits); attempts < 2 {
+		t.Errorf("collector got %d attempts, want retries", attempts)
+	}
+}
+
+func TestBudgetedRetryAttemptTimeout(t *testing.T) {
+	keep(t, &gaTimeout)
+	keep(t, &gaMaxAttempts)
+	gaTimeout, gaMaxAttempts = 50*time.Millisecond, 0
+
+	var timeouts []time.Duration
+	errFailed := errors.New("failed")
+	err := budgetedRetry(context.Background(), testServer.logger, 300*time.Millisecond, func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		timeouts = append(timeouts, time.Until(deadline))
+		return errFailed
+	})
+	if err != errFailed {
+		t.Errorf("budgetedRetry() = %v, want the last error", err)
+	}
+	for i, timeout := range timeouts {
+		if timeout > gaTimeout {
+			t.Errorf("attempt %d had %v, want at most -gaTimeout", i+1, timeout)
+		}
+	}
+}
+
+func TestBudgetedRetryMaxAttempts(t *testing.T) {
+	keep(t, &gaMaxAttempts)
+	gaMaxAttempts = 3
+
+	attempts := 0
+	budgetedRetry(context.Background(), testServer.logger, 10*time.Second, func(ctx context.Context) error {
+		attempts++
+		return errors.New("failed")
+	})
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// sampleBuckets is the resolution of sample rates.
+const sampleBuckets = 10000
+
+var (
+	// accountSampleRates maps accounts to the share of their visitors whose
+	// hits are reported, overriding -sampleRate. Set from
+	// -accountSampleRates.
+	accountSampleRates map[string]float64
+
+	sampledOutHits = metrics.Counter("gabeacon_sampled_out_hits_total", "Hits left out by -sampleRate.")
+)
+
+// validSampleRate checks an -accountSampleRates value.
+func validSampleRate(s string) error {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate <= 0 || rate > 1 {
+		return fmt.Errorf("sample rate must be a number above 0 and at most 1, not %q", s)
+	}
+	return nil
+}
+
+// parseSampleRates parses -accountSampleRates, a comma-separated list of
+// account=rate pairs.
+func parseSampleRates(s string) (map[string]float64, error) {
+	values, err := parseAccountMap(s, validSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	rates := map[string]float64{}
+	for account, value := range values {
+		rates[account], _ = strconv.ParseFloat(value, 64)
+	}
+	return rates, nil
+}
+
+// sampleRateFor returns the share of hits to account that are reported.
+func sampleRateFor(account string) float64 {
+	if rate, ok := accountSampleRates[account]; ok {
+		return rate
+	}
+	return sampleRate
+}
+
+// sampledOut reports whether the hits of cid to account are left out by the
+// account's sample rate. Visitors are sampled by their client ID, so either
+// all or none of a visitor's hits are reported and sessions stay whole.
+func sampledOut(cid, account string) bool {
+	rate := sampleRateFor(account)
+	if rate >= 1 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(cid))
+	out := h.Sum64()%sampleBuckets >= uint64(rate*sampleBuckets)
+	if out {
+		sampledOutHits.Inc()
+	}
+	return out
+}
+
+// sampleWeight returns how many hits each reported hit to account stands for,
+// or 0 if the account is not sampled.
+func sampleWeight(account string) float64 {
+	rate := sampleRateFor(account)
+	if rate >= 1 {
+		return 0
+	}
+	return math.Round(100/rate) / 100
+}
+
+// applySampleWeight adds the sample weight of a sampled account's hit to a
+// v1 payload as -sampleWeightMetric, so reports can sum it to estimate the
+// hits before sampling.
+func applySampleWeight(payload url.Values, account string) {
+	if weight := sampleWeight(account); weight > 0 && sampleWeightMetric > 0 {
+		payload.Set(fmt.Sprintf("cm%d", sampleWeightMetric), strconv.FormatFloat(weight, 'f', -1, 64))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSampleRates(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]float64
+		err  string
+	}{
+		{"", map[string]float64{}, ""},
+		{"UA-1234-1=0.1, G-ABC123=1", map[string]float64{"UA-1234-1": 0.1, "G-ABC123": 1}, ""},
+		{"UA-1234-1", nil, "malformed pair"},
+		{"UA-1234-1=0", nil, "UA-1234-1: sample rate must be a number above 0"},
+		{"UA-1234-1=1.5", nil, "UA-1234-1: sample rate must be a number above 0"},
+		{"UA-1234-1=half", nil, "UA-1234-1: sample rate must be a number above 0"},
+	}
+	for _, tt := range tests {
+		got, err := parseSampleRates(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseSampleRates(%q) = %v, want an error with %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSampleRates(%q): %v", tt.in, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSampleRates(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSampledOut(t *testing.T) {
+	setFlags(t, "-sampleRate=0.1")
+	keep(t, &accountSampleRates)
+	accountSampleRates = map[string]float64{"UA-2222-1": 0.5, "UA-3333-1": 1}
+
+	const n = 10000
+	tests := []struct {
+		account string
+		rate    float64
+	}{
+		{"UA-1111-1", 0.1},
+		{"UA-2222-1", 0.5},
+		{"UA-3333-1", 1},
+	}
+	for _, tt := range tests {
+		kept := 0
+		for i := 0; i < n; i++ {
+			cid := fmt.Sprintf("%d.%d", 1000000+i, 1700000000+i)
+			out := sampledOut(cid, tt.account)
+			// A visitor is always sampled the same way.
+			if sampledOut(cid, tt.account) != out {
+				t.Fatalf("%s: sampledOut(%q) changed", tt.account, cid)
+			}
+			if !out {
+				kept++
+			}
+		}
+		if got := float64(kept) / n; math.Abs(got-tt.rate) > 0.02 {
+			t.Errorf("%s: kept %.3f of visitors, want about %v", tt.account, got, tt.rate)
+		}
+	}
+}
+
+func TestSampledOutSameVisitorAcrossAccounts(t *testing.T) {
+	setFlags(t, "-sampleRate=0.5")
+	keep(t, &accountSampleRates)
+	accountSampleRates = nil
+
+	// The bucket is of the client ID alone: a visitor kept by one account is
+	// kept by all the accounts at the same rate.
+	for i := 0; i < 100; i++ {
+		cid := fmt.Sprintf("cid-%d", i)
+		if sampledOut(cid, "UA-1111-1") != sampledOut(cid, "UA-2222-1") {
+			t.Errorf("%s sampled differently by two accounts at the same rate", cid)
+		}
+	}
+}
+
+func TestSampleWeight(t *testing.T) {
+	setFlags(t, "-sampleRate=1", "-sampleWeightMetric=3")
+	keep(t, &accountSampleRates)
+	accountSampleRates = map[string]float64{"UA-1111-1": 0.1, "UA-2222-1": 0.3, "UA-3333-1": 1}
+
+	tests := []struct {
+		account string
+		weight  float64
+		cm      string
+	}{
+		{"UA-1111-1", 10, "10"},
+		{"UA-2222-1", 3.33, "3.33"},
+		{"UA-3333-1", 0, ""},
+		{"UA-4444-1", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := sampleWeight(tt.account); got != tt.weight {
+			t.Errorf("sampleWeight(%s) = %v, want %v", tt.account, got, tt.weight)
+		}
+		payload := url.Values{}
+		applySampleWeight(payload, tt.account)
+		if got := payload.Get("cm3"); got != tt.cm || len(payload) > 1 {
+			t.Errorf("applySampleWeight(%s) = %s, want cm3=%s", tt.account, payload.Encode(), tt.cm)
+		}
+	}
+
+	setFlags(t, "-sampleWeightMetric=-1")
+	payload := url.Values{}
+	applySampleWeight(payload, "UA-1111-1")
+	if len(payload) != 0 {
+		t.Errorf("applySampleWeight() = %s without -sampleWeightMetric, want nothing", payload.Encode())
+	}
+}
+
+func TestSampledHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0", "-sampleRate=0.5", "-sampleWeightMetric=3")
+	var kept, dropped string
+	for i := 0; kept == "" || dropped == ""; i++ {
+		cid := fmt.Sprintf("%d.1700000000", 1000000+i)
+		if sampledOut(cid, "UA-1234-1") {
+			dropped = cid
+		} else {
+			kept = cid
+		}
+	}
+	sampled := sampledOutHits.Value()
+
+	if w := get("/UA-1234-1/docs", "Cookie", "cid="+dropped); w.Code != http.StatusOK {
+		t.Errorf("status = %d for a visitor sampled out, want the badge", w.Code)
+	}
+	stub.none(t)
+	if got := sampledOutHits.Value() - sampled; got != 1 {
+		t.Errorf("%d hits sampled out, want 1", got)
+	}
+	get("/UA-1234-1/docs", "Cookie", "cid="+kept)
+	if form := stub.next(t).form(); form.Get("cid") != kept || form.Get("cm3") != "2" {
+		t.Errorf("hit = %s, want the kept visitor's with cm3=2", form.Encode())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// callbackPattern restricts JavaScript callback names to plain (dotted)
+// identifiers so they cannot inject script.
+var callbackPattern = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+
+// wantsScript reports whether the beacon was loaded from a <script> tag,
+// either explicitly via ?js or through the Accept header.
+func wantsScript(r *http.Request, query url.Values) bool {
+	if !enableScriptBeacon {
+		return false
+	}
+	if _, ok := query["js"]; ok {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/javascript") || strings.Contains(accept, "application/javascript")
+}
+
+// validCallback reports whether name may be used as a JavaScript callback.
+// An empty name is valid and means no callback.
+func validCallback(name string) bool {
+	return name == "" || (len(name) <= 64 && callbackPattern.MatchString(name))
+}
+
+// writeScript responds with a script calling callback, or a no-op if there is
+// no callback.
+func writeScript(w http.ResponseWriter, callback string, tracked bool) {
+	w.Header().Set("Content-Type", "application/javascript")
+	if callback == "" {
+		fmt.Fprint(w, "void(0);")
+		return
+	}
+	fmt.Fprintf(w, `%s({"tracked":%t});`, callback, tracked)
+}
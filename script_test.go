@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestScriptBeacon(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		want   string
+	}{
+		{"callback", "/UA-1234-1/page?js&callback=app.track", nil, `app.track({"tracked":true});`},
+		{"no callback", "/UA-1234-1/page?js", nil, "void(0);"},
+		{"accept header", "/UA-1234-1/page?callback=cb", []string{"Accept", "text/javascript"}, `cb({"tracked":true});`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, "-enableScriptBeacon")
+			w := get(tt.target, tt.header...)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/javascript" {
+				t.Errorf("Content-Type = %q, want application/javascript", got)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if got := stub.next(t).form().Get("dp"); got != "page" {
+				t.Errorf("reported page = %q, want page", got)
+			}
+		})
+	}
+}
+
+func TestScriptBeaconInvalidCallback(t *testing.T) {
+	stub := newTestBeacon(t, "-enableScriptBeacon")
+	for _, callback := range []string{"alert(1)", "a-b", "1cb", "a..b"} {
+		if w := get("/UA-1234-1/page?js&callback=" + callback); w.Code != http.StatusBadRequest {
+			t.Errorf("callback %q: status = %d, want 400", callback, w.Code)
+		}
+	}
+	stub.none(t)
+}
+
+func TestScriptBeaconDisabled(t *testing.T) {
+	newTestBeacon(t)
+	w := get("/UA-1234-1/page?js&callback=cb")
+	if got := w.Header().Get("Content-Type"); got != "image/svg+xml" {
+		t.Errorf("Content-Type = %q without -enableScriptBeacon, want the badge", got)
+	}
+}
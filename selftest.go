@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const selfTestUUIDs = 10
+
+var cidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// selfTestCheck is one check of the self-test.
+type selfTestCheck struct {
+	name string
+	run  func() error
+	// degradable checks only warn at startup, as the beacon serves fallbacks
+	// for what they find wrong. `ga-beacon check` still fails on them.
+	degradable bool
+	// network checks probe a collector. They only warn at startup unless
+	// -selfTest=strict, so that an outage or an egress-restricted deployment
+	// does not keep the beacon from starting.
+	network bool
+	// skip, if set, is why the check does not apply.
+	skip string
+}
+
+// selfTestMode is the value of -selfTest: true, false or strict. It is a
+// boolean flag, so a bare -selfTest means true.
+type selfTestMode string
+
+func (m *selfTestMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *selfTestMode) Set(v string) error {
+	if v != "strict" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("want true, false or strict")
+		}
+		v = strconv.FormatBool(b)
+	}
+	*m = selfTestMode(v)
+	return nil
+}
+
+func (m *selfTestMode) IsBoolFlag() bool { return true }
+
+// selfTestChecks returns the checks of the subsystems the beacon depends on,
+// for the collectors in use.
+func selfTestChecks() []selfTestCheck {
+	checks := []selfTestCheck{
+		{name: "assets", run: checkAssets, degradable: true},
+		{name: "page template", run: checkPageTemplate},
+		{name: "badge template", run: checkBadgeTemplate},
+		{name: "client IDs", run: checkClientIDs},
+	}
+	for _, c := range []struct {
+		collector string
+		run       func() error
+	}{
+		{"ga", selfTestCollector},
+		{"matomo", func() error { return checkReachable(matomoURL) }},
+		{"plausible", func() error { return checkReachable(plausibleURL) }},
+	} {
+		if !usesCollector(c.collector) {
+			continue
+		}
+		check := selfTestCheck{name: c.collector + " collector", run: c.run, network: true}
+		if dryRun {
+			check.skip = "-dryRun"
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// selfTest checks that the subsystems the beacon depends on work before the
+// server starts accepting traffic. Problems the beacon can work around, and
+// collectors it cannot reach unless -selfTest=strict, are logged; the
+// others fail it.
+func (s *server) selfTest() error {
+	for _, check := range selfTestChecks() {
+		if check.skip != "" {
+			continue
+		}
+		err := check.run()
+		switch {
+		case err == nil:
+		case check.degradable:
+			s.logger.Warn("Self-test found a problem, serving fallbacks", "check", check.name, "err", err)
+		case check.network && runSelfTest != "strict":
+			s.logger.Warn("Self-test cannot reach a collector, serving anyway", "check", check.name, "err", err)
+		default:
+			return fmt.Errorf("%s: %v", check.name, err)
+		}
+	}
+	return nil
+}
+
+// runCheck implements `ga-beacon check`, which takes the server's flags,
+// runs the self-test and prints a report instead of serving. It returns 1 if
+// the configuration is invalid or any check fails, for CI pipelines to stop
+// a deployment on.
+func runCheck() int {
+	fmt.Println("ok    config")
+	checks := selfTestChecks()
+	failed := 0
+	for _, check := range checks {
+		if check.skip != "" {
+			fmt.Printf("skip  %s: %s\n", check.name, check.skip)
+			continue
+		}
+		if err := check.run(); err != nil {
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok    %s\n", check.name)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(checks)+1)
+		return 1
+	}
+	fmt.Println("all checks passed")
+	return 0
+}
+
+// checkAssets reports unusable embedded assets and badges that failed their
+// integrity check.
+func checkAssets() error {
+	var problems []string
+	for path, err := range embeddedAssetErrors {
+		problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+	}
+	sort.Strings(problems)
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	for name, img := range badgeImages {
+		if len(img.data) == 0 {
+			problems = append(problems, fmt.Sprintf("asset for badge variant %q is empty", name))
+		}
+	}
+	if degradedMode.Load() && len(embeddedAssetErrors) == 0 {
+		problems = append(problems, "a badge failed its integrity check and is served as the pixel")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkPageTemplate() error {
+	if err := pageTemplate.ExecuteTemplate(io.Discard, "page.html", struct {
+		Account string
+		Referer string
+	}{"UA-000000-0", "https://example.com/"}); err != nil {
+		return fmt.Errorf("cannot execute page template: %v", err)
+	}
+	return nil
+}
+
+func checkBadgeTemplate() error {
+	if img := renderBadge("self-test", "ok", ""); !bytes.Contains(img.data, []byte("self-test")) {
+		return errors.New("rendered badge does not show its label")
+	}
+	return nil
+}
+
+func checkClientIDs() error {
+	for i := 0; i < selfTestUUIDs; i++ {
+		cid, err := cidGenerator.Generate()
+		if err != nil {
+			return fmt.Errorf("cannot generate client ID: %v", err)
+		}
+		if !cidPattern.MatchString(cid) {
+			return fmt.Errorf("generated malformed client ID %q", cid)
+		}
+	}
+	return nil
+}
+
+// selfTestCollector sends a test hit to the GA validation endpoint, which
+// checks the hit without recording it.
+func selfTestCollector() error {
+	debugURL := strings.Replace(gaEndpoint, "/collect", "/debug/collect", 1)
+	payload := url.Values{
+		"v":   {"1"},
+		"t":   {"pageview"},
+		"tid": {"UA-000000-0"},
+		"cid": {"self-test"},
+		"dp":  {"/self-test"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gaTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", debugURL, strings.NewReader(payload.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := gaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("validation endpoint returned " + resp.Status)
+	}
+	return nil
+}
+
+// checkReachable checks that a collector endpoint answers. Any answer but a
+// server error will do, since an empty request is not a valid hit.
+func checkReachable(rawURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gaTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := gaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", rawURL, resp.Status)
+	}
+	return nil
+}
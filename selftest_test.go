@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"html/template"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// brokenCIDGenerator generates client IDs that are not UUIDs, or fails.
+type brokenCIDGenerator struct{ err error }
+
+func (g brokenCIDGenerator) Generate() (string, error) {
+	return "not-a-uuid", g.err
+}
+
+// clearRenderedBadges empties the rendered badge cache now and when t ends,
+// so badges rendered with another template are not served from it.
+func clearRenderedBadges(t *testing.T) {
+	clear := func() {
+		renderedBadgesMu.Lock()
+		renderedBadges = map[badgeText]badgeImage{}
+		renderedBadgesMu.Unlock()
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func() error
+		// breaks sets up the unhealthy configuration of the check.
+		breaks func(t *testing.T, stub *gaStub)
+	}{
+		{
+			"assets",
+			checkAssets,
+			func(t *testing.T, stub *gaStub) {
+				keep(t, &badgeImages)
+				images := map[string]badgeImage{}
+				for name, img := range badgeImages {
+					images[name] = img
+				}
+				images["flat"] = badgeImage{contentType: "image/svg+xml"}
+				badgeImages = images
+			},
+		},
+		{
+			"page template",
+			checkPageTemplate,
+			func(t *testing.T, stub *gaStub) {
+				keep(t, &pageTemplate)
+				pageTemplate = template.Must(template.New("page.html").Parse("{{.Missing}}"))
+			},
+		},
+		{
+			"badge template",
+			checkBadgeTemplate,
+			func(t *testing.T, stub *gaStub) {
+				keep(t, &badgeTemplate)
+				tmpl, err := parseBadgeTemplate([]byte("<svg/>"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				badgeTemplate = tmpl
+				clearRenderedBadges(t)
+			},
+		},
+		{
+			"malformed client IDs",
+			checkClientIDs,
+			func(t *testing.T, stub *gaStub) { cidGenerator = brokenCIDGenerator{} },
+		},
+		{
+			"failing client IDs",
+			checkClientIDs,
+			func(t *testing.T, stub *gaStub) { cidGenerator = brokenCIDGenerator{errors.New("no entropy")} },
+		},
+		{
+			"collector",
+			selfTestCollector,
+			func(t *testing.T, stub *gaStub) { stub.respond(http.StatusBadRequest) },
+		},
+		{
+			"unreachable collector",
+			selfTestCollector,
+			func(t *testing.T, stub *gaStub) { stub.Close() },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t)
+			if err := tt.check(); err != nil {
+				t.Fatalf("healthy check failed: %v", err)
+			}
+			tt.breaks(t, stub)
+			if tt.check() == nil {
+				t.Error("unhealthy check passed")
+			}
+		})
+	}
+}
+
+func TestSelfTestCollectorEndpoint(t *testing.T) {
+	stub := newTestBeacon(t)
+	if err := selfTestCollector(); err != nil {
+		t.Fatal(err)
+	}
+	hit := stub.next(t)
+	if hit.path != "/debug/collect" {
+		t.Errorf("test hit sent to %s, want the validation endpoint", hit.path)
+	}
+	if got := hit.form().Get("tid"); got != "UA-000000-0" {
+		t.Errorf("tid = %q, want the self-test account", got)
+	}
+}
+
+func TestSelfTestResult(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		newTestBeacon(t)
+		if err := testServer.selfTest(); err != nil {
+			t.Errorf("selfTest() = %v", err)
+		}
+	})
+
+	t.Run("failing check", func(t *testing.T) {
+		newTestBeacon(t)
+		keep(t, &cidGenerator)
+		cidGenerator = brokenCIDGenerator{}
+		err := testServer.selfTest()
+		if err == nil || !strings.HasPrefix(err.Error(), "client IDs: ") {
+			t.Errorf("selfTest() = %v, want the client IDs check to fail", err)
+		}
+	})
+
+	t.Run("unreachable collector", func(t *testing.T) {
+		stub := newTestBeacon(t)
+		stub.respond(http.StatusInternalServerError)
+		var log bytes.Buffer
+		if err := newLoggingServer(&log).selfTest(); err != nil {
+			t.Errorf("selfTest() = %v, want the collector only warned about", err)
+		}
+		if !strings.Contains(log.String(), "level=WARN") || !strings.Contains(log.String(), `check="ga collector"`) {
+			t.Errorf("logged %q, want a warning about the ga collector", log.String())
+		}
+
+		setFlags(t, "-selfTest=strict")
+		if err := testServer.selfTest(); err == nil || !strings.HasPrefix(err.Error(), "ga collector: ") {
+			t.Errorf("selfTest() = %v with -selfTest=strict, want the ga collector check to fail", err)
+		}
+	})
+
+	t.Run("degradable check", func(t *testing.T) {
+		newTestBeacon(t)
+		degraded := degradedMode.Load()
+		degradedMode.Store(true)
+		t.Cleanup(func() { degradedMode.Store(degraded) })
+		if checkAssets() == nil {
+			t.Fatal("checkAssets() passed in degraded mode")
+		}
+		if err := testServer.selfTest(); err != nil {
+			t.Errorf("selfTest() = %v, want asset problems only logged", err)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		stub := newTestBeacon(t, "-dryRun")
+		stub.respond(http.StatusInternalServerError)
+		if err := testServer.selfTest(); err != nil {
+			t.Errorf("selfTest() = %v, want the collector check skipped with -dryRun", err)
+		}
+	})
+}
+
+func TestSelfTestMode(t *testing.T) {
+	tests := []struct {
+		arg, want string
+	}{
+		{"-selfTest", "true"},
+		{"-selfTest=1", "true"},
+		{"-selfTest=false", "false"},
+		{"-selfTest=strict", "strict"},
+	}
+	for _, tt := range tests {
+		setFlags(t, tt.arg)
+		if runSelfTest != selfTestMode(tt.want) {
+			t.Errorf("%s: -selfTest = %s, want %s", tt.arg, runSelfTest, tt.want)
+		}
+	}
+	if err := flag.Set("selfTest", "always"); err == nil {
+		t.Error("-selfTest=always accepted")
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+	f()
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRunCheck(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		newTestBeacon(t)
+		var code int
+		out := captureStdout(t, func() { code = runCheck() })
+		if code != 0 {
+			t.Errorf("runCheck() = %d, want 0", code)
+		}
+		for _, want := range []string{"ok    config\n", "ok    assets\n", "ok    ga collector\n", "all checks passed\n"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("report %q lacks %q", out, want)
+			}
+		}
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		stub := newTestBeacon(t, "-gaMaxAttempts=1")
+		stub.respond(http.StatusInternalServerError)
+		keep(t, &embeddedAssetErrors)
+		embeddedAssetErrors = map[string]error{"page.html": errors.New("template: page.html:1: unexpected EOF")}
+		var code int
+		out := captureStdout(t, func() { code = runCheck() })
+		if code != 1 {
+			t.Errorf("runCheck() = %d, want 1", code)
+		}
+		for _, want := range []string{"FAIL  assets: page.html: template: page.html:1: unexpected EOF\n", "FAIL  ga collector: ", "2 of ", " checks failed\n"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("report %q lacks %q", out, want)
+			}
+		}
+	})
+
+	t.Run("skipped", func(t *testing.T) {
+		newTestBeacon(t, "-dryRun")
+		out := captureStdout(t, func() { runCheck() })
+		if !strings.Contains(out, "skip  ga collector: ") {
+			t.Errorf("report %q, want the collector check skipped with -dryRun", out)
+		}
+	})
+}
+
+func TestFatalInCheckMode(t *testing.T) {
+	if os.Getenv("BEACON_TEST_FATAL") == "1" {
+		checkMode = true
+		testServer.fatal("Invalid -rateLimitRPS", "value", -1)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFatalInCheckMode$")
+	cmd.Env = append(os.Environ(), "BEACON_TEST_FATAL=1")
+	out, err := cmd.Output()
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 1 {
+		t.Errorf("fatal() in check mode: %v, want exit status 1", err)
+	}
+	if want := "FAIL  config: Invalid -rateLimitRPS value=-1\n"; string(out) != want {
+		t.Errorf("fatal() printed %q, want %q", out, want)
+	}
+}
+
+func TestEmbeddedTemplateFallback(t *testing.T) {
+	keep(t, &embeddedAssetErrors)
+	embeddedAssetErrors = nil
+	tmpl := embeddedHTMLTemplate("missing.html", fallbackPageTemplate)
+	if _, ok := embeddedAssetErrors["missing.html"]; !ok {
+		t.Errorf("embeddedAssetErrors = %v, want the missing template recorded", embeddedAssetErrors)
+	}
+	var page strings.Builder
+	if err := tmpl.Execute(&page, struct{ Account string }{"UA-1234-1"}); err != nil || !strings.Contains(page.String(), "GA account: UA-1234-1") {
+		t.Errorf("fallback page = %q, %v, want the account shown", page.String(), err)
+	}
+	if err := checkAssets(); err == nil || !strings.Contains(err.Error(), "missing.html") {
+		t.Errorf("checkAssets() = %v, want the missing template reported", err)
+	}
+}
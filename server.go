@@ -0,0 +1,278 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// server serves the beacon and its API. Its logger is handed on to the hits
+// it queues and to the components main sets up.
+type server struct {
+	logger *slog.Logger
+}
+
+// Config holds the settings needed to build the HTTP server.
+type Config struct {
+	Addr         string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+// ServerOption configures a ServerBuilder.
+type ServerOption func(*ServerBuilder)
+
+// ServerBuilder assembles the HTTP server from a handler and a chain of
+// middleware. Middleware added first ends up outermost.
+type ServerBuilder struct {
+	cfg        *Config
+	opts       []ServerOption
+	handler    http.Handler
+	middleware []func(http.Handler) http.Handler
+}
+
+func NewServerBuilder(cfg *Config) *ServerBuilder {
+	return &ServerBuilder{cfg: cfg}
+}
+
+// With adds options, applied in order by Build.
+func (b *ServerBuilder) With(opts ...ServerOption) *ServerBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+// Build applies the options and returns the server.
+func (b *ServerBuilder) Build() *http.Server {
+	b.handler, b.middleware = nil, nil
+	for _, opt := range b.opts {
+		opt(b)
+	}
+
+	h := b.handler
+	if h == nil {
+		h = http.NotFoundHandler()
+	}
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		h = b.middleware[i](h)
+	}
+
+	return &http.Server{
+		Addr:         b.cfg.Addr,
+		Handler:      h,
+		ReadTimeout:  b.cfg.ReadTimeout,
+		WriteTimeout: b.cfg.WriteTimeout,
+		IdleTimeout:  b.cfg.IdleTimeout,
+	}
+}
+
+// WithHandler sets the handler at the end of the middleware chain.
+func WithHandler(h http.Handler) ServerOption {
+	return func(b *ServerBuilder) { b.handler = h }
+}
+
+// WithMiddleware adds an arbitrary middleware to the chain.
+func WithMiddleware(mw func(http.Handler) http.Handler) ServerOption {
+	return func(b *ServerBuilder) { b.middleware = append(b.middleware, mw) }
+}
+
+// WithMetrics counts and times requests.
+func WithMetrics() ServerOption {
+	return WithMiddleware(instrument)
+}
+
+// WithAccessLog writes an access log line per request to w, in one of the
+// accessLogFormats.
+func WithAccessLog(w io.Writer, format string) ServerOption {
+	line := accessLogFormats[format]
+	return WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+			h.ServeHTTP(sw, r)
+			w.Write(line(r, sw, start))
+		})
+	})
+}
+
+// WithTracing records a span per request with -otlpEndpoint, continuing the
+// caller's trace from its traceparent header.
+func WithTracing() ServerOption {
+	return WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, sp := startServerSpan(r)
+			if sp == nil {
+				h.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(sw, r.WithContext(ctx))
+			sp.Set("http.request.method", r.Method)
+			sp.Set("url.path", r.URL.Path)
+			sp.Set("http.response.status_code", sw.status)
+			if id := sw.Header().Get("X-Request-ID"); id != "" {
+				sp.Set("beacon.request_id", id)
+			}
+			var err error
+			if sw.status >= 500 {
+				err = errors.New(http.StatusText(sw.status))
+			}
+			sp.End(err)
+		})
+	})
+}
+
+// WithGZIP compresses responses for clients accepting gzip.
+func WithGZIP() ServerOption {
+	return WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gw := &gzipWriter{
+				ResponseWriter: w,
+				compress:       strings.Contains(r.Header.Get("Accept-Encoding"), "gzip"),
+			}
+			defer gw.Close()
+			h.ServeHTTP(gw, r)
+		})
+	})
+}
+
+// WithSecurityHeaders sets headers hardening responses against sniffing and
+// framing.
+func WithSecurityHeaders() ServerOption {
+	return WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("X-Frame-Options", "DENY")
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			h.ServeHTTP(w, r)
+		})
+	})
+}
+
+// statusWriter records the status code and body size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gzipWriter compresses the response body once the handler starts writing.
+// Vary is added at that point since handlers set their own Vary header.
+type gzipWriter struct {
+	http.ResponseWriter
+	compress bool
+	started  bool
+	gz       *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	w.start(nil)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	w.start(b)
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipWriter) start(b []byte) {
+	if w.started {
+		return
+	}
+	w.started = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if !w.compress {
+		return
+	}
+	if h.Get("Content-Type") == "" && b != nil {
+		h.Set("Content-Type", http.DetectContentType(b))
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+// Flush sends what has been written so far, compressed if it is.
+func (w *gzipWriter) Flush() {
+	w.start(nil)
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipWriter) Close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// WithCORSMiddleware lets pages on origins fetch() beacons and POST to
+// /collect/. An origin of "*" allows any page; otherwise the request's Origin
+// must match one exactly. Preflight requests are answered with 204.
+func WithCORSMiddleware(origins []string) ServerOption {
+	allowed := map[string]bool{}
+	for _, origin := range origins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed[origin] = true
+		}
+	}
+	return WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if !allowed["*"] {
+				w.Header().Add("Vary", "Origin")
+			}
+			if origin == "" || !allowed["*"] && !allowed[origin] {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if allowed["*"] {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				// Listed origins may send the client ID cookie with
+				// credentials: "include"; browsers refuse that for "*".
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+				if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+					w.Header().Set("Access-Control-Allow-Headers", headers)
+				}
+				w.Header().Set("Access-Control-Max-Age", "86400")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trace returns an option recording name in calls when a request passes
+// its middleware, on the way in and out.
+func trace(calls *[]string, name string) ServerOption {
+	return WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name)
+			h.ServeHTTP(w, r)
+			*calls = append(*calls, "/"+name)
+		})
+	})
+}
+
+// serve sends r through the handler of the server built from opts.
+func serve(r *http.Request, opts ...ServerOption) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	NewServerBuilder(&Config{}).With(opts...).Build().Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestServerBuilderOrder(t *testing.T) {
+	var calls []string
+	handler := WithHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	}))
+	b := NewServerBuilder(&Config{}).With(trace(&calls, "a"), trace(&calls, "b")).With(handler, trace(&calls, "c"))
+
+	for i := 0; i < 2; i++ {
+		calls = nil
+		b.Build().Handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if want := []string{"a", "b", "c", "handler", "/c", "/b", "/a"}; !slices.Equal(calls, want) {
+			t.Errorf("build %d: calls = %q, want %q", i+1, calls, want)
+		}
+	}
+}
+
+func TestServerBuilderConfig(t *testing.T) {
+	srv := NewServerBuilder(&Config{Addr: ":8080", ReadTimeout: time.Second, WriteTimeout: 2 * time.Second, IdleTimeout: 3 * time.Second}).Build()
+	if srv.Addr != ":8080" || srv.ReadTimeout != time.Second || srv.WriteTimeout != 2*time.Second || srv.IdleTimeout != 3*time.Second {
+		t.Errorf("server = %+v, want the configured address and timeouts", srv)
+	}
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d without a handler, want 404", w.Code)
+	}
+}
+
+var helloHandler = WithHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, strings.Repeat("hello ", 100))
+}))
+
+func TestServerBuilderGZIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := serve(r, WithSecurityHeaders(), WithGZIP(), helloHandler)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != strings.Repeat("hello ", 100) {
+		t.Errorf("body = %.20q..., want the handler's", body)
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Errorf("security headers missing from %v", w.Header())
+	}
+
+	w = serve(httptest.NewRequest("GET", "/", nil), WithGZIP(), helloHandler)
+	if w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(w.Body.String(), "hello") {
+		t.Errorf("response compressed for a client not accepting gzip")
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q uncompressed, want Accept-Encoding", w.Header().Get("Vary"))
+	}
+}
+
+func TestServerBuilderFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	var flushed int
+	handler := WithHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "hello")
+		rw.(http.Flusher).Flush()
+		flushed = w.Body.Len()
+		io.WriteString(rw, " world")
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	NewServerBuilder(&Config{}).With(WithAccessLog(io.Discard, "json"), WithGZIP(), handler).Build().Handler.ServeHTTP(w, r)
+
+	// The access log and gzip writers pass the flush on.
+	if !w.Flushed || flushed == 0 {
+		t.Errorf("flushed %d bytes, want the compressed hello sent", flushed)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != "hello world" {
+		t.Errorf("body = %q, want hello world", body)
+	}
+}
+
+func TestServerBuilderCORS(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		origin      string
+		allowOrigin string
+		status      int
+	}{
+		{"any origin", []string{"*"}, "GET", "https://example.com", "*", http.StatusOK},
+		{"listed origin", []string{"https://a.example", " https://example.com "}, "GET", "https://example.com", "https://example.com", http.StatusOK},
+		{"unlisted origin", []string{"https://a.example"}, "GET", "https://example.com", "", http.StatusOK},
+		{"no origin", []string{"*"}, "GET", "", "", http.StatusOK},
+		{"preflight", []string{"*"}, "OPTIONS", "https://example.com", "*", http.StatusNoContent},
+		{"unlisted preflight", []string{"https://a.example"}, "OPTIONS", "https://example.com", "", http.StatusOK},
+		{"no origins configured", nil, "GET", "https://example.com", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			w := serve(r, WithCORSMiddleware(tt.origins), helloHandler)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			credentials := w.Header().Get("Access-Control-Allow-Credentials") == "true"
+			if want := tt.allowOrigin != "" && tt.allowOrigin != "*"; credentials != want {
+				t.Errorf("credentials allowed: %v, want %v", credentials, want)
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	for _, origins := range [][]string{{"*"}, {"https://example.com"}} {
+		r := httptest.NewRequest("OPTIONS", "/UA-1234-1/page", nil)
+		r.Header.Set("Origin", "https://example.com")
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		r.Header.Set("Access-Control-Request-Headers", "X-Beacon-Source")
+		w := serve(r, WithCORSMiddleware(origins), WithHandler(http.HandlerFunc(testServer.handler)))
+		if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+			t.Errorf("%v: preflight = %d with %d bytes, want 204 with no body", origins, w.Code, w.Body.Len())
+		}
+		for header, want := range map[string]string{
+			"Access-Control-Allow-Methods": "GET, POST",
+			"Access-Control-Allow-Headers": "X-Beacon-Source",
+			"Access-Control-Max-Age":       "86400",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("%v: %s = %q, want %q", origins, header, got, want)
+			}
+		}
+	}
+}
+
+func TestCORSBeacon(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		allowOrigin string
+	}{
+		{"disabled", nil, ""},
+		{"wildcard", []string{"*"}, "*"},
+		{"exact match", []string{"https://example.com"}, "https://example.com"},
+		{"no match", []string{"https://example.org"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t)
+			r := httptest.NewRequest("GET", "/UA-1234-1/page", nil)
+			r.Header.Set("Origin", "https://example.com")
+			opts := []ServerOption{WithHandler(http.HandlerFunc(testServer.handler))}
+			if tt.origins != nil {
+				opts = append(opts, WithCORSMiddleware(tt.origins))
+			}
+			w := serve(r, opts...)
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), badgeImages[""].data) {
+				t.Errorf("status = %d, want the badge", w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if tt.origins == nil {
+				for header := range w.Header() {
+					if strings.HasPrefix(header, "Access-Control-") {
+						t.Errorf("%s set without -corsOrigins", header)
+					}
+				}
+			}
+			stub.next(t)
+		})
+	}
+}
+
+func TestServerBuilderAccessLog(t *testing.T) {
+	var log bytes.Buffer
+	requestID := WithMiddleware(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-ID", "req-1")
+			h.ServeHTTP(w, r)
+		})
+	})
+	serve(httptest.NewRequest("GET", "/UA-1234-1/page?api_secret=hush", nil), WithAccessLog(&log, "json"), requestID, helloHandler)
+
+	var line struct {
+		URI       string `json:"uri"`
+		Status    int    `json:"status"`
+		Bytes     int    `json:"bytes"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(log.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, log.Bytes())
+	}
+	if line.URI != "/UA-1234-1/page?api_secret=REDACTED" || line.Status != http.StatusOK || line.Bytes != 600 || line.RequestID != "req-1" {
+		t.Errorf("access log line = %+v", line)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	stub := newTestBeacon(t)
+	cert := writeCert(t, time.Now().AddDate(0, 1, 0))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServerBuilder(&Config{}).With(WithHandler(http.HandlerFunc(testServer.handler))).Build()
+	served := make(chan error, 1)
+	go func() { served <- server.ServeTLS(listener, cert, cert) }()
+
+	data, err := os.ReadFile(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(data)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "beacon.example.com"},
+	}}
+	resp, err := client.Get("https://" + listener.Addr().String() + "/UA-1234-1/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil || !bytes.Equal(body, badgeImages[""].data) {
+		t.Errorf("status %d over TLS %v, want the badge served over HTTPS", resp.StatusCode, resp.TLS != nil)
+	}
+	if got := stub.next(t).form().Get("dp"); got != "page" {
+		t.Errorf("dp = %q, want the HTTPS beacon reported", got)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("ServeTLS() = %v after Shutdown, want http.ErrServerClosed", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxQueueTime is how old a v1 hit may be for GA to still record it.
+	//
+	// GA Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/v1/parameters#qt
+	maxQueueTime = 4 * time.Hour
+	// maxClockSkew is how far ahead of the beacon's clock a ?ts= may be. Later
+	// timestamps are taken for now.
+	maxClockSkew = time.Minute
+	// minQueueTime is the age below which hits are sent without a queue time,
+	// as made when they are received.
+	minQueueTime = time.Second
+)
+
+// emailPattern matches user IDs that are e-mail addresses, which the GA terms
+// forbid sending as they identify the person.
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// hitTimeFor returns when the hit of a request received at now was made: the
+// ?ts= of the client, in milliseconds since the epoch, if it is within
+// maxQueueTime, and now without it.
+func hitTimeFor(logger *slog.Logger, query url.Values, now time.Time) time.Time {
+	ts := query.Get("ts")
+	if ts == "" {
+		return now
+	}
+	ms, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		logger.Debug("Ignoring invalid client timestamp", "ts", ts)
+		return now
+	}
+	t := time.UnixMilli(ms)
+	switch {
+	case t.After(now.Add(maxClockSkew)) || now.Sub(t) >= maxQueueTime:
+		logger.Debug("Ignoring client timestamp out of range", "ts", ts)
+		return now
+	case t.After(now):
+		return now
+	}
+	return t
+}
+
+// queueTime returns how long ago the hit of job was made, or 0 if it is
+// under minQueueTime.
+func queueTime(job hitJob) time.Duration {
+	if job.hitTime.IsZero() {
+		return 0
+	}
+	if qt := time.Since(job.hitTime); qt >= minQueueTime {
+		return qt
+	}
+	return 0
+}
+
+// nonInteraction reports whether the hit was sent with ni=1, so that it does
+// not count as engagement and does not turn a bounce into a session.
+func nonInteraction(forwarded url.Values) bool {
+	return forwarded.Get("ni") == "1"
+}
+
+// validQueueTime checks a qt in milliseconds.
+func validQueueTime(v string) error {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms < 0 {
+		return fmt.Errorf("queue time must be a non-negative integer, got %s", strconv.Quote(v))
+	}
+	if time.Duration(ms)*time.Millisecond >= maxQueueTime {
+		return fmt.Errorf("queue time of %dms is more than the %v the collector records", ms, maxQueueTime)
+	}
+	return nil
+}
+
+// validUserID checks a uid. It must not be an e-mail address.
+func validUserID(v string) error {
+	if err := maxPrintable(256)(v); err != nil {
+		return err
+	}
+	if emailPattern.MatchString(v) {
+		return fmt.Errorf("user ID %s is an e-mail address", strconv.Quote(v))
+	}
+	return nil
+}
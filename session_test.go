@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHitTimeFor(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	ts := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).UnixMilli(), 10) }
+	tests := []struct {
+		name string
+		ts   string
+		want time.Time
+	}{
+		{"none", "", now},
+		{"recent", ts(-time.Minute), now.Add(-time.Minute)},
+		{"just under the queue time", ts(-maxQueueTime + time.Second), now.Add(-maxQueueTime + time.Second)},
+		{"queue time", ts(-maxQueueTime), now},
+		{"older", ts(-5 * time.Hour), now},
+		{"skewed ahead", ts(30 * time.Second), now},
+		{"skewed by the most allowed", ts(maxClockSkew), now},
+		{"too far ahead", ts(maxClockSkew + time.Second), now},
+		{"not a number", "yesterday", now},
+		{"seconds", "1.5e12", now},
+		{"overflow", "99999999999999999999", now},
+	}
+	for _, tt := range tests {
+		query := url.Values{}
+		if tt.ts != "" {
+			query.Set("ts", tt.ts)
+		}
+		if got := hitTimeFor(testServer.logger, query, now); !got.Equal(tt.want) {
+			t.Errorf("%s: hitTimeFor(ts=%s) = %v, want %v", tt.name, tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestQueueTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		hitTime time.Time
+		want    time.Duration
+	}{
+		{"unset", time.Time{}, 0},
+		{"just now", time.Now(), 0},
+		{"under a second", time.Now().Add(-500 * time.Millisecond), 0},
+		{"a minute ago", time.Now().Add(-time.Minute), time.Minute},
+	}
+	for _, tt := range tests {
+		got := queueTime(hitJob{hitTime: tt.hitTime})
+		if tt.want == 0 && got != 0 || tt.want != 0 && (got < tt.want || got > tt.want+time.Second) {
+			t.Errorf("%s: queueTime() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestQueueTimeHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+
+	get("/UA-1234-1/docs")
+	if form := stub.next(t).form(); form.Has("qt") {
+		t.Errorf("hit = %s, want no qt for a hit made on receipt", form.Encode())
+	}
+	get("/UA-1234-1/docs?ts=" + strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10))
+	qt, _ := strconv.ParseInt(stub.next(t).form().Get("qt"), 10, 64)
+	if qt < time.Hour.Milliseconds() || qt > (time.Hour+5*time.Second).Milliseconds() {
+		t.Errorf("qt = %dms, want about an hour", qt)
+	}
+	// A ts the collector would not record is taken for now.
+	get("/UA-1234-1/docs?ts=" + strconv.FormatInt(time.Now().Add(-5*time.Hour).UnixMilli(), 10))
+	if form := stub.next(t).form(); form.Has("qt") || form.Has("ts") {
+		t.Errorf("hit = %s, want neither qt nor ts for a hit too old", form.Encode())
+	}
+}
+
+func TestValidQueueTime(t *testing.T) {
+	tests := []struct {
+		v   string
+		err string
+	}{
+		{"0", ""},
+		{"3600000", ""},
+		{strconv.FormatInt(maxQueueTime.Milliseconds()-1, 10), ""},
+		{strconv.FormatInt(maxQueueTime.Milliseconds(), 10), "more than the 4h0m0s"},
+		{"-1", "non-negative integer"},
+		{"1.5", "non-negative integer"},
+		{"", "non-negative integer"},
+	}
+	for _, tt := range tests {
+		err := validQueueTime(tt.v)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validQueueTime(%q) = %v, want %q", tt.v, err, tt.err)
+		}
+	}
+}
+
+func TestValidUserID(t *testing.T) {
+	tests := []struct {
+		v   string
+		err string
+	}{
+		{"user-42", ""},
+		{"42", ""},
+		{"team@acme", ""}, // no domain
+		{"@example.com", ""},
+		{"jane@example.com", "is an e-mail address"},
+		{"jane.doe+docs@mail.example.co.uk", "is an e-mail address"},
+		{strings.Repeat("u", 256), ""},
+		{strings.Repeat("u", 257), "longer than 256 bytes"},
+	}
+	for _, tt := range tests {
+		err := validUserID(tt.v)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("validUserID(%q) = %v, want %q", tt.v, err, tt.err)
+		}
+	}
+}
+
+func TestUserIDHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+
+	get("/UA-1234-1/docs?uid=user-42")
+	if form := stub.next(t).form(); form.Get("uid") != "user-42" {
+		t.Errorf("hit = %s, want uid=user-42", form.Encode())
+	}
+	get("/UA-1234-1/docs?uid=jane@example.com")
+	if form := stub.next(t).form(); form.Has("uid") {
+		t.Errorf("hit = %s, want the e-mail address not forwarded", form.Encode())
+	}
+}
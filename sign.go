@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// unsignedHits counts hits not reported for lacking a valid ?sig with
+// -signingKey.
+var unsignedHits atomic.Int64
+
+// urlSignature returns the ?sig value of the beacon path account/page: the
+// first 16 bytes of its HMAC-SHA256 under key, hex-encoded.
+func urlSignature(key, path string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Trim(path, "/")))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// validSignature reports whether sig signs path under -signingKey.
+func validSignature(path, sig string) bool {
+	return hmac.Equal([]byte(urlSignature(signingKey, path)), []byte(strings.ToLower(sig)))
+}
+
+// signedPath returns what the ?sig of a beacon URL signs: its account/page as
+// embedded, before ?useReferer picks the page, followed by "?useReferer" if
+// it has that param. Signing the param too keeps it from being added to a URL
+// signed for a single page.
+func signedPath(path string, query url.Values) string {
+	path = strings.Trim(path, "/")
+	if _, ok := query["useReferer"]; ok {
+		path += "?useReferer"
+	}
+	return path
+}
+
+// runSign implements `ga-beacon sign`, printing a signed URL for each
+// account/page path given.
+func runSign(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	key := fs.String("key", os.Getenv(envName("signingKey")), "The server's -signingKey; defaults to "+envName("signingKey"))
+	base := fs.String("baseURL", "https://gabeacon.irvinlim.com", "URL the beacon is served at")
+	useReferer := fs.Bool("useReferer", false, "Sign ?useReferer URLs, which report the page they are embedded in")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ga-beacon sign [-key key] [-baseURL url] [-useReferer] account/page...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *key == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	for _, path := range fs.Args() {
+		query := url.Values{}
+		if *useReferer {
+			query.Set("useReferer", "")
+		}
+		sig := url.Values{"sig": {urlSignature(*key, signedPath(path, query))}}.Encode()
+		u := strings.TrimSuffix(*base, "/") + "/" + strings.Trim(path, "/") + "?"
+		if *useReferer {
+			u += "useReferer&"
+		}
+		fmt.Println(u + sig)
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidSignature(t *testing.T) {
+	setFlags(t, "-signingKey=s3cret")
+	sig := urlSignature("s3cret", "UA-1234-1/page")
+	tests := []struct {
+		name string
+		path string
+		sig  string
+		want bool
+	}{
+		{"valid", "UA-1234-1/page", sig, true},
+		{"slashes trimmed", "/UA-1234-1/page/", sig, true},
+		{"upper case", "UA-1234-1/page", strings.ToUpper(sig), true},
+		{"other page", "UA-1234-1/other", sig, false},
+		{"other account", "UA-9999-9/page", sig, false},
+		{"tampered", "UA-1234-1/page", "0" + sig[1:], false},
+		{"truncated", "UA-1234-1/page", sig[:16], false},
+		{"missing", "UA-1234-1/page", "", false},
+		{"other key", "UA-1234-1/page", urlSignature("guess", "UA-1234-1/page"), false},
+		{"useReferer not signed", "UA-1234-1/page?useReferer", sig, false},
+	}
+	for _, tt := range tests {
+		if got := validSignature(tt.path, tt.sig); got != tt.want {
+			t.Errorf("%s: validSignature(%q, %q) = %v, want %v", tt.name, tt.path, tt.sig, got, tt.want)
+		}
+	}
+	if len(sig) != 32 {
+		t.Errorf("signature %q is %d characters, want 32", sig, len(sig))
+	}
+}
+
+func TestRunSign(t *testing.T) {
+	setFlags(t, "-signingKey=s3cret")
+	tests := []struct {
+		args []string
+		path string
+	}{
+		{[]string{"-key=s3cret", "UA-1234-1/page"}, "/UA-1234-1/page"},
+		{[]string{"-key=s3cret", "-baseURL=https://beacon.example.com/", "/UA-1234-1/docs/intro/"}, "/UA-1234-1/docs/intro"},
+		{[]string{"-key=s3cret", "-useReferer", "UA-1234-1"}, "/UA-1234-1"},
+	}
+	for _, tt := range tests {
+		var code int
+		out := captureStdout(t, func() { code = runSign(tt.args) })
+		if code != 0 {
+			t.Fatalf("runSign(%q) = %d, want 0", tt.args, code)
+		}
+		u, err := url.Parse(strings.TrimSpace(out))
+		if err != nil {
+			t.Fatalf("runSign(%q) printed %q: %v", tt.args, out, err)
+		}
+		if u.Path != tt.path {
+			t.Errorf("runSign(%q) path = %s, want %s", tt.args, u.Path, tt.path)
+		}
+		if !validSignature(signedPath(u.Path, u.Query()), u.Query().Get("sig")) {
+			t.Errorf("runSign(%q) printed %s, whose signature does not check out", tt.args, u)
+		}
+	}
+
+	t.Setenv(envName("signingKey"), "")
+	usage := captureStderr(t)
+	for _, args := range [][]string{nil, {"-key=s3cret"}, {"UA-1234-1/page"}} {
+		if code := runSign(args); code != 2 {
+			t.Errorf("runSign(%q) = %d, want 2", args, code)
+		}
+	}
+	if !strings.Contains(string(usage()), "Usage: ga-beacon sign") {
+		t.Errorf("printed %q, want the usage", usage())
+	}
+}
+
+func TestSignedHits(t *testing.T) {
+	signed := func(path string) string {
+		return path + "?sig=" + urlSignature("s3cret", path)
+	}
+	referer := "/UA-1234-1?useReferer&sig=" + urlSignature("s3cret", "UA-1234-1?useReferer")
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		dp     string
+	}{
+		{"signed", signed("/UA-1234-1/page"), nil, "page"},
+		{"unsigned", "/UA-1234-1/page", nil, ""},
+		{"other params", signed("/UA-1234-1/page") + "&pixel", nil, "page"},
+		{"path changed", strings.Replace(signed("/UA-1234-1/page"), "page", "other", 1), nil, ""},
+		{"useReferer", referer, []string{"Referer", "https://example.com/docs"}, "example.com/docs"},
+		{"useReferer added", signed("/UA-1234-1/page") + "&useReferer", []string{"Referer", "https://example.com/docs"}, ""},
+		{"header changes account", signed("/UA-1234-1/page"), []string{"X-Beacon-TID", "UA-9999-9"}, ""},
+		{"header changes page", signed("/UA-1234-1/page"), []string{"X-Beacon-Page", "/other"}, ""},
+		{"header keeps page", signed("/UA-1234-1/page"), []string{"X-Beacon-Page", "/page"}, "page"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTestBeacon(t, "-signingKey=s3cret", "-allowHeaderParams")
+			if w := get(tt.target, tt.header...); w.Code != 200 {
+				t.Fatalf("status = %d, want the badge served either way", w.Code)
+			}
+			if tt.dp == "" {
+				stub.none(t)
+				return
+			}
+			form := stub.next(t).form()
+			if form.Get("tid") != "UA-1234-1" || form.Get("dp") != tt.dp {
+				t.Errorf("reported tid %s, dp %q, want UA-1234-1 and %q", form.Get("tid"), form.Get("dp"), tt.dp)
+			}
+		})
+	}
+}
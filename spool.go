@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// spoolReplayInterval is how often the spool tries to deliver spooled hits.
+const spoolReplayInterval = 30 * time.Second
+
+// hitSpool is set when -spoolFile is given.
+var hitSpool *spool
+
+var (
+	// Spooled hits that were never delivered: the spool was full, or they
+	// outlived -spoolMaxAge.
+	spoolDropped atomic.Int64
+	spoolExpired atomic.Int64
+)
+
+// spooledHit is one line of the spool file.
+type spooledHit struct {
+	Time time.Time `json:"time"`
+	// URL is stored without the -ga4APISecret, which is added back when
+	// FlagSecret is set.
+	URL         string      `json:"url"`
+	FlagSecret  bool        `json:"flag_secret,omitempty"`
+	ContentType string      `json:"content_type"`
+	UA          string      `json:"ua,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        string      `json:"body"`
+}
+
+// spool is an append-only file of hits the collector could not take, stored
+// one JSON object per line. It is replayed oldest first every
+// spoolReplayInterval, until a hit fails again; what is left is written back.
+// The file is only readable by its owner, as hits given an ?api_secret keep
+// it in their URL.
+type spool struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	logger  *slog.Logger
+
+	replayMu sync.Mutex // serializes Replay
+	mu       sync.Mutex // guards the file and size
+	size     int64
+}
+
+// openSpool opens the spool at path, keeping the hits a previous run left
+// in it.
+func openSpool(path string, maxSize int64, maxAge time.Duration, logger *slog.Logger) (*spool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &spool{path: path, maxSize: maxSize, maxAge: maxAge, logger: logger, size: info.Size()}, nil
+}
+
+// Add appends a hit, reporting false if it was dropped because the spool is
+// full or cannot be written.
+func (s *spool) Add(hit spooledHit) bool {
+	line, err := json.Marshal(hit)
+	if err != nil {
+		return false
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize {
+		spoolDropped.Add(1)
+		return false
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.Write(line)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		s.logger.Error("Cannot spool hit", "path", s.path, "err", err)
+		spoolDropped.Add(1)
+		return false
+	}
+	s.size += int64(len(line))
+	return true
+}
+
+// Size returns the spool file's size in bytes.
+func (s *spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Replay delivers the spooled hits in order, stopping at the first one that
+// fails, and rewrites the spool with the hits left. The spool is not locked
+// while hits are delivered, so workers keep spooling; hits added meanwhile
+// are kept after the ones left.
+func (s *spool) Replay() error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	if s.size == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var left bytes.Buffer
+	delivered, failed := 0, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if failed {
+			left.Write(line)
+			left.WriteByte('\n')
+			continue
+		}
+		var hit spooledHit
+		if err := json.Unmarshal(line, &hit); err != nil {
+			s.logger.Warn("Dropping unreadable spooled hit", "path", s.path, "err", err)
+			continue
+		}
+		if time.Since(hit.Time) > s.maxAge {
+			spoolExpired.Add(1)
+			hitsErrored.Inc()
+			continue
+		}
+		if err := s.deliver(hit); err != nil {
+			s.logger.Debug("Spooled hit still undeliverable", "url", redactSecret(hit.URL), "err", redactURLError(err))
+			failed = true
+			left.Write(line)
+			left.WriteByte('\n')
+			continue
+		}
+		delivered++
+		hitsLogged.Inc()
+	}
+	if delivered > 0 {
+		s.logger.Info("Replayed spooled hits", "hits", delivered, "left_bytes", left.Len())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	if len(current) > len(data) {
+		left.Write(current[len(data):])
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, left.Bytes(), 0600); err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return err
+	}
+	s.size = int64(left.Len())
+	return nil
+}
+
+// run replays the spool right away, for the hits an earlier run left, and
+// then every interval.
+func (s *spool) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Replay(); err != nil {
+			s.logger.Error("Cannot replay spooled hits", "path", s.path, "err", err)
+		}
+		<-ticker.C
+	}
+}
+
+// spoolHit stores a hit the collector could not take, reporting whether it
+// was spooled.
+func spoolHit(job hitJob, payload gaRequest) bool {
+	if hitSpool == nil {
+		return false
+	}
+	rawURL, flagSecret := withoutFlagSecret(payload.url)
+	return hitSpool.Add(spooledHit{
+		Time:        time.Now(),
+		URL:         rawURL,
+		FlagSecret:  flagSecret,
+		ContentType: payload.contentType,
+		UA:          job.ua,
+		Header:      payload.header,
+		Body:        payload.body,
+	})
+}
+
+// withoutFlagSecret removes the api_secret param of rawURL if it is the
+// -ga4APISecret, reporting whether it did. Secrets given by ?api_secret are
+// kept, as the hit could not be delivered without them.
+func withoutFlagSecret(rawURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || ga4APISecret == "" {
+		return rawURL, false
+	}
+	query := u.Query()
+	if query.Get("api_secret") != ga4APISecret {
+		return rawURL, false
+	}
+	query.Del("api_secret")
+	u.RawQuery = query.Encode()
+	return u.String(), true
+}
+
+// withFlagSecret adds the -ga4APISecret back to a URL withoutFlagSecret
+// removed it from.
+func withFlagSecret(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set("api_secret", ga4APISecret)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// deliver makes a single attempt at reporting a spooled hit. v1 hits get
+// the queue time parameter, so GA dates them to when they were made.
+func (s *spool) deliver(hit spooledHit) error {
+	if hit.FlagSecret {
+		hit.URL = withFlagSecret(hit.URL)
+	}
+	breaker := breakerFor(hit.URL, s.logger)
+	if !breaker.Allow() {
+		return errCircuitOpen
+	}
+
+	body := hit.Body
+	if hit.URL == gaEndpoint {
+		q, err := url.ParseQuery(body)
+		if err == nil {
+			// Hits made before they were sent already carry their age.
+			qt, _ := strconv.ParseInt(q.Get("qt"), 10, 64)
+			q.Set("qt", strconv.FormatInt(qt+time.Since(hit.Time).Milliseconds(), 10))
+			body = q.Encode()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gaTimeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", hit.URL, strings.NewReader(body))
+	if hit.UA != "" {
+		req.Header.Add("User-Agent", hit.UA)
+	}
+	req.Header.Add("Content-Type", hit.ContentType)
+	for key, values := range hit.Header {
+		req.Header[key] = values
+	}
+
+	start := time.Now()
+	resp, err := gaClient.Do(req)
+	gaRequestDuration.ObserveSince(start)
+	if err == nil {
+		resp.Body.Close()
+		countProto(resp)
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("collector returned %s", resp.Status)
+		}
+	}
+	breaker.Record(err == nil)
+	return err
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSpool opens a spool in a temporary directory.
+func newTestSpool(t *testing.T, maxSize int64, maxAge time.Duration) *spool {
+	t.Helper()
+	s, err := openSpool(filepath.Join(t.TempDir(), "spool.jsonl"), maxSize, maxAge, testServer.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// spooledV1 returns a spooled v1 hit for tid, made age ago.
+func spooledV1(tid string, age time.Duration) spooledHit {
+	return spooledHit{
+		Time:        time.Now().Add(-age),
+		URL:         gaEndpoint,
+		ContentType: "application/x-www-form-urlencoded",
+		Body:        "v=1&t=pageview&tid=" + tid,
+	}
+}
+
+// spooledTIDs returns the tid of each hit in the spool file.
+func spooledTIDs(t *testing.T, s *spool) []string {
+	t.Helper()
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tids []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var hit spooledHit
+		if err := json.Unmarshal([]byte(line), &hit); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		tids = append(tids, strings.TrimPrefix(hit.Body, "v=1&t=pageview&tid="))
+	}
+	return tids
+}
+
+func TestSpoolReplay(t *testing.T) {
+	stub := newTestBeacon(t)
+	s := newTestSpool(t, 0, time.Hour)
+	for _, tid := range []string{"UA-1-1", "UA-2-1", "UA-3-1"} {
+		if !s.Add(spooledV1(tid, time.Minute)) {
+			t.Fatalf("hit %s not spooled", tid)
+		}
+	}
+
+	if err := s.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"UA-1-1", "UA-2-1", "UA-3-1"} {
+		form := stub.next(t).form()
+		if form.Get("tid") != want {
+			t.Errorf("replayed %s, want %s", form.Get("tid"), want)
+		}
+		// The hit is dated to when it was made.
+		if qt := form.Get("qt"); len(qt) < 5 {
+			t.Errorf("qt = %q, want about a minute", qt)
+		}
+	}
+	if s.Size() != 0 || len(spooledTIDs(t, s)) != 0 {
+		t.Errorf("spool holds %d bytes after a full replay, want it empty", s.Size())
+	}
+}
+
+func TestSpoolReplayStopsAtFailure(t *testing.T) {
+	stub := newTestBeacon(t, "-breakerThreshold=0")
+	s := newTestSpool(t, 0, time.Hour)
+	for _, tid := range []string{"UA-1-1", "UA-2-1", "UA-3-1"} {
+		s.Add(spooledV1(tid, 0))
+	}
+	stub.respond(http.StatusServiceUnavailable)
+
+	if err := s.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stub.next(t).form().Get("tid"); got != "UA-1-1" {
+		t.Errorf("tried %s first, want UA-1-1", got)
+	}
+	stub.none(t)
+	if got := strings.Join(spooledTIDs(t, s), ","); got != "UA-1-1,UA-2-1,UA-3-1" {
+		t.Errorf("spool holds %s, want all three hits in order", got)
+	}
+
+	stub.respond(http.StatusOK)
+	if err := s.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		stub.next(t)
+	}
+	if s.Size() != 0 {
+		t.Errorf("spool holds %d bytes once the collector is back, want 0", s.Size())
+	}
+}
+
+func TestSpoolExpiresHits(t *testing.T) {
+	stub := newTestBeacon(t)
+	s := newTestSpool(t, 0, time.Hour)
+	s.Add(spooledV1("UA-1-1", 2*time.Hour))
+	s.Add(spooledV1("UA-2-1", time.Minute))
+	// Unreadable lines are dropped too.
+	f, _ := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString("{not json\n")
+	f.Close()
+	expired := spoolExpired.Load()
+
+	if err := s.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if got := stub.next(t).form().Get("tid"); got != "UA-2-1" {
+		t.Errorf("replayed %s, want only the fresh UA-2-1", got)
+	}
+	stub.none(t)
+	if got := spoolExpired.Load() - expired; got != 1 {
+		t.Errorf("%d hits expired, want 1", got)
+	}
+	if s.Size() != 0 {
+		t.Errorf("spool holds %d bytes, want the expired and unreadable hits dropped", s.Size())
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	newTestBeacon(t)
+	hit := spooledV1("UA-1-1", 0)
+	line, _ := json.Marshal(hit)
+	s := newTestSpool(t, int64(2*(len(line)+1)), time.Hour)
+	dropped := spoolDropped.Load()
+
+	for i, want := range []bool{true, true, false} {
+		if got := s.Add(hit); got != want {
+			t.Errorf("Add() #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if got := spoolDropped.Load() - dropped; got != 1 {
+		t.Errorf("%d hits dropped, want 1", got)
+	}
+	if s.Size() != int64(2*(len(line)+1)) {
+		t.Errorf("size = %d, want two hits", s.Size())
+	}
+}
+
+func TestSpoolKeepsHitsAddedDuringReplay(t *testing.T) {
+	newTestBeacon(t)
+	var s *spool
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Workers keep spooling while the spool is replayed.
+		if !s.Add(spooledV1("UA-9-1", 0)) {
+			t.Error("Add() during Replay failed")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(collector.Close)
+	keep(t, &gaEndpoint)
+	gaEndpoint = collector.URL + "/collect"
+
+	s = newTestSpool(t, 0, time.Hour)
+	s.Add(spooledV1("UA-1-1", 0))
+	s.Add(spooledV1("UA-2-1", 0))
+	if err := s.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(spooledTIDs(t, s), ","); got != "UA-1-1,UA-2-1,UA-9-1" {
+		t.Errorf("spool holds %s, want the new hit after the ones left", got)
+	}
+	data, _ := os.ReadFile(s.path)
+	if s.Size() != int64(len(data)) {
+		t.Errorf("size = %d, want the file's %d bytes", s.Size(), len(data))
+	}
+}
+
+func TestSpoolFileMode(t *testing.T) {
+	stub := newTestBeacon(t)
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	// A spool left by an older version is made private.
+	os.WriteFile(path, nil, 0644)
+	s, err := openSpool(path, 0, time.Hour, testServer.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(spooledV1("UA-1-1", 0))
+	s.Replay()
+	stub.next(t)
+	s.Add(spooledV1("UA-2-1", 0))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode = %v, want 0600", mode)
+	}
+}
+
+func TestSpoolSecret(t *testing.T) {
+	stub := newTestBeacon(t, "-ga4APISecret=fl4g")
+	keep(t, &hitSpool)
+	hitSpool = newTestSpool(t, 0, time.Hour)
+
+	spoolHit(hitJob{ua: "Firefox"}, gaRequest{url: ga4Endpoint + "?api_secret=fl4g&measurement_id=G-1", contentType: "application/json", body: `{"client_id":"1"}`})
+	spoolHit(hitJob{}, gaRequest{url: ga4Endpoint + "?api_secret=own&measurement_id=G-2", contentType: "application/json", body: `{"client_id":"2"}`})
+	data, _ := os.ReadFile(hitSpool.path)
+	if strings.Contains(string(data), "fl4g") {
+		t.Errorf("spool file holds the -ga4APISecret: %s", data)
+	}
+	if !strings.Contains(string(data), "api_secret=own") {
+		t.Errorf("spool file lost a secret given by ?api_secret: %s", data)
+	}
+
+	if err := hitSpool.Replay(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		secret, id, ua string
+	}{
+		{"fl4g", "G-1", "Firefox"},
+		{"own", "G-2", ""},
+	}
+	for _, tt := range tests {
+		hit := stub.next(t)
+		if hit.path != "/mp/collect" || hit.query.Get("api_secret") != tt.secret || hit.query.Get("measurement_id") != tt.id {
+			t.Errorf("replayed to %s?%s, want /mp/collect with the secret %s and %s", hit.path, hit.query.Encode(), tt.secret, tt.id)
+		}
+		if tt.ua != "" && hit.header.Get("User-Agent") != tt.ua {
+			t.Errorf("User-Agent = %q, want %q", hit.header.Get("User-Agent"), tt.ua)
+		}
+	}
+}
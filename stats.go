@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+	statsTopPages    = 20
+	statsBarWidth    = 300 // pixels, of the busiest day's bar
+)
+
+// fallbackStatsTemplate is shown if the embedded stats page is unusable.
+const fallbackStatsTemplate = `<!DOCTYPE HTML><title>Pageviews: {{.Account}}</title>` +
+	`<h1>{{.Account}}</h1><p>{{.Views}} pageviews in the last {{.Days}} days.</p>`
+
+var statsTemplate = embeddedHTMLTemplate("static/stats.html", fallbackStatsTemplate)
+
+// statsDay is a row of the pageviews per day table.
+type statsDay struct {
+	dailyViews
+	Width int // of the bar, in pixels
+}
+
+// statsAuthorized checks -statsToken, given as a bearer token or as ?token=
+// so the page can be bookmarked. Without one the stats are public.
+func statsAuthorized(r *http.Request) bool {
+	if statsToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(statsToken)) == 1
+}
+
+// statsHandler serves /stats/<account>: the pageviews per day and the top
+// pages of the account over the last ?days=, from -hitStore.
+func (s *server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if !statsAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	account := strings.Trim(strings.TrimPrefix(r.URL.Path, "/stats/"), "/")
+	if account == "" || strings.Contains(account, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	days := defaultStatsDays
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxStatsDays {
+			http.Error(w, "days must be a number from 1 to 366", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	// Whole UTC days, today included.
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+	daily, err := hitStorage.DailyViews(r.Context(), account, since)
+	if err != nil {
+		s.logger.Error("Cannot read stats", "account", account, "err", err)
+		http.Error(w, "cannot read stats", http.StatusInternalServerError)
+		return
+	}
+	pages, err := hitStorage.TopPages(r.Context(), account, since, statsTopPages)
+	if err != nil {
+		s.logger.Error("Cannot read stats", "account", account, "err", err)
+		http.Error(w, "cannot read stats", http.StatusInternalServerError)
+		return
+	}
+
+	// Days without views are missing from daily; show them as zeros.
+	byDay := map[string]dailyViews{}
+	var total, busiest int64
+	for _, d := range daily {
+		byDay[d.Day] = d
+		total += d.Views
+		if d.Views > busiest {
+			busiest = d.Views
+		}
+	}
+	rows := make([]statsDay, 0, days)
+	for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		d, ok := byDay[key]
+		if !ok {
+			d = dailyViews{Day: key}
+		}
+		row := statsDay{dailyViews: d}
+		if busiest > 0 {
+			row.Width = int(d.Views * statsBarWidth / busiest)
+		}
+		rows = append(rows, row)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := statsTemplate.Execute(w, struct {
+		Account string
+		Token   string
+		Days    int
+		Ranges  []int
+		Views   int64
+		Daily   []statsDay
+		Pages   []pageViews
+	}{account, r.URL.Query().Get("token"), days, []int{7, 30, 90, 365}, total, rows, pages}); err != nil {
+		s.logger.Error("Cannot execute template", "err", err)
+	}
+}
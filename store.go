@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go, so the image still builds with CGO_ENABLED=0
+)
+
+// hitStorage is where the local collector keeps hits, nil unless -hitStore
+// is set.
+var hitStorage HitStore
+
+// storedHit is a hit as kept by a HitStore.
+type storedHit struct {
+	Time     time.Time `json:"time"`
+	Account  string    `json:"account"`
+	Page     string    `json:"page"`
+	Type     string    `json:"type"`
+	ClientID string    `json:"cid"`
+	Referrer string    `json:"referrer"`
+}
+
+// dailyViews are the pageviews of an account on a day.
+type dailyViews struct {
+	Day      string // YYYY-MM-DD, UTC
+	Views    int64
+	Visitors int64 // distinct client IDs
+}
+
+// pageViews are the pageviews of a page.
+type pageViews struct {
+	Page  string
+	Views int64
+}
+
+// HitStore keeps hits for self-hosted analytics without GA.
+type HitStore interface {
+	Record(ctx context.Context, hit storedHit) error
+	// DailyViews returns the pageviews of account per day since since,
+	// oldest first. Days without any are left out.
+	DailyViews(ctx context.Context, account string, since time.Time) ([]dailyViews, error)
+	// TopPages returns the limit most viewed pages of account since since.
+	TopPages(ctx context.Context, account string, since time.Time, limit int) ([]pageViews, error)
+	Close() error
+}
+
+// newHitStore returns the -hitStore backend: sqlite, keeping hits in the
+// database file at dsn, or clickhouse, keeping them in a table of the
+// ClickHouse server whose HTTP interface is at dsn.
+func newHitStore(backend, dsn, table string) (HitStore, error) {
+	switch backend {
+	case "sqlite":
+		return openSQLiteStore(dsn)
+	case "clickhouse":
+		return openClickHouseStore(dsn, table)
+	}
+	return nil, fmt.Errorf("unknown hit store %q (want sqlite or clickhouse)", backend)
+}
+
+// localCollector keeps hits in -hitStore instead of reporting them to an
+// analytics service. They are shown on /stats/<account>.
+type localCollector struct{}
+
+func (localCollector) Collect(ctx context.Context, job hitJob) error {
+	forwarded := forwardedQuery(job.logger, job.query)
+	hit := storedHit{
+		Time:     time.Now().UTC(),
+		Account:  job.params[0],
+		Page:     job.params[1],
+		Type:     "pageview",
+		ClientID: job.cid,
+		Referrer: forwarded.Get("dr"),
+	}
+	if t := forwarded.Get("t"); t != "" {
+		hit.Type = t
+	}
+	if dryRun {
+		job.logger.Info("Dry run, not storing hit", "account", hit.Account, "page", hit.Page, "cid", job.cid, "request_id", job.requestID)
+		return nil
+	}
+	if err := hitStorage.Record(ctx, hit); err != nil {
+		hitsErrored.Inc()
+		job.logger.Error("Cannot store hit", "err", err, "request_id", job.requestID)
+		return err
+	}
+	hitsLogged.Inc()
+	return nil
+}
+
+// sqliteStore keeps hits in a SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteSchema creates the hits table, times in Unix seconds.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS hits (
+		time     INTEGER NOT NULL,
+		account  TEXT NOT NULL,
+		page     TEXT NOT NULL,
+		type     TEXT NOT NULL,
+		cid      TEXT NOT NULL,
+		referrer TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS hits_account_time ON hits (account, time)`,
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite takes one writer at a time; a single connection queues them
+	// here instead of failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range append([]string{"PRAGMA journal_mode=WAL"}, sqliteSchema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Record(ctx context.Context, hit storedHit) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO hits (time, account, page, type, cid, referrer) VALUES (?, ?, ?, ?, ?, ?)",
+		hit.Time.Unix(), hit.Account, hit.Page, hit.Type, hit.ClientID, hit.Referrer)
+	return err
+}
+
+func (s *sqliteStore) DailyViews(ctx context.Context, account string, since time.Time) ([]dailyViews, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT date(time, 'unixepoch') AS day, COUNT(*), COUNT(DISTINCT cid)
+		FROM hits WHERE account = ? AND time >= ? AND type = 'pageview'
+		GROUP BY day ORDER BY day`, account, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []dailyViews
+	for rows.Next() {
+		var d dailyViews
+		if err := rows.Scan(&d.Day, &d.Views, &d.Visitors); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func (s *sqliteStore) TopPages(ctx context.Context, account string, since time.Time, limit int) ([]pageViews, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT page, COUNT(*) AS views
+		FROM hits WHERE account = ? AND time >= ? AND type = 'pageview'
+		GROUP BY page ORDER BY views DESC, page LIMIT ?`, account, since.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pages []pageViews
+	for rows.Next() {
+		var p pageViews
+		if err := rows.Scan(&p.Page, &p.Views); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
+
+// clickhouseTablePattern matches the table names -clickhouseTable accepts,
+// optionally qualified with a database.
+var clickhouseTablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// clickhouseStore keeps hits in a ClickHouse table, through the HTTP
+// interface so no driver is needed. Hits are inserted one at a time with
+// async_insert, leaving the batching to the server.
+//
+// HTTP interface reference: https://clickhouse.com/docs/en/interfaces/http
+type clickhouseStore struct {
+	url    string
+	table  string
+	client *http.Client
+}
+
+func openClickHouseStore(rawURL, table string) (*clickhouseStore, error) {
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q", rawURL)
+	}
+	if !clickhouseTablePattern.MatchString(table) {
+		return nil, fmt.Errorf("invalid ClickHouse table %q", table)
+	}
+	s := &clickhouseStore{url: rawURL, table: table, client: &http.Client{Timeout: 10 * time.Second}}
+	_, err := s.query(context.Background(), "CREATE TABLE IF NOT EXISTS "+table+` (
+		time DateTime, account String, page String, type LowCardinality(String), cid String, referrer String
+	) ENGINE = MergeTree ORDER BY (account, time)`, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// query runs stmt with the given {name:Type} query parameters, sending body
+// as its input data, and returns the response.
+func (s *clickhouseStore) query(ctx context.Context, stmt string, params url.Values, body io.Reader) ([]byte, error) {
+	u, _ := url.Parse(s.url)
+	q := u.Query()
+	q.Set("query", stmt)
+	for name, values := range params {
+		q["param_"+name] = values
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ClickHouse returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (s *clickhouseStore) Record(ctx context.Context, hit storedHit) error {
+	row, err := json.Marshal(map[string]interface{}{
+		"time":     hit.Time.Unix(),
+		"account":  hit.Account,
+		"page":     hit.Page,
+		"type":     hit.Type,
+		"cid":      hit.ClientID,
+		"referrer": hit.Referrer,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.query(ctx,
+		"INSERT INTO "+s.table+" SETTINGS async_insert=1, wait_for_async_insert=0 FORMAT JSONEachRow",
+		nil, strings.NewReader(string(row)+"\n"))
+	return err
+}
+
+// selectRows runs a SELECT and decodes its FORMAT JSONCompact rows.
+func (s *clickhouseStore) selectRows(ctx context.Context, stmt string, params url.Values) ([][]json.RawMessage, error) {
+	data, err := s.query(ctx, stmt+" FORMAT JSONCompact", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Data [][]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot decode ClickHouse response: %v", err)
+	}
+	return result.Data, nil
+}
+
+func (s *clickhouseStore) DailyViews(ctx context.Context, account string, since time.Time) ([]dailyViews, error) {
+	rows, err := s.selectRows(ctx, `
+		SELECT toString(toDate(time)) AS day, count(), uniq(cid)
+		FROM `+s.table+` WHERE account = {account:String} AND time >= {since:DateTime} AND type = 'pageview'
+		GROUP BY day ORDER BY day`,
+		url.Values{"account": {account}, "since": {fmt.Sprint(since.Unix())}})
+	if err != nil {
+		return nil, err
+	}
+	days := make([]dailyViews, 0, len(rows))
+	for _, row := range rows {
+		var d dailyViews
+		if len(row) != 3 || json.Unmarshal(row[0], &d.Day) != nil {
+			return nil, fmt.Errorf("unexpected ClickHouse row %s", row)
+		}
+		// 64-bit integers are quoted in JSON output.
+		if err := unmarshalCHInt(row[1], &d.Views); err != nil {
+			return nil, err
+		}
+		if err := unmarshalCHInt(row[2], &d.Visitors); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+func (s *clickhouseStore) TopPages(ctx context.Context, account string, since time.Time, limit int) ([]pageViews, error) {
+	rows, err := s.selectRows(ctx, `
+		SELECT page, count() AS views
+		FROM `+s.table+` WHERE account = {account:String} AND time >= {since:DateTime} AND type = 'pageview'
+		GROUP BY page ORDER BY views DESC, page LIMIT {limit:UInt32}`,
+		url.Values{"account": {account}, "since": {fmt.Sprint(since.Unix())}, "limit": {fmt.Sprint(limit)}})
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]pageViews, 0, len(rows))
+	for _, row := range rows {
+		var p pageViews
+		if len(row) != 2 || json.Unmarshal(row[0], &p.Page) != nil {
+			return nil, fmt.Errorf("unexpected ClickHouse row %s", row)
+		}
+		if err := unmarshalCHInt(row[1], &p.Views); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, nil
+}
+
+func (s *clickhouseStore) Close() error { return nil }
+
+// unmarshalCHInt decodes a ClickHouse integer, quoted or not.
+func unmarshalCHInt(raw json.RawMessage, n *int64) error {
+	var num json.Number
+	if err := json.Unmarshal(raw, &num); err != nil {
+		return fmt.Errorf("unexpected ClickHouse count %s", raw)
+	}
+	v, err := num.Int64()
+	*n = v
+	return err
+}
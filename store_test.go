@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSQLiteStore opens a sqlite store in a temporary directory.
+func newTestSQLiteStore(t *testing.T) *sqliteStore {
+	t.Helper()
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "hits.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLiteStore(t)
+	day := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	hits := []storedHit{
+		{Time: day.AddDate(0, 0, -10), Account: "UA-1234-1", Page: "old", Type: "pageview", ClientID: "a"},
+		{Time: day, Account: "UA-1234-1", Page: "docs", Type: "pageview", ClientID: "a"},
+		{Time: day.Add(time.Hour), Account: "UA-1234-1", Page: "docs", Type: "pageview", ClientID: "a"},
+		{Time: day.Add(2 * time.Hour), Account: "UA-1234-1", Page: "intro", Type: "pageview", ClientID: "b", Referrer: "https://example.com/"},
+		{Time: day.Add(3 * time.Hour), Account: "UA-1234-1", Page: "docs", Type: "event", ClientID: "c"},
+		{Time: day.AddDate(0, 0, 1), Account: "UA-1234-1", Page: "setup", Type: "pageview", ClientID: "b"},
+		{Time: day.AddDate(0, 0, 1), Account: "UA-1234-1", Page: "intro", Type: "pageview", ClientID: "c"},
+		{Time: day, Account: "UA-9999-1", Page: "docs", Type: "pageview", ClientID: "z"},
+	}
+	for _, hit := range hits {
+		if err := s.Record(ctx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := day.Truncate(24 * time.Hour)
+	daily, err := s.DailyViews(ctx, "UA-1234-1", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDaily := []dailyViews{{"2026-03-01", 3, 2}, {"2026-03-02", 2, 2}}
+	if !reflect.DeepEqual(daily, wantDaily) {
+		t.Errorf("DailyViews() = %+v, want %+v", daily, wantDaily)
+	}
+
+	pages, err := s.TopPages(ctx, "UA-1234-1", since, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ties are ordered by page.
+	wantPages := []pageViews{{"docs", 2}, {"intro", 2}}
+	if !reflect.DeepEqual(pages, wantPages) {
+		t.Errorf("TopPages() = %+v, want %+v", pages, wantPages)
+	}
+
+	if daily, _ := s.DailyViews(ctx, "UA-5555-1", since); len(daily) != 0 {
+		t.Errorf("DailyViews() of an account without hits = %+v, want none", daily)
+	}
+}
+
+func TestSQLiteStoreReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "hits.db")
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record(ctx, storedHit{Time: time.Now(), Account: "UA-1234-1", Page: "docs", Type: "pageview", ClientID: "a"})
+	s.Close()
+
+	if s, err = openSQLiteStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if daily, _ := s.DailyViews(ctx, "UA-1234-1", time.Now().Add(-time.Hour)); len(daily) != 1 || daily[0].Views != 1 {
+		t.Errorf("DailyViews() = %+v after reopening, want the hit kept", daily)
+	}
+
+	if _, err := openSQLiteStore(filepath.Join(t.TempDir(), "missing", "hits.db")); err == nil {
+		t.Error("openSQLiteStore() in a missing directory succeeded")
+	}
+}
+
+func TestNewHitStore(t *testing.T) {
+	tests := []struct {
+		backend, dsn, table string
+		err                 string
+	}{
+		{"postgres", "", "", `unknown hit store "postgres"`},
+		{"clickhouse", "tcp://localhost:9000", "hits", "invalid ClickHouse URL"},
+		{"clickhouse", "http://localhost:8123", "hits; DROP TABLE x", "invalid ClickHouse table"},
+	}
+	for _, tt := range tests {
+		if _, err := newHitStore(tt.backend, tt.dsn, tt.table); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("newHitStore(%s, %s, %s) = %v, want an error with %q", tt.backend, tt.dsn, tt.table, err, tt.err)
+		}
+	}
+}
+
+func TestLocalCollector(t *testing.T) {
+	keep(t, &hitStorage)
+	hitStorage = newTestSQLiteStore(t)
+	newTestBeacon(t, "-coalesceWindow=0", "-collector=local")
+	logged := hitsLogged.Value()
+
+	get("/UA-1234-1/docs?dr=https://example.com/")
+	get("/UA-1234-1/docs?t=event&ec=docs&ea=download")
+	for deadline := time.Now().Add(5 * time.Second); hitsLogged.Value()-logged < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var hits []storedHit
+	rows, err := hitStorage.(*sqliteStore).db.Query("SELECT account, page, type, referrer FROM hits ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hit storedHit
+		rows.Scan(&hit.Account, &hit.Page, &hit.Type, &hit.Referrer)
+		hits = append(hits, hit)
+	}
+	want := []storedHit{
+		{Account: "UA-1234-1", Page: "docs", Type: "pageview", Referrer: "https://example.com/"},
+		{Account: "UA-1234-1", Page: "docs", Type: "event"},
+	}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("stored %+v, want %+v", hits, want)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	keep(t, &hitStorage)
+	hitStorage = newTestSQLiteStore(t)
+	setFlags(t, "-statsToken=s3cret")
+	now := time.Now().UTC()
+	for i, page := range []string{"docs", "docs", "intro"} {
+		hitStorage.Record(context.Background(), storedHit{Time: now, Account: "UA-1234-1", Page: page, Type: "pageview", ClientID: string(rune('a' + i))})
+	}
+
+	stats := func(target, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		testServer.statsHandler(w, r)
+		return w
+	}
+	tests := []struct {
+		target, authorization string
+		want                  int
+	}{
+		{"/stats/UA-1234-1", "", http.StatusUnauthorized},
+		{"/stats/UA-1234-1?token=guess", "", http.StatusUnauthorized},
+		{"/stats/UA-1234-1", "Bearer s3cret", http.StatusOK},
+		{"/stats/UA-1234-1?token=s3cret&days=7", "", http.StatusOK},
+		{"/stats/UA-1234-1?token=s3cret&days=0", "", http.StatusBadRequest},
+		{"/stats/UA-1234-1?token=s3cret&days=367", "", http.StatusBadRequest},
+		{"/stats/?token=s3cret", "", http.StatusNotFound},
+		{"/stats/UA-1234-1/docs?token=s3cret", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := stats(tt.target, tt.authorization); w.Code != tt.want {
+			t.Errorf("GET %s: status = %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+
+	w := stats("/stats/UA-1234-1?days=7", "Bearer s3cret")
+	if body := w.Body.String(); !strings.Contains(body, "docs") || !strings.Contains(body, "intro") {
+		t.Errorf("stats page lacks the top pages: %s", body)
+	}
+	if w.Header().Get("Cache-Control") != "private, no-store" {
+		t.Errorf("Cache-Control = %q, want private, no-store", w.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	defaultBadgeLabel   = "analytics"
+	defaultBadgeMessage = "GA"
+	defaultBadgeColor   = "#007ec6"
+
+	// badgeTextPadding is the horizontal space around each text, in pixels.
+	badgeTextPadding = 10
+
+	// maxRenderedBadges bounds renderedBadges; the cache is emptied when it
+	// fills up.
+	maxRenderedBadges = 1024
+)
+
+var (
+	badgeTemplate = embeddedBadgeTemplate()
+
+	// badgeColorValues are the fills of the named ?color= values.
+	badgeColorValues = map[string]string{
+		"brightgreen": "#4c1",
+		"green":       "#97ca00",
+		"yellowgreen": "#a4a61d",
+		"yellow":      "#dfb317",
+		"orange":      "#fe7d37",
+		"red":         "#e05d44",
+		"blue":        "#007ec6",
+		"lightgrey":   "#9f9f9f",
+		"grey":        "#555",
+		"gray":        "#555",
+	}
+
+	// Approximate advance widths of Verdana at 11px, in pixels, for the
+	// characters that differ most from the average.
+	narrowChars = "fijlrtI!,.:;'|() "
+	wideChars   = "mwMW@%"
+
+	renderedBadgesMu sync.Mutex
+	renderedBadges   = map[badgeText]badgeImage{}
+)
+
+// badgeText is what a rendered badge shows, and in which format.
+type badgeText struct {
+	label, message, color string
+	gif                   bool
+}
+
+// textWidth estimates the rendered width of s in pixels.
+func textWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune(narrowChars, r):
+			width += 4
+		case strings.ContainsRune(wideChars, r):
+			width += 11
+		case r >= 'A' && r <= 'Z':
+			width += 8
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+// badgeFill returns the fill for a ?color= value, which has already been
+// checked against badgeColors and hexColorPattern.
+func badgeFill(color string) string {
+	if color == "" {
+		return defaultBadgeColor
+	}
+	if fill, ok := badgeColorValues[color]; ok {
+		return fill
+	}
+	return "#" + strings.TrimPrefix(color, "#")
+}
+
+// validateBadgeText checks the ?label=, ?message= and ?color= values.
+func validateBadgeText(label, message, color string) error {
+	if len(label) > maxLabelLength || len(message) > maxLabelLength {
+		return fmt.Errorf("label and message must be at most %d characters", maxLabelLength)
+	}
+	if color != "" && !badgeColors[color] && !hexColorPattern.MatchString(color) {
+		return fmt.Errorf("invalid color %q", color)
+	}
+	return nil
+}
+
+// wantsRenderedBadge reports whether query asks for custom badge text on a
+// badge variant. The pixel is always served as it is.
+func wantsRenderedBadge(variant string, query url.Values) bool {
+	if variant == "pixel" {
+		return false
+	}
+	for _, param := range []string{"label", "message", "color"} {
+		if query.Get(param) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// renderedBadgeText returns the texts renderBadge shows for label and message.
+func renderedBadgeText(label, message string) (string, string) {
+	if label == "" {
+		label = defaultBadgeLabel
+	}
+	if message == "" {
+		message = defaultBadgeMessage
+	}
+	return label, message
+}
+
+// renderVariantBadge renders a custom text badge for variant: a GIF for the
+// GIF variants, an SVG otherwise.
+func renderVariantBadge(variant, label, message, color string) badgeImage {
+	if variant == "gif" || variant == "flat-gif" {
+		return renderGIFBadge(label, message, color)
+	}
+	return renderBadge(label, message, color)
+}
+
+// fallbackBadgeTemplate is rendered from if the embedded template is
+// unusable: the same badge, without the rounded corners of a custom one.
+const fallbackBadgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20">` +
+	`<path fill="#555" d="M0 0h{{.LabelWidth}}v20H0z"/><path fill="{{.Color}}" d="M{{.LabelWidth}} 0h{{.MessageWidth}}v20H{{.LabelWidth}}z"/>` +
+	`<g fill="#fff" text-anchor="middle" font-family="DejaVu Sans,Verdana,Geneva,sans-serif" font-size="11">` +
+	`<text x="{{.LabelX}}" y="14">{{xml .Label}}</text><text x="{{.MessageX}}" y="14">{{xml .Message}}</text></g></svg>`
+
+// embeddedBadgeTemplate returns the built-in rendered badge template, or
+// fallbackBadgeTemplate if it can't be parsed.
+func embeddedBadgeTemplate() *template.Template {
+	const path = "static/badge.svg.tmpl"
+	if data := embeddedAsset(path); data != nil {
+		t, err := parseBadgeTemplate(data)
+		if err == nil {
+			return t
+		}
+		embeddedAssetFailed(path, err)
+	}
+	return template.Must(parseBadgeTemplate([]byte(fallbackBadgeTemplate)))
+}
+
+// parseBadgeTemplate parses the SVG template the rendered badges are made
+// from.
+func parseBadgeTemplate(src []byte) (*template.Template, error) {
+	return template.New("badge").
+		Funcs(template.FuncMap{"xml": template.HTMLEscapeString}).
+		Parse(string(src))
+}
+
+// renderBadge returns an SVG badge showing label and message on a color
+// background, sized to fit the text. Empty values take the defaults of the
+// static badge. Rendered badges are cached.
+func renderBadge(label, message, color string) badgeImage {
+	label, message = renderedBadgeText(label, message)
+	key := badgeText{label, message, badgeFill(color), false}
+
+	renderedBadgesMu.Lock()
+	defer renderedBadgesMu.Unlock()
+	if img, ok := renderedBadges[key]; ok {
+		return img
+	}
+
+	labelWidth := textWidth(label) + badgeTextPadding
+	messageWidth := textWidth(message) + badgeTextPadding
+	var b bytes.Buffer
+	assetsMu.RLock()
+	tmpl := badgeTemplate
+	assetsMu.RUnlock()
+	tmpl.Execute(&b, struct {
+		Width, LabelWidth, MessageWidth int
+		LabelX, MessageX                float64
+		Label, Message, Color           string
+	}{
+		Width:        labelWidth + messageWidth,
+		LabelWidth:   labelWidth,
+		MessageWidth: messageWidth,
+		LabelX:       float64(labelWidth) / 2,
+		MessageX:     float64(labelWidth) + float64(messageWidth)/2,
+		Label:        key.label,
+		Message:      key.message,
+		Color:        key.color,
+	})
+	img := badgeImage{"image/svg+xml", b.Bytes()}
+
+	if len(renderedBadges) >= maxRenderedBadges {
+		renderedBadges = map[badgeText]badgeImage{}
+	}
+	renderedBadges[key] = img
+	return img
+}
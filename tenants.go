@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// tenants is the registry loaded from -tenantsFile. It is nil without
+	// one.
+	tenants atomic.Pointer[tenantRegistry]
+
+	tenantHits = metrics.CounterVec("gabeacon_tenant_hits_total", "Hits of each tenant, by result.", "tenant", "result")
+)
+
+// tenant is an operator's customer on a shared beacon. Its hits are only
+// reported for its own tracking IDs, with its key in the badge URL as ?key=,
+// and up to DailyQuota a day.
+type tenant struct {
+	Name        string   `json:"name"`
+	Key         string   `json:"key"`
+	TrackingIDs []string `json:"trackingIDs"`
+	// DailyQuota is the number of hits reported per UTC day, or 0 for no
+	// limit.
+	DailyQuota int64 `json:"dailyQuota"`
+	// GAEndpoint, if set, replaces -gaEndpoint for the tenant's v1 hits.
+	GAEndpoint string `json:"gaEndpoint"`
+
+	quota *dailyQuota
+}
+
+// tenantRegistry maps tracking IDs to the tenant owning them.
+type tenantRegistry struct {
+	byAccount map[string]*tenant
+}
+
+// dailyQuota counts a tenant's reported hits of the current UTC day. It is
+// kept in memory only, so a restart starts the day over.
+type dailyQuota struct {
+	mu   sync.Mutex
+	day  string
+	used int64
+}
+
+// loadTenants reads and validates a -tenantsFile, a JSON object listing the
+// tenants:
+//
+//	{"tenants": [{"name": "acme", "key": "k3y", "trackingIDs": ["UA-1234-1"], "dailyQuota": 100000}]}
+//
+// Tenants keep the quota they used today from previous, if they are in it
+// under the same name.
+func loadTenants(path string, previous *tenantRegistry) (*tenantRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tenants []*tenant `json:"tenants"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Tenants) == 0 {
+		return nil, fmt.Errorf("%s: no tenants", path)
+	}
+
+	quotas := map[string]*dailyQuota{}
+	if previous != nil {
+		for _, t := range previous.byAccount {
+			quotas[t.Name] = t.quota
+		}
+	}
+	reg := &tenantRegistry{byAccount: map[string]*tenant{}}
+	names := map[string]bool{}
+	for i, t := range file.Tenants {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("%s: tenant %d has no name", path, i+1)
+		case names[t.Name]:
+			return nil, fmt.Errorf("%s: tenant %q is listed twice", path, t.Name)
+		case t.Key == "":
+			return nil, fmt.Errorf("%s: tenant %q has no key", path, t.Name)
+		case len(t.TrackingIDs) == 0:
+			return nil, fmt.Errorf("%s: tenant %q has no tracking IDs", path, t.Name)
+		case t.DailyQuota < 0:
+			return nil, fmt.Errorf("%s: tenant %q has a negative daily quota", path, t.Name)
+		}
+		if t.GAEndpoint != "" {
+			if u, err := url.Parse(t.GAEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("%s: tenant %q: gaEndpoint must be an http or https URL", path, t.Name)
+			}
+		}
+		names[t.Name] = true
+		for _, id := range t.TrackingIDs {
+			if other, ok := reg.byAccount[id]; ok {
+				return nil, fmt.Errorf("%s: tracking ID %s belongs to both %q and %q", path, id, other.Name, t.Name)
+			}
+			reg.byAccount[id] = t
+		}
+		if t.quota = quotas[t.Name]; t.quota == nil {
+			t.quota = &dailyQuota{}
+		}
+	}
+	return reg, nil
+}
+
+// reloadTenants re-reads -tenantsFile, keeping the current registry if it is
+// invalid.
+func reloadTenants() error {
+	reg, err := loadTenants(tenantsFile, tenants.Load())
+	if err != nil {
+		return err
+	}
+	tenants.Store(reg)
+	return nil
+}
+
+// lookupTenant returns the tenant owning account. registered is false if a
+// -tenantsFile is loaded and no tenant owns account; without one every
+// account is registered, to no tenant.
+func lookupTenant(account string) (t *tenant, registered bool) {
+	reg := tenants.Load()
+	if reg == nil {
+		return nil, true
+	}
+	t, registered = reg.byAccount[account]
+	return t, registered
+}
+
+// validKey reports whether key is the tenant's. It is always true without a
+// tenant.
+func (t *tenant) validKey(key string) bool {
+	if t == nil {
+		return true
+	}
+	valid := subtle.ConstantTimeCompare([]byte(key), []byte(t.Key)) == 1
+	if !valid {
+		t.count("invalid_key")
+	}
+	return valid
+}
+
+// overQuota reports whether the tenant has used up today's quota. With take,
+// the hit is counted towards the quota if it is not. It is always false
+// without a tenant.
+func (t *tenant) overQuota(take bool) bool {
+	if t == nil {
+		return false
+	}
+	q := t.quota
+	q.mu.Lock()
+	if day := time.Now().UTC().Format("2006-01-02"); q.day != day {
+		q.day, q.used = day, 0
+	}
+	over := t.DailyQuota > 0 && q.used >= t.DailyQuota
+	if take && !over {
+		q.used++
+	}
+	q.mu.Unlock()
+
+	switch {
+	case take && over:
+		t.count("quota_exceeded")
+	case take:
+		t.count("ok")
+	}
+	return over
+}
+
+func (t *tenant) count(result string) {
+	tenantHits.With(t.Name, result).Inc()
+}
+
+// gaEndpointFor returns the collector URL for account's v1 hits.
+func gaEndpointFor(account string) string {
+	if t, _ := lookupTenant(account); t != nil && t.GAEndpoint != "" {
+		return t.GAEndpoint
+	}
+	return gaEndpoint
+}
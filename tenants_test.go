@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTenants writes a -tenantsFile and returns its path.
+func writeTenants(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useTenants loads the -tenantsFile data for the rest of t.
+func useTenants(t *testing.T, data string) {
+	t.Helper()
+	previous := tenants.Load()
+	t.Cleanup(func() { tenants.Store(previous) })
+	setFlags(t, "-tenantsFile="+writeTenants(t, data))
+	if err := reloadTenants(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string // empty for a valid file
+	}{
+		{"valid", `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1", "UA-1111-2"], "dailyQuota": 10, "gaEndpoint": "https://proxy.example.com/collect"}, {"name": "beta", "key": "k", "trackingIDs": ["UA-2222-1"]}]}`, ""},
+		{"not JSON", `tenants: []`, "invalid character"},
+		{"no tenants", `{"tenants": []}`, "no tenants"},
+		{"no name", `{"tenants": [{"key": "k", "trackingIDs": ["UA-1111-1"]}]}`, "tenant 1 has no name"},
+		{"listed twice", `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"]}, {"name": "acme", "key": "k", "trackingIDs": ["UA-2222-1"]}]}`, "listed twice"},
+		{"no key", `{"tenants": [{"name": "acme", "trackingIDs": ["UA-1111-1"]}]}`, "has no key"},
+		{"no tracking IDs", `{"tenants": [{"name": "acme", "key": "k"}]}`, "has no tracking IDs"},
+		{"negative quota", `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"], "dailyQuota": -1}]}`, "negative daily quota"},
+		{"bad endpoint", `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"], "gaEndpoint": "ftp://proxy.example.com/collect"}]}`, "gaEndpoint must be"},
+		{"shared tracking ID", `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"]}, {"name": "beta", "key": "k", "trackingIDs": ["UA-1111-1"]}]}`, `belongs to both "acme" and "beta"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg, err := loadTenants(writeTenants(t, tt.data), nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("loadTenants() = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acme := reg.byAccount["UA-1111-2"]; acme == nil || acme.Name != "acme" || acme.DailyQuota != 10 || acme.quota == nil {
+				t.Errorf("UA-1111-2 belongs to %+v, want acme with a quota of 10", acme)
+			}
+			if beta := reg.byAccount["UA-2222-1"]; beta == nil || beta.Name != "beta" {
+				t.Errorf("UA-2222-1 belongs to %+v, want beta", beta)
+			}
+		})
+	}
+
+	if _, err := loadTenants(filepath.Join(t.TempDir(), "missing.json"), nil); err == nil {
+		t.Error("loadTenants() of a missing file succeeded")
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	reg, err := loadTenants(writeTenants(t, `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"], "dailyQuota": 2}, {"name": "free", "key": "k", "trackingIDs": ["UA-2222-1"]}]}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := reg.byAccount["UA-1111-1"]
+	if acme.overQuota(false) {
+		t.Error("over quota before any hit")
+	}
+	for i := 0; i < 2; i++ {
+		if acme.overQuota(true) {
+			t.Errorf("hit %d over a quota of 2", i+1)
+		}
+	}
+	if !acme.overQuota(true) || !acme.overQuota(false) {
+		t.Error("third hit within a quota of 2")
+	}
+	if acme.quota.used != 2 {
+		t.Errorf("used = %d, want hits over the quota not counted", acme.quota.used)
+	}
+
+	// The next UTC day starts over.
+	acme.quota.day = time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	if acme.overQuota(true) {
+		t.Error("over quota on a new day")
+	}
+	if acme.quota.used != 1 {
+		t.Errorf("used = %d on a new day after one hit, want 1", acme.quota.used)
+	}
+
+	free := reg.byAccount["UA-2222-1"]
+	for i := 0; i < 100; i++ {
+		if free.overQuota(true) {
+			t.Fatalf("hit %d over no quota", i+1)
+		}
+	}
+	if (*tenant)(nil).overQuota(true) {
+		t.Error("over quota without a tenant")
+	}
+}
+
+func TestReloadTenantsKeepsQuota(t *testing.T) {
+	useTenants(t, `{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"], "dailyQuota": 2}]}`)
+	acme, _ := lookupTenant("UA-1111-1")
+	acme.overQuota(true)
+	acme.overQuota(true)
+
+	os.WriteFile(tenantsFile, []byte(`{"tenants": [{"name": "acme", "key": "new", "trackingIDs": ["UA-1111-1", "UA-1111-2"], "dailyQuota": 3}, {"name": "beta", "key": "k", "trackingIDs": ["UA-2222-1"], "dailyQuota": 2}]}`), 0600)
+	if err := reloadTenants(); err != nil {
+		t.Fatal(err)
+	}
+	acme, _ = lookupTenant("UA-1111-2")
+	if acme.Key != "new" || acme.quota.used != 2 {
+		t.Errorf("acme after the reload = key %q, %d hits used, want the new key and today's 2 hits", acme.Key, acme.quota.used)
+	}
+	if acme.overQuota(true) || !acme.overQuota(true) {
+		t.Error("reloaded acme can't take exactly one more hit within its new quota of 3")
+	}
+	if beta, _ := lookupTenant("UA-2222-1"); beta.quota.used != 0 {
+		t.Errorf("new tenant has %d hits used, want 0", beta.quota.used)
+	}
+
+	os.WriteFile(tenantsFile, []byte(`{"tenants": [{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"], "dailyQuota": -5}]}`), 0600)
+	if err := reloadTenants(); err == nil {
+		t.Error("reload of a negative quota succeeded")
+	}
+	if acme, _ := lookupTenant("UA-1111-2"); acme == nil || acme.Key != "new" {
+		t.Errorf("tenant after a failed reload = %+v, want the previous registry kept", acme)
+	}
+}
+
+func TestTenantHits(t *testing.T) {
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	useTenants(t, `{"tenants": [{"name": "acme", "key": "k3y", "trackingIDs": ["UA-1111-1"], "dailyQuota": 1}]}`)
+
+	if w := get("/UA-9999-9/page?key=k3y"); w.Code != 403 {
+		t.Errorf("status = %d for an account of no tenant, want 403", w.Code)
+	}
+	if w := get("/UA-1111-1/page?key=guess"); w.Code != 200 {
+		t.Errorf("status = %d with a wrong key, want the badge", w.Code)
+	}
+	stub.none(t)
+	get("/UA-1111-1/page?key=k3y")
+	if got := stub.next(t).form().Get("tid"); got != "UA-1111-1" {
+		t.Errorf("tid = %s, want UA-1111-1", got)
+	}
+	if w := get("/UA-1111-1/page?key=k3y"); w.Code != 429 {
+		t.Errorf("status = %d over the quota, want 429", w.Code)
+	}
+	stub.none(t)
+
+	setFlags(t, "-rateLimitAction=suppress")
+	if w := get("/UA-1111-1/page?key=k3y"); w.Code != 200 {
+		t.Errorf("status = %d over the quota with -rateLimitAction=suppress, want the badge", w.Code)
+	}
+	stub.none(t)
+}
+
+func TestTenantBatches(t *testing.T) {
+	stub := newTestBeacon(t, "-gaBatch", "-coalesceWindow=0")
+	proxy, single := newGAStub(t), newGAStub(t)
+	useTenants(t, `{"tenants": [
+		{"name": "acme", "key": "k", "trackingIDs": ["UA-1111-1"], "gaEndpoint": "`+proxy.URL+`/proxy/collect"},
+		{"name": "beta", "key": "k", "trackingIDs": ["UA-2222-1"]},
+		{"name": "gamma", "key": "k", "trackingIDs": ["UA-3333-1"], "gaEndpoint": "`+single.URL+`/hits"}]}`)
+	keep(t, &hitBatcher)
+	hitBatcher = newBatchDispatcher(20*time.Millisecond, testServer.logger)
+	t.Cleanup(func() { hitBatcher.Stop(context.Background()) })
+
+	for _, account := range []string{"UA-1111-1", "UA-2222-1", "UA-1111-1", "UA-3333-1"} {
+		get("/" + account + "/page?key=k")
+	}
+	tests := []struct {
+		stub *gaStub
+		path string
+		hits int
+		tid  string
+	}{
+		{proxy, "/proxy/batch", 2, "UA-1111-1"},
+		{stub, "/batch", 1, "UA-2222-1"},
+		{single, "/hits", 1, "UA-3333-1"},
+	}
+	for _, tt := range tests {
+		hit := tt.stub.next(t)
+		lines := strings.Split(hit.body, "\n")
+		if hit.path != tt.path || len(lines) != tt.hits || !strings.Contains(lines[0], "tid="+tt.tid) {
+			t.Errorf("%s got %d hits on %s: %s, want %d of %s on %s", tt.tid, len(lines), hit.path, hit.body, tt.hits, tt.tid, tt.path)
+		}
+		tt.stub.none(t)
+	}
+}
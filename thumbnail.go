@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	maxThumbnailSize = 1 << 20
+	maxPageSize      = 2 << 20
+	thumbnailTimeout = 5 * time.Second
+	// maxThumbnailCacheFiles bounds the disk cache, which gets an entry per
+	// referring page; the oldest entries are evicted past it.
+	maxThumbnailCacheFiles = 1000
+)
+
+var (
+	// thumbnailContentTypes are the image types served as thumbnails. They
+	// are served from the beacon's origin, so types that can carry scripts,
+	// like SVG, are not.
+	thumbnailContentTypes = map[string]bool{
+		"image/png":  true,
+		"image/jpeg": true,
+		"image/gif":  true,
+		"image/webp": true,
+	}
+
+	thumbnailEntryPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// fetchOGImage fetches pageURL, finds its og:image and returns the image and
+// its content type. Both URLs must be https and the image a PNG, JPEG, GIF
+// or WebP of at most 1MB.
+func fetchOGImage(pageURL string, timeout time.Duration) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	page, err := url.Parse(pageURL)
+	if err != nil || page.Scheme != "https" {
+		return nil, "", fmt.Errorf("page URL %q is not https", pageURL)
+	}
+	body, _, err := fetchLimited(ctx, page.String(), maxPageSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	ref := findOGImage(doc)
+	if ref == "" {
+		return nil, "", errors.New("page has no og:image")
+	}
+	img, err := page.Parse(ref)
+	if err != nil || img.Scheme != "https" {
+		return nil, "", fmt.Errorf("og:image %q is not https", ref)
+	}
+
+	data, contentType, err := fetchLimited(ctx, img.String(), maxThumbnailSize)
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !thumbnailContentTypes[mediaType] {
+		return nil, "", fmt.Errorf("og:image has unsupported content type %q", contentType)
+	}
+	return data, mediaType, nil
+}
+
+// findOGImage returns the content of the first <meta property="og:image">.
+func findOGImage(n *html.Node) string {
+	if n.Type == html.ElementNode && n.Data == "meta" {
+		var property, content string
+		for _, attr := range n.Attr {
+			switch attr.Key {
+			case "property":
+				property = attr.Val
+			case "content":
+				content = attr.Val
+			}
+		}
+		if property == "og:image" && content != "" {
+			return content
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if ref := findOGImage(c); ref != "" {
+			return ref
+		}
+	}
+	return ""
+}
+
+// cachedThumbnail returns the thumbnail for pageURL from the disk cache,
+// fetching and caching it when it is missing or older than the TTL. A cache
+// entry is the content type on the first line followed by the image.
+func cachedThumbnail(logger *slog.Logger, pageURL string) ([]byte, string, error) {
+	sum := sha256.Sum256([]byte(pageURL))
+	path := filepath.Join(thumbnailCacheDir, hex.EncodeToString(sum[:]))
+
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < thumbnailCacheTTL {
+		if entry, err := os.ReadFile(path); err == nil {
+			if i := bytes.IndexByte(entry, '\n'); i >= 0 && thumbnailContentTypes[string(entry[:i])] {
+				return entry[i+1:], string(entry[:i]), nil
+			}
+		}
+	}
+
+	data, contentType, err := fetchOGImage(pageURL, thumbnailTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	entry := append([]byte(contentType+"\n"), data...)
+	if err := os.MkdirAll(thumbnailCacheDir, 0700); err != nil {
+		logger.Error("Cannot create thumbnail cache", "dir", thumbnailCacheDir, "err", err)
+	} else if err := os.WriteFile(path, entry, 0600); err != nil {
+		logger.Error("Cannot cache thumbnail", "page", pageURL, "err", err)
+	} else {
+		pruneThumbnailCache()
+	}
+	return data, contentType, nil
+}
+
+// pruneThumbnailCache removes the expired cache entries, then the oldest
+// ones past maxThumbnailCacheFiles. Files not named like cache entries are
+// left alone, in case -thumbnailCacheDir is shared.
+func pruneThumbnailCache() {
+	files, err := os.ReadDir(thumbnailCacheDir)
+	if err != nil {
+		return
+	}
+	type cacheEntry struct {
+		path    string
+		modTime time.Time
+	}
+	var entries []cacheEntry
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() || !thumbnailEntryPattern.MatchString(f.Name()) {
+			continue
+		}
+		path := filepath.Join(thumbnailCacheDir, f.Name())
+		if time.Since(info.ModTime()) >= thumbnailCacheTTL {
+			os.Remove(path)
+			continue
+		}
+		entries = append(entries, cacheEntry{path, info.ModTime()})
+	}
+	if len(entries) <= maxThumbnailCacheFiles {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	for _, e := range entries[:len(entries)-maxThumbnailCacheFiles] {
+		os.Remove(e.path)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\nthumbnail")
+
+// ogServer is an HTTPS site serving pages with the <head> and images of the
+// content type asked for in the query, and counting the requests it gets.
+// The images are testPNG padded with ?pad= bytes. fetchClient trusts it
+// until t ends.
+type ogServer struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+func newOGServer(t *testing.T) *ogServer {
+	s := &ogServer{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		if r.URL.Path == "/image" {
+			pad, _ := strconv.Atoi(r.URL.Query().Get("pad"))
+			w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+			w.Write(append(testPNG, bytes.Repeat([]byte{0}, pad)...))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head><title>Page</title>%s</head><body></body></html>", r.URL.Query().Get("head"))
+	}))
+	t.Cleanup(s.Close)
+	keep(t, &fetchClient)
+	fetchClient = s.Client()
+	return s
+}
+
+// page returns the URL of a page with head in its <head>.
+func (s *ogServer) page(head string) string {
+	return s.URL + "/page?" + url.Values{"head": {head}}.Encode()
+}
+
+// ogImage returns an og:image tag naming image.
+func ogImage(image string) string {
+	return `<meta property="og:image" content="` + html.EscapeString(image) + `">`
+}
+
+// imageURL returns the path of an image of contentType and size bytes.
+func imageURL(contentType string, size int) string {
+	return "/image?" + url.Values{"type": {contentType}, "pad": {strconv.Itoa(size - len(testPNG))}}.Encode()
+}
+
+func TestFetchOGImage(t *testing.T) {
+	s := newOGServer(t)
+	tests := []struct {
+		name            string
+		page            string
+		wantContentType string
+	}{
+		{"absolute", s.page(ogImage(s.URL + imageURL("image/png", len(testPNG)))), "image/png"},
+		{"relative", s.page(ogImage(imageURL("image/jpeg", len(testPNG)))), "image/jpeg"},
+		{"first of several", s.page(ogImage(imageURL("image/gif", len(testPNG))) + ogImage(imageURL("image/png", len(testPNG)))), "image/gif"},
+		{"content type params", s.page(ogImage(imageURL("image/webp; q=1", len(testPNG)))), "image/webp"},
+		{"largest image", s.page(ogImage(imageURL("image/png", maxThumbnailSize))), "image/png"},
+		{"no og:image", s.page(`<meta property="og:title" content="Page">`), ""},
+		{"empty og:image", s.page(ogImage("")), ""},
+		{"http page", strings.Replace(s.page(ogImage(imageURL("image/png", len(testPNG)))), "https:", "http:", 1), ""},
+		{"http og:image", s.page(ogImage("http://example.com/og.png")), ""},
+		{"svg og:image", s.page(ogImage(imageURL("image/svg+xml", len(testPNG)))), ""},
+		{"image too large", s.page(ogImage(imageURL("image/png", maxThumbnailSize+1))), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, contentType, err := fetchOGImage(tt.page, thumbnailTimeout)
+			if tt.wantContentType == "" {
+				if err == nil {
+					t.Errorf("fetchOGImage() = %d bytes of %s, want an error", len(data), contentType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != tt.wantContentType || !bytes.HasPrefix(data, testPNG) {
+				t.Errorf("fetchOGImage() = %q of %s, want the test image as %s", data, contentType, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	s := newOGServer(t)
+	newTestBeacon(t, "-enableThumbnails", "-thumbnailCacheDir="+t.TempDir())
+	page := s.page(ogImage(imageURL("image/png", len(testPNG))))
+
+	for i := 0; i < 2; i++ {
+		w := get("/UA-1234-1/page?thumbnail", "Referer", page)
+		if got := w.Header().Get("Content-Type"); got != "image/png" {
+			t.Fatalf("request %d: Content-Type = %q, want image/png", i+1, got)
+		}
+		if !bytes.Equal(w.Body.Bytes(), testPNG) {
+			t.Errorf("request %d: body = %q, want the og:image", i+1, w.Body)
+		}
+		if got := w.Header().Get("Content-Security-Policy"); got != "sandbox" {
+			t.Errorf("request %d: Content-Security-Policy = %q, want sandbox", i+1, got)
+		}
+	}
+	if got := s.requests.Load(); got != 2 {
+		t.Errorf("site got %d requests, want 2 for the page and image, then the cache", got)
+	}
+}
+
+func TestThumbnailFallback(t *testing.T) {
+	s := newOGServer(t)
+	page := s.page(ogImage(imageURL("image/png", len(testPNG))))
+	tests := []struct {
+		name   string
+		args   []string
+		target string
+		header []string
+	}{
+		{"disabled", nil, "/UA-1234-1/page?thumbnail", []string{"Referer", page}},
+		{"no referrer", []string{"-enableThumbnails"}, "/UA-1234-1/page?thumbnail", nil},
+		{"no og:image", []string{"-enableThumbnails"}, "/UA-1234-1/page?thumbnail", []string{"Referer", s.page("")}},
+		{"not asked for", []string{"-enableThumbnails"}, "/UA-1234-1/page", []string{"Referer", page}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBeacon(t, append(tt.args, "-thumbnailCacheDir="+t.TempDir())...)
+			w := get(tt.target, tt.header...)
+			if got := w.Header().Get("Content-Type"); got != "image/svg+xml" {
+				t.Errorf("Content-Type = %q, want the badge", got)
+			}
+		})
+	}
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:443", false},
+		{"[::1]:443", false},
+		{"10.1.2.3:443", false},
+		{"192.168.0.1:443", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:443", false},
+		{"0.0.0.0:443", false},
+		{"[::ffff:127.0.0.1]:443", false},
+		{"[fe80::1]:443", false},
+		{"224.0.0.1:443", false},
+	}
+	for _, tt := range tests {
+		if err := publicAddressOnly("tcp", tt.address, nil); (err == nil) != tt.public {
+			t.Errorf("publicAddressOnly(%s) = %v, want public: %v", tt.address, err, tt.public)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	otlpExportInterval = 5 * time.Second
+	otlpExportTimeout  = 10 * time.Second
+	// otlpBatchSize spans or log records are exported at once; at
+	// otlpMaxBuffered, newer ones are dropped until the next export.
+	otlpBatchSize   = 512
+	otlpMaxBuffered = 4096
+)
+
+// OTLP span kinds, and the status code of failed spans.
+//
+// OTLP reference: https://opentelemetry.io/docs/specs/otlp/
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+
+	statusError = 2
+)
+
+var (
+	// tracer exports to -otlpEndpoint. It is nil without one, and tracing is
+	// then off.
+	tracer *otlpExporter
+
+	otlpDropped = metrics.Counter("gabeacon_otlp_dropped_total", "Spans and log records dropped because the export buffer was full.")
+
+	otlpExported     = metrics.CounterVec("gabeacon_otlp_exported_total", "Spans and log records exported, by signal.", "signal")
+	otlpExportErrors = metrics.CounterVec("gabeacon_otlp_export_errors_total", "Failed exports, by signal.", "signal")
+)
+
+type spanKey struct{}
+
+// span is an operation of a trace, exported once it ends.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]interface{}
+	status  int
+	message string
+	// unsampled marks a trace that is not exported, so that neither are
+	// the spans of the operations it leads to.
+	unsampled bool
+}
+
+// unsampledSpan is in the context of operations of unsampled traces.
+var unsampledSpan = &span{unsampled: true}
+
+// startSpan starts a span that is a child of the span in ctx, if any, and
+// returns ctx with it. Without a tracer, or if the trace is not sampled, it
+// returns ctx and a nil span, whose methods do nothing.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	rand.Read(sp.spanID[:])
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent.unsampled {
+		return ctx, nil
+	} else if ok {
+		sp.traceID, sp.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(sp.traceID[:])
+		if !sampledTrace(sp.traceID) {
+			return context.WithValue(ctx, spanKey{}, unsampledSpan), nil
+		}
+	}
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// startServerSpan starts the span of an incoming request, continuing the
+// trace of its traceparent header if it has a valid one.
+//
+// W3C Trace Context reference: https://www.w3.org/TR/trace-context/#traceparent-header
+func startServerSpan(r *http.Request) (context.Context, *span) {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if tracer == nil || len(parts) != 4 || parts[0] != "00" {
+		return startSpan(r.Context(), r.Method, spanServer)
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	parentID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(parentID) != 8 || len(flags) != 1 ||
+		bytes.Equal(traceID, make([]byte, 16)) || bytes.Equal(parentID, make([]byte, 8)) {
+		return startSpan(r.Context(), r.Method, spanServer)
+	}
+	// The caller decided whether the trace is sampled.
+	if flags[0]&1 == 0 {
+		return context.WithValue(r.Context(), spanKey{}, unsampledSpan), nil
+	}
+	parent := &span{}
+	copy(parent.traceID[:], traceID)
+	copy(parent.spanID[:], parentID)
+	return startSpan(context.WithValue(r.Context(), spanKey{}, parent), r.Method, spanServer)
+}
+
+// sampledTrace reports whether a new trace is kept at -otlpSampleRatio.
+func sampledTrace(traceID [16]byte) bool {
+	if otlpSampleRatio >= 1 {
+		return true
+	}
+	var n uint64
+	for _, b := range traceID[8:] {
+		n = n<<8 | uint64(b)
+	}
+	return float64(n) < otlpSampleRatio*math.MaxUint64
+}
+
+// Set sets an attribute of the span.
+func (sp *span) Set(key string, value interface{}) {
+	if sp != nil {
+		sp.attrs[key] = value
+	}
+}
+
+// End ends the span, with an error status if err is not nil, and queues it
+// for export.
+func (sp *span) End(err error) {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	if err != nil {
+		sp.status, sp.message = statusError, err.Error()
+	}
+	tracer.addSpan(sp)
+}
+
+// traceparent returns the span as a traceparent header value.
+func (sp *span) traceparent() string {
+	return "00-" + hex.EncodeToString(sp.traceID[:]) + "-" + hex.EncodeToString(sp.spanID[:]) + "-01"
+}
+
+// logRecord is an OTel log record, exported with -otlpLogHits.
+type logRecord struct {
+	time     time.Time
+	severity string
+	body     string
+	attrs    map[string]interface{}
+	span     *span
+}
+
+// logHitRecord exports the outcome of reporting job as a log record of the
+// span in ctx, with -otlpLogHits.
+func logHitRecord(ctx context.Context, job hitJob, err error) {
+	if tracer == nil || !otlpLogHits {
+		return
+	}
+	rec := logRecord{time: time.Now(), severity: "INFO", body: "hit reported", attrs: map[string]interface{}{
+		"beacon.account":    job.params[0],
+		"beacon.page":       job.params[1],
+		"beacon.collector":  collectorNameFor(job.params[0]),
+		"beacon.request_id": job.requestID,
+	}}
+	if err != nil {
+		rec.severity, rec.body = "ERROR", "hit not reported"
+		rec.attrs["error.message"] = err.Error()
+	}
+	if sp, ok := ctx.Value(spanKey{}).(*span); ok && !sp.unsampled {
+		rec.span = sp
+	}
+	tracer.addLog(rec)
+}
+
+// otlpExporter batches spans and log records and POSTs them to an OTLP/HTTP
+// endpoint as JSON, which OpenTelemetry collectors, Jaeger and Tempo accept.
+type otlpExporter struct {
+	endpoint string
+	header   http.Header
+	resource map[string]interface{}
+	client   *http.Client
+	logger   *slog.Logger
+
+	mu    sync.Mutex
+	spans []*span
+	logs  []logRecord
+
+	flush chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newOTLPExporter(endpoint string, header http.Header, serviceName string, logger *slog.Logger) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		header:   header,
+		resource: map[string]interface{}{"attributes": otlpAttributes(map[string]interface{}{"service.name": serviceName})},
+		client:   &http.Client{Timeout: otlpExportTimeout},
+		logger:   logger,
+		flush:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// parseOTLPHeaders parses -otlpHeaders, a comma-separated list of
+// name=value pairs.
+func parseOTLPHeaders(s string) (http.Header, error) {
+	header := http.Header{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("header %q is not name=value", pair)
+		}
+		header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+func (e *otlpExporter) addSpan(sp *span) {
+	e.mu.Lock()
+	full := len(e.spans) >= otlpMaxBuffered
+	if !full {
+		e.spans = append(e.spans, sp)
+	}
+	n := len(e.spans)
+	e.mu.Unlock()
+	e.added(full, n)
+}
+
+func (e *otlpExporter) addLog(rec logRecord) {
+	e.mu.Lock()
+	full := len(e.logs) >= otlpMaxBuffered
+	if !full {
+		e.logs = append(e.logs, rec)
+	}
+	n := len(e.logs)
+	e.mu.Unlock()
+	e.added(full, n)
+}
+
+func (e *otlpExporter) added(dropped bool, buffered int) {
+	if dropped {
+		otlpDropped.Inc()
+	} else if buffered >= otlpBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		case <-e.stop:
+			e.export()
+			return
+		}
+		e.export()
+	}
+}
+
+// Stop exports what is buffered and stops exporting.
+func (e *otlpExporter) Stop(ctx context.Context) {
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+// export sends the buffered spans and log records. What fails to export is
+// dropped, so a broken endpoint can't hold up the beacon.
+func (e *otlpExporter) export() {
+	e.mu.Lock()
+	spans, logs := e.spans, e.logs
+	e.spans, e.logs = nil, nil
+	e.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := min(len(spans), otlpBatchSize)
+		e.post("traces", map[string]interface{}{"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   e.resource,
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": otlpScope, "spans": otlpSpans(spans[:n])}},
+		}}}, n)
+		spans = spans[n:]
+	}
+	for len(logs) > 0 {
+		n := min(len(logs), otlpBatchSize)
+		e.post("logs", map[string]interface{}{"resourceLogs": []interface{}{map[string]interface{}{
+			"resource":  e.resource,
+			"scopeLogs": []interface{}{map[string]interface{}{"scope": otlpScope, "logRecords": otlpLogRecords(logs[:n])}},
+		}}}, n)
+		logs = logs[n:]
+	}
+}
+
+func (e *otlpExporter) post(signal string, body interface{}, n int) {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", e.endpoint+"/v1/"+signal, bytes.NewReader(data))
+	for name, values := range e.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("endpoint returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		otlpExportErrors.With(signal).Inc()
+		e.logger.Warn("Cannot export telemetry", "signal", signal, "count", n, "err", err)
+		return
+	}
+	otlpExported.With(signal).Add(int64(n))
+}
+
+var otlpScope = map[string]interface{}{"name": "ga-beacon"}
+
+func otlpSpans(spans []*span) []interface{} {
+	out := make([]interface{}, len(spans))
+	for i, sp := range spans {
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attrs),
+		}
+		if sp.parent != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(sp.parent[:])
+		}
+		if sp.status != 0 {
+			s["status"] = map[string]interface{}{"code": sp.status, "message": sp.message}
+		}
+		out[i] = s
+	}
+	return out
+}
+
+// otlpSeverities map log severities to OTLP severity numbers.
+var otlpSeverities = map[string]int{"INFO": 9, "ERROR": 17}
+
+func otlpLogRecords(logs []logRecord) []interface{} {
+	out := make([]interface{}, len(logs))
+	for i, rec := range logs {
+		r := map[string]interface{}{
+			"timeUnixNano":   strconv.FormatInt(rec.time.UnixNano(), 10),
+			"severityNumber": otlpSeverities[rec.severity],
+			"severityText":   rec.severity,
+			"body":           map[string]interface{}{"stringValue": rec.body},
+			"attributes":     otlpAttributes(rec.attrs),
+		}
+		if rec.span != nil {
+			r["traceId"] = hex.EncodeToString(rec.span.traceID[:])
+			r["spanId"] = hex.EncodeToString(rec.span.spanID[:])
+		}
+		out[i] = r
+	}
+	return out
+}
+
+// otlpAttributes encodes attributes as OTLP key-values, sorted by key.
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for _, key := range sortedKeys(attrs) {
+		var value map[string]interface{}
+		switch v := attrs[key].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": key, "value": value})
+	}
+	return out
+}
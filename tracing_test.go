@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otlpReceiver is an OTLP/HTTP endpoint recording the spans exported to it.
+type otlpReceiver struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	spans  []otlpSpan
+	header http.Header
+}
+
+// otlpSpan is a span as exported in OTLP/JSON, with its resource's service
+// name.
+type otlpSpan struct {
+	Service      string
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	} `json:"attributes"`
+}
+
+// attr returns the value of an attribute as a string.
+func (s otlpSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				b, _ := json.Marshal(v)
+				return strings.Trim(string(b), `"`)
+			}
+		}
+	}
+	return ""
+}
+
+func newOTLPReceiver(t *testing.T, status int) *otlpReceiver {
+	t.Helper()
+	recv := &otlpReceiver{}
+	recv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(data, &body) != nil {
+			t.Errorf("receiver got %s %s (%s): %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"), data)
+		}
+		recv.mu.Lock()
+		recv.header = r.Header.Clone()
+		for _, rs := range body.ResourceSpans {
+			var service string
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					service = a.Value.StringValue
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				for _, sp := range ss.Spans {
+					sp.Service = service
+					recv.spans = append(recv.spans, sp)
+				}
+			}
+		}
+		recv.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(recv.Close)
+	return recv
+}
+
+// byName returns the received spans by name.
+func (recv *otlpReceiver) byName() map[string]otlpSpan {
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	spans := map[string]otlpSpan{}
+	for _, sp := range recv.spans {
+		spans[sp.Name] = sp
+	}
+	return spans
+}
+
+// useTracer exports to recv for the rest of t. It must be called before
+// newTestBeacon, so that the workers are stopped before it is restored.
+func useTracer(t *testing.T, recv *otlpReceiver, header http.Header) {
+	t.Helper()
+	keep(t, &tracer)
+	tracer = newOTLPExporter(recv.URL+"/", header, "beacon-test", testServer.logger)
+	exporter := tracer
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		exporter.Stop(ctx)
+	})
+}
+
+// serveTraced serves a beacon through the WithTracing middleware.
+func serveTraced(target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Add(header[i], header[i+1])
+	}
+	return serve(r, WithTracing(), WithHandler(http.HandlerFunc(testServer.handler)))
+}
+
+func TestTracing(t *testing.T) {
+	recv := newOTLPReceiver(t, http.StatusOK)
+	useTracer(t, recv, http.Header{"X-Api-Key": {"k3y"}})
+	stub := newTestBeacon(t, "-coalesceWindow=0", "-otlpSampleRatio=1")
+
+	const traceID, callerID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	if w := serveTraced("/UA-1234-1/docs", "traceparent", "00-"+traceID+"-"+callerID+"-01"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	hit := stub.next(t)
+	hitWorkers.Stop(context.Background())
+	tracer.export()
+
+	spans := recv.byName()
+	server, report, post := spans["GET"], spans["report hit"], spans["POST"]
+	tests := []struct {
+		name   string
+		span   otlpSpan
+		kind   int
+		parent string
+		attrs  map[string]string
+	}{
+		{"GET", server, spanServer, callerID, map[string]string{"http.request.method": "GET", "url.path": "/UA-1234-1/docs", "http.response.status_code": "200"}},
+		{"report hit", report, spanInternal, server.SpanID, map[string]string{"beacon.account": "UA-1234-1", "beacon.page": "docs"}},
+		{"POST", post, spanClient, report.SpanID, map[string]string{"url.full": gaEndpoint, "http.response.status_code": "200", "beacon.attempts": "1"}},
+	}
+	for _, tt := range tests {
+		if tt.span.Name != tt.name {
+			t.Errorf("no %q span exported, got %v", tt.name, spans)
+			continue
+		}
+		if tt.span.TraceID != traceID || tt.span.ParentSpanID != tt.parent || tt.span.Kind != tt.kind || tt.span.Service != "beacon-test" {
+			t.Errorf("%s span = trace %s, parent %s, kind %d, service %q, want trace %s, parent %s, kind %d, beacon-test", tt.name,
+				tt.span.TraceID, tt.span.ParentSpanID, tt.span.Kind, tt.span.Service, traceID, tt.parent, tt.kind)
+		}
+		for key, want := range tt.attrs {
+			if got := tt.span.attr(key); got != want {
+				t.Errorf("%s span %s = %q, want %q", tt.name, key, got, want)
+			}
+		}
+	}
+	if want := "00-" + traceID + "-" + post.SpanID + "-01"; hit.header.Get("traceparent") != want {
+		t.Errorf("collector got traceparent %q, want %q", hit.header.Get("traceparent"), want)
+	}
+	recv.mu.Lock()
+	if recv.header.Get("X-Api-Key") != "k3y" {
+		t.Errorf("receiver got headers %v, want the -otlpHeaders", recv.header)
+	}
+	recv.mu.Unlock()
+}
+
+func TestTracingUnsampled(t *testing.T) {
+	recv := newOTLPReceiver(t, http.StatusOK)
+	useTracer(t, recv, nil)
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+
+	serveTraced("/UA-1234-1/docs", "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if hit := stub.next(t); hit.header.Get("traceparent") != "" {
+		t.Errorf("collector got traceparent %q for an unsampled trace, want none", hit.header.Get("traceparent"))
+	}
+	hitWorkers.Stop(context.Background())
+	tracer.export()
+	if spans := recv.byName(); len(spans) != 0 {
+		t.Errorf("exported %v for an unsampled trace, want nothing", spans)
+	}
+}
+
+func TestTracingNewTrace(t *testing.T) {
+	recv := newOTLPReceiver(t, http.StatusOK)
+	useTracer(t, recv, nil)
+	newTestBeacon(t)
+
+	// A malformed traceparent starts a trace of its own.
+	serveTraced("/UA-1234-1/docs", "traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	tracer.export()
+	server := recv.byName()["GET"]
+	if len(server.TraceID) != 32 || server.TraceID == strings.Repeat("0", 32) || server.ParentSpanID != "" {
+		t.Errorf("GET span = trace %q, parent %q, want a new root span", server.TraceID, server.ParentSpanID)
+	}
+}
+
+func TestTracingExportFailure(t *testing.T) {
+	// The receiver hangs until the test ends.
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hanging.Close)
+	keep(t, &tracer)
+	tracer = newOTLPExporter(hanging.URL, nil, "beacon-test", testServer.logger)
+	exporter := tracer
+	t.Cleanup(func() { exporter.Stop(context.Background()) })
+	t.Cleanup(func() { close(release) })
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+
+	serveTraced("/UA-1234-1/first")
+	stub.next(t)
+	go tracer.export()
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		serveTraced("/UA-1234-1/page")
+		stub.next(t)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("hit took %v to report while the export hangs", elapsed)
+		}
+	}
+}
+
+func TestTracingExportError(t *testing.T) {
+	recv := newOTLPReceiver(t, http.StatusServiceUnavailable)
+	useTracer(t, recv, nil)
+	stub := newTestBeacon(t, "-coalesceWindow=0")
+	failed := otlpExportErrors.With("traces").Value()
+
+	serveTraced("/UA-1234-1/page")
+	stub.next(t)
+	hitWorkers.Stop(context.Background())
+	tracer.export()
+	if got := otlpExportErrors.With("traces").Value() - failed; got != 1 {
+		t.Errorf("%d failed exports counted, want 1", got)
+	}
+	// Spans that failed to export are dropped, not retried.
+	n := len(recv.byName())
+	tracer.export()
+	if len(recv.byName()) != n {
+		t.Error("failed spans exported again")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uniqueVisitors is set when -enableUnique is enabled.
+var uniqueVisitors *uniqueStore
+
+const (
+	// hllPrecision is the number of hash bits choosing an HLL register.
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+	// maxUniqueDays is the longest period /api/v1/unique serves, and so
+	// how long daily sketches are kept.
+	maxUniqueDays = 30
+)
+
+// HLL is a HyperLogLog sketch estimating the number of distinct items added
+// to it in 16 KiB, with a standard error of about 0.8%.
+type HLL struct {
+	registers [hllRegisters]uint8
+}
+
+// Add adds item to the sketch.
+func (h *HLL) Add(item string) {
+	x := hllHash(item)
+	i := x >> (64 - hllPrecision)
+	// The rank is the position of the first set bit of the remaining bits;
+	// the guard bit caps it for an all-zero remainder.
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// Merge adds the items of other to the sketch, making it estimate the size
+// of their union.
+func (h *HLL) Merge(other *HLL) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+// Count returns the estimated number of distinct items added. Small counts,
+// which leave registers empty, are estimated by linear counting.
+func (h *HLL) Count() uint64 {
+	var sum float64
+	var zeros int
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	m := float64(hllRegisters)
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + .5)
+}
+
+// hllHash hashes item with FNV-1a, whose low bits are mixed into the high
+// ones the sketch uses by the murmur3 finalizer.
+func hllHash(item string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// uniqueStore keeps a sketch of the client IDs of each page and UTC day, in
+// process memory, under the partition keys of a CounterStore. At most
+// maxKeys pages are counted, to bound memory to about 500 KiB per page.
+type uniqueStore struct {
+	mu       sync.Mutex
+	sketches map[string]*HLL
+	pages    map[string]int // number of daily sketches by page key
+	maxKeys  int
+}
+
+func newUniqueStore(maxKeys int) *uniqueStore {
+	return &uniqueStore{sketches: map[string]*HLL{}, pages: map[string]int{}, maxKeys: maxKeys}
+}
+
+// Add counts a visit of cid to key on the UTC day of t.
+func (s *uniqueStore) Add(key, cid string, t time.Time) error {
+	day := counterDayKey(key, t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.sketches[day]
+	if !ok {
+		if _, counted := s.pages[key]; !counted && len(s.pages) >= s.maxKeys {
+			return errCounterFull
+		}
+		h = &HLL{}
+		s.sketches[day] = h
+		s.pages[key]++
+	}
+	h.Add(cid)
+	return nil
+}
+
+// Daily returns the estimated unique visitors of key on each UTC day from
+// from to to, both included, and over the whole range.
+func (s *uniqueStore) Daily(key string, from, to time.Time) (daily map[string]uint64, total uint64) {
+	daily = map[string]uint64{}
+	var union HLL
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, day := range counterDays(from, to) {
+		h, ok := s.sketches[key+"#"+day]
+		if !ok {
+			daily[day] = 0
+			continue
+		}
+		daily[day] = h.Count()
+		union.Merge(h)
+	}
+	return daily, union.Count()
+}
+
+// Prune deletes the sketches of the days before the UTC day of before.
+func (s *uniqueStore) Prune(before time.Time) error {
+	oldest := before.UTC().Format("2006-01-02")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.sketches {
+		if m := counterDayPartition.FindStringSubmatch(key); m != nil && m[1] < oldest {
+			delete(s.sketches, key)
+			page := strings.TrimSuffix(key, m[0])
+			if s.pages[page]--; s.pages[page] == 0 {
+				delete(s.pages, page)
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueHandler serves /api/v1/unique/<account>/<page>: the estimated
+// unique visitors of the page as JSON, over the last ?days= UTC days
+// including today (30 by default and at most), and on each of them.
+func (s *server) uniqueHandler(w http.ResponseWriter, r *http.Request) {
+	account, page, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/unique/"), "/")
+	if !ok || account == "" || page == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !accountAllowed(account) {
+		http.Error(w, "account not allowed", http.StatusForbidden)
+		return
+	}
+	days := maxUniqueDays
+	if param := r.URL.Query().Get("days"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxUniqueDays {
+			http.Error(w, "days must be from 1 to "+strconv.Itoa(maxUniqueDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	page = normalizePage(s.logger, page)
+	to := time.Now().UTC()
+	daily, total := uniqueVisitors.Daily(account+"/"+page, to.AddDate(0, 0, 1-days), to)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(struct {
+		Account        string            `json:"account"`
+		Page           string            `json:"page"`
+		UniqueVisitors uint64            `json:"unique_visitors"`
+		PeriodDays     int               `json:"period_days"`
+		Daily          map[string]uint64 `json:"daily"`
+	}{account, page, total, days, daily})
+}
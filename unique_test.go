@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// addCIDs adds the client IDs cid-<from> to cid-<to-1> to h.
+func addCIDs(h *HLL, from, to int) {
+	for i := from; i < to; i++ {
+		h.Add(fmt.Sprint("cid-", i))
+	}
+}
+
+// within reports whether got is within the fraction tolerance of want.
+func within(got uint64, want int, tolerance float64) bool {
+	return math.Abs(float64(got)-float64(want)) <= tolerance*float64(want)
+}
+
+func TestHLLCount(t *testing.T) {
+	tests := []struct {
+		n         int
+		tolerance float64
+	}{
+		{0, 0},
+		{1, 0},
+		{10, 0},
+		{1000, .05},
+		{100000, .03},
+	}
+	for _, tt := range tests {
+		var h HLL
+		addCIDs(&h, 0, tt.n)
+		if got := h.Count(); !within(got, tt.n, tt.tolerance) {
+			t.Errorf("Count() of %d unique CIDs = %d, want within %g%%", tt.n, got, tt.tolerance*100)
+		}
+	}
+}
+
+func TestHLLRepeatedCIDs(t *testing.T) {
+	var h HLL
+	for i := 0; i < 10; i++ {
+		addCIDs(&h, 0, 1000)
+	}
+	if got := h.Count(); !within(got, 1000, .05) {
+		t.Errorf("Count() of 1000 CIDs added 10 times = %d, want within 5%% of 1000", got)
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	tests := []struct {
+		name       string
+		days       [][2]int // CIDs from, to of each day
+		wantUnion  int
+		wantDailyN []int
+	}{
+		{"disjoint", [][2]int{{0, 1000}, {1000, 2000}}, 2000, []int{1000, 1000}},
+		{"overlapping", [][2]int{{0, 1000}, {500, 1500}}, 1500, []int{1000, 1000}},
+		{"same visitors", [][2]int{{0, 1000}, {0, 1000}, {0, 1000}}, 1000, []int{1000, 1000, 1000}},
+		{"subset", [][2]int{{0, 1000}, {0, 100}}, 1000, []int{1000, 100}},
+		{"empty day", [][2]int{{0, 1000}, {0, 0}}, 1000, []int{1000, 0}},
+	}
+	for _, tt := range tests {
+		var union HLL
+		for i, cids := range tt.days {
+			var day HLL
+			addCIDs(&day, cids[0], cids[1])
+			if got := day.Count(); !within(got, tt.wantDailyN[i], .05) {
+				t.Errorf("%s: day %d Count() = %d, want within 5%% of %d", tt.name, i+1, got, tt.wantDailyN[i])
+			}
+			union.Merge(&day)
+		}
+		if got := union.Count(); !within(got, tt.wantUnion, .05) {
+			t.Errorf("%s: merged Count() = %d, want within 5%% of %d", tt.name, got, tt.wantUnion)
+		}
+	}
+}
+
+func TestUniqueStoreDaily(t *testing.T) {
+	s := newUniqueStore(10)
+	for i := 0; i < 100; i++ {
+		s.Add("UA-1234-1/page", fmt.Sprint("cid-", i), day(2026, 1, 31, 12, 0))
+	}
+	for i := 50; i < 200; i++ {
+		s.Add("UA-1234-1/page", fmt.Sprint("cid-", i), day(2026, 2, 1, 23, 59))
+	}
+	s.Add("UA-1234-1/other", "cid-1000", day(2026, 2, 1, 0, 0))
+
+	daily, total := s.Daily("UA-1234-1/page", day(2026, 1, 30, 0, 0), day(2026, 2, 1, 0, 0))
+	if daily["2026-01-30"] != 0 || !within(daily["2026-01-31"], 100, .02) || !within(daily["2026-02-01"], 150, .02) || len(daily) != 3 {
+		t.Errorf("daily = %v, want 0, 100 and 150 within 2%%", daily)
+	}
+	if !within(total, 200, .02) {
+		t.Errorf("total = %d, want the 200 CIDs of both days within 2%%", total)
+	}
+	if _, total := s.Daily("UA-1234-1/page", day(2026, 2, 1, 0, 0), day(2026, 2, 1, 0, 0)); total != daily["2026-02-01"] {
+		t.Errorf("total of one day = %d, want that day's %d", total, daily["2026-02-01"])
+	}
+}
+
+func TestUniqueStorePrune(t *testing.T) {
+	s := newUniqueStore(1)
+	s.Add("UA-1234-1/page", "cid-1", day(2026, 1, 31, 12, 0))
+	s.Add("UA-1234-1/page", "cid-2", day(2026, 2, 1, 12, 0))
+	if err := s.Add("UA-1234-1/other", "cid-1", day(2026, 2, 1, 12, 0)); err != errCounterFull {
+		t.Errorf("Add() of a second page = %v, want errCounterFull", err)
+	}
+
+	s.Prune(day(2026, 2, 1, 0, 0))
+	if _, total := s.Daily("UA-1234-1/page", day(2026, 1, 1, 0, 0), day(2026, 2, 28, 0, 0)); total != 1 {
+		t.Errorf("total after pruning = %d, want the 1 CID of the day kept", total)
+	}
+	s.Prune(day(2026, 2, 2, 0, 0))
+	if len(s.sketches) != 0 || len(s.pages) != 0 {
+		t.Errorf("sketches %v of pages %v left after pruning all days", s.sketches, s.pages)
+	}
+	if err := s.Add("UA-1234-1/other", "cid-1", day(2026, 2, 2, 12, 0)); err != nil {
+		t.Errorf("Add() of a page after the pruned one = %v, want room for it", err)
+	}
+}
+
+func TestUniqueHandler(t *testing.T) {
+	newTestBeacon(t, "-coalesceWindow=0")
+	keep(t, &uniqueVisitors)
+	uniqueVisitors = newUniqueStore(10)
+	for i := 0; i < 3; i++ {
+		get("/UA-1234-1/page", "Cookie", fmt.Sprint("cid=visitor-", i))
+		get("/UA-1234-1/page", "Cookie", fmt.Sprint("cid=visitor-", i))
+	}
+	get("/UA-1234-1/other", "Cookie", "cid=visitor-0")
+	today := time.Now().UTC().Format("2006-01-02")
+
+	tests := []struct {
+		target string
+		status int
+		unique uint64
+		days   int
+	}{
+		{"/api/v1/unique/UA-1234-1/page", http.StatusOK, 3, 30},
+		{"/api/v1/unique/UA-1234-1/page?days=1", http.StatusOK, 3, 1},
+		{"/api/v1/unique/UA-1234-1/other", http.StatusOK, 1, 30},
+		{"/api/v1/unique/UA-1234-1/unvisited", http.StatusOK, 0, 30},
+		{"/api/v1/unique/UA-1234-1/page?days=0", http.StatusBadRequest, 0, 0},
+		{"/api/v1/unique/UA-1234-1/page?days=31", http.StatusBadRequest, 0, 0},
+		{"/api/v1/unique/UA-1234-1/page?days=week", http.StatusBadRequest, 0, 0},
+		{"/api/v1/unique/UA-1234-1", http.StatusNotFound, 0, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		testServer.uniqueHandler(w, httptest.NewRequest("GET", tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.target, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			UniqueVisitors uint64            `json:"unique_visitors"`
+			PeriodDays     int               `json:"period_days"`
+			Daily          map[string]uint64 `json:"daily"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.UniqueVisitors != tt.unique || resp.PeriodDays != tt.days {
+			t.Errorf("%s: unique_visitors = %d over %d days, want %d over %d", tt.target, resp.UniqueVisitors, resp.PeriodDays, tt.unique, tt.days)
+		}
+		if len(resp.Daily) != tt.days || resp.Daily[today] != tt.unique {
+			t.Errorf("%s: daily = %v, want %d days with %d today", tt.target, resp.Daily, tt.days, tt.unique)
+		}
+	}
+}
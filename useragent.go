@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mssola/useragent"
+)
+
+// maxClientCacheEntries bounds the parsed User-Agent cache; it is emptied
+// when full. Most hits come from a few hundred distinct browsers.
+const maxClientCacheEntries = 10000
+
+var (
+	clientCacheMu sync.Mutex
+	clientCache   = map[string]*clientInfo{}
+)
+
+// clientInfo is what -parseUserAgent finds in a hit's User-Agent. GA works
+// it out of the User-Agent for tags in the page, but not for Measurement
+// Protocol hits, which it otherwise files under the beacon's own
+// environment.
+type clientInfo struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	Device         string // desktop, mobile, tablet or bot
+}
+
+// clientInfoFor parses ua with -parseUserAgent, and returns nil without it.
+func clientInfoFor(ua string) *clientInfo {
+	if !parseUserAgent || ua == "" {
+		return nil
+	}
+	clientCacheMu.Lock()
+	client, ok := clientCache[ua]
+	clientCacheMu.Unlock()
+	if ok {
+		return client
+	}
+
+	parsed := useragent.New(ua)
+	client = &clientInfo{}
+	client.Browser, client.BrowserVersion = parsed.Browser()
+	os := parsed.OSInfo()
+	client.OS, client.OSVersion = os.Name, os.Version
+	switch {
+	case parsed.Bot():
+		client.Device = "bot"
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+		os.Name == "Android" && !parsed.Mobile():
+		client.Device = "tablet"
+	case parsed.Mobile():
+		client.Device = "mobile"
+	default:
+		client.Device = "desktop"
+	}
+
+	clientCacheMu.Lock()
+	if len(clientCache) >= maxClientCacheEntries {
+		clientCache = map[string]*clientInfo{}
+	}
+	clientCache[ua] = client
+	clientCacheMu.Unlock()
+	return client
+}
+
+// applyClient adds the browser, OS and device class of client to a v1
+// payload as -browserDimension, -osDimension and -deviceDimension.
+func applyClient(payload url.Values, client *clientInfo) {
+	if client == nil {
+		return
+	}
+	for _, d := range []struct {
+		index int
+		value string
+	}{
+		{browserDimension, client.Browser},
+		{osDimension, client.OS},
+		{deviceDimension, client.Device},
+	} {
+		if d.index > 0 && d.value != "" {
+			payload.Set(fmt.Sprintf("cd%d", d.index), truncateUTF8(d.value, maxDimensionLength))
+		}
+	}
+}
+
+// ga4Device returns client as the device field of a GA4 hit. GA4 has no
+// device category for bots.
+//
+// GA4 Protocol reference: https://developers.google.com/analytics/devguides/collection/protocol/ga4/reference#device
+func ga4Device(client *clientInfo) map[string]string {
+	device := map[string]string{}
+	if client.Device != "bot" {
+		device["category"] = client.Device
+	}
+	for key, value := range map[string]string{
+		"browser":                  client.Browser,
+		"browser_version":          client.BrowserVersion,
+		"operating_system":         client.OS,
+		"operating_system_version": client.OSVersion,
+	} {
+		if value != "" {
+			device[key] = value
+		}
+	}
+	return device
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxEnqueueWait is how long a high priority hit waits for room in a full
+// queue before it is dropped, holding up its beacon response meanwhile.
+const maxEnqueueWait = time.Second
+
+// hitPriority decides which hits are reported first and dropped last when
+// the queue is under pressure.
+type hitPriority int
+
+const (
+	priorityLow hitPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+func (p hitPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// hitJob is a single hit waiting to be reported to the GA collector.
+type hitJob struct {
+	params []string
+	query  url.Values
+	ua     string
+	ip     string
+	cid    string
+
+	correlationID string // from the request headers, reported to GA
+	requestID     string // correlationID, or generated; for logs only
+	source        string
+	priority      hitPriority
+	bot           bool              // from a crawler, reported because of -botAction=tag
+	customFields  map[string]string // from -customFields
+	client        *clientInfo       // from -parseUserAgent
+	hitTime       time.Time         // when the hit was made, from ?ts= or on receipt
+	host          string            // the beacon was requested at, for GA4's page_location
+	logger        *slog.Logger      // of the server the hit came from
+
+	// ctx carries the values of the request the hit came from. Hits are
+	// reported after that request is done, so its cancellation is not
+	// passed on; the pool's context is used for that instead.
+	ctx context.Context
+}
+
+// queuedHit is a hitJob in the queue. seq keeps hits of equal priority in
+// arrival order.
+type queuedHit struct {
+	job hitJob
+	seq uint64
+}
+
+// hitQueue is a container/heap of queued hits, highest priority first.
+type hitQueue []queuedHit
+
+func (q hitQueue) Len() int { return len(q) }
+func (q hitQueue) Less(i, j int) bool {
+	if q[i].job.priority != q[j].job.priority {
+		return q[i].job.priority > q[j].job.priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q hitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *hitQueue) Push(x interface{}) { *q = append(*q, x.(queuedHit)) }
+func (q *hitQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// hitWorkerPool reports queued hits to the GA collector in the background so
+// that beacon responses never wait on GA.
+type hitWorkerPool struct {
+	depth      int
+	dropPolicy string
+	logger     *slog.Logger
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    hitQueue
+	seq      uint64
+	closed   bool
+
+	// ctx is passed to in-flight reports and cancelled if Stop runs out of
+	// time draining the queue.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg      sync.WaitGroup
+	dropped [priorityHigh + 1]atomic.Int64
+}
+
+// newHitWorkerPool starts workers draining a queue of up to queueDepth hits.
+// With the "low-first" drop policy, a full queue makes room for a new hit by
+// dropping a queued one of lower priority; otherwise the new hit is dropped.
+// High priority hits are never dropped, Enqueue blocks for them instead.
+func newHitWorkerPool(workers, queueDepth int, dropPolicy string, logger *slog.Logger) *hitWorkerPool {
+	p := &hitWorkerPool{depth: queueDepth, dropPolicy: dropPolicy, logger: logger}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.notEmpty = sync.NewCond(&p.mu)
+	p.notFull = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *hitWorkerPool) work() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.notEmpty.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		item := heap.Pop(&p.queue).(queuedHit)
+		p.notFull.Signal()
+		p.mu.Unlock()
+
+		p.report(item.job)
+	}
+}
+
+// report sends job to its collectors, fanout destinations and mirrors with a
+// context holding the values of the originating request. It is cancelled
+// after -collectorTimeout, or when the pool's context is.
+func (p *hitWorkerPool) report(job hitJob) {
+	parent := context.Background()
+	if job.ctx != nil {
+		parent = context.WithoutCancel(job.ctx)
+	}
+	ctx, cancel := context.WithTimeout(parent, collectorTimeout)
+	defer cancel()
+	stop := context.AfterFunc(p.ctx, cancel)
+	defer stop()
+
+	ctx, sp := startSpan(ctx, "report hit", spanInternal)
+	sp.Set("beacon.account", job.params[0])
+	sp.Set("beacon.page", job.params[1])
+	sp.Set("beacon.request_id", job.requestID)
+	err := logHit(ctx, job)
+	sp.End(err)
+	logHitRecord(ctx, job, err)
+}
+
+// Enqueue queues job. It returns false if the hit was dropped because the
+// queue is full or stopped. High priority hits wait for room instead, for up
+// to maxEnqueueWait or until their request is cancelled.
+func (p *hitWorkerPool) Enqueue(job hitJob) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var waitCtx context.Context
+	for !p.closed && len(p.queue) >= p.depth {
+		if p.dropPolicy == "low-first" && p.evictBelow(job.priority) {
+			break
+		}
+		if job.priority != priorityHigh {
+			p.drop(job)
+			return false
+		}
+		if waitCtx == nil {
+			parent := job.ctx
+			if parent == nil {
+				parent = context.Background()
+			}
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(parent, maxEnqueueWait)
+			defer cancel()
+			// Wake the wait below when waitCtx is done; sync.Cond has no
+			// deadline of its own.
+			stop := context.AfterFunc(waitCtx, func() {
+				p.mu.Lock()
+				p.notFull.Broadcast()
+				p.mu.Unlock()
+			})
+			defer stop()
+		}
+		if waitCtx.Err() != nil {
+			p.drop(job)
+			return false
+		}
+		p.notFull.Wait()
+	}
+	if p.closed {
+		p.drop(job)
+		return false
+	}
+
+	p.seq++
+	heap.Push(&p.queue, queuedHit{job: job, seq: p.seq})
+	p.notEmpty.Signal()
+	return true
+}
+
+// evictBelow drops the lowest priority queued hit if its priority is below
+// priority, reporting whether one was dropped. The caller holds p.mu.
+func (p *hitWorkerPool) evictBelow(priority hitPriority) bool {
+	lowest := -1
+	for i, item := range p.queue {
+		if item.job.priority < priority && (lowest < 0 || p.queue.Less(lowest, i)) {
+			lowest = i
+		}
+	}
+	if lowest < 0 {
+		return false
+	}
+	p.drop(heap.Remove(&p.queue, lowest).(queuedHit).job)
+	return true
+}
+
+func (p *hitWorkerPool) drop(job hitJob) {
+	p.dropped[job.priority].Add(1)
+	job.logger.Warn("Hit queue full, dropping hit", "priority", job.priority.String(), "account", job.params[0])
+}
+
+// Dropped returns the number of hits dropped with the given priority.
+func (p *hitWorkerPool) Dropped(priority hitPriority) int64 {
+	return p.dropped[priority].Load()
+}
+
+// QueueLen returns the number of hits waiting to be reported.
+func (p *hitWorkerPool) QueueLen() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// QueueFillPct returns how full the queue is, between 0 and 1.
+func (p *hitWorkerPool) QueueFillPct() float64 {
+	if p.depth == 0 {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return float64(len(p.queue)) / float64(p.depth)
+}
+
+// Stop stops accepting hits and waits until the queued ones are reported.
+// If ctx is done first, hits still queued are dropped and in-flight reports
+// are cancelled.
+func (p *hitWorkerPool) Stop(ctx context.Context) {
+	p.mu.Lock()
+	p.closed = true
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+	p.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	for _, item := range p.queue {
+		p.dropped[item.job.priority].Add(1)
+	}
+	p.logger.Warn("Shutdown deadline reached, dropping queued hits", "hits", len(p.queue))
+	p.queue = nil
+	p.mu.Unlock()
+	p.cancel()
+	<-drained
+}
+
+// backpressureListener slows down accepting new connections while the hit
+// queue is close to full, giving the workers time to drain it.
+type backpressureListener struct {
+	net.Listener
+	pool      *hitWorkerPool
+	threshold float64
+	delay     time.Duration
+	logger    *slog.Logger
+	active    atomic.Bool
+}
+
+func (l *backpressureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if fill := l.pool.QueueFillPct(); fill > l.threshold {
+		if l.active.CompareAndSwap(false, true) {
+			l.logger.Warn("Backpressure activated", "queue_fill_percent", int(fill*100))
+		}
+		time.Sleep(l.delay)
+	} else if l.active.CompareAndSwap(true, false) {
+		l.logger.Info("Backpressure deactivated", "queue_fill_percent", int(fill*100))
+	}
+	return conn, nil
+}
+
+// connWarnInterval is how often connections rejected from one IP are logged.
+const connWarnInterval = time.Minute
+
+// perIPConnLimiter closes new connections from client IPs that already have
+// too many open, so idle connections cannot exhaust file descriptors.
+type perIPConnLimiter struct {
+	net.Listener
+	limit  int64
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	conns      map[string]int64     // open connections per IP
+	lastWarned map[string]time.Time // last rejection logged per IP
+	rejected   atomic.Int64
+}
+
+func newPerIPConnLimiter(l net.Listener, limit int64, logger *slog.Logger) *perIPConnLimiter {
+	c := &perIPConnLimiter{Listener: l, limit: limit, logger: logger, conns: map[string]int64{}, lastWarned: map[string]time.Time{}}
+	go c.sweep()
+	return c
+}
+
+func (l *perIPConnLimiter) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		host := hostOnly(conn.RemoteAddr().String())
+		if ipInNets(host, exemptNets) {
+			return conn, nil
+		}
+		ip := clientKey(host)
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, limiter: l, ip: ip}, nil
+		}
+		l.reject(conn, ip)
+	}
+}
+
+// acquire takes one of the connection slots of ip, reporting false if it has
+// none left.
+func (l *perIPConnLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.limit {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *perIPConnLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// reject resets conn and logs it, at most once a minute per IP.
+func (l *perIPConnLimiter) reject(conn net.Conn, ip string) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+	l.rejected.Add(1)
+
+	now := time.Now()
+	l.mu.Lock()
+	last, ok := l.lastWarned[ip]
+	warn := !ok || now.Sub(last) >= connWarnInterval
+	if warn {
+		l.lastWarned[ip] = now
+	}
+	l.mu.Unlock()
+	if warn {
+		l.logger.Warn("Rejecting connection, too many open", "ip", ip, "limit", l.limit)
+	}
+}
+
+// sweep periodically forgets when rejections were logged for IPs that have
+// not been rejected since.
+func (l *perIPConnLimiter) sweep() {
+	for range time.Tick(connWarnInterval) {
+		l.forgetWarnings(time.Now())
+	}
+}
+
+func (l *perIPConnLimiter) forgetWarnings(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, last := range l.lastWarned {
+		if now.Sub(last) >= connWarnInterval {
+			delete(l.lastWarned, ip)
+		}
+	}
+}
+
+// Rejected returns the number of connections rejected so far.
+func (l *perIPConnLimiter) Rejected() int64 {
+	return l.rejected.Load()
+}
+
+// limitedConn releases its slot in the perIPConnLimiter when closed.
+type limitedConn struct {
+	net.Conn
+	limiter *perIPConnLimiter
+	ip      string
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limiter.release(c.ip) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testJob returns a hit for account with the given priority.
+func testJob(account string, priority hitPriority) hitJob {
+	return hitJob{params: []string{account, "page"}, priority: priority, logger: testServer.logger}
+}
+
+// acceptTime returns how long l takes to accept a new connection.
+func acceptTime(t *testing.T, l net.Listener) time.Duration {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+	return time.Since(start)
+}
+
+func TestBackpressureListener(t *testing.T) {
+	// Without workers, nothing drains the queue.
+	pool := newHitWorkerPool(0, 10, "newest", testServer.logger)
+	defer pool.Stop(context.Background())
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	const delay = 100 * time.Millisecond
+	l := &backpressureListener{Listener: inner, pool: pool, threshold: 0.9, delay: delay, logger: testServer.logger}
+
+	for i := 0; i < 9; i++ {
+		pool.Enqueue(testJob("UA-1234-1", priorityNormal))
+	}
+	if d := acceptTime(t, l); d >= delay {
+		t.Errorf("accept at 90%% took %v, want no delay", d)
+	}
+
+	pool.Enqueue(testJob("UA-1234-1", priorityNormal))
+	for i := 0; i < 2; i++ {
+		if d := acceptTime(t, l); d < delay {
+			t.Errorf("accept %d at 100%% took %v, want at least %v", i+1, d, delay)
+		}
+	}
+	if !l.active.Load() {
+		t.Error("backpressure is not active on a full queue")
+	}
+}
+
+// newConnLimiter returns a perIPConnLimiter allowing limit connections on a
+// loopback listener. The connections it lets through are kept open until
+// the client closes them.
+func newConnLimiter(t *testing.T, limit int64) *perIPConnLimiter {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newPerIPConnLimiter(inner, limit, testServer.logger)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { inner.Close() })
+	return l
+}
+
+// dialAll opens n connections to l. Those the server reset so fast that
+// dialing failed are nil.
+func dialAll(t *testing.T, l net.Listener, n int) []net.Conn {
+	var conns []net.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if errors.Is(err, syscall.ECONNRESET) {
+			conns = append(conns, nil)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("connection %d: %v", i+1, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// closedByServer reports whether the server closed conn within timeout.
+func closedByServer(conn net.Conn, timeout time.Duration) bool {
+	if conn == nil {
+		return true
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestPerIPConnLimiter(t *testing.T) {
+	keep(t, &exemptNets)
+	exemptNets = nil
+	l := newConnLimiter(t, 20)
+	conns := dialAll(t, l, 25)
+
+	for i, conn := range conns[20:] {
+		if !closedByServer(conn, 2*time.Second) {
+			t.Errorf("connection %d left open", 21+i)
+		}
+	}
+	for i, conn := range conns[:20] {
+		if closedByServer(conn, 10*time.Millisecond) {
+			t.Errorf("connection %d closed, want it within the limit", i+1)
+		}
+	}
+	// The count goes up just after the connection is reset.
+	for deadline := time.Now().Add(time.Second); l.Rejected() < 5 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := l.Rejected(); got != 5 {
+		t.Errorf("Rejected() = %d, want 5", got)
+	}
+
+	conns[0].Close()
+	time.Sleep(50 * time.Millisecond)
+	if conn := dialAll(t, l, 1)[0]; closedByServer(conn, 100*time.Millisecond) {
+		t.Error("connection closed after another one made room")
+	}
+}
+
+func TestPerIPConnLimiterExempt(t *testing.T) {
+	keep(t, &exemptNets)
+	var err error
+	if exemptNets, err = parseIPList("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	l := newConnLimiter(t, 2)
+	for i, conn := range dialAll(t, l, 5) {
+		if closedByServer(conn, 50*time.Millisecond) {
+			t.Errorf("connection %d from an exempt IP closed", i+1)
+		}
+	}
+}
+
+func TestPerIPConnLimiterConcurrent(t *testing.T) {
+	l := newPerIPConnLimiter(nil, 3, testServer.logger)
+	var mu sync.Mutex
+	var open, most int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if !l.acquire("192.0.2.1") {
+					continue
+				}
+				mu.Lock()
+				open++
+				most = max(most, open)
+				open--
+				mu.Unlock()
+				l.release("192.0.2.1")
+			}
+		}()
+	}
+	wg.Wait()
+	if most > 3 {
+		t.Errorf("%d connections open at once, want at most 3", most)
+	}
+	if len(l.conns) != 0 {
+		t.Errorf("counts %v left once every connection closed, want none", l.conns)
+	}
+}
+
+func TestPerIPConnLimiterForgetsWarnings(t *testing.T) {
+	l := newPerIPConnLimiter(nil, 1, testServer.logger)
+	now := time.Now()
+	l.lastWarned["192.0.2.1"] = now.Add(-2 * connWarnInterval)
+	l.lastWarned["192.0.2.2"] = now.Add(-time.Second)
+	l.forgetWarnings(now)
+	if _, ok := l.lastWarned["192.0.2.1"]; ok {
+		t.Error("warning from two intervals ago kept")
+	}
+	if _, ok := l.lastWarned["192.0.2.2"]; !ok {
+		t.Error("warning from a second ago forgotten, want it to hold back the next one")
+	}
+}
+
+// popQueued takes the next hit a worker would report off p's queue.
+func popQueued(p *hitWorkerPool) hitJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	item := heap.Pop(&p.queue).(queuedHit)
+	p.notFull.Signal()
+	return item.job
+}
+
+func TestHitQueueOrder(t *testing.T) {
+	pool := newHitWorkerPool(0, 10, "newest", testServer.logger)
+	defer pool.Stop(context.Background())
+	for _, job := range []hitJob{
+		testJob("UA-1-1", priorityLow),
+		testJob("UA-2-1", priorityNormal),
+		testJob("UA-3-1", priorityHigh),
+		testJob("UA-4-1", priorityNormal),
+		testJob("UA-5-1", priorityHigh),
+	} {
+		pool.Enqueue(job)
+	}
+	want := []string{"UA-3-1", "UA-5-1", "UA-2-1", "UA-4-1", "UA-1-1"}
+	for i, account := range want {
+		if got := popQueued(pool).params[0]; got != account {
+			t.Errorf("hit %d reported for %s, want %s", i+1, got, account)
+		}
+	}
+}
+
+func TestDropLowFirst(t *testing.T) {
+	pool := newHitWorkerPool(0, 2, "low-first", testServer.logger)
+	defer pool.Stop(context.Background())
+	pool.Enqueue(testJob("UA-1-1", priorityLow))
+	pool.Enqueue(testJob("UA-2-1", priorityLow))
+
+	if !pool.Enqueue(testJob("UA-3-1", priorityHigh)) {
+		t.Fatal("high priority hit dropped with low priority ones queued")
+	}
+	if !pool.Enqueue(testJob("UA-4-1", priorityNormal)) {
+		t.Fatal("normal priority hit dropped with a low priority one queued")
+	}
+	if pool.Enqueue(testJob("UA-5-1", priorityLow)) {
+		t.Error("low priority hit queued on a queue without lower priority hits")
+	}
+	if got := pool.Dropped(priorityLow); got != 3 {
+		t.Errorf("Dropped(low) = %d, want 3", got)
+	}
+	if got := pool.Dropped(priorityNormal) + pool.Dropped(priorityHigh); got != 0 {
+		t.Errorf("%d normal or high priority hits dropped, want none", got)
+	}
+	if got := popQueued(pool).params[0]; got != "UA-3-1" {
+		t.Errorf("first hit reported for %s, want the high priority one", got)
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	pool := newHitWorkerPool(0, 1, "newest", testServer.logger)
+	defer pool.Stop(context.Background())
+	pool.Enqueue(testJob("UA-1-1", priorityLow))
+	if pool.Enqueue(testJob("UA-2-1", priorityNormal)) {
+		t.Error("normal priority hit queued on a full queue")
+	}
+	if got := pool.Dropped(priorityNormal); got != 1 {
+		t.Errorf("Dropped(normal) = %d, want 1", got)
+	}
+}
+
+func TestHighPriorityWaitsForRoom(t *testing.T) {
+	pool := newHitWorkerPool(0, 1, "low-first", testServer.logger)
+	defer pool.Stop(context.Background())
+	pool.Enqueue(testJob("UA-1-1", priorityHigh))
+
+	queued := make(chan bool)
+	go func() { queued <- pool.Enqueue(testJob("UA-2-1", priorityHigh)) }()
+	select {
+	case <-queued:
+		t.Fatal("high priority hit did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+	popQueued(pool)
+	if !<-queued {
+		t.Error("high priority hit dropped although room was made")
+	}
+	if got := pool.Dropped(priorityHigh); got != 0 {
+		t.Errorf("Dropped(high) = %d, want 0", got)
+	}
+}
+
+func TestHighPriorityWaitBounded(t *testing.T) {
+	pool := newHitWorkerPool(0, 1, "low-first", testServer.logger)
+	defer pool.Stop(context.Background())
+	pool.Enqueue(testJob("UA-1-1", priorityHigh))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	job := testJob("UA-2-1", priorityHigh)
+	job.ctx = ctx
+	start := time.Now()
+	if pool.Enqueue(job) {
+		t.Fatal("high priority hit queued on a queue that never drains")
+	}
+	if d := time.Since(start); d > maxEnqueueWait {
+		t.Errorf("Enqueue waited %v after its request was cancelled", d)
+	}
+}
+
+func TestHitPriorityFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		account string
+		query   string
+		want    hitPriority
+	}{
+		{"normal", nil, "UA-1234-1", "", priorityNormal},
+		{"high", []string{"-highPriorityAccounts=UA-5678-1, UA-1234-1"}, "UA-1234-1", "", priorityHigh},
+		{"param ignored", nil, "UA-1234-1", "priority=low", priorityNormal},
+		{"low", []string{"-allowPriorityParam"}, "UA-1234-1", "priority=low", priorityLow},
+		{"high wins over param", []string{"-allowPriorityParam", "-highPriorityAccounts=UA-1234-1"}, "UA-1234-1", "priority=low", priorityHigh},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestBeacon(t, tt.args...)
+			query, _ := url.ParseQuery(tt.query)
+			if got := hitPriorityFor(tt.account, query); got != tt.want {
+				t.Errorf("hitPriorityFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// blockingCollector is a collector holding each hit until released, or
+// until the hit's request to it is cancelled. Hits are reported to it
+// instead of the gaStub until t ends, when it releases them.
+type blockingCollector struct {
+	*httptest.Server
+	arrived chan struct{}
+	aborted chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func newBlockingCollector(t *testing.T) *blockingCollector {
+	c := &blockingCollector{arrived: make(chan struct{}, 10), aborted: make(chan struct{}, 10), release: make(chan struct{})}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once it has read
+		// the body.
+		io.ReadAll(r.Body)
+		c.arrived <- struct{}{}
+		select {
+		case <-c.release:
+		case <-r.Context().Done():
+			c.aborted <- struct{}{}
+		}
+	}))
+	t.Cleanup(c.Close)
+	t.Cleanup(c.unblock)
+	gaEndpoint = c.URL + "/collect"
+	return c
+}
+
+// unblock releases the held hits and all later ones.
+func (c *blockingCollector) unblock() { c.once.Do(func() { close(c.release) }) }
+
+// wait fails t unless ch receives within a second.
+func wait(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("%s within a second", what)
+	}
+}
+
+func TestResponseBeforeCollector(t *testing.T) {
+	newTestBeacon(t, "-gaWorkers=1", "-gaQueueDepth=1", "-coalesceWindow=0")
+	c := newBlockingCollector(t)
+
+	start := time.Now()
+	w := get("/UA-1234-1/page")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("status %d, Content-Type %q, want the badge", w.Code, w.Header().Get("Content-Type"))
+	}
+	wait(t, c.arrived, "no hit reached the collector")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("response took %v with the collector blocked", elapsed)
+	}
+
+	// One hit is held by the collector and one waits in the queue; the
+	// next is dropped, but still gets its badge.
+	before := hitWorkers.Dropped(priorityNormal)
+	for i := 0; i < 2; i++ {
+		if w := get("/UA-1234-1/page"); w.Code != http.StatusOK {
+			t.Errorf("hit %d: status %d with the queue full, want 200", i+2, w.Code)
+		}
+	}
+	if got := hitWorkers.Dropped(priorityNormal) - before; got != 1 {
+		t.Errorf("%d hits dropped, want 1", got)
+	}
+	registerTestMetrics(t)
+	r := httptest.NewRecorder()
+	metricsHandler(r, httptest.NewRequest("GET", "/metrics", nil))
+	if want := fmt.Sprintf(`gabeacon_hits_dropped_total{priority="normal"} %d`, hitWorkers.Dropped(priorityNormal)); !strings.Contains(r.Body.String(), want) {
+		t.Errorf("/metrics does not show %s", want)
+	}
+	c.unblock()
+	wait(t, c.arrived, "queued hit not reported once the collector answered")
+}
+
+func TestReportOutlivesRequest(t *testing.T) {
+	newTestBeacon(t)
+	c := newBlockingCollector(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	testServer.handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/UA-1234-1/page", nil).WithContext(ctx))
+	wait(t, c.arrived, "no hit reached the collector")
+	cancel()
+	select {
+	case <-c.aborted:
+		t.Error("report aborted when its beacon request ended")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestReportCancelledOnShutdown(t *testing.T) {
+	newTestBeacon(t)
+	c := newBlockingCollector(t)
+	get("/UA-1234-1/page")
+	wait(t, c.arrived, "no hit reached the collector")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hitWorkers.Stop(ctx)
+	wait(t, c.aborted, "report not aborted by a shutdown out of time")
+}
+
+func TestLogHitCancelled(t *testing.T) {
+	newTestBeacon(t)
+	c := newBlockingCollector(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- logHit(ctx, hitJob{params: []string{"UA-1234-1", "page"}, query: url.Values{}, cid: "cid", ip: "192.0.2.1", logger: testServer.logger})
+	}()
+	wait(t, c.arrived, "no hit reached the collector")
+	cancel()
+	wait(t, c.aborted, "collector call not aborted")
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("logHit() = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("logHit() still running after its context was cancelled")
+	}
+}